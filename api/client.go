@@ -13,15 +13,20 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/google/uuid"
 
 	"github.com/jmorganca/ollama/format"
 	"github.com/jmorganca/ollama/version"
 )
 
 type Client struct {
-	base *url.URL
-	http *http.Client
+	base  *url.URL
+	http  *http.Client
+	retry RetryPolicy
 }
 
 func checkError(resp *http.Response, body []byte) error {
@@ -45,6 +50,16 @@ func ClientFromEnvironment() (*Client, error) {
 
 	scheme, hostport, ok := strings.Cut(os.Getenv("OLLAMA_HOST"), "://")
 	switch {
+	case scheme == "unix":
+		return socketClient(func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", hostport)
+		}), nil
+	case scheme == "npipe":
+		path := strings.ReplaceAll(hostport, "/", `\`)
+		return socketClient(func(ctx context.Context) (net.Conn, error) {
+			return dialPipe(ctx, path)
+		}), nil
 	case !ok:
 		scheme, hostport = "http", os.Getenv("OLLAMA_HOST")
 	case scheme == "http":
@@ -75,15 +90,33 @@ func ClientFromEnvironment() (*Client, error) {
 	}, nil
 }
 
+// socketClient returns a client which connects with dial, for servers
+// listening on a unix socket or named pipe
+func socketClient(dial func(context.Context) (net.Conn, error)) *Client {
+	return &Client{
+		base: &url.URL{Scheme: "http", Host: "localhost"},
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dial(ctx)
+				},
+			},
+		},
+	}
+}
+
 func (c *Client) do(ctx context.Context, method, path string, reqData, respData any) error {
 	var reqBody io.Reader
 	var data []byte
 	var err error
 
+	// requests with a body which is a reader can't be sent again
+	retry := c.retry
 	switch reqData := reqData.(type) {
 	case io.Reader:
 		// reqData is already an io.Reader
 		reqBody = reqData
+		retry = RetryPolicy{}
 	case nil:
 		// noop
 	default:
@@ -91,32 +124,41 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 		if err != nil {
 			return err
 		}
-
-		reqBody = bytes.NewReader(data)
 	}
 
-	requestURL := c.base.JoinPath(path)
-	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
-	if err != nil {
-		return err
-	}
+	var respBody []byte
+	if err := retry.do(ctx, func() error {
+		if data != nil {
+			reqBody = bytes.NewReader(data)
+		}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Accept", "application/json")
-	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+		requestURL := c.base.JoinPath(path)
+		request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), reqBody)
+		if err != nil {
+			return err
+		}
 
-	respObj, err := c.http.Do(request)
-	if err != nil {
-		return err
-	}
-	defer respObj.Body.Close()
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Accept", "application/json")
+		request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
-	respBody, err := io.ReadAll(respObj.Body)
-	if err != nil {
-		return err
-	}
+		respObj, err := c.http.Do(request)
+		if err != nil {
+			return retryable(ctx, err, 0)
+		}
+		defer respObj.Body.Close()
+
+		respBody, err = io.ReadAll(respObj.Body)
+		if err != nil {
+			return retryable(ctx, err, 0)
+		}
 
-	if err := checkError(respObj, respBody); err != nil {
+		if err := checkError(respObj, respBody); err != nil {
+			return retryableStatus(respObj, err)
+		}
+
+		return nil
+	}); err != nil {
 		return err
 	}
 
@@ -131,14 +173,57 @@ func (c *Client) do(ctx context.Context, method, path string, reqData, respData
 const maxBufferSize = 512 * format.KiloByte
 
 func (c *Client) stream(ctx context.Context, method, path string, data any, fn func([]byte) error) error {
-	var buf *bytes.Buffer
+	return c.streamRequest(ctx, method, path, data, false, fn)
+}
+
+// streamRequest streams the responses to a request. If the stream is
+// resumable and the client retries requests, an interrupted stream is
+// resumed from the last response, which a resumable stream ends with.
+func (c *Client) streamRequest(ctx context.Context, method, path string, data any, resumable bool, fn func([]byte) error) error {
+	var bts []byte
 	if data != nil {
-		bts, err := json.Marshal(data)
-		if err != nil {
+		var err error
+		if bts, err = json.Marshal(data); err != nil {
 			return err
 		}
+	}
 
-		buf = bytes.NewBuffer(bts)
+	header := make(http.Header)
+	resumable = resumable && c.retry.MaxRetries > 0
+	if resumable {
+		header.Set("X-Ollama-Request-Id", uuid.New().String())
+	}
+
+	var received int
+	var sent bool
+	return c.retry.do(ctx, func() error {
+		// the server starts the request if it never arrived
+		if resumable && sent {
+			header.Set("X-Ollama-Resume-From", strconv.Itoa(received))
+		}
+
+		sent = true
+
+		err := c.streamOnce(ctx, method, path, bts, header, resumable, func(bts []byte) error {
+			received++
+			return fn(bts)
+		})
+
+		// a stream which can't be resumed is only sent again if nothing
+		// of it was received
+		var rErr *retryError
+		if received > 0 && !resumable && errors.As(err, &rErr) {
+			return rErr.err
+		}
+
+		return err
+	})
+}
+
+func (c *Client) streamOnce(ctx context.Context, method, path string, data []byte, header http.Header, resumable bool, fn func([]byte) error) error {
+	var buf *bytes.Buffer
+	if data != nil {
+		buf = bytes.NewBuffer(data)
 	}
 
 	requestURL := c.base.JoinPath(path)
@@ -147,23 +232,41 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		return err
 	}
 
+	for k, v := range header {
+		request.Header[k] = v
+	}
+
 	request.Header.Set("Content-Type", "application/json")
 	request.Header.Set("Accept", "application/x-ndjson")
 	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
 
 	response, err := c.http.Do(request)
 	if err != nil {
-		return err
+		return retryable(ctx, err, 0)
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			return retryable(ctx, err, 0)
+		}
+
+		return retryableStatus(response, checkError(response, body))
+	}
+
 	scanner := bufio.NewScanner(response.Body)
 	// increase the buffer size to avoid running out of space
 	scanBuf := make([]byte, 0, maxBufferSize)
 	scanner.Buffer(scanBuf, maxBufferSize)
+
+	var done bool
 	for scanner.Scan() {
 		var errorResponse struct {
-			Error string `json:"error,omitempty"`
+			Error string    `json:"error,omitempty"`
+			Code  ErrorCode `json:"code,omitempty"`
+			Param string    `json:"param,omitempty"`
+			Done  bool      `json:"done,omitempty"`
 		}
 
 		bts := scanner.Bytes()
@@ -172,7 +275,12 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 		}
 
 		if errorResponse.Error != "" {
-			return fmt.Errorf(errorResponse.Error)
+			return StatusError{
+				StatusCode:   response.StatusCode,
+				ErrorMessage: errorResponse.Error,
+				Code:         errorResponse.Code,
+				Param:        errorResponse.Param,
+			}
 		}
 
 		if response.StatusCode >= http.StatusBadRequest {
@@ -183,18 +291,27 @@ func (c *Client) stream(ctx context.Context, method, path string, data any, fn f
 			}
 		}
 
+		done = errorResponse.Done
 		if err := fn(bts); err != nil {
 			return err
 		}
 	}
 
+	if err := scanner.Err(); err != nil {
+		return retryable(ctx, err, 0)
+	}
+
+	if resumable && !done {
+		return retryable(ctx, io.ErrUnexpectedEOF, 0)
+	}
+
 	return nil
 }
 
 type GenerateResponseFunc func(GenerateResponse) error
 
 func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn GenerateResponseFunc) error {
-	return c.stream(ctx, http.MethodPost, "/api/generate", req, func(bts []byte) error {
+	return c.streamRequest(ctx, http.MethodPost, "/api/generate", req, true, func(bts []byte) error {
 		var resp GenerateResponse
 		if err := json.Unmarshal(bts, &resp); err != nil {
 			return err
@@ -207,7 +324,7 @@ func (c *Client) Generate(ctx context.Context, req *GenerateRequest, fn Generate
 type ChatResponseFunc func(ChatResponse) error
 
 func (c *Client) Chat(ctx context.Context, req *ChatRequest, fn ChatResponseFunc) error {
-	return c.stream(ctx, http.MethodPost, "/api/chat", req, func(bts []byte) error {
+	return c.streamRequest(ctx, http.MethodPost, "/api/chat", req, true, func(bts []byte) error {
 		var resp ChatResponse
 		if err := json.Unmarshal(bts, &resp); err != nil {
 			return err
@@ -264,6 +381,24 @@ func (c *Client) List(ctx context.Context) (*ListResponse, error) {
 	return &lr, nil
 }
 
+// ListRunning lists the models which are loaded
+func (c *Client) ListRunning(ctx context.Context) (*ProcessResponse, error) {
+	var resp ProcessResponse
+	if err := c.do(ctx, http.MethodGet, "/api/ps", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CheckUpdates checks the registry of every model for a newer version of it
+func (c *Client) CheckUpdates(ctx context.Context) (*UpdatesResponse, error) {
+	var resp UpdatesResponse
+	if err := c.do(ctx, http.MethodPost, "/api/updates", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 func (c *Client) Copy(ctx context.Context, req *CopyRequest) error {
 	if err := c.do(ctx, http.MethodPost, "/api/copy", req, nil); err != nil {
 		return err
@@ -286,6 +421,124 @@ func (c *Client) Show(ctx context.Context, req *ShowRequest) (*ShowResponse, err
 	return &resp, nil
 }
 
+func (c *Client) ModelOptions(ctx context.Context, model string) (*ModelOptionsResponse, error) {
+	var resp ModelOptionsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/models/"+model+"/options", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) UpdateModelOptions(ctx context.Context, model string, req *ModelOptionsRequest) (*ModelOptionsResponse, error) {
+	var resp ModelOptionsResponse
+	if err := c.do(ctx, http.MethodPatch, "/api/models/"+model+"/options", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) ReloadOptions(ctx context.Context, model string, req *ReloadOptionsRequest) (*ReloadOptionsResponse, error) {
+	var resp ReloadOptionsResponse
+	if err := c.do(ctx, http.MethodPost, "/api/models/"+model+"/reload-options", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Queue(ctx context.Context) (*QueueResponse, error) {
+	var resp QueueResponse
+	if err := c.do(ctx, http.MethodGet, "/api/queue", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Usage(ctx context.Context) (*UsageResponse, error) {
+	var resp UsageResponse
+	if err := c.do(ctx, http.MethodGet, "/api/usage", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) CreateSession(ctx context.Context, req *SessionRequest) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodPost, "/api/sessions", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) ListSessions(ctx context.Context) (*ListSessionsResponse, error) {
+	var resp ListSessionsResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Session(ctx context.Context, id string) (*SessionResponse, error) {
+	var resp SessionResponse
+	if err := c.do(ctx, http.MethodGet, "/api/sessions/"+id, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) DeleteSession(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/sessions/"+id, nil, nil)
+}
+
+// SessionChat sends the next message of a session, which keeps the message
+// and the response
+func (c *Client) SessionChat(ctx context.Context, id string, req *SessionChatRequest, fn ChatResponseFunc) error {
+	return c.stream(ctx, http.MethodPost, "/api/sessions/"+id+"/chat", req, func(bts []byte) error {
+		var resp ChatResponse
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return err
+		}
+
+		return fn(resp)
+	})
+}
+
+func (c *Client) ListAliases(ctx context.Context) (*ListAliasesResponse, error) {
+	var resp ListAliasesResponse
+	if err := c.do(ctx, http.MethodGet, "/api/alias", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SetAlias points an alias at a model, replacing the model it pointed at
+func (c *Client) SetAlias(ctx context.Context, req *AliasRequest) error {
+	return c.do(ctx, http.MethodPost, "/api/alias", req, nil)
+}
+
+func (c *Client) DeleteAlias(ctx context.Context, req *DeleteAliasRequest) error {
+	return c.do(ctx, http.MethodDelete, "/api/alias", req, nil)
+}
+
+// SaveSnapshot saves the state of the server so it can be restored, such as
+// after the host restarts
+func (c *Client) SaveSnapshot(ctx context.Context, req *SnapshotRequest) (*Snapshot, error) {
+	var resp Snapshot
+	if err := c.do(ctx, http.MethodPost, "/api/snapshot", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RestoreSnapshot restores the state of the server from a snapshot, loading
+// the model which was loaded
+func (c *Client) RestoreSnapshot(ctx context.Context, req *RestoreSnapshotRequest) (*Snapshot, error) {
+	var resp Snapshot
+	if err := c.do(ctx, http.MethodPost, "/api/snapshot/restore", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 func (c *Client) Heartbeat(ctx context.Context) error {
 	if err := c.do(ctx, http.MethodHead, "/", nil, nil); err != nil {
 		return err
@@ -300,6 +553,30 @@ func (c *Client) Embeddings(ctx context.Context, req *EmbeddingRequest) (*Embedd
 	return &resp, nil
 }
 
+func (c *Client) Tokenize(ctx context.Context, req *TokenizeRequest) (*TokenizeResponse, error) {
+	var resp TokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/tokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) Detokenize(ctx context.Context, req *DetokenizeRequest) (*DetokenizeResponse, error) {
+	var resp DetokenizeResponse
+	if err := c.do(ctx, http.MethodPost, "/api/detokenize", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (c *Client) RenderTemplate(ctx context.Context, req *RenderTemplateRequest) (*RenderTemplateResponse, error) {
+	var resp RenderTemplateResponse
+	if err := c.do(ctx, http.MethodPost, "/api/template/render", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
 func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) error {
 	if err := c.do(ctx, http.MethodHead, fmt.Sprintf("/api/blobs/%s", digest), nil, nil); err != nil {
 		var statusError StatusError
@@ -315,6 +592,105 @@ func (c *Client) CreateBlob(ctx context.Context, digest string, r io.Reader) err
 	return nil
 }
 
+// Export writes a model to w as an archive which Import can create it from
+func (c *Client) Export(ctx context.Context, req *ExportRequest, w io.Writer) error {
+	bts, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.raw(ctx, http.MethodPost, "/api/export", nil, bytes.NewReader(bts))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import creates a model from an archive written by Export. The model is
+// named as it was exported unless model is set.
+func (c *Client) Import(ctx context.Context, model string, r io.Reader) (*ImportResponse, error) {
+	query := make(url.Values)
+	if model != "" {
+		query.Set("model", model)
+	}
+
+	resp, err := c.raw(ctx, http.MethodPost, "/api/import", query, r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var importResp ImportResponse
+	if err := json.NewDecoder(resp.Body).Decode(&importResp); err != nil {
+		return nil, err
+	}
+
+	return &importResp, nil
+}
+
+// Audit returns the entries of the audit log which match req, oldest first
+func (c *Client) Audit(ctx context.Context, req *AuditRequest) (*AuditResponse, error) {
+	query := make(url.Values)
+	if req.Model != "" {
+		query.Set("model", req.Model)
+	}
+
+	if req.Operation != "" {
+		query.Set("operation", req.Operation)
+	}
+
+	if !req.Since.IsZero() {
+		query.Set("since", req.Since.Format(time.RFC3339Nano))
+	}
+
+	resp, err := c.raw(ctx, http.MethodGet, "/api/audit", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var auditResp AuditResponse
+	if err := json.NewDecoder(resp.Body).Decode(&auditResp); err != nil {
+		return nil, err
+	}
+
+	return &auditResp, nil
+}
+
+// raw makes a request with a body which isn't JSON, or a response which isn't,
+// so neither is buffered
+func (c *Client) raw(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Response, error) {
+	requestURL := c.base.JoinPath(path)
+	requestURL.RawQuery = query.Encode()
+	request, err := http.NewRequestWithContext(ctx, method, requestURL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("User-Agent", fmt.Sprintf("ollama/%s (%s %s) Go/%s", version.Version, runtime.GOARCH, runtime.GOOS, runtime.Version()))
+
+	resp, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, checkError(resp, respBody)
+	}
+
+	return resp, nil
+}
+
 func (c *Client) Version(ctx context.Context) (string, error) {
 	var version struct {
 		Version string `json:"version"`
@@ -1,6 +1,16 @@
 package api
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 func TestClientFromEnvironment(t *testing.T) {
 	type testCase struct {
@@ -41,3 +51,89 @@ func TestClientFromEnvironment(t *testing.T) {
 		})
 	}
 }
+
+func TestClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ollama.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "localhost" {
+			t.Errorf("expected host localhost, got %s", r.Host)
+		}
+	}))
+	srv.Listener = ln
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	t.Setenv("OLLAMA_HOST", "unix://"+path)
+
+	client, err := ClientFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Heartbeat(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": "busy"}`)
+		case 2:
+			// the stream ends before it's done
+			fmt.Fprintln(w, `{"response": "hello"}`)
+		default:
+			id := r.Header.Get("X-Ollama-Request-Id")
+			if id == "" {
+				t.Error("expected a request id")
+			}
+
+			if from := r.Header.Get("X-Ollama-Resume-From"); from != "1" {
+				t.Errorf("expected to resume from 1, got %q", from)
+			}
+
+			fmt.Fprintln(w, `{"response": " there", "done": true}`)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	base, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &Client{base: base, http: http.DefaultClient}
+	client.SetRetryPolicy(RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond})
+
+	var response string
+	if err := client.Generate(context.Background(), &GenerateRequest{Model: "test"}, func(resp GenerateResponse) error {
+		response += resp.Response
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if response != "hello there" {
+		t.Errorf("expected %q, got %q", "hello there", response)
+	}
+
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+
+	// without retries the error is returned
+	requests = 0
+	client.SetRetryPolicy(RetryPolicy{})
+	if err := client.Heartbeat(context.Background()); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy sets how a Client retries requests which fail because of the
+// network or because the server is busy. The zero value doesn't retry.
+//
+// Generate and Chat requests which are interrupted while streaming are
+// resumed after the last response received, rather than started again.
+type RetryPolicy struct {
+	// MaxRetries is how many times a request is retried
+	MaxRetries int
+
+	// Backoff is how long to wait before the first retry. It's doubled for
+	// each retry after it, up to MaxBackoff. A server which sends
+	// Retry-After is waited for as long as it asks.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy retries a request a few times, over about a minute
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 5,
+	Backoff:    time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+// SetRetryPolicy sets how the client retries requests
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
+// retryError is a failure which may succeed if the request is sent again
+type retryError struct {
+	err error
+
+	// after is how long the server asked to wait, if it did
+	after time.Duration
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryError) Unwrap() error {
+	return e.err
+}
+
+// retryable marks err to be retried, unless ctx is done
+func retryable(ctx context.Context, err error, after time.Duration) error {
+	if ctx.Err() != nil {
+		return err
+	}
+
+	return &retryError{err: err, after: after}
+}
+
+// retryableStatus marks err to be retried if the server is busy
+func retryableStatus(resp *http.Response, err error) error {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		var after time.Duration
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			after = time.Duration(s) * time.Second
+		}
+
+		return &retryError{err: err, after: after}
+	}
+
+	return err
+}
+
+// do calls fn until it succeeds, returns an error which isn't retryable, or
+// has been retried p.MaxRetries times
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	backoff := p.Backoff
+	for retries := 0; ; retries++ {
+		err := fn()
+
+		var rErr *retryError
+		if !errors.As(err, &rErr) {
+			return err
+		}
+
+		if retries >= p.MaxRetries {
+			return rErr.err
+		}
+
+		wait := min(backoff, max(p.MaxBackoff, p.Backoff))
+		if rErr.after > 0 {
+			wait = rErr.after
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		backoff *= 2
+	}
+}
@@ -2,10 +2,12 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -14,9 +16,34 @@ import (
 type StatusError struct {
 	StatusCode   int
 	Status       string
-	ErrorMessage string `json:"error"`
+	ErrorMessage string    `json:"error"`
+	Code         ErrorCode `json:"code,omitempty"`
+
+	// Param is the option or field of the request the error is about, such
+	// as an unknown or out of range option
+	Param string `json:"param,omitempty"`
 }
 
+// ErrorCode classifies an error response so clients can handle errors
+// without matching on the message
+type ErrorCode string
+
+const (
+	ErrorCodeInvalidRequest      ErrorCode = "invalid_request"
+	ErrorCodeNotFound            ErrorCode = "not_found"
+	ErrorCodeModelNotFound       ErrorCode = "model_not_found"
+	ErrorCodeOutOfMemory         ErrorCode = "out_of_memory"
+	ErrorCodeContextExceeded     ErrorCode = "context_exceeded"
+	ErrorCodeRunnerCrashed       ErrorCode = "runner_crashed"
+	ErrorCodeUnauthorized        ErrorCode = "unauthorized"
+	ErrorCodeForbidden           ErrorCode = "forbidden"
+	ErrorCodeQueueFull           ErrorCode = "queue_full"
+	ErrorCodeInsufficientStorage ErrorCode = "insufficient_storage"
+	ErrorCodeBudgetExceeded      ErrorCode = "budget_exceeded"
+	ErrorCodeTTFTExceeded        ErrorCode = "ttft_exceeded"
+	ErrorCodeInternal            ErrorCode = "internal_error"
+)
+
 func (e StatusError) Error() string {
 	switch {
 	case e.Status != "" && e.ErrorMessage != "":
@@ -36,6 +63,7 @@ type ImageData []byte
 type GenerateRequest struct {
 	Model     string      `json:"model"`
 	Prompt    string      `json:"prompt"`
+	Suffix    string      `json:"suffix,omitempty"`
 	System    string      `json:"system"`
 	Template  string      `json:"template"`
 	Context   []int       `json:"context,omitempty"`
@@ -55,13 +83,119 @@ type ChatRequest struct {
 	Format    string    `json:"format"`
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// N is the number of choices to generate for the messages, which are
+	// decoded together and share the evaluation of the prompt. 0 is one.
+	N int `json:"n,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
+// SessionRequest creates a session, which keeps the messages of a
+// conversation so each request only sends the next message
+type SessionRequest struct {
+	Model     string    `json:"model"`
+	System    string    `json:"system,omitempty"`
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+type SessionResponse struct {
+	ID        string    `json:"id"`
+	Model     string    `json:"model"`
+	Messages  []Message `json:"messages"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+// SessionChatRequest sends the next user message of a session. Options are
+// merged with the options of the session.
+type SessionChatRequest struct {
+	Content   string      `json:"content"`
+	Images    []ImageData `json:"images,omitempty"`
+	Format    string      `json:"format,omitempty"`
+	Stream    *bool       `json:"stream,omitempty"`
+	KeepAlive *Duration   `json:"keep_alive,omitempty"`
+
+	Options map[string]interface{} `json:"options,omitempty"`
+}
+
+// AliasRequest points the alias Name at the model Target. Requests fall back
+// to the models in Fallbacks, in order, when Target doesn't fit in the free
+// VRAM, and to the last of them when more than MaxQueue requests are waiting.
+type AliasRequest struct {
+	Name      string   `json:"name"`
+	Target    string   `json:"target"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	MaxQueue  int      `json:"max_queue,omitempty"`
+}
+
+type DeleteAliasRequest struct {
+	Name string `json:"name"`
+}
+
+type Alias struct {
+	Name      string   `json:"name"`
+	Target    string   `json:"target"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	MaxQueue  int      `json:"max_queue,omitempty"`
+}
+
+type ListAliasesResponse struct {
+	Aliases []Alias `json:"aliases"`
+}
+
+// SnapshotRequest saves a snapshot of the server's state. Sessions are only
+// included if Sessions is set.
+type SnapshotRequest struct {
+	Sessions bool `json:"sessions,omitempty"`
+}
+
+// Snapshot is the state of a server, which is restored with RestoreSnapshot:
+// its loaded model, its aliases, and optionally its sessions
+type Snapshot struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Model     *SnapshotModel    `json:"model,omitempty"`
+	Aliases   []Alias           `json:"aliases"`
+	Sessions  []SnapshotSession `json:"sessions,omitempty"`
+}
+
+// SnapshotModel is the model which was loaded. Options are the runner options
+// it was loaded with which aren't its own, and LiveOptions are the options
+// changed with ReloadOptions.
+type SnapshotModel struct {
+	Name        string                 `json:"name"`
+	Options     map[string]interface{} `json:"options,omitempty"`
+	LiveOptions map[string]interface{} `json:"live_options,omitempty"`
+	ExpiresAt   time.Time              `json:"expires_at"`
+}
+
+type SnapshotSession struct {
+	SessionResponse
+
+	// KeepAlive is a duration such as "5m"
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+}
+
+// RestoreSnapshotRequest restores Snapshot, or the snapshot the server saved
+// last if it's not set
+type RestoreSnapshotRequest struct {
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
+
 type Message struct {
 	Role    string      `json:"role"` // one of ["system", "user", "assistant"]
 	Content string      `json:"content"`
 	Images  []ImageData `json:"images,omitempty"`
+
+	// Thinking is the thinking of models with the think_end option, which
+	// isn't part of the content. It isn't templated when the message is
+	// sent back as history.
+	Thinking string `json:"thinking,omitempty"`
 }
 
 type ChatResponse struct {
@@ -69,11 +203,29 @@ type ChatResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Message   Message   `json:"message"`
 
+	// Index is the choice of a request with n set which a streamed response
+	// is of. Each choice ends with its own response with done set.
+	Index int `json:"index,omitempty"`
+
+	// Choices are the messages of each choice of a request with n set which
+	// isn't streamed. Message is the first of them.
+	Choices []Message `json:"choices,omitempty"`
+
 	Done bool `json:"done"`
 
+	Build *BuildInfo `json:"build,omitempty"`
+
 	Metrics
 }
 
+// BuildInfo records the runner and options used for a deterministic response
+// so it can be reproduced
+type BuildInfo struct {
+	Version string  `json:"version"`
+	Library string  `json:"library"`
+	Options Options `json:"options"`
+}
+
 type Metrics struct {
 	TotalDuration      time.Duration `json:"total_duration,omitempty"`
 	LoadDuration       time.Duration `json:"load_duration,omitempty"`
@@ -95,6 +247,8 @@ type Options struct {
 	TopP             float32  `json:"top_p,omitempty"`
 	TFSZ             float32  `json:"tfs_z,omitempty"`
 	TypicalP         float32  `json:"typical_p,omitempty"`
+	MinP             float32  `json:"min_p,omitempty"`
+	Samplers         []string `json:"samplers,omitempty"`
 	RepeatLastN      int      `json:"repeat_last_n,omitempty"`
 	Temperature      float32  `json:"temperature,omitempty"`
 	RepeatPenalty    float32  `json:"repeat_penalty,omitempty"`
@@ -105,8 +259,39 @@ type Options struct {
 	MirostatEta      float32  `json:"mirostat_eta,omitempty"`
 	PenalizeNewline  bool     `json:"penalize_newline,omitempty"`
 	Stop             []string `json:"stop,omitempty"`
+	StopRegex        []string `json:"stop_regex,omitempty"`
+	StopTokens       []int    `json:"stop_tokens,omitempty"`
+	IncludeStop      bool     `json:"include_stop,omitempty"`
+	Deterministic    bool     `json:"deterministic,omitempty"`
+
+	// ThinkStart and ThinkEnd mark the thinking a model does before it
+	// responds, which is returned separately from the response. Models
+	// whose templates start the thinking only need ThinkEnd.
+	ThinkStart string `json:"think_start,omitempty"`
+	ThinkEnd   string `json:"think_end,omitempty"`
+
+	// TTFTBudget is how long, in milliseconds, the prompt may take to be
+	// evaluated before the first token is generated. Prompts estimated to
+	// take longer are handled by TTFTStrategy. 0 is no budget.
+	TTFTBudget   int    `json:"ttft_budget,omitempty"`
+	TTFTStrategy string `json:"ttft_strategy,omitempty"`
 }
 
+// TTFT strategies are how prompts which take longer than their ttft_budget
+// are handled
+const (
+	TTFTStrategyWarn       = "warn"
+	TTFTStrategyReject     = "reject"
+	TTFTStrategyDropMiddle = "drop_middle"
+	TTFTStrategySummarize  = "summarize"
+)
+
+var TTFTStrategies = []string{TTFTStrategyWarn, TTFTStrategyReject, TTFTStrategyDropMiddle, TTFTStrategySummarize}
+
+// RopeScalingTypes are the values of rope_scaling_type. An empty one uses yarn
+// when num_ctx is longer than the context the model was trained with.
+var RopeScalingTypes = []string{"none", "linear", "yarn"}
+
 // Runner options which must be set when the model is loaded into memory
 type Runner struct {
 	UseNUMA            bool    `json:"numa,omitempty"`
@@ -123,7 +308,17 @@ type Runner struct {
 	UseMLock           bool    `json:"use_mlock,omitempty"`
 	RopeFrequencyBase  float32 `json:"rope_frequency_base,omitempty"`
 	RopeFrequencyScale float32 `json:"rope_frequency_scale,omitempty"`
+	RopeScalingType    string  `json:"rope_scaling_type,omitempty"`
 	NumThread          int     `json:"num_thread,omitempty"`
+	Pooling            string  `json:"pooling,omitempty"`
+
+	// NumParallel is how many sequences the model decodes at once, each with
+	// a context window of NumCtx. It's the largest n of a chat request.
+	NumParallel int `json:"num_parallel,omitempty"`
+
+	// KVOverrides replace values of the model's metadata when it's loaded,
+	// each in the format key=type:value. See ParseKVOverride.
+	KVOverrides []string `json:"kv_overrides,omitempty"`
 }
 
 type EmbeddingRequest struct {
@@ -131,6 +326,21 @@ type EmbeddingRequest struct {
 	Prompt    string    `json:"prompt"`
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Images are embedded in place of the prompt by models with a vision
+	// projector. Only one image can be embedded at a time.
+	Images []ImageData `json:"images,omitempty"`
+
+	// Normalize scales the embedding to unit length
+	Normalize bool `json:"normalize,omitempty"`
+
+	// Pooling is how the embeddings of each token are combined: mean, cls or
+	// last. It overrides the pooling option, and the model's own pooling.
+	Pooling string `json:"pooling,omitempty"`
+
+	// Dimensions truncates the embedding, for models which support it. 0
+	// keeps every dimension.
+	Dimensions int `json:"dimensions,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
@@ -138,6 +348,65 @@ type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+type TokenizeRequest struct {
+	Model     string    `json:"model"`
+	Prompt    string    `json:"prompt"`
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Options map[string]interface{} `json:"options"`
+}
+
+type TokenizeResponse struct {
+	Tokens []int `json:"tokens"`
+}
+
+type DetokenizeRequest struct {
+	Model     string    `json:"model"`
+	Tokens    []int     `json:"tokens"`
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Options map[string]interface{} `json:"options"`
+}
+
+type DetokenizeResponse struct {
+	Prompt string `json:"prompt"`
+}
+
+// RenderTemplateRequest renders the prompt of a generate request, or of a
+// chat request if it has messages, without generating
+type RenderTemplateRequest struct {
+	Model    string    `json:"model,omitempty"`
+	Template string    `json:"template,omitempty"`
+	System   string    `json:"system,omitempty"`
+	Prompt   string    `json:"prompt,omitempty"`
+	Messages []Message `json:"messages,omitempty"`
+	Tools    []Tool    `json:"tools,omitempty"`
+
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+
+	Options map[string]interface{} `json:"options"`
+}
+
+// Tool is the definition of a tool a template renders for the model to call
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+}
+
+type RenderTemplateResponse struct {
+	Prompt string `json:"prompt"`
+
+	// TokenCount is how many tokens the prompt is, if a model was given
+	TokenCount int      `json:"token_count,omitempty"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
 type CreateRequest struct {
 	Model     string `json:"model"`
 	Path      string `json:"path"`
@@ -174,6 +443,49 @@ type ShowResponse struct {
 	System     string       `json:"system,omitempty"`
 	Details    ModelDetails `json:"details,omitempty"`
 	Messages   []Message    `json:"messages,omitempty"`
+
+	// Capabilities are the kinds of requests the model supports: completion,
+	// chat, embedding, vision and fim
+	Capabilities []string `json:"capabilities,omitempty"`
+
+	// Loading is the progress of loading the model, while it's being loaded
+	Loading *LoadProgress `json:"loading,omitempty"`
+}
+
+// LoadProgress is the progress of loading a model. The model file is read
+// first, then the runner starts.
+type LoadProgress struct {
+	Model     string `json:"model"`
+	Status    string `json:"status"`
+	Completed int64  `json:"completed,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+}
+
+// ModelOptionsRequest updates the default options of a model. Options which
+// are null are removed.
+type ModelOptionsRequest struct {
+	Options map[string]interface{} `json:"options"`
+}
+
+type ModelOptionsResponse struct {
+	Options map[string]interface{} `json:"options"`
+}
+
+// ReloadOptionsRequest changes the options of a loaded model which don't
+// need it to be loaded again: num_thread, num_batch and the options of
+// predictions, such as the samplers. Options which are null are reset.
+type ReloadOptionsRequest struct {
+	Options map[string]interface{} `json:"options"`
+
+	// KeepAlive is how long the model stays loaded from now
+	KeepAlive *Duration `json:"keep_alive,omitempty"`
+}
+
+// ReloadOptionsResponse is the options a loaded model runs requests with
+// until it's unloaded, and when it's unloaded
+type ReloadOptionsResponse struct {
+	Options   map[string]interface{} `json:"options"`
+	ExpiresAt time.Time              `json:"expires_at"`
 }
 
 type CopyRequest struct {
@@ -181,6 +493,82 @@ type CopyRequest struct {
 	Destination string `json:"destination"`
 }
 
+// QueueResponse is the requests waiting for the loaded model, in the order
+// they'll run
+type QueueResponse struct {
+	Running  bool            `json:"running"`
+	Queued   []QueuedRequest `json:"queued"`
+	MaxQueue int             `json:"max_queue"`
+}
+
+type QueuedRequest struct {
+	Path     string    `json:"path"`
+	Priority int       `json:"priority"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+// Usage is the tokens an account has used. Accounts are API keys, named by
+// the fingerprint of the key as "key:<fingerprint>", sessions as
+// "session:<id>", or "anonymous" for requests without either.
+type Usage struct {
+	Account          string `json:"account"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	TotalTokens      int64  `json:"total_tokens"`
+
+	// DailyTokens are the tokens used since midnight UTC
+	DailyTokens int64 `json:"daily_tokens"`
+}
+
+// UsageResponse is the usage of each account, and the budgets which apply
+// to each of them
+type UsageResponse struct {
+	Usage       []Usage `json:"usage"`
+	DailyBudget int64   `json:"daily_budget,omitempty"`
+	TotalBudget int64   `json:"total_budget,omitempty"`
+}
+
+type ExportRequest struct {
+	Model string `json:"model"`
+}
+
+type ImportResponse struct {
+	Model string `json:"model"`
+}
+
+// AuditEntry records an operation which changed the models: a create, pull,
+// push, copy, import or delete
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Model     string    `json:"model"`
+
+	// Digest is the digest of the model's manifest
+	Digest string `json:"digest,omitempty"`
+
+	// Source is where the model came from: the FROM of a create, the model
+	// pulled or copied, or the archive of an import
+	Source string `json:"source,omitempty"`
+
+	// Client and UserAgent are the address and user agent of the client
+	// which sent the request
+	Client    string `json:"client,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// AuditRequest filters the audit log. Fields which are empty match every entry.
+type AuditRequest struct {
+	Model     string
+	Operation string
+	Since     time.Time
+}
+
+type AuditResponse struct {
+	Entries []AuditEntry `json:"entries"`
+}
+
 type PullRequest struct {
 	Model    string `json:"model"`
 	Insecure bool   `json:"insecure,omitempty"`
@@ -188,6 +576,9 @@ type PullRequest struct {
 	Password string `json:"password"`
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// RateLimit is the most bytes per second to download at, 0 is unlimited
+	RateLimit int64 `json:"rate_limit,omitempty"`
+
 	// Name is deprecated, see Model
 	Name string `json:"name"`
 }
@@ -206,6 +597,15 @@ type PushRequest struct {
 	Password string `json:"password"`
 	Stream   *bool  `json:"stream,omitempty"`
 
+	// RateLimit is the most bytes per second to upload at, 0 is unlimited
+	RateLimit int64 `json:"rate_limit,omitempty"`
+
+	// Base is a model to push the difference from, for clients which have it
+	Base string `json:"base,omitempty"`
+
+	// Compression compresses model layers in the registry, only zstd is supported
+	Compression string `json:"compression,omitempty"`
+
 	// Name is deprecated, see Model
 	Name string `json:"name"`
 }
@@ -221,6 +621,40 @@ type ModelResponse struct {
 	Size       int64        `json:"size"`
 	Digest     string       `json:"digest"`
 	Details    ModelDetails `json:"details,omitempty"`
+
+	// UpdateAvailable is set when the last update check found a newer
+	// version of the model in its registry
+	UpdateAvailable bool `json:"update_available,omitempty"`
+}
+
+// ProcessResponse is the models which are loaded
+type ProcessResponse struct {
+	Models []ProcessModelResponse `json:"models"`
+}
+
+type ProcessModelResponse struct {
+	Name      string    `json:"name"`
+	Model     string    `json:"model"`
+	Digest    string    `json:"digest"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Size is the memory the model was estimated to need when it was loaded,
+	// and SizeVRAM how much of it is in VRAM. The rest is in system memory.
+	Size     int64 `json:"size"`
+	SizeVRAM int64 `json:"size_vram"`
+}
+
+// ModelUpdate is the result of checking the registry of a model for a newer
+// version of it
+type ModelUpdate struct {
+	Model           string    `json:"model"`
+	UpdateAvailable bool      `json:"update_available"`
+	CheckedAt       time.Time `json:"checked_at"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type UpdatesResponse struct {
+	Models []ModelUpdate `json:"models"`
 }
 
 type TokenResponse struct {
@@ -232,9 +666,21 @@ type GenerateResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response"`
 
+	// Thinking is the thinking of models with the think_end option, which
+	// isn't part of the response
+	Thinking string `json:"thinking,omitempty"`
+
+	// Status, Completed and Total are the progress of loading the model,
+	// which streamed requests are sent before the response
+	Status    string `json:"status,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+
 	Done    bool  `json:"done"`
 	Context []int `json:"context,omitempty"`
 
+	Build *BuildInfo `json:"build,omitempty"`
+
 	Metrics
 }
 
@@ -277,16 +723,95 @@ func (m *Metrics) Summary() {
 
 var ErrInvalidOpts = fmt.Errorf("invalid options")
 
+// OptionError is an option, or a field of a request, which is unknown or has
+// an invalid value. It wraps ErrInvalidOpts and is reported with the name in
+// the param of the error response.
+type OptionError struct {
+	Option string
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("%v: %s %s", ErrInvalidOpts, e.Option, e.Reason)
+}
+
+func (e *OptionError) Unwrap() error {
+	return ErrInvalidOpts
+}
+
+// UnknownOptionError returns an error for an option which isn't one of
+// names, suggesting the closest of them in case it's misspelled
+func UnknownOptionError(option string, names []string) *OptionError {
+	reason := "is unknown"
+	if name := closestName(option, names); name != "" {
+		reason += fmt.Sprintf(", did you mean %s?", name)
+	}
+
+	return &OptionError{Option: option, Reason: reason}
+}
+
+// UnknownOptionsError returns an error for each of options which isn't one of
+// names. The first of them is the option the error is reported with.
+func UnknownOptionsError(options []string, names []string) error {
+	errs := make([]error, len(options))
+	for i, option := range options {
+		errs[i] = UnknownOptionError(option, names)
+	}
+
+	return errors.Join(errs...)
+}
+
+// closestName returns the name closest to s by edit distance, if it's close
+// enough to be a misspelling of it
+func closestName(s string, names []string) string {
+	var closest string
+	best := max(len(s)/3, 1) + 1
+	for _, name := range names {
+		if d := editDistance(strings.ToLower(s), name); d < best {
+			closest, best = name, d
+		}
+	}
+
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
 func (opts *Options) FromMap(m map[string]interface{}) error {
 	valueOpts := reflect.ValueOf(opts).Elem() // names of the fields in the options struct
 	typeOpts := reflect.TypeOf(opts).Elem()   // types of the fields in the options struct
 
 	// build map of json struct tags to their types
 	jsonOpts := make(map[string]reflect.StructField)
+	var names []string
 	for _, field := range reflect.VisibleFields(typeOpts) {
 		jsonTag := strings.Split(field.Tag.Get("json"), ",")[0]
 		if jsonTag != "" {
 			jsonOpts[jsonTag] = field
+			names = append(names, jsonTag)
 		}
 	}
 
@@ -308,43 +833,58 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 						// when JSON unmarshals numbers, it uses float64, not int
 						field.SetInt(int64(t))
 					default:
-						return fmt.Errorf("option %q must be of type integer", key)
+						return &OptionError{Option: key, Reason: "must be of type integer"}
 					}
 				case reflect.Bool:
 					val, ok := val.(bool)
 					if !ok {
-						return fmt.Errorf("option %q must be of type boolean", key)
+						return &OptionError{Option: key, Reason: "must be of type boolean"}
 					}
 					field.SetBool(val)
 				case reflect.Float32:
 					// JSON unmarshals to float64
 					val, ok := val.(float64)
 					if !ok {
-						return fmt.Errorf("option %q must be of type float32", key)
+						return &OptionError{Option: key, Reason: "must be of type float32"}
 					}
 					field.SetFloat(val)
 				case reflect.String:
 					val, ok := val.(string)
 					if !ok {
-						return fmt.Errorf("option %q must be of type string", key)
+						return &OptionError{Option: key, Reason: "must be of type string"}
 					}
 					field.SetString(val)
 				case reflect.Slice:
 					// JSON unmarshals to []interface{}, not []string
 					val, ok := val.([]interface{})
 					if !ok {
-						return fmt.Errorf("option %q must be of type array", key)
+						return &OptionError{Option: key, Reason: "must be of type array"}
 					}
-					// convert []interface{} to []string
-					slice := make([]string, len(val))
-					for i, item := range val {
-						str, ok := item.(string)
-						if !ok {
-							return fmt.Errorf("option %q must be of an array of strings", key)
+
+					switch field.Type().Elem().Kind() {
+					case reflect.Int:
+						// convert []interface{} to []int
+						slice := make([]int, len(val))
+						for i, item := range val {
+							num, ok := item.(float64)
+							if !ok {
+								return &OptionError{Option: key, Reason: "must be of an array of integers"}
+							}
+							slice[i] = int(num)
+						}
+						field.Set(reflect.ValueOf(slice))
+					default:
+						// convert []interface{} to []string
+						slice := make([]string, len(val))
+						for i, item := range val {
+							str, ok := item.(string)
+							if !ok {
+								return &OptionError{Option: key, Reason: "must be of an array of strings"}
+							}
+							slice[i] = str
 						}
-						slice[i] = str
+						field.Set(reflect.ValueOf(slice))
 					}
-					field.Set(reflect.ValueOf(slice))
 				default:
 					return fmt.Errorf("unknown type loading config params: %v", field.Kind())
 				}
@@ -354,12 +894,181 @@ func (opts *Options) FromMap(m map[string]interface{}) error {
 		}
 	}
 
+	// all the unknown options are reported, with suggestions for those which
+	// are misspelled
 	if len(invalidOpts) > 0 {
-		return fmt.Errorf("%w: %v", ErrInvalidOpts, strings.Join(invalidOpts, ", "))
+		slices.Sort(invalidOpts)
+		return UnknownOptionsError(invalidOpts, names)
 	}
 	return nil
 }
 
+// Samplers are the samplers which can be ordered with the samplers option.
+// Mirostat replaces these when it's enabled.
+var Samplers = []string{"top_k", "tfs_z", "typical_p", "top_p", "min_p", "temperature"}
+
+// ValidateSampling checks that the sampling options are within their valid ranges
+func (opts *Options) ValidateSampling() error {
+	for _, o := range []struct {
+		name  string
+		value float32
+	}{
+		{"top_p", opts.TopP},
+		{"min_p", opts.MinP},
+	} {
+		if o.value < 0 || o.value > 1 {
+			return &OptionError{Option: o.name, Reason: "must be between 0 and 1"}
+		}
+	}
+
+	// values of 1 or more disable tfs_z and typical_p
+	for _, o := range []struct {
+		name  string
+		value float32
+	}{
+		{"temperature", opts.Temperature},
+		{"tfs_z", opts.TFSZ},
+		{"typical_p", opts.TypicalP},
+		{"repeat_penalty", opts.RepeatPenalty},
+		{"mirostat_tau", opts.MirostatTau},
+		{"mirostat_eta", opts.MirostatEta},
+	} {
+		if o.value < 0 {
+			return &OptionError{Option: o.name, Reason: "must not be negative"}
+		}
+	}
+
+	// -1 is unlimited for num_predict and repeat_last_n, and -2 fills the
+	// context for num_predict. -1 as num_keep keeps the whole prompt.
+	for _, o := range []struct {
+		name       string
+		value, min int
+	}{
+		{"top_k", opts.TopK, 0},
+		{"num_keep", opts.NumKeep, -1},
+		{"num_predict", opts.NumPredict, -2},
+		{"repeat_last_n", opts.RepeatLastN, -1},
+	} {
+		if o.value < o.min {
+			return &OptionError{Option: o.name, Reason: fmt.Sprintf("must be %d or more", o.min)}
+		}
+	}
+
+	if opts.Mirostat < 0 || opts.Mirostat > 2 {
+		return &OptionError{Option: "mirostat", Reason: "must be 0, 1 or 2"}
+	}
+
+	for i, sampler := range opts.Samplers {
+		if !slices.Contains(Samplers, sampler) {
+			return &OptionError{Option: "samplers", Reason: fmt.Sprintf("has unknown sampler %q, must be one of %s", sampler, strings.Join(Samplers, ", "))}
+		}
+
+		if slices.Contains(opts.Samplers[:i], sampler) {
+			return &OptionError{Option: "samplers", Reason: fmt.Sprintf("has sampler %q repeated", sampler)}
+		}
+	}
+
+	return nil
+}
+
+// ValidateRunner checks that the runner options are within their valid
+// ranges, so they're rejected before the model is loaded with them
+func (opts *Options) ValidateRunner() error {
+	// -1 as num_gpu offloads as many layers as fit
+	for _, o := range []struct {
+		name       string
+		value, min int
+	}{
+		{"num_ctx", opts.NumCtx, 0},
+		{"num_batch", opts.NumBatch, 1},
+		{"num_parallel", opts.NumParallel, 1},
+		{"num_gpu", opts.NumGPU, -1},
+		{"main_gpu", opts.MainGPU, 0},
+		{"num_thread", opts.NumThread, 0},
+	} {
+		if o.value < o.min {
+			return &OptionError{Option: o.name, Reason: fmt.Sprintf("must be %d or more", o.min)}
+		}
+	}
+
+	if opts.RopeScalingType != "" && !slices.Contains(RopeScalingTypes, opts.RopeScalingType) {
+		return &OptionError{Option: "rope_scaling_type", Reason: fmt.Sprintf("must be one of %s", strings.Join(RopeScalingTypes, ", "))}
+	}
+
+	return nil
+}
+
+// ValidateTTFT checks the ttft_budget and ttft_strategy options
+func (opts *Options) ValidateTTFT() error {
+	if opts.TTFTBudget < 0 {
+		return &OptionError{Option: "ttft_budget", Reason: "must be 0 or more"}
+	}
+
+	if opts.TTFTStrategy != "" && !slices.Contains(TTFTStrategies, opts.TTFTStrategy) {
+		return &OptionError{Option: "ttft_strategy", Reason: fmt.Sprintf("must be one of %s", strings.Join(TTFTStrategies, ", "))}
+	}
+
+	return nil
+}
+
+// KVOverride replaces a value of a model's metadata when it's loaded, without
+// changing the model file
+type KVOverride struct {
+	Key string
+
+	// Value is an int64, float64 or bool
+	Value any
+}
+
+// ParseKVOverride parses an override in the format key=type:value, where type
+// is int, float or bool, like llama.cpp's --override-kv
+func ParseKVOverride(s string) (KVOverride, error) {
+	key, typed, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return KVOverride{}, fmt.Errorf("%w: kv override %q must be in the format key=type:value", ErrInvalidOpts, s)
+	}
+
+	// llama.cpp keeps keys in a 128 byte buffer with a null terminator
+	if len(key) > 127 {
+		return KVOverride{}, fmt.Errorf("%w: kv override key %q is longer than 127 bytes", ErrInvalidOpts, key)
+	}
+
+	kind, value, ok := strings.Cut(typed, ":")
+	if !ok {
+		return KVOverride{}, fmt.Errorf("%w: kv override %q must be in the format key=type:value", ErrInvalidOpts, s)
+	}
+
+	var err error
+	kv := KVOverride{Key: key}
+	switch kind {
+	case "int":
+		kv.Value, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		kv.Value, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		kv.Value, err = strconv.ParseBool(value)
+	default:
+		return KVOverride{}, fmt.Errorf("%w: kv override %q has unknown type %q, must be one of int, float or bool", ErrInvalidOpts, s, kind)
+	}
+
+	if err != nil {
+		return KVOverride{}, fmt.Errorf("%w: kv override %q has an invalid %s value", ErrInvalidOpts, s, kind)
+	}
+
+	return kv, nil
+}
+
+// ValidateKVOverrides checks that the kv overrides can be parsed
+func (opts *Options) ValidateKVOverrides() error {
+	for _, s := range opts.KVOverrides {
+		if _, err := ParseKVOverride(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func DefaultOptions() Options {
 	return Options{
 		// options set on request to runner
@@ -370,6 +1079,7 @@ func DefaultOptions() Options {
 		TopP:             0.9,
 		TFSZ:             1.0,
 		TypicalP:         1.0,
+		MinP:             0.05,
 		RepeatLastN:      64,
 		RepeatPenalty:    1.1,
 		PresencePenalty:  0.0,
@@ -383,9 +1093,10 @@ func DefaultOptions() Options {
 		Runner: Runner{
 			// options set when the model is loaded
 			NumCtx:             2048,
-			RopeFrequencyBase:  10000.0,
-			RopeFrequencyScale: 1.0,
+			RopeFrequencyBase:  0.0, // 0 here indicates that the value encoded in the model should be used
+			RopeFrequencyScale: 0.0,
 			NumBatch:           512,
+			NumParallel:        1,
 			NumGPU:             -1, // -1 here indicates that NumGPU should be set dynamically
 			NumGQA:             1,
 			NumThread:          0, // let the runtime decide
@@ -478,7 +1189,21 @@ func FormatParams(params map[string][]string) (map[string]interface{}, error) {
 				case reflect.String:
 					out[key] = vals[0]
 				case reflect.Slice:
-					// TODO: only string slices are supported right now
+					if field.Type().Elem().Kind() == reflect.Int {
+						ints := make([]int, len(vals))
+						for i, val := range vals {
+							intVal, err := strconv.Atoi(val)
+							if err != nil {
+								return nil, fmt.Errorf("invalid int value %s", vals)
+							}
+
+							ints[i] = intVal
+						}
+
+						out[key] = ints
+						continue
+					}
+
 					out[key] = vals
 				default:
 					return nil, fmt.Errorf("unknown type %s for %s", field.Kind(), key)
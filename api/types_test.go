@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/json"
 	"math"
+	"strings"
 	"testing"
 	"time"
 
@@ -48,3 +49,135 @@ func TestKeepAliveParsingFromJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateSampling(t *testing.T) {
+	tests := []struct {
+		name string
+		opts map[string]interface{}
+		err  bool
+	}{
+		{"defaults", map[string]interface{}{}, false},
+		{"min_p", map[string]interface{}{"min_p": 0.1}, false},
+		{"min_p out of range", map[string]interface{}{"min_p": 1.5}, true},
+		{"negative temperature", map[string]interface{}{"temperature": -1.0}, true},
+		{"mirostat v2", map[string]interface{}{"mirostat": 2.0}, false},
+		{"mirostat v3", map[string]interface{}{"mirostat": 3.0}, true},
+		{"samplers", map[string]interface{}{"samplers": []interface{}{"min_p", "temperature"}}, false},
+		{"unknown sampler", map[string]interface{}{"samplers": []interface{}{"dry"}}, true},
+		{"repeated sampler", map[string]interface{}{"samplers": []interface{}{"top_k", "top_k"}}, true},
+		{"negative top_k", map[string]interface{}{"top_k": -1.0}, true},
+		{"unlimited num_predict", map[string]interface{}{"num_predict": -1.0}, false},
+		{"fill context num_predict", map[string]interface{}{"num_predict": -2.0}, false},
+		{"num_predict out of range", map[string]interface{}{"num_predict": -3.0}, true},
+		{"negative repeat_penalty", map[string]interface{}{"repeat_penalty": -0.5}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			require.NoError(t, opts.FromMap(test.opts))
+
+			err := opts.ValidateSampling()
+			if test.err {
+				assert.ErrorIs(t, err, ErrInvalidOpts)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestValidateRunner(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  map[string]interface{}
+		param string
+	}{
+		{"defaults", map[string]interface{}{}, ""},
+		{"num_gpu", map[string]interface{}{"num_gpu": 0.0}, ""},
+		{"no num_batch", map[string]interface{}{"num_batch": 0.0}, "num_batch"},
+		{"negative num_ctx", map[string]interface{}{"num_ctx": -1.0}, "num_ctx"},
+		{"negative num_thread", map[string]interface{}{"num_thread": -4.0}, "num_thread"},
+		{"rope_scaling_type", map[string]interface{}{"rope_scaling_type": "linear"}, ""},
+		{"unknown rope_scaling_type", map[string]interface{}{"rope_scaling_type": "ntk"}, "rope_scaling_type"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			require.NoError(t, opts.FromMap(test.opts))
+
+			err := opts.ValidateRunner()
+			if test.param == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			var optErr *OptionError
+			require.ErrorAs(t, err, &optErr)
+			assert.Equal(t, test.param, optErr.Option)
+			assert.ErrorIs(t, err, ErrInvalidOpts)
+
+			for option := range test.opts {
+				assert.Contains(t, err.Error(), option)
+			}
+		})
+	}
+}
+
+func TestFromMapErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts map[string]interface{}
+		exp  OptionError
+	}{
+		{"misspelled", map[string]interface{}{"temprature": 0.1}, OptionError{"temprature", "is unknown, did you mean temperature?"}},
+		{"case", map[string]interface{}{"Top_K": 10.0}, OptionError{"Top_K", "is unknown, did you mean top_k?"}},
+		{"unknown", map[string]interface{}{"creativity": 1.0}, OptionError{"creativity", "is unknown"}},
+		{"all unknown", map[string]interface{}{"zzz": 1.0, "seeed": 1.0}, OptionError{"seeed", "is unknown, did you mean seed?"}},
+		{"wrong type", map[string]interface{}{"top_k": "many"}, OptionError{"top_k", "must be of type integer"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			err := opts.FromMap(test.opts)
+
+			var optErr *OptionError
+			require.ErrorAs(t, err, &optErr)
+			assert.Equal(t, test.exp, *optErr)
+			assert.ErrorIs(t, err, ErrInvalidOpts)
+		})
+	}
+}
+
+func TestParseKVOverride(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp KVOverride
+		err bool
+	}{
+		{"llama.context_length=int:8192", KVOverride{"llama.context_length", int64(8192)}, false},
+		{"llama.rope.freq_base=float:1e6", KVOverride{"llama.rope.freq_base", 1e6}, false},
+		{"tokenizer.ggml.add_bos_token=bool:false", KVOverride{"tokenizer.ggml.add_bos_token", false}, false},
+		{"llama.context_length", KVOverride{}, true},
+		{"=int:1", KVOverride{}, true},
+		{"llama.context_length=8192", KVOverride{}, true},
+		{"general.name=str:llama", KVOverride{}, true},
+		{"llama.context_length=int:long", KVOverride{}, true},
+		{strings.Repeat("k", 128) + "=int:1", KVOverride{}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			kv, err := ParseKVOverride(test.in)
+			if test.err {
+				assert.ErrorIs(t, err, ErrInvalidOpts)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.exp, kv)
+		})
+	}
+}
@@ -2,11 +2,13 @@ package cmd
 
 import (
 	"archive/zip"
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -18,6 +20,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -31,10 +34,10 @@ import (
 	"golang.org/x/term"
 
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/config"
 	"github.com/jmorganca/ollama/format"
 	"github.com/jmorganca/ollama/parser"
 	"github.com/jmorganca/ollama/progress"
-	"github.com/jmorganca/ollama/server"
 	"github.com/jmorganca/ollama/version"
 )
 
@@ -194,6 +197,19 @@ func CreateHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
+	kvs, err := cmd.Flags().GetStringArray("kv")
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range kvs {
+		if _, err := api.ParseKVOverride(kv); err != nil {
+			return err
+		}
+
+		modelfile = append(modelfile, []byte("\nOVERRIDE "+kv)...)
+	}
+
 	request := api.CreateRequest{Name: args[0], Modelfile: string(modelfile)}
 	if err := client.Create(cmd.Context(), &request, fn); err != nil {
 		return err
@@ -263,6 +279,31 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 	}
 	opts.Format = format
 
+	kvs, err := cmd.Flags().GetStringArray("kv")
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range kvs {
+		if _, err := api.ParseKVOverride(kv); err != nil {
+			return err
+		}
+	}
+
+	if len(kvs) > 0 {
+		opts.Options["kv_overrides"] = kvs
+	}
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(outputModes, output) {
+		return fmt.Errorf("invalid output %q, must be one of %s", output, strings.Join(outputModes, ", "))
+	}
+	opts.Output = output
+
 	prompts := args[1:]
 	// prepend stdin to the prompt if provided
 	if !term.IsTerminal(int(os.Stdin.Fd())) {
@@ -284,7 +325,7 @@ func RunHandler(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	opts.WordWrap = !nowrap
+	opts.WordWrap = !nowrap && opts.Output == "text"
 
 	if !interactive {
 		return generate(cmd, opts)
@@ -304,6 +345,21 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	compression, err := cmd.Flags().GetString("compression")
+	if err != nil {
+		return err
+	}
+
+	base, err := cmd.Flags().GetString("base")
+	if err != nil {
+		return err
+	}
+
+	rateLimit, err := rateLimitFlag(cmd)
+	if err != nil {
+		return err
+	}
+
 	p := progress.NewProgress(os.Stderr)
 	defer p.Stop()
 
@@ -338,7 +394,7 @@ func PushHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	request := api.PushRequest{Name: args[0], Insecure: insecure}
+	request := api.PushRequest{Name: args[0], Insecure: insecure, Base: base, Compression: compression, RateLimit: rateLimit}
 	if err := client.Push(cmd.Context(), &request, fn); err != nil {
 		return err
 	}
@@ -359,15 +415,32 @@ func ListHandler(cmd *cobra.Command, args []string) error {
 	}
 
 	var data [][]string
+	header := []string{"NAME", "ID", "SIZE", "MODIFIED"}
+
+	// updates are only shown once a check has found one
+	updates := slices.ContainsFunc(models.Models, func(m api.ModelResponse) bool { return m.UpdateAvailable })
+	if updates {
+		header = append(header, "UPDATE")
+	}
 
 	for _, m := range models.Models {
 		if len(args) == 0 || strings.HasPrefix(m.Name, args[0]) {
-			data = append(data, []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")})
+			row := []string{m.Name, m.Digest[:12], format.HumanBytes(m.Size), format.HumanTime(m.ModifiedAt, "Never")}
+			if updates {
+				var update string
+				if m.UpdateAvailable {
+					update = "available"
+				}
+
+				row = append(row, update)
+			}
+
+			data = append(data, row)
 		}
 	}
 
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"NAME", "ID", "SIZE", "MODIFIED"})
+	table.SetHeader(header)
 	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
 	table.SetAlignment(tablewriter.ALIGN_LEFT)
 	table.SetHeaderLine(false)
@@ -411,8 +484,9 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 	parameters, errParams := cmd.Flags().GetBool("parameters")
 	system, errSystem := cmd.Flags().GetBool("system")
 	template, errTemplate := cmd.Flags().GetBool("template")
+	loading, errLoading := cmd.Flags().GetBool("loading")
 
-	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate} {
+	for _, boolErr := range []error{errLicense, errModelfile, errParams, errSystem, errTemplate, errLoading} {
 		if boolErr != nil {
 			return errors.New("error retrieving flags")
 		}
@@ -446,10 +520,15 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		showType = "template"
 	}
 
+	if loading {
+		flagsSet++
+		showType = "loading"
+	}
+
 	if flagsSet > 1 {
-		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', or '--template' can be specified")
+		return errors.New("only one of '--license', '--modelfile', '--parameters', '--system', '--template', or '--loading' can be specified")
 	} else if flagsSet == 0 {
-		return errors.New("one of '--license', '--modelfile', '--parameters', '--system', or '--template' must be specified")
+		return errors.New("one of '--license', '--modelfile', '--parameters', '--system', '--template', or '--loading' must be specified")
 	}
 
 	req := api.ShowRequest{Name: args[0]}
@@ -469,6 +548,15 @@ func ShowHandler(cmd *cobra.Command, args []string) error {
 		fmt.Println(resp.System)
 	case "template":
 		fmt.Println(resp.Template)
+	case "loading":
+		switch {
+		case resp.Loading == nil:
+			fmt.Println("not loading")
+		case resp.Loading.Total > 0:
+			fmt.Printf("%s %s/%s (%d%%)\n", resp.Loading.Status, format.HumanBytes(resp.Loading.Completed), format.HumanBytes(resp.Loading.Total), resp.Loading.Completed*100/resp.Loading.Total)
+		default:
+			fmt.Println(resp.Loading.Status)
+		}
 	}
 
 	return nil
@@ -488,17 +576,231 @@ func CopyHandler(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+func ExportHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.StopAndClear()
+
+	spinner := progress.NewSpinner(fmt.Sprintf("exporting '%s'", args[0]))
+	p.Add("", spinner)
+
+	if err := client.Export(cmd.Context(), &api.ExportRequest{Model: args[0]}, f); err != nil {
+		f.Close()
+		os.Remove(args[1])
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	p.StopAndClear()
+	fmt.Printf("exported '%s' to '%s'\n", args[0], args[1])
+	return nil
+}
+
+func SnapshotSaveHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	withSessions, err := cmd.Flags().GetBool("sessions")
+	if err != nil {
+		return err
+	}
+
+	snap, err := client.SaveSnapshot(cmd.Context(), &api.SnapshotRequest{Sessions: withSessions})
+	if err != nil {
+		return err
+	}
+
+	// the server keeps the snapshot too, the file is to restore it elsewhere
+	if len(args) > 0 {
+		bts, err := json.MarshalIndent(snap, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(args[0], bts, 0o644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println(describeSnapshot("saved", snap))
+	return nil
+}
+
+func SnapshotRestoreHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	var req api.RestoreSnapshotRequest
+	if len(args) > 0 {
+		bts, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(bts, &req.Snapshot); err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.StopAndClear()
+
+	spinner := progress.NewSpinner("restoring snapshot")
+	p.Add("", spinner)
+
+	snap, err := client.RestoreSnapshot(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	p.StopAndClear()
+	fmt.Println(describeSnapshot("restored", snap))
+	return nil
+}
+
+// describeSnapshot returns what a snapshot has, such as "saved 'llama3' with
+// 2 aliases and 1 session"
+func describeSnapshot(verb string, snap *api.Snapshot) string {
+	model := "no loaded model"
+	if snap.Model != nil {
+		model = fmt.Sprintf("'%s'", snap.Model.Name)
+	}
+
+	count := func(n int, one, many string) string {
+		if n == 1 {
+			return "1 " + one
+		}
+
+		return fmt.Sprintf("%d %s", n, many)
+	}
+
+	return fmt.Sprintf("%s %s with %s and %s", verb, model, count(len(snap.Aliases), "alias", "aliases"), count(len(snap.Sessions), "session", "sessions"))
+}
+
+func ImportHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var name string
+	if len(args) > 1 {
+		name = args[1]
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.StopAndClear()
+
+	spinner := progress.NewSpinner(fmt.Sprintf("importing '%s'", args[0]))
+	p.Add("", spinner)
+
+	resp, err := client.Import(cmd.Context(), name, f)
+	if err != nil {
+		return err
+	}
+
+	p.StopAndClear()
+	fmt.Printf("imported '%s'\n", resp.Model)
+	return nil
+}
+
 func PullHandler(cmd *cobra.Command, args []string) error {
 	insecure, err := cmd.Flags().GetBool("insecure")
 	if err != nil {
 		return err
 	}
 
+	// run pulls missing models with its own flags, which don't include --all
+	all, _ := cmd.Flags().GetBool("all")
+
+	rateLimit, err := rateLimitFlag(cmd)
+	if err != nil {
+		return err
+	}
+
 	client, err := api.ClientFromEnvironment()
 	if err != nil {
 		return err
 	}
 
+	if !all {
+		if len(args) != 1 {
+			return errors.New("pull requires a model, or --all")
+		}
+
+		return pullModel(cmd.Context(), client, args[0], insecure, rateLimit)
+	}
+
+	if len(args) > 0 {
+		return errors.New("--all doesn't take a model")
+	}
+
+	updates, err := client.CheckUpdates(cmd.Context())
+	if err != nil {
+		return err
+	}
+
+	var pulled int
+	for _, m := range updates.Models {
+		if !m.UpdateAvailable {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "updating %s\n", m.Model)
+		if err := pullModel(cmd.Context(), client, m.Model, insecure, rateLimit); err != nil {
+			return err
+		}
+
+		pulled++
+	}
+
+	if pulled == 0 {
+		fmt.Fprintln(os.Stderr, "all models are up to date")
+	}
+
+	return nil
+}
+
+// rateLimitFlag returns the bytes per second set by --rate-limit, such as
+// 10MB, or 0 if it isn't set
+func rateLimitFlag(cmd *cobra.Command) (int64, error) {
+	s, _ := cmd.Flags().GetString("rate-limit")
+	if s == "" {
+		return 0, nil
+	}
+
+	rate, err := format.ParseBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --rate-limit: %w", err)
+	}
+
+	return rate, nil
+}
+
+func pullModel(ctx context.Context, client *api.Client, name string, insecure bool, rateLimit int64) error {
 	p := progress.NewProgress(os.Stderr)
 	defer p.Stop()
 
@@ -534,12 +836,8 @@ func PullHandler(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	request := api.PullRequest{Name: args[0], Insecure: insecure}
-	if err := client.Pull(cmd.Context(), &request, fn); err != nil {
-		return err
-	}
-
-	return nil
+	request := api.PullRequest{Name: name, Insecure: insecure, RateLimit: rateLimit}
+	return client.Pull(ctx, &request, fn)
 }
 
 type generateContextKey string
@@ -551,6 +849,7 @@ type runOptions struct {
 	Messages    []api.Message
 	WordWrap    bool
 	Format      string
+	Output      string
 	System      string
 	Template    string
 	Images      []api.ImageData
@@ -705,6 +1004,7 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 	}()
 
 	var state *displayResponseState = &displayResponseState{}
+	var fullResponse strings.Builder
 
 	fn := func(response api.GenerateResponse) error {
 		p.StopAndClear()
@@ -712,7 +1012,13 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		latest = response
 		content := response.Response
 
-		displayResponse(content, opts.WordWrap, state)
+		switch opts.Output {
+		case "json", "plain":
+			// the full response is needed before it can be written out
+			fullResponse.WriteString(content)
+		default:
+			displayResponse(content, opts.WordWrap, state)
+		}
 
 		return nil
 	}
@@ -742,9 +1048,26 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 		return err
 	}
 
-	if opts.Prompt != "" {
-		fmt.Println()
-		fmt.Println()
+	switch opts.Output {
+	case "json":
+		resp := latest
+		resp.Response = fullResponse.String()
+		resp.Context = nil
+
+		bts, err := json.Marshal(resp)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bts))
+	case "plain":
+		fmt.Println(stripMarkdown(fullResponse.String()))
+	case "raw":
+	default:
+		if opts.Prompt != "" {
+			fmt.Println()
+			fmt.Println()
+		}
 	}
 
 	if !latest.Done {
@@ -766,25 +1089,442 @@ func generate(cmd *cobra.Command, opts runOptions) error {
 	return nil
 }
 
-func RunServer(cmd *cobra.Command, _ []string) error {
-	host, port, err := net.SplitHostPort(strings.Trim(os.Getenv("OLLAMA_HOST"), "\"'"))
+// batchRequest is a single line of a batch input file. ID is optional and is
+// copied to the matching output line.
+type batchRequest struct {
+	ID string `json:"id,omitempty"`
+	api.GenerateRequest
+}
+
+type batchResponse struct {
+	ID string `json:"id,omitempty"`
+	api.GenerateResponse
+	Error string `json:"error,omitempty"`
+}
+
+// batchResult is the response to a batch request, or the error which stops
+// the batch
+type batchResult struct {
+	resp batchResponse
+	err  error
+}
+
+func BatchHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
 	if err != nil {
-		host, port = "127.0.0.1", "11434"
-		if ip := net.ParseIP(strings.Trim(os.Getenv("OLLAMA_HOST"), "[]")); ip != nil {
-			host = ip.String()
+		return err
+	}
+
+	input, err := cmd.Flags().GetString("input")
+	if err != nil {
+		return err
+	}
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	concurrency, err := cmd.Flags().GetInt("concurrency")
+	if err != nil {
+		return err
+	}
+
+	if concurrency < 1 {
+		return errors.New("concurrency must be 1 or more")
+	}
+
+	var r io.Reader = os.Stdin
+	if input != "" && input != "-" {
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" && output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	defer p.StopAndClear()
+
+	spinner := progress.NewSpinner("")
+	p.Add("", spinner)
+
+	start := time.Now()
+	total, failed, err := runBatch(cmd.Context(), client, args[0], r, w, concurrency)
+	if err != nil {
+		return err
+	}
+
+	p.StopAndClear()
+	fmt.Fprintf(os.Stderr, "processed %d prompts (%d failed) in %s\n", total, failed, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runBatch runs the generate requests read from r, one for each line, with up
+// to concurrency of them at once, and writes their responses to w in the order
+// of the requests. Requests without a model are run with model.
+func runBatch(ctx context.Context, client *api.Client, model string, r io.Reader, w io.Writer, concurrency int) (total, failed int, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	running := make(chan struct{}, concurrency)
+	pending := make(chan chan batchResult, concurrency)
+
+	written := make(chan error)
+	go func() {
+		var err error
+		enc := json.NewEncoder(w)
+		for result := range pending {
+			result := <-result
+			switch {
+			case err != nil:
+				// the batch has stopped, the rest are only waited for
+			case result.err != nil:
+				err = result.err
+				cancel()
+			default:
+				if result.resp.Error != "" {
+					failed++
+				}
+
+				total++
+				if err = enc.Encode(result.resp); err != nil {
+					cancel()
+				}
+			}
+		}
+
+		written <- err
+	}()
+
+	br := bufio.NewReader(r)
+	for n := 1; ctx.Err() == nil; n++ {
+		line, rerr := br.ReadBytes('\n')
+		if rerr != nil && !errors.Is(rerr, io.EOF) {
+			err = rerr
+			break
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			var req batchRequest
+			if jerr := json.Unmarshal(line, &req); jerr != nil {
+				err = fmt.Errorf("line %d: %w", n, jerr)
+				break
+			}
+
+			if req.Model == "" {
+				req.Model = model
+			}
+
+			result := make(chan batchResult, 1)
+			pending <- result
+			running <- struct{}{}
+			go func() {
+				defer func() { <-running }()
+				result <- generateBatch(ctx, client, req)
+			}()
+		}
+
+		if errors.Is(rerr, io.EOF) {
+			break
+		}
+	}
+
+	// the requests which are running are finished before returning
+	close(pending)
+	if werr := <-written; err == nil {
+		err = werr
+	}
+
+	return total, failed, err
+}
+
+// generateBatch runs a batch request. Requests which fail have the error in
+// their response, unless the batch was cancelled.
+func generateBatch(ctx context.Context, client *api.Client, req batchRequest) batchResult {
+	stream := false
+	req.Stream = &stream
+
+	resp := batchResponse{ID: req.ID}
+	if err := client.Generate(ctx, &req.GenerateRequest, func(r api.GenerateResponse) error {
+		resp.GenerateResponse = r
+		return nil
+	}); err != nil {
+		if errors.Is(err, context.Canceled) {
+			return batchResult{err: err}
 		}
+
+		resp.Model = req.Model
+		resp.Error = err.Error()
+	}
+
+	resp.Context = nil
+	return batchResult{resp: resp}
+}
+
+var benchWords = strings.Fields("the quick brown fox jumps over a lazy dog while seven wizards quietly judge boxing matches")
+
+// benchPrompt builds a prompt of roughly n tokens. Each run starts at a
+// different word so the server's prompt cache can't be reused between runs.
+func benchPrompt(n, run int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = benchWords[(i+run)%len(benchWords)]
+	}
+
+	return strings.Join(words, " ")
+}
+
+// benchProcessor describes how much of a model of size bytes, of which vram
+// are on the GPU, runs on each processor.
+func benchProcessor(size, vram int64) string {
+	switch {
+	case size <= 0:
+		return "unknown"
+	case vram <= 0:
+		return "100% CPU"
+	case vram >= size:
+		return "100% GPU"
+	}
+
+	gpu := int(vram * 100 / size)
+	return fmt.Sprintf("%d%%/%d%% CPU/GPU", 100-gpu, gpu)
+}
+
+func BenchHandler(cmd *cobra.Command, args []string) error {
+	client, err := api.ClientFromEnvironment()
+	if err != nil {
+		return err
 	}
 
+	promptLengths, err := cmd.Flags().GetIntSlice("prompt-lengths")
+	if err != nil {
+		return err
+	}
+
+	genLengths, err := cmd.Flags().GetIntSlice("gen-lengths")
+	if err != nil {
+		return err
+	}
+
+	batchSizes, err := cmd.Flags().GetIntSlice("batch-sizes")
+	if err != nil {
+		return err
+	}
+
+	runs, err := cmd.Flags().GetInt("runs")
+	if err != nil {
+		return err
+	}
+
+	if runs < 1 {
+		return errors.New("runs must be at least 1")
+	}
+
+	numGPU, err := cmd.Flags().GetInt("num-gpu")
+	if err != nil {
+		return err
+	}
+
+	show, err := client.Show(cmd.Context(), &api.ShowRequest{Name: args[0]})
+	if err != nil {
+		return err
+	}
+
+	// use the same context size for every run so the model is only reloaded
+	// when the batch size changes
+	numCtx := 2048
+	for _, pl := range promptLengths {
+		for _, gl := range genLengths {
+			if pl+gl+len(benchWords) > numCtx {
+				numCtx = pl + gl + len(benchWords)
+			}
+		}
+	}
+
+	p := progress.NewProgress(os.Stderr)
+	spinner := progress.NewSpinner("")
+	p.Add("", spinner)
+
+	stream := false
+	var data [][]string
+	for _, batchSize := range batchSizes {
+		for _, pl := range promptLengths {
+			for _, gl := range genLengths {
+				var promptEvalRate, evalRate float64
+				var loadDuration time.Duration
+				for run := 0; run < runs; run++ {
+					options := map[string]interface{}{
+						"num_ctx":     numCtx,
+						"num_batch":   batchSize,
+						"num_predict": gl,
+						"temperature": 0,
+						"seed":        42,
+					}
+
+					if numGPU >= 0 {
+						options["num_gpu"] = numGPU
+					}
+
+					req := api.GenerateRequest{
+						Model:   args[0],
+						Prompt:  benchPrompt(pl, run),
+						Raw:     true,
+						Stream:  &stream,
+						Options: options,
+					}
+
+					var resp api.GenerateResponse
+					if err := client.Generate(cmd.Context(), &req, func(r api.GenerateResponse) error {
+						resp = r
+						return nil
+					}); err != nil {
+						p.StopAndClear()
+						return err
+					}
+
+					if resp.PromptEvalDuration > 0 {
+						promptEvalRate += float64(resp.PromptEvalCount) / resp.PromptEvalDuration.Seconds()
+					}
+
+					if resp.EvalDuration > 0 {
+						evalRate += float64(resp.EvalCount) / resp.EvalDuration.Seconds()
+					}
+
+					loadDuration += resp.LoadDuration
+				}
+
+				// the model stays loaded after the last run so the server
+				// can report how it was split between the CPU and GPU
+				running, err := client.ListRunning(cmd.Context())
+				if err != nil {
+					p.StopAndClear()
+					return err
+				}
+
+				processor, memory := "unknown", "unknown"
+				if len(running.Models) > 0 {
+					m := running.Models[0]
+					processor, memory = benchProcessor(m.Size, m.SizeVRAM), format.HumanBytes(m.Size)
+				}
+
+				data = append(data, []string{
+					strconv.Itoa(batchSize),
+					strconv.Itoa(pl),
+					strconv.Itoa(gl),
+					fmt.Sprintf("%.2f", promptEvalRate/float64(runs)),
+					fmt.Sprintf("%.2f", evalRate/float64(runs)),
+					(loadDuration / time.Duration(runs)).Round(time.Millisecond).String(),
+					processor,
+					memory,
+				})
+			}
+		}
+	}
+
+	p.StopAndClear()
+
+	fmt.Fprintf(cmd.OutOrStdout(), "%s (%s, %s, num_ctx %d, %d runs)\n\n", args[0], show.Details.ParameterSize, show.Details.QuantizationLevel, numCtx, runs)
+
+	table := tablewriter.NewWriter(cmd.OutOrStdout())
+	table.SetHeader([]string{"BATCH", "PROMPT", "GENERATE", "PROMPT EVAL TOK/S", "EVAL TOK/S", "LOAD", "PROCESSOR", "MEMORY"})
+	table.SetHeaderAlignment(tablewriter.ALIGN_LEFT)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetHeaderLine(false)
+	table.SetBorder(false)
+	table.SetNoWhiteSpace(true)
+	table.SetTablePadding("\t")
+	table.AppendBulk(data)
+	table.Render()
+
+	return nil
+}
+
+func RunServer(cmd *cobra.Command, _ []string) error {
 	if err := initializeKeypair(); err != nil {
 		return err
 	}
 
-	ln, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	ln, err := listenHost(strings.Trim(os.Getenv("OLLAMA_HOST"), "\"'"))
 	if err != nil {
 		return err
 	}
 
-	return server.Serve(ln)
+	preload, err := cmd.Flags().GetStringSlice("preload")
+	if err != nil {
+		return err
+	}
+
+	return serve(ln, preload)
+}
+
+// listenHost listens on OLLAMA_HOST: a host:port, a unix socket such as
+// unix:///run/ollama.sock, or a named pipe such as npipe:////./pipe/ollama
+func listenHost(addr string) (net.Listener, error) {
+	switch scheme, path, _ := strings.Cut(addr, "://"); scheme {
+	case "unix":
+		return listenUnix(path)
+	case "npipe":
+		return listenPipe(strings.ReplaceAll(path, "/", `\`))
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = "127.0.0.1", "11434"
+		if ip := net.ParseIP(strings.Trim(addr, "[]")); ip != nil {
+			host = ip.String()
+		}
+	}
+
+	return listen(net.JoinHostPort(host, port))
+}
+
+// listenUnix listens on a unix socket which only the server's user can
+// connect to, unless OLLAMA_SOCKET_MODE sets other permissions such as 0660
+func listenUnix(path string) (net.Listener, error) {
+	mode := os.FileMode(0o600)
+	if s := os.Getenv("OLLAMA_SOCKET_MODE"); s != "" {
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || m > 0o777 {
+			return nil, fmt.Errorf("invalid OLLAMA_SOCKET_MODE %q", s)
+		}
+
+		mode = os.FileMode(m)
+	}
+
+	// remove the socket of a server which didn't stop cleanly
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	// the socket is created with permissions for only the server's user, so
+	// no one else can connect to it before its mode is set
+	old := umask(0o177)
+	ln, err := net.Listen("unix", path)
+	umask(old)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
 }
 
 func initializeKeypair() error {
@@ -890,7 +1630,7 @@ func versionHandler(cmd *cobra.Command, _ []string) {
 func appendHostEnvDocs(cmd *cobra.Command) {
 	const hostEnvDocs = `
 Environment Variables:
-      OLLAMA_HOST        The host:port or base URL of the Ollama server (e.g. http://localhost:11434)
+      OLLAMA_HOST        The host:port or base URL of the Ollama server (e.g. http://localhost:11434, unix:///run/ollama.sock)
 `
 	cmd.SetUsageTemplate(cmd.UsageTemplate() + hostEnvDocs)
 }
@@ -911,6 +1651,9 @@ func NewCLI() *cobra.Command {
 		CompletionOptions: cobra.CompletionOptions{
 			DisableDefaultCmd: true,
 		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return config.Load()
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			if version, _ := cmd.Flags().GetBool("version"); version {
 				versionHandler(cmd, args)
@@ -932,6 +1675,7 @@ func NewCLI() *cobra.Command {
 	}
 
 	createCmd.Flags().StringP("file", "f", "Modelfile", "Name of the Modelfile (default \"Modelfile\")")
+	createCmd.Flags().StringArray("kv", nil, "Override model metadata when it's loaded, as key=type:value where type is int, float or bool")
 
 	showCmd := &cobra.Command{
 		Use:     "show MODEL",
@@ -945,6 +1689,7 @@ func NewCLI() *cobra.Command {
 	showCmd.Flags().Bool("modelfile", false, "Show Modelfile of a model")
 	showCmd.Flags().Bool("parameters", false, "Show parameters of a model")
 	showCmd.Flags().Bool("template", false, "Show template of a model")
+	showCmd.Flags().Bool("loading", false, "Show the progress of loading a model")
 	showCmd.Flags().Bool("system", false, "Show system message of a model")
 
 	runCmd := &cobra.Command{
@@ -959,6 +1704,41 @@ func NewCLI() *cobra.Command {
 	runCmd.Flags().Bool("insecure", false, "Use an insecure registry")
 	runCmd.Flags().Bool("nowordwrap", false, "Don't wrap words to the next line automatically")
 	runCmd.Flags().String("format", "", "Response format (e.g. json)")
+	runCmd.Flags().String("output", "text", "Output mode for non-interactive use (text, json, raw, plain)")
+	runCmd.Flags().StringArray("kv", nil, "Override model metadata when it's loaded, as key=type:value where type is int, float or bool")
+	batchCmd := &cobra.Command{
+		Use:   "batch MODEL",
+		Short: "Run a model over a JSONL file of prompts",
+		Long: `Run a model over a JSONL file of prompts, with one generate request per line,
+and write one response per line in the order of the requests.
+
+--concurrency only sets how many requests are sent to the server at once. The
+server runs one request to a model at a time, so the others wait in its queue;
+it overlaps sending, queueing and writing the responses, but doesn't make the
+model generate any faster.`,
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    BatchHandler,
+	}
+
+	batchCmd.Flags().StringP("input", "i", "-", "JSONL file of generate requests to read")
+	batchCmd.Flags().StringP("output", "o", "-", "JSONL file to write responses to")
+	batchCmd.Flags().IntP("concurrency", "c", 1, "Number of requests to send at once (the server still runs them one at a time)")
+
+	benchCmd := &cobra.Command{
+		Use:     "bench MODEL",
+		Short:   "Benchmark a model",
+		Args:    cobra.ExactArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    BenchHandler,
+	}
+
+	benchCmd.Flags().IntSlice("prompt-lengths", []int{128, 512}, "Prompt lengths in tokens")
+	benchCmd.Flags().IntSlice("gen-lengths", []int{128}, "Number of tokens to generate")
+	benchCmd.Flags().IntSlice("batch-sizes", []int{512}, "Prompt processing batch sizes (num_batch)")
+	benchCmd.Flags().Int("runs", 3, "Number of runs to average for each combination")
+	benchCmd.Flags().Int("num-gpu", -1, "Number of layers to offload to the GPU (default is automatic)")
+
 	serveCmd := &cobra.Command{
 		Use:     "serve",
 		Aliases: []string{"start"},
@@ -966,24 +1746,47 @@ func NewCLI() *cobra.Command {
 		Args:    cobra.ExactArgs(0),
 		RunE:    RunServer,
 	}
+	serveCmd.Flags().StringSlice("preload", nil, "Models to load before the server reports it's ready")
 	serveCmd.SetUsageTemplate(serveCmd.UsageTemplate() + `
 Environment Variables:
 
-    OLLAMA_HOST         The host:port to bind to (default "127.0.0.1:11434")
+    OLLAMA_HOST         The host:port, unix:///path socket or npipe:////./pipe/name pipe to bind to (default "127.0.0.1:11434")
+    OLLAMA_SOCKET_MODE  The permissions of a unix socket (default "0600")
     OLLAMA_ORIGINS      A comma separated list of allowed origins.
     OLLAMA_MODELS       The path to the models directory (default is "~/.ollama/models")
     OLLAMA_KEEP_ALIVE   The duration that models stay loaded in memory (default is "5m")
+    OLLAMA_DRAIN_TIMEOUT    How long to wait for requests to finish when stopping (default is "30s")
+    OLLAMA_READONLY         Reject requests which pull, create, push, copy or delete models (default is false)
+    OLLAMA_UPDATE_INTERVAL  How often to check models for updates, such as "24h" (default is never)
+    OLLAMA_AUTO_UPDATE      Pull the models updates are found for (default is false)
+    OLLAMA_MAX_STORAGE      The most bytes the blobs of models can use (default is the free disk space)
+    OLLAMA_EMBEDDING_CACHE  The most bytes of embeddings to cache on disk (default is 0, no cache)
+    OLLAMA_RESPONSE_CACHE   The most bytes of deterministic generate responses to cache on disk (default is 0, no cache)
+    OLLAMA_STRICT_REQUESTS  Reject requests with unknown fields rather than ignoring them (default is false)
+    OLLAMA_MAX_SESSIONS     The most chat sessions to keep (default is 256)
+    OLLAMA_SESSION_TIMEOUT  How long to keep chat sessions after their last message (default is "1h")
+    OLLAMA_DAILY_TOKEN_BUDGET  The most tokens each API key or session can use each day (default is 0, unlimited)
+    OLLAMA_TOKEN_BUDGET     The most tokens each API key or session can use in total (default is 0, unlimited)
+    OLLAMA_API_KEYS         A comma separated list of name=key API keys which are counted against their own budget
+    OLLAMA_REGISTRY_MIRRORS A comma separated list of registry=mirror URLs to pull from
+    OLLAMA_MAX_DOWNLOAD_RATE  The most bytes per second to pull at, such as "10MB" (default is unlimited)
+    OLLAMA_MAX_UPLOAD_RATE  The most bytes per second to push at, such as "10MB" (default is unlimited)
+    OLLAMA_OFF_HOURS        The hours to defer large pulls to, such as "22:00-06:00" (default is never deferred)
+    OLLAMA_DEFER_PULL_SIZE  The size of pulls deferred to OLLAMA_OFF_HOURS (default is "1GB")
+    OLLAMA_CONFIG           The path to the config file (default is "~/.ollama/config.json")
 `)
 
 	pullCmd := &cobra.Command{
 		Use:     "pull MODEL",
 		Short:   "Pull a model from a registry",
-		Args:    cobra.ExactArgs(1),
+		Args:    cobra.MaximumNArgs(1),
 		PreRunE: checkServerHeartbeat,
 		RunE:    PullHandler,
 	}
 
 	pullCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pullCmd.Flags().Bool("all", false, "Pull every model which has an update")
+	pullCmd.Flags().String("rate-limit", "", "The most bytes per second to download at, such as 10MB")
 
 	pushCmd := &cobra.Command{
 		Use:     "push MODEL",
@@ -994,6 +1797,9 @@ Environment Variables:
 	}
 
 	pushCmd.Flags().Bool("insecure", false, "Use an insecure registry")
+	pushCmd.Flags().String("compression", "", "Compress model layers in the registry (zstd)")
+	pushCmd.Flags().String("base", "", "Push the difference from a model, such as another quantization")
+	pushCmd.Flags().String("rate-limit", "", "The most bytes per second to upload at, such as 10MB")
 
 	listCmd := &cobra.Command{
 		Use:     "list",
@@ -1010,6 +1816,47 @@ Environment Variables:
 		RunE:    CopyHandler,
 	}
 
+	exportCmd := &cobra.Command{
+		Use:     "export MODEL FILE",
+		Short:   "Export a model to an archive",
+		Args:    cobra.ExactArgs(2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    ExportHandler,
+	}
+
+	importCmd := &cobra.Command{
+		Use:     "import FILE [MODEL]",
+		Short:   "Import a model from an archive",
+		Args:    cobra.RangeArgs(1, 2),
+		PreRunE: checkServerHeartbeat,
+		RunE:    ImportHandler,
+	}
+
+	snapshotCmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Save or restore the loaded model, aliases and sessions of the server",
+	}
+
+	snapshotSaveCmd := &cobra.Command{
+		Use:     "save [FILE]",
+		Short:   "Save a snapshot of the server, and write it to FILE if it's set",
+		Args:    cobra.MaximumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    SnapshotSaveHandler,
+	}
+
+	snapshotSaveCmd.Flags().Bool("sessions", false, "Include sessions and their messages")
+
+	snapshotRestoreCmd := &cobra.Command{
+		Use:     "restore [FILE]",
+		Short:   "Restore the snapshot in FILE, or the one the server saved last",
+		Args:    cobra.MaximumNArgs(1),
+		PreRunE: checkServerHeartbeat,
+		RunE:    SnapshotRestoreHandler,
+	}
+
+	snapshotCmd.AddCommand(snapshotSaveCmd, snapshotRestoreCmd)
+
 	deleteCmd := &cobra.Command{
 		Use:     "rm MODEL [MODEL...]",
 		Short:   "Remove a model",
@@ -1022,10 +1869,16 @@ Environment Variables:
 		createCmd,
 		showCmd,
 		runCmd,
+		batchCmd,
+		benchCmd,
 		pullCmd,
 		pushCmd,
 		listCmd,
 		copyCmd,
+		exportCmd,
+		importCmd,
+		snapshotSaveCmd,
+		snapshotRestoreCmd,
 		deleteCmd,
 	} {
 		appendHostEnvDocs(cmd)
@@ -1036,10 +1889,15 @@ Environment Variables:
 		createCmd,
 		showCmd,
 		runCmd,
+		batchCmd,
+		benchCmd,
 		pullCmd,
 		pushCmd,
 		listCmd,
 		copyCmd,
+		exportCmd,
+		importCmd,
+		snapshotCmd,
 		deleteCmd,
 	)
 
@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestRunBatch(t *testing.T) {
+	var mu sync.Mutex
+	var running, most int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req api.GenerateRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+
+		// the earlier prompts take longer, so they finish out of order
+		time.Sleep(time.Duration(10-len(req.Prompt)) * 10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		if req.Prompt == "fail" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad prompt"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(api.GenerateResponse{Model: req.Model, Response: strings.ToUpper(req.Prompt), Done: true, Context: []int{1, 2}})
+	}))
+	defer srv.Close()
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+	client, err := api.ClientFromEnvironment()
+	require.NoError(t, err)
+
+	input := strings.Join([]string{
+		`{"id": "1", "prompt": "a"}`,
+		``,
+		`{"id": "2", "prompt": "bb", "model": "other"}`,
+		`{"prompt": "fail"}`,
+		`{"id": "4", "prompt": "dddddd"}`,
+	}, "\n")
+
+	var out bytes.Buffer
+	total, failed, err := runBatch(context.Background(), client, "test", strings.NewReader(input), &out, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, 2, most)
+
+	// the responses are in the order of the requests, which are read back
+	var responses []batchResponse
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var resp batchResponse
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &resp))
+		responses = append(responses, resp)
+	}
+
+	require.Len(t, responses, 4)
+	assert.Equal(t, batchResponse{ID: "1", GenerateResponse: api.GenerateResponse{Model: "test", Response: "A", Done: true}}, responses[0])
+	assert.Equal(t, "other", responses[1].Model)
+	assert.Equal(t, "BB", responses[1].Response)
+	assert.Equal(t, batchResponse{GenerateResponse: api.GenerateResponse{Model: "test"}, Error: "bad prompt"}, responses[2])
+	assert.Equal(t, "4", responses[3].ID)
+	assert.Equal(t, "DDDDDD", responses[3].Response)
+
+	t.Run("invalid line", func(t *testing.T) {
+		var out bytes.Buffer
+		total, _, err := runBatch(context.Background(), client, "test", strings.NewReader("{\"prompt\": \"a\"}\nnot json\n{\"prompt\": \"b\"}"), &out, 2)
+		assert.ErrorContains(t, err, "line 2")
+
+		// the requests before it still finish
+		assert.Equal(t, 1, total)
+		assert.Contains(t, out.String(), `"response":"A"`)
+	})
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the permissions of unix sockets aren't checked on Windows")
+	}
+
+	old := umask(0o022)
+	t.Cleanup(func() { umask(old) })
+
+	for _, tt := range []struct {
+		env  string
+		mode os.FileMode
+	}{
+		{"", 0o600},
+		{"0660", 0o660},
+	} {
+		t.Setenv("OLLAMA_SOCKET_MODE", tt.env)
+
+		path := filepath.Join(t.TempDir(), "ollama.sock")
+		ln, err := listenUnix(path)
+		require.NoError(t, err)
+
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, tt.mode, fi.Mode().Perm(), tt.env)
+		ln.Close()
+
+		// the umask of the process is restored
+		assert.Equal(t, 0o022, umask(0o022))
+	}
+}
+
+func TestBench(t *testing.T) {
+	var batches []int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/api/show", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.ShowResponse{Details: api.ModelDetails{ParameterSize: "7B", QuantizationLevel: "Q4_0"}})
+	})
+	mux.HandleFunc("/api/generate", func(w http.ResponseWriter, r *http.Request) {
+		var req api.GenerateRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		batches = append(batches, int(req.Options["num_batch"].(float64)))
+
+		json.NewEncoder(w).Encode(api.GenerateResponse{
+			Model: req.Model,
+			Done:  true,
+			Metrics: api.Metrics{
+				PromptEvalCount:    100,
+				PromptEvalDuration: time.Second,
+				EvalCount:          20,
+				EvalDuration:       time.Second,
+			},
+		})
+	})
+	mux.HandleFunc("/api/ps", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(api.ProcessResponse{Models: []api.ProcessModelResponse{
+			{Name: "test:latest", Size: 4 << 30, SizeVRAM: 3 << 30},
+		}})
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Setenv("OLLAMA_HOST", srv.URL)
+
+	var out bytes.Buffer
+	cmd := NewCLI()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{"bench", "test", "--batch-sizes", "256,512", "--prompt-lengths", "8", "--runs", "2"})
+	require.NoError(t, cmd.Execute())
+
+	assert.Equal(t, []int{256, 256, 512, 512}, batches)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 5)
+	assert.Equal(t, "test (7B, Q4_0, num_ctx 2048, 2 runs)", lines[0])
+	assert.Equal(t, []string{"BATCH", "PROMPT", "GENERATE", "PROMPT", "EVAL", "TOK/S", "EVAL", "TOK/S", "LOAD", "PROCESSOR", "MEMORY"}, strings.Fields(lines[2]))
+	assert.Equal(t, []string{"256", "8", "128", "100.00", "20.00", "0s", "25%/75%", "CPU/GPU", "4.3", "GB"}, strings.Fields(lines[3]))
+	assert.Equal(t, "512", strings.Fields(lines[4])[0])
+}
+
+func TestBenchProcessor(t *testing.T) {
+	assert.Equal(t, "unknown", benchProcessor(0, 0))
+	assert.Equal(t, "100% CPU", benchProcessor(100, 0))
+	assert.Equal(t, "100% GPU", benchProcessor(100, 100))
+	assert.Equal(t, "40%/60% CPU/GPU", benchProcessor(100, 60))
+}
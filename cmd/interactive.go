@@ -94,6 +94,7 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 		fmt.Fprintln(os.Stderr, "  /show           Show model information")
 		fmt.Fprintln(os.Stderr, "  /load <model>   Load a session or model")
 		fmt.Fprintln(os.Stderr, "  /save <model>   Save your current session")
+		fmt.Fprintln(os.Stderr, "  /clear          Clear session context")
 		fmt.Fprintln(os.Stderr, "  /bye            Exit")
 		fmt.Fprintln(os.Stderr, "  /?, /help       Help for a command")
 		fmt.Fprintln(os.Stderr, "  /? shortcuts    Help for keyboard shortcuts")
@@ -237,6 +238,10 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 		case scanner.Pasting:
 			fmt.Fprintln(&sb, line)
 			continue
+		case strings.HasPrefix(line, "/clear"):
+			clearSession(&opts)
+			fmt.Println("Cleared session context")
+			continue
 		case strings.HasPrefix(line, "/list"):
 			args := strings.Fields(line)
 			if err := ListHandler(cmd, args[1:]); err != nil {
@@ -316,13 +321,11 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 						continue
 					}
 					params := args[3:]
-					fp, err := api.FormatParams(map[string][]string{args[2]: params})
-					if err != nil {
+					if err := setParameter(&opts, args[2], params); err != nil {
 						fmt.Printf("Couldn't set parameter: %q\n", err)
 						continue
 					}
 					fmt.Printf("Set parameter '%s' to '%s'\n", args[2], strings.Join(params, ", "))
-					opts.Options[args[2]] = fp[args[2]]
 				case "system", "template":
 					if len(args) < 3 {
 						usageSet()
@@ -419,7 +422,7 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 				case "modelfile":
 					fmt.Println(resp.Modelfile)
 				case "parameters":
-					if resp.Parameters == "" {
+					if resp.Parameters == "" && len(opts.Options) == 0 {
 						fmt.Println("No parameters were specified for this model.")
 					} else {
 						if len(opts.Options) > 0 {
@@ -429,8 +432,10 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 							}
 							fmt.Println()
 						}
-						fmt.Println("Model defined parameters:")
-						fmt.Println(resp.Parameters)
+						if resp.Parameters != "" {
+							fmt.Println("Model defined parameters:")
+							fmt.Println(resp.Parameters)
+						}
 					}
 				case "system":
 					switch {
@@ -530,6 +535,26 @@ func generateInteractive(cmd *cobra.Command, opts runOptions) error {
 	}
 }
 
+// clearSession drops the messages of the session, keeping its system message
+func clearSession(opts *runOptions) {
+	opts.Messages = []api.Message{}
+	if opts.System != "" {
+		opts.Messages = append(opts.Messages, api.Message{Role: "system", Content: opts.System})
+	}
+}
+
+// setParameter sets the parameter name of the session to values, which are
+// all kept for parameters such as stop which can be repeated
+func setParameter(opts *runOptions, name string, values []string) error {
+	fp, err := api.FormatParams(map[string][]string{name: values})
+	if err != nil {
+		return err
+	}
+
+	opts.Options[name] = fp[name]
+	return nil
+}
+
 func buildModelfile(opts runOptions) string {
 	var mf strings.Builder
 	model := opts.ParentModel
@@ -551,7 +576,15 @@ func buildModelfile(opts runOptions) string {
 	}
 	sort.Strings(keys)
 	for _, k := range keys {
-		fmt.Fprintf(&mf, "PARAMETER %s %v\n", k, opts.Options[k])
+		switch v := opts.Options[k].(type) {
+		case []string:
+			// parameters such as stop can be repeated
+			for _, s := range v {
+				fmt.Fprintf(&mf, "PARAMETER %s %s\n", k, s)
+			}
+		default:
+			fmt.Fprintf(&mf, "PARAMETER %s %v\n", k, v)
+		}
 	}
 	fmt.Fprintln(&mf)
 
@@ -2,12 +2,15 @@ package cmd
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 	"text/template"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/parser"
 )
 
 func TestExtractFilenames(t *testing.T) {
@@ -77,7 +80,8 @@ SYSTEM """{{.System}}"""
 TEMPLATE """{{.Template}}"""
 PARAMETER penalize_newline false
 PARAMETER seed 42
-PARAMETER stop [hi there]
+PARAMETER stop hi
+PARAMETER stop there
 PARAMETER temperature 0.9
 
 MESSAGE user """Hey there hork!"""
@@ -99,7 +103,8 @@ SYSTEM """{{.System}}"""
 TEMPLATE """{{.Template}}"""
 PARAMETER penalize_newline false
 PARAMETER seed 42
-PARAMETER stop [hi there]
+PARAMETER stop hi
+PARAMETER stop there
 PARAMETER temperature 0.9
 
 MESSAGE user """Hey there hork!"""
@@ -114,3 +119,43 @@ MESSAGE assistant """Yes it is true, I am half horse, half shark."""
 	assert.Nil(t, err)
 	assert.Equal(t, parentBuf.String(), mf)
 }
+
+func TestClearSession(t *testing.T) {
+	opts := runOptions{
+		System: "Be brief.",
+		Messages: []api.Message{
+			{Role: "system", Content: "Be brief."},
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello"},
+		},
+	}
+
+	clearSession(&opts)
+	assert.Equal(t, []api.Message{{Role: "system", Content: "Be brief."}}, opts.Messages)
+
+	opts.System = ""
+	clearSession(&opts)
+	assert.Empty(t, opts.Messages)
+}
+
+func TestSaveRepeatedParameter(t *testing.T) {
+	opts := runOptions{Model: "hork", Options: map[string]interface{}{}}
+	require.NoError(t, setParameter(&opts, "stop", []string{"<|im_end|>", "###"}))
+	require.NoError(t, setParameter(&opts, "temperature", []string{"0.5"}))
+	assert.Error(t, setParameter(&opts, "temperature", []string{"hot"}))
+
+	// each of the values is saved, so the model created from the session
+	// has all of them
+	commands, err := parser.Parse(strings.NewReader(buildModelfile(opts)))
+	require.NoError(t, err)
+
+	var stops []string
+	for _, c := range commands {
+		if c.Name == "stop" {
+			stops = append(stops, c.Args)
+		}
+	}
+
+	assert.Equal(t, []string{"<|im_end|>", "###"}, stops)
+	assert.Contains(t, commands, parser.Command{Name: "temperature", Args: "0.5"})
+}
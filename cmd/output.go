@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"regexp"
+	"strings"
+)
+
+// outputModes are the supported values of the run command's --output flag:
+//
+//	text   the response as it streams, with word wrapping (default)
+//	json   a single line of JSON with the response and timing metadata
+//	raw    the response as it streams, with nothing added
+//	plain  the response with markdown formatting removed
+var outputModes = []string{"text", "json", "raw", "plain"}
+
+var (
+	markdownFence    = regexp.MustCompile("^\\s*(```|~~~)")
+	markdownHeading  = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	markdownQuote    = regexp.MustCompile(`^\s{0,3}>\s?`)
+	markdownRule     = regexp.MustCompile(`^\s{0,3}([-*_]\s*){3,}$`)
+	markdownImage    = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	markdownStrong   = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	markdownEmphasis = regexp.MustCompile(`(^|[^\w*])[*_](\S(?:.*?\S)?)[*_]([^\w*]|$)`)
+	markdownCode     = regexp.MustCompile("`([^`]+)`")
+)
+
+// stripMarkdown removes common markdown formatting from s, leaving the text
+// content. Code blocks are kept verbatim without their fences.
+func stripMarkdown(s string) string {
+	lines := strings.Split(s, "\n")
+
+	var inCode bool
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if markdownFence.MatchString(line) {
+			inCode = !inCode
+			continue
+		}
+
+		if inCode {
+			out = append(out, line)
+			continue
+		}
+
+		if markdownRule.MatchString(line) {
+			continue
+		}
+
+		line = markdownHeading.ReplaceAllString(line, "")
+		line = markdownQuote.ReplaceAllString(line, "")
+		line = markdownImage.ReplaceAllString(line, "$1")
+		line = markdownLink.ReplaceAllString(line, "$1")
+		line = markdownStrong.ReplaceAllString(line, "$2")
+		line = markdownEmphasis.ReplaceAllString(line, "$1$2$3")
+		line = markdownCode.ReplaceAllString(line, "$1")
+		out = append(out, line)
+	}
+
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripMarkdown(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"heading", "## Title\ntext", "Title\ntext"},
+		{"emphasis", "some **bold**, *italic* and __strong__ text", "some bold, italic and strong text"},
+		{"snake case", "call my_func_name now", "call my_func_name now"},
+		{"list", "- one\n- two", "- one\n- two"},
+		{"link", "see [the docs](https://ollama.ai) and ![logo](logo.png)", "see the docs and logo"},
+		{"inline code", "run `ollama serve`", "run ollama serve"},
+		{"code block", "```go\nfmt.Println(\"**hi**\")\n```", "fmt.Println(\"**hi**\")"},
+		{"quote and rule", "> quoted\n\n---\nafter", "quoted\n\nafter"},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, stripMarkdown(tt.input))
+		})
+	}
+}
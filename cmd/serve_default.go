@@ -0,0 +1,29 @@
+//go:build !linux && !windows
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/jmorganca/ollama/server"
+)
+
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func serve(ln net.Listener, preload []string) error {
+	return server.Serve(context.Background(), ln, preload)
+}
+
+func listenPipe(string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
+
+// umask sets the file mode creation mask of the process, returning the old one
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/jmorganca/ollama/server"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+// listen uses the socket passed by systemd socket activation if there is one,
+// otherwise it listens on addr
+func listen(addr string) (net.Listener, error) {
+	return listenFds(addr, listenFdsStart)
+}
+
+// listenFds is listen with the first passed socket at fd
+func listenFds(addr string, fd uintptr) (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return net.Listen("tcp", addr)
+	}
+
+	if fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || fds < 1 {
+		return net.Listen("tcp", addr)
+	}
+
+	// don't pass the sockets on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(fd, "systemd")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+func serve(ln net.Listener, preload []string) error {
+	return server.Serve(context.Background(), ln, preload)
+}
+
+func listenPipe(string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
+
+// umask sets the file mode creation mask of the process, returning the old one
+func umask(mask int) int {
+	return syscall.Umask(mask)
+}
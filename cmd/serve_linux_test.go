@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenFds(t *testing.T) {
+	// the socket systemd would have passed, duplicated since listenFds
+	// closes the file it's passed
+	passed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer passed.Close()
+
+	f, err := passed.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer f.Close()
+
+	pid := strconv.Itoa(os.Getpid())
+	cases := []struct {
+		name      string
+		pid, fds  string
+		activated bool
+	}{
+		{"not activated", "", "", false},
+		{"another process", strconv.Itoa(os.Getpid() + 1), "1", false},
+		{"no sockets", pid, "0", false},
+		{"invalid sockets", pid, "one", false},
+		{"activated", pid, "1", true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			t.Setenv("LISTEN_FDNAMES", "ollama.socket")
+
+			fd, err := syscall.Dup(int(f.Fd()))
+			require.NoError(t, err)
+			if !tt.activated {
+				defer syscall.Close(fd)
+			}
+
+			ln, err := listenFds("127.0.0.1:0", uintptr(fd))
+			require.NoError(t, err)
+			defer ln.Close()
+
+			if !tt.activated {
+				assert.NotEqual(t, passed.Addr().String(), ln.Addr().String())
+				assert.Equal(t, tt.pid, os.Getenv("LISTEN_PID"))
+				return
+			}
+
+			assert.Equal(t, passed.Addr().String(), ln.Addr().String())
+
+			// the variables aren't passed on to child processes
+			for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+				_, ok := os.LookupEnv(key)
+				assert.False(t, ok, key)
+			}
+		})
+	}
+}
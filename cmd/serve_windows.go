@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+
+	"github.com/jmorganca/ollama/server"
+)
+
+const serviceName = "Ollama"
+
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// umask does nothing, the permissions of unix sockets aren't checked on Windows
+func umask(int) int {
+	return 0
+}
+
+// listenPipe listens on a named pipe, which by default only the server's
+// user, administrators and the system can connect to
+func listenPipe(path string) (net.Listener, error) {
+	return winio.ListenPipe(path, nil)
+}
+
+// serve runs the server as a Windows service when started by the service
+// control manager, otherwise it runs it directly
+func serve(ln net.Listener, preload []string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+
+	if !isService {
+		return server.Serve(context.Background(), ln, preload)
+	}
+
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	defer elog.Close()
+
+	// services don't have a console, so write the server log to a file
+	logDir := filepath.Join(os.Getenv("ProgramData"), "Ollama")
+	if err := os.MkdirAll(logDir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(logDir, "server.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	os.Stdout, os.Stderr = f, f
+
+	return svc.Run(serviceName, &service{ln: ln, preload: preload, elog: elog})
+}
+
+type service struct {
+	ln      net.Listener
+	preload []string
+	elog    *eventlog.Log
+}
+
+func (s *service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, s.ln, s.preload)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	s.elog.Info(1, fmt.Sprintf("%s started, listening on %s", serviceName, s.ln.Addr()))
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				s.elog.Error(1, fmt.Sprintf("%s stopped: %v", serviceName, err))
+				return true, 1
+			}
+
+			s.elog.Info(1, fmt.Sprintf("%s stopped", serviceName))
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s.elog.Info(1, fmt.Sprintf("%s stopping", serviceName))
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((30 * time.Second).Milliseconds())}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Package config loads settings from Ollama's config file. Each setting is
+// applied as the environment variable it corresponds to, so environment
+// variables which are already set take precedence over the file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Config is the contents of the config file. The env tag is the environment
+// variable each setting is applied as.
+type Config struct {
+	Host           string   `json:"host" env:"OLLAMA_HOST"`
+	SocketMode     string   `json:"socket_mode" env:"OLLAMA_SOCKET_MODE"`
+	Origins        []string `json:"origins" env:"OLLAMA_ORIGINS"`
+	Models         string   `json:"models" env:"OLLAMA_MODELS"`
+	KeepAlive      string   `json:"keep_alive" env:"OLLAMA_KEEP_ALIVE"`
+	KeepAliveVRAM  string   `json:"keep_alive_vram" env:"OLLAMA_KEEP_ALIVE_VRAM"`
+	DrainTimeout   string   `json:"drain_timeout" env:"OLLAMA_DRAIN_TIMEOUT"`
+	NoPrune        bool     `json:"noprune" env:"OLLAMA_NOPRUNE"`
+	Debug          bool     `json:"debug" env:"OLLAMA_DEBUG"`
+	MaxQueue       uint64   `json:"max_queue" env:"OLLAMA_MAX_QUEUE"`
+	Hook           string   `json:"hook" env:"OLLAMA_HOOK"`
+	HookTimeout    string   `json:"hook_timeout" env:"OLLAMA_HOOK_TIMEOUT"`
+	ReadOnly       bool     `json:"readonly" env:"OLLAMA_READONLY"`
+	UpdateInterval string   `json:"update_interval" env:"OLLAMA_UPDATE_INTERVAL"`
+	AutoUpdate     bool     `json:"auto_update" env:"OLLAMA_AUTO_UPDATE"`
+	MaxStorage     uint64   `json:"max_storage" env:"OLLAMA_MAX_STORAGE"`
+	EmbeddingCache uint64   `json:"embedding_cache" env:"OLLAMA_EMBEDDING_CACHE"`
+	ResponseCache  uint64   `json:"response_cache" env:"OLLAMA_RESPONSE_CACHE"`
+	StrictRequests bool     `json:"strict_requests" env:"OLLAMA_STRICT_REQUESTS"`
+	MaxSessions    uint64   `json:"max_sessions" env:"OLLAMA_MAX_SESSIONS"`
+	SessionTimeout string   `json:"session_timeout" env:"OLLAMA_SESSION_TIMEOUT"`
+
+	// transfers
+	MaxDownloadRate string `json:"max_download_rate" env:"OLLAMA_MAX_DOWNLOAD_RATE"`
+	MaxUploadRate   string `json:"max_upload_rate" env:"OLLAMA_MAX_UPLOAD_RATE"`
+	OffHours        string `json:"off_hours" env:"OLLAMA_OFF_HOURS"`
+	DeferPullSize   string `json:"defer_pull_size" env:"OLLAMA_DEFER_PULL_SIZE"`
+
+	// token budgets of each API key or session
+	DailyTokenBudget uint64 `json:"daily_token_budget" env:"OLLAMA_DAILY_TOKEN_BUDGET"`
+	TokenBudget      uint64 `json:"token_budget" env:"OLLAMA_TOKEN_BUDGET"`
+
+	// APIKeys maps the names of accounts to the API key they're counted by
+	APIKeys map[string]string `json:"api_keys" env:"OLLAMA_API_KEYS"`
+
+	// GPU overrides
+	LLMLibrary            string `json:"llm_library" env:"OLLAMA_LLM_LIBRARY"`
+	MaxVRAM               uint64 `json:"max_vram" env:"OLLAMA_MAX_VRAM"`
+	CUDAVisibleDevices    string `json:"cuda_visible_devices" env:"CUDA_VISIBLE_DEVICES"`
+	HIPVisibleDevices     string `json:"hip_visible_devices" env:"HIP_VISIBLE_DEVICES"`
+	HSAOverrideGFXVersion string `json:"hsa_override_gfx_version" env:"HSA_OVERRIDE_GFX_VERSION"`
+
+	// RegistryMirrors maps registry hosts to a mirror to pull from instead
+	RegistryMirrors map[string]string `json:"registry_mirrors" env:"OLLAMA_REGISTRY_MIRRORS"`
+}
+
+// Path returns the path of the config file, set by OLLAMA_CONFIG or
+// ~/.ollama/config.json by default
+func Path() (string, error) {
+	if path, ok := os.LookupEnv("OLLAMA_CONFIG"); ok {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".ollama", "config.json"), nil
+}
+
+// Load reads the config file, if there is one, and applies its settings
+func Load() error {
+	path, err := Path()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	config, err := Parse(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return config.Apply()
+}
+
+func Parse(r io.Reader) (*Config, error) {
+	var config Config
+	d := json.NewDecoder(r)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Apply sets the environment variable for each setting, unless it is set already
+func (c *Config) Apply() error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("env")
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+
+		value, ok := envValue(v.Field(i))
+		if !ok {
+			continue
+		}
+
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// envValue formats a setting as an environment variable. Settings which are
+// unset, or false, are skipped.
+func envValue(v reflect.Value) (string, bool) {
+	if v.IsZero() {
+		return "", false
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), true
+	case reflect.Bool:
+		return "1", true
+	case reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Slice:
+		return strings.Join(v.Interface().([]string), ","), true
+	case reflect.Map:
+		var pairs []string
+		for k, v := range v.Interface().(map[string]string) {
+			pairs = append(pairs, k+"="+v)
+		}
+
+		sort.Strings(pairs)
+		return strings.Join(pairs, ","), true
+	default:
+		panic(fmt.Sprintf("unsupported config type %s", v.Kind()))
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApply(t *testing.T) {
+	config, err := Parse(strings.NewReader(`{
+		"host": "0.0.0.0:8080",
+		"origins": ["http://a", "http://b"],
+		"keep_alive": "1h",
+		"debug": true,
+		"noprune": false,
+		"max_vram": 4000000000,
+		"registry_mirrors": {"registry.ollama.ai": "https://mirror.example.com", "example.com": "http://localhost:5000"}
+	}`))
+	require.NoError(t, err)
+
+	t.Setenv("OLLAMA_KEEP_ALIVE", "5m")
+	for _, key := range []string{"OLLAMA_HOST", "OLLAMA_ORIGINS", "OLLAMA_DEBUG", "OLLAMA_NOPRUNE", "OLLAMA_MAX_VRAM", "OLLAMA_REGISTRY_MIRRORS", "OLLAMA_MODELS"} {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+
+	require.NoError(t, config.Apply())
+
+	cases := map[string]string{
+		"OLLAMA_HOST":             "0.0.0.0:8080",
+		"OLLAMA_ORIGINS":          "http://a,http://b",
+		"OLLAMA_KEEP_ALIVE":       "5m", // set in the environment
+		"OLLAMA_DEBUG":            "1",
+		"OLLAMA_MAX_VRAM":         "4000000000",
+		"OLLAMA_REGISTRY_MIRRORS": "example.com=http://localhost:5000,registry.ollama.ai=https://mirror.example.com",
+	}
+
+	for key, expected := range cases {
+		t.Run(key, func(t *testing.T) {
+			assert.Equal(t, expected, os.Getenv(key))
+		})
+	}
+
+	for _, key := range []string{"OLLAMA_NOPRUNE", "OLLAMA_MODELS"} {
+		_, ok := os.LookupEnv(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	_, err := Parse(strings.NewReader(`{"hots": "0.0.0.0"}`))
+	assert.ErrorContains(t, err, `unknown field "hots"`)
+}
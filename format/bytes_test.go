@@ -0,0 +1,43 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	cases := map[string]int64{
+		"0":       0,
+		"512":     512,
+		"512 B":   512,
+		"10KB":    10 * KiloByte,
+		"10 MB":   10 * MegaByte,
+		"1.5 GB":  1500 * MegaByte,
+		"2tb":     2 * TeraByte,
+		" 3 mb  ": 3 * MegaByte,
+	}
+
+	for s, want := range cases {
+		got, err := ParseBytes(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+
+		assertEqual(t, got, want)
+	}
+
+	for _, s := range []string{"", "MB", "10 MiB", "ten", "-1"} {
+		if _, err := ParseBytes(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+
+	// sizes written by HumanBytes can be parsed again
+	for _, b := range []int64{512, 42 * MegaByte, 3 * GigaByte} {
+		got, err := ParseBytes(HumanBytes(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertEqual(t, got, b)
+	}
+}
@@ -19,3 +19,14 @@ func GetCPUVariant() string {
 	// else LCD
 	return ""
 }
+
+// FreeSystemMemory returns the bytes of system memory which are free, or 0 if
+// that isn't known
+func FreeSystemMemory() uint64 {
+	mem, err := getCPUMem()
+	if err != nil {
+		return 0
+	}
+
+	return mem.FreeMemory
+}
@@ -0,0 +1,133 @@
+package llm
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Architecture is how a model architecture, the general.architecture of a
+// model, is loaded
+type Architecture struct {
+	// Keys are the metadata keys models of the architecture need, without the
+	// architecture prefix. Models missing one are rejected when they're
+	// loaded rather than failing in llama.cpp.
+	Keys []string
+
+	// Memory estimates the memory a model needs with a context window of
+	// numCtx tokens. Architectures without one are estimated as transformers.
+	Memory func(ggml *GGML, numCtx int) Memory
+
+	// CPUOnly is set for architectures llama.cpp can't run on GPUs yet
+	CPUOnly bool
+
+	// TensorNames maps the names other converters give tensors, such as
+	// model.embed_tokens, to the names llama.cpp loads them by. The tensors
+	// of blocks are named without their block prefix. Models of
+	// architectures with names have their tensors renamed when they're
+	// created, and are rejected if any can't be.
+	TensorNames map[string]string
+
+	// PermutedTensors are the tensors, named like TensorNames, which other
+	// converters store with their rows in another order than llama.cpp
+	// loads them in, such as the q and k tensors Hugging Face permutes for
+	// its rotary embeddings. Models with them are rejected, renaming them
+	// isn't enough.
+	PermutedTensors []string
+}
+
+// transformerKeys are the keys transformers need to estimate their memory.
+// The kv head count defaults to the head count.
+var transformerKeys = []string{"context_length", "block_count", "embedding_length", "attention.head_count"}
+
+var architectures = struct {
+	mu     sync.RWMutex
+	byName map[string]Architecture
+}{byName: map[string]Architecture{
+	"llama": {Keys: transformerKeys, TensorNames: llamaTensorNames, PermutedTensors: []string{"self_attn.q_proj", "self_attn.k_proj"}},
+	"qwen2": {Keys: transformerKeys, TensorNames: llamaTensorNames},
+	"phi3":  {Keys: transformerKeys, TensorNames: phi3TensorNames},
+	"gemma": {Keys: transformerKeys, TensorNames: llamaTensorNames},
+
+	// the head size of these isn't embedding_length / head_count
+	"gemma2":    {Keys: append([]string{"attention.key_length", "attention.value_length"}, transformerKeys...)},
+	"deepseek2": {Keys: append([]string{"attention.key_length", "attention.value_length"}, transformerKeys...)},
+
+	"mamba": {
+		Keys:    []string{"block_count", "embedding_length", "ssm.conv_kernel", "ssm.inner_size", "ssm.state_size"},
+		Memory:  mambaMemory,
+		CPUOnly: true,
+	},
+}}
+
+// RegisterArchitecture adds an architecture, or replaces the one with the
+// same name
+func RegisterArchitecture(name string, arch Architecture) {
+	architectures.mu.Lock()
+	defer architectures.mu.Unlock()
+
+	architectures.byName[name] = arch
+}
+
+// architecture returns how the model's architecture is loaded. Architectures
+// which aren't registered are loaded as transformers without checking their
+// keys.
+func (ggml *GGML) architecture() Architecture {
+	architectures.mu.RLock()
+	defer architectures.mu.RUnlock()
+
+	return architectures.byName[ggml.ModelFamily()]
+}
+
+// checkKeys returns an error naming the first key the model's architecture
+// needs which it doesn't have
+func (ggml *GGML) checkKeys() error {
+	kv := ggml.KV()
+	for _, key := range ggml.architecture().Keys {
+		key = fmt.Sprintf("%s.%s", ggml.ModelFamily(), key)
+		if _, ok := kv[key]; !ok {
+			return fmt.Errorf("%s model is missing %s, it may need to be converted again or have it set with OVERRIDE", ggml.ModelFamily(), key)
+		}
+	}
+
+	return nil
+}
+
+// transformerMemory estimates the memory of a transformer, whose kv cache
+// has a key and value per token for each kv head of each layer
+func transformerMemory(ggml *GGML, numCtx int) Memory {
+	heads := max(ggml.NumHead(), 1)
+
+	headsKv := ggml.NumHeadKv()
+	if headsKv == 0 {
+		headsKv = heads
+	}
+
+	keyLength, valueLength := ggml.kvUint32("attention.key_length"), ggml.kvUint32("attention.value_length")
+	if keyLength == 0 || valueLength == 0 {
+		keyLength = ggml.NumEmbed() / heads
+		valueLength = keyLength
+	}
+
+	// fp16 k,v matrices require = n_ctx * n_layer * n_head_kv * (n_embd_head_k + n_embd_head_v) * 2 bytes each
+	kv := 2 * int64(numCtx) * int64(ggml.NumLayers()) * int64(headsKv) * int64(keyLength+valueLength)
+
+	// this amount is the overhead + tensors in memory
+	// TODO: get this from the llama.cpp's graph calculations instead of
+	// estimating it's 1/6 * kv_cache_size * num_gqa
+	graph := int64(heads/headsKv) * kv / 6
+
+	return Memory{Weights: ggml.Size, KV: kv, Graph: graph}
+}
+
+// mambaMemory estimates the memory of a mamba model, whose state is the same
+// size however long the context is
+func mambaMemory(ggml *GGML, _ int) Memory {
+	inner := int64(ggml.kvUint32("ssm.inner_size"))
+	conv := int64(max(ggml.kvUint32("ssm.conv_kernel"), 1) - 1)
+	state := int64(ggml.kvUint32("ssm.state_size"))
+
+	// f32 conv and ssm states for each layer
+	kv := 4 * int64(ggml.NumLayers()) * inner * (conv + state)
+
+	return Memory{Weights: ggml.Size, KV: kv, Graph: kv / 6}
+}
@@ -52,6 +52,7 @@ void dyn_init(const char *libPath, struct dynamic_llama_server *s,
       {"llama_server_embedding", (void *)&s->llama_server_embedding},
       {"llama_server_release_json_resp",
        (void *)&s->llama_server_release_json_resp},
+      {"llama_server_reconfigure", (void *)&s->llama_server_reconfigure},
       {"", NULL},
   };
 
@@ -140,3 +141,9 @@ inline void dyn_llama_server_release_json_resp(
     struct dynamic_llama_server s, char **json_resp) {
   s.llama_server_release_json_resp(json_resp);
 }
+
+inline void dyn_llama_server_reconfigure(struct dynamic_llama_server s,
+                                         uint32_t n_threads, uint32_t n_batch,
+                                         ext_server_resp_t *err) {
+  s.llama_server_reconfigure(n_threads, n_batch, err);
+}
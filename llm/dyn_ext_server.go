@@ -24,10 +24,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -40,6 +43,12 @@ import (
 type dynExtServer struct {
 	s       C.struct_dynamic_llama_server
 	options api.Options
+	library string
+	infill  *infill
+
+	// size is the memory the model was estimated to need, and sizeVRAM how
+	// much of it is in VRAM
+	size, sizeVRAM int64
 }
 
 // Note: current implementation does not support concurrent instantiations
@@ -61,10 +70,45 @@ func freeExtServerResp(resp C.ext_server_resp_t) {
 }
 
 func extServerResponseToErr(resp C.ext_server_resp_t) error {
-	return fmt.Errorf(C.GoString(resp.msg))
+	msg := C.GoString(resp.msg)
+	if isOutOfMemory(msg) {
+		return fmt.Errorf("%w: %s", ErrOutOfMemory, msg)
+	}
+
+	if reason, ok := strings.CutPrefix(msg, "runner crashed: "); ok {
+		return fmt.Errorf("%w: %s", ErrRunnerCrashed, reason)
+	}
+
+	return errors.New(msg)
+}
+
+// isOutOfMemory reports whether a llama.cpp error is from a failed allocation
+func isOutOfMemory(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, s := range []string{"out of memory", "failed to allocate", "unable to allocate", "cudamalloc failed"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+
+	return false
 }
 
-func newDynExtServer(library, model string, adapters, projectors []string, opts api.Options) (LLM, error) {
+func newDynExtServer(library, model string, infill *infill, adapters, projectors []string, opts api.Options) (LLM, error) {
+	if opts.Pooling != "" && !slices.Contains(Poolings, opts.Pooling) {
+		return nil, fmt.Errorf("%w: unknown pooling %q", api.ErrInvalidOpts, opts.Pooling)
+	}
+
+	var overrides []api.KVOverride
+	for _, s := range opts.KVOverrides {
+		override, err := api.ParseKVOverride(s)
+		if err != nil {
+			return nil, err
+		}
+
+		overrides = append(overrides, override)
+	}
+
 	if !mutex.TryLock() {
 		slog.Info("concurrent llm servers not yet supported, waiting for prior server to complete")
 		mutex.Lock()
@@ -83,6 +127,8 @@ func newDynExtServer(library, model string, adapters, projectors []string, opts
 	llm := dynExtServer{
 		s:       srv,
 		options: opts,
+		library: filepath.Base(filepath.Dir(library)),
+		infill:  infill,
 	}
 	slog.Info(fmt.Sprintf("Loading Dynamic llm server: %s", library))
 
@@ -91,15 +137,33 @@ func newDynExtServer(library, model string, adapters, projectors []string, opts
 	defer C.free(unsafe.Pointer(sparams.model))
 
 	sparams.embedding = true
-	sparams.n_ctx = C.uint(opts.NumCtx)
+	// the context is split between the slots, which each decode a sequence
+	sparams.n_ctx = C.uint(opts.NumCtx * opts.NumParallel)
 	sparams.n_batch = C.uint(opts.NumBatch)
 	sparams.n_gpu_layers = C.int(opts.NumGPU)
 	sparams.main_gpu = C.int(opts.MainGPU)
-	sparams.n_parallel = 1 // TODO - wire up concurrency
+	sparams.n_parallel = C.int32_t(opts.NumParallel)
+
+	// 0 uses the value encoded in the model
+	sparams.rope_freq_base = C.float(opts.RopeFrequencyBase)
+	sparams.rope_freq_scale = C.float(opts.RopeFrequencyScale)
+	switch opts.RopeScalingType {
+	case "none":
+		sparams.rope_scaling_type = 0
+	case "linear":
+		sparams.rope_scaling_type = 1
+	case "yarn":
+		sparams.rope_scaling_type = 2
+	default:
+		sparams.rope_scaling_type = -1 // from model
+	}
 
-	// Always use the value encoded in the model
-	sparams.rope_freq_base = 0.0
-	sparams.rope_freq_scale = 0.0
+	// embeddings are pooled by Embedding unless the model's pooling is used
+	if opts.Pooling != "" {
+		sparams.pooling_type = 0
+	} else {
+		sparams.pooling_type = -1 // from model
+	}
 	sparams.memory_f16 = C.bool(opts.F16KV)
 	sparams.use_mlock = C.bool(opts.UseMLock)
 	sparams.use_mmap = C.bool(opts.UseMMap)
@@ -128,6 +192,28 @@ func newDynExtServer(library, model string, adapters, projectors []string, opts
 		}
 	}
 
+	sparams.kv_overrides = nil
+	for i := len(overrides) - 1; i >= 0; i-- {
+		kv := (*C.ext_server_kv_override_t)(C.malloc(C.sizeof_ext_server_kv_override_t))
+		defer C.free(unsafe.Pointer(kv))
+		kv.key = C.CString(overrides[i].Key)
+		defer C.free(unsafe.Pointer(kv.key))
+		switch v := overrides[i].Value.(type) {
+		case int64:
+			kv._type = 0
+			kv.int_value = C.int64_t(v)
+		case float64:
+			kv._type = 1
+			kv.float_value = C.double(v)
+		case bool:
+			kv._type = 2
+			kv.bool_value = C.bool(v)
+		}
+
+		kv.next = sparams.kv_overrides
+		sparams.kv_overrides = kv
+	}
+
 	if len(projectors) > 0 {
 		// TODO: applying multiple projectors is not supported by the llama.cpp server yet
 		sparams.mmproj = C.CString(projectors[0])
@@ -165,12 +251,26 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 	resp := newExtServerResp(128)
 	defer freeExtServerResp(resp)
 
+	// the runner waits for a slot it doesn't have forever
+	if predict.Slot < 0 || predict.Slot >= max(llm.options.NumParallel, 1) {
+		return fmt.Errorf("slot %d is out of the num_parallel %d the model was loaded with", predict.Slot, llm.options.NumParallel)
+	}
+
 	if len(predict.Images) > 0 {
 		slog.Info(fmt.Sprintf("loaded %d images", len(predict.Images)))
 	}
 
+	var prompt any = predict.Prompt
+	if predict.Suffix != "" {
+		if llm.infill == nil {
+			return ErrInfillUnsupported
+		}
+
+		prompt = llm.infill.prompt(predict.Prompt, predict.Suffix)
+	}
+
 	request := map[string]any{
-		"prompt":            predict.Prompt,
+		"prompt":            prompt,
 		"stream":            true,
 		"n_predict":         predict.Options.NumPredict,
 		"n_keep":            predict.Options.NumKeep,
@@ -179,6 +279,7 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 		"top_p":             predict.Options.TopP,
 		"tfs_z":             predict.Options.TFSZ,
 		"typical_p":         predict.Options.TypicalP,
+		"min_p":             predict.Options.MinP,
 		"repeat_last_n":     predict.Options.RepeatLastN,
 		"repeat_penalty":    predict.Options.RepeatPenalty,
 		"presence_penalty":  predict.Options.PresencePenalty,
@@ -190,7 +291,28 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 		"seed":              predict.Options.Seed,
 		"stop":              predict.Options.Stop,
 		"image_data":        predict.Images,
-		"cache_prompt":      true,
+		"cache_prompt":      !predict.Options.Deterministic, // a cached prompt may be evaluated in different batches
+		"slot_id":           predict.Slot,                   // the prompt is cached by the slot
+	}
+
+	if len(predict.Options.Samplers) > 0 {
+		request["samplers"] = predict.Options.Samplers
+	}
+
+	newStop := func() (*stopper, error) {
+		return newStopper(predict.Options, func(tokens []int) (string, error) {
+			return llm.Decode(ctx, tokens)
+		})
+	}
+
+	stop, err := newStop()
+	if err != nil {
+		return err
+	}
+
+	if stop != nil {
+		// stop sequences are matched as content is streamed instead of by the runner
+		request["stop"] = []string{}
 	}
 
 	if predict.Format == "json" {
@@ -200,6 +322,10 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 		}
 	}
 
+	if predict.N > 1 {
+		return llm.predictChoices(ctx, predict, request, newStop, fn)
+	}
+
 	retryDelay := 100 * time.Microsecond
 	for retries := 0; retries < maxRetries; retries++ {
 		if retries > 0 {
@@ -207,93 +333,262 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 			retryDelay *= 2        // exponential backoff
 		}
 
-		// Handling JSON marshaling with special characters unescaped.
-		buffer := &bytes.Buffer{}
-		enc := json.NewEncoder(buffer)
-		enc.SetEscapeHTML(false)
+		if err := llm.startCompletion(request, &resp); err != nil {
+			return err
+		}
 
-		if err := enc.Encode(request); err != nil {
-			return fmt.Errorf("failed to marshal data: %w", err)
+		retryNeeded, err := llm.completion(ctx, resp, predict.Prompt, stop, fn)
+		if err != nil || !retryNeeded {
+			return err
 		}
+	}
+
+	// should never reach here ideally
+	return fmt.Errorf("max retries exceeded")
+}
 
-		req := C.CString(buffer.String())
-		defer C.free(unsafe.Pointer(req))
+// predictChoices generates predict.N choices for the prompt of request, each
+// in a slot of its own. The slots are decoded in the same batches, and the
+// first choice evaluates the prompt for all of them unless there are images,
+// which are embedded by each slot.
+func (llm *dynExtServer) predictChoices(ctx context.Context, predict PredictOpts, request map[string]any, newStop func() (*stopper, error), fn func(PredictResult)) error {
+	if predict.N > llm.options.NumParallel {
+		return fmt.Errorf("%w: n %d is more than the num_parallel %d the model was loaded with", api.ErrInvalidOpts, predict.N, llm.options.NumParallel)
+	}
 
-		C.dyn_llama_server_completion(llm.s, req, &resp)
-		if resp.id < 0 {
-			return extServerResponseToErr(resp)
+	stops := make([]*stopper, predict.N)
+	for i := range stops {
+		var err error
+		if stops[i], err = newStop(); err != nil {
+			return err
 		}
+	}
 
-		retryNeeded := false
-		// keep track of the last token generated, this is used to abort if the model starts looping
-		var lastToken string
-		var tokenRepeat int
-	out:
-		for {
-			select {
-			case <-ctx.Done():
-				return cancelCompletion(llm, resp)
-			default:
-				var result C.ext_server_task_result_t
-				C.dyn_llama_server_completion_next_result(llm.s, resp.id, &result)
-				json_resp := C.GoString(result.json_resp)
-				C.dyn_llama_server_release_task_result(llm.s, &result)
-
-				var p prediction
-				if err := json.Unmarshal([]byte(json_resp), &p); err != nil {
-					C.dyn_llama_server_completion_cancel(llm.s, resp.id, &resp)
-					if resp.id < 0 {
-						return fmt.Errorf("error unmarshaling llm prediction response: %w and cancel %s", err, C.GoString(resp.msg))
-					} else {
-						return fmt.Errorf("error unmarshaling llm prediction response: %w", err)
-					}
-				}
+	resps := make([]C.ext_server_resp_t, predict.N)
+	for i := range resps {
+		resps[i] = newExtServerResp(128)
+		defer freeExtServerResp(resps[i])
+	}
 
-				if bool(result.error) && strings.Contains(json_resp, "slot unavailable") {
-					retryNeeded = true
-					// task will already be canceled
-					break out
-				}
+	for i := range resps {
+		choice := maps.Clone(request)
+		if len(predict.Images) == 0 {
+			if i == 0 {
+				choice["n_choices"] = predict.N
+			} else {
+				choice["choice_of"] = int(resps[0].id)
+				choice["slot_id"] = -1
+			}
+		}
+
+		if err := llm.startCompletion(choice, &resps[i]); err != nil {
+			// the choices which have started would wait for this one
+			for _, resp := range resps[:i] {
+				cancelCompletion(llm, resp)
+			}
+
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(resps))
+	for i, resp := range resps {
+		prompt := predict.Prompt
+		if i > 0 && len(predict.Images) == 0 {
+			// the prompt is only evaluated by the first choice
+			prompt = ""
+		}
 
-				switch {
-				case strings.TrimSpace(p.Content) == lastToken:
-					tokenRepeat++
-				default:
-					lastToken = strings.TrimSpace(p.Content)
-					tokenRepeat = 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			retryNeeded, err := llm.completion(ctx, resp, prompt, stops[i], func(r PredictResult) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				r.Index = i
+				fn(r)
+			})
+			if err == nil && retryNeeded {
+				err = errors.New("no slot is available for the choice")
+			}
+
+			if err != nil {
+				errs[i] = err
+
+				// the other choices are canceled with it
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// startCompletion starts a completion of request, setting resp.id to the id
+// of its task
+func (llm *dynExtServer) startCompletion(request map[string]any, resp *C.ext_server_resp_t) error {
+	// Handling JSON marshaling with special characters unescaped.
+	buffer := &bytes.Buffer{}
+	enc := json.NewEncoder(buffer)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(request); err != nil {
+		return fmt.Errorf("failed to marshal data: %w", err)
+	}
+
+	req := C.CString(buffer.String())
+	defer C.free(unsafe.Pointer(req))
+
+	C.dyn_llama_server_completion(llm.s, req, resp)
+	if resp.id < 0 {
+		return extServerResponseToErr(*resp)
+	}
+
+	return nil
+}
+
+// completion calls fn with the results of the completion task resp.id until
+// it's done. retryNeeded is set if the runner had no slot for the task. The
+// prompt is counted when a stop sequence cancels the completion, since the
+// runner doesn't report timings then.
+func (llm *dynExtServer) completion(ctx context.Context, resp C.ext_server_resp_t, prompt string, stop *stopper, fn func(PredictResult)) (retryNeeded bool, err error) {
+	start := time.Now()
+	var firstToken time.Time
+	var evalCount int
+
+	// keep track of the last token generated, this is used to abort if the model starts looping
+	var lastToken string
+	var tokenRepeat int
+	for {
+		select {
+		case <-ctx.Done():
+			return false, cancelCompletion(llm, resp)
+		default:
+			var result C.ext_server_task_result_t
+			C.dyn_llama_server_completion_next_result(llm.s, resp.id, &result)
+			json_resp := C.GoString(result.json_resp)
+			C.dyn_llama_server_release_task_result(llm.s, &result)
+
+			var p prediction
+			if err := json.Unmarshal([]byte(json_resp), &p); err != nil {
+				C.dyn_llama_server_completion_cancel(llm.s, resp.id, &resp)
+				if resp.id < 0 {
+					return false, fmt.Errorf("error unmarshaling llm prediction response: %w and cancel %s", err, C.GoString(resp.msg))
+				} else {
+					return false, fmt.Errorf("error unmarshaling llm prediction response: %w", err)
 				}
+			}
+
+			if bool(result.error) && strings.Contains(json_resp, "slot unavailable") {
+				// task will already be canceled
+				return true, nil
+			}
 
-				// 30 picked as an arbitrary max token repeat limit, modify as needed
-				if tokenRepeat > 30 {
-					slog.Debug("prediction aborted, token repeat limit reached")
-					return cancelCompletion(llm, resp)
+			if bool(result.error) {
+				// the task has been canceled so no more results will arrive
+				return false, predictionError(p)
+			}
+
+			switch {
+			case strings.TrimSpace(p.Content) == lastToken:
+				tokenRepeat++
+			default:
+				lastToken = strings.TrimSpace(p.Content)
+				tokenRepeat = 0
+			}
+
+			// 30 picked as an arbitrary max token repeat limit, modify as needed
+			if tokenRepeat > 30 {
+				slog.Debug("prediction aborted, token repeat limit reached")
+				return false, cancelCompletion(llm, resp)
+			}
+
+			if p.Content != "" {
+				if firstToken.IsZero() {
+					firstToken = time.Now()
+				}
+				evalCount++
+
+				content := p.Content
+				if stop != nil {
+					var stopped bool
+					content, stopped = stop.Write(content)
+					if stopped {
+						if content != "" {
+							fn(PredictResult{Content: content})
+						}
+
+						if err := cancelCompletion(llm, resp); err != nil {
+							return false, err
+						}
+
+						// the runner doesn't report timings for canceled completions
+						promptEvalCount := 0
+						if prompt != "" {
+							if tokens, err := llm.Encode(ctx, prompt); err == nil {
+								promptEvalCount = len(tokens)
+							}
+						}
+
+						fn(PredictResult{
+							Done:               true,
+							PromptEvalCount:    promptEvalCount,
+							PromptEvalDuration: firstToken.Sub(start),
+							EvalCount:          evalCount,
+							EvalDuration:       time.Since(firstToken),
+						})
+						return false, nil
+					}
 				}
 
-				if p.Content != "" {
+				if content != "" {
 					fn(PredictResult{
-						Content: p.Content,
+						Content: content,
 					})
 				}
+			}
 
-				if p.Stop || bool(result.stop) {
-					fn(PredictResult{
-						Done:               true,
-						PromptEvalCount:    p.Timings.PromptN,
-						PromptEvalDuration: parseDurationMs(p.Timings.PromptMS),
-						EvalCount:          p.Timings.PredictedN,
-						EvalDuration:       parseDurationMs(p.Timings.PredictedMS),
-					})
-					return nil
+			if p.Stop || bool(result.stop) {
+				if stop != nil {
+					if content := stop.Flush(); content != "" {
+						fn(PredictResult{Content: content})
+					}
 				}
+
+				fn(PredictResult{
+					Done:               true,
+					PromptEvalCount:    p.Timings.PromptN,
+					PromptEvalDuration: parseDurationMs(p.Timings.PromptMS),
+					EvalCount:          p.Timings.PredictedN,
+					EvalDuration:       parseDurationMs(p.Timings.PredictedMS),
+				})
+				return false, nil
 			}
 		}
-		if !retryNeeded {
-			return nil // success
-		}
+	}
+}
+
+// predictionError returns the error for a failed completion
+func predictionError(p prediction) error {
+	msg := p.Error
+	if msg == "" {
+		// errors from the runner's tasks are reported as content
+		msg = p.Content
 	}
 
-	// should never reach here ideally
-	return fmt.Errorf("max retries exceeded")
+	if reason, ok := strings.CutPrefix(msg, "runner crashed: "); ok {
+		return fmt.Errorf("%w: %s", ErrRunnerCrashed, reason)
+	}
+
+	return errors.New(msg)
 }
 
 func cancelCompletion(llm *dynExtServer, resp C.ext_server_resp_t) error {
@@ -305,6 +600,15 @@ func cancelCompletion(llm *dynExtServer, resp C.ext_server_resp_t) error {
 	}
 }
 
+// Library returns the name of the runner library, e.g. cpu_avx2 or cuda_v11
+func (llm *dynExtServer) Library() string {
+	return llm.library
+}
+
+func (llm *dynExtServer) Size() (int64, int64) {
+	return llm.size, llm.sizeVRAM
+}
+
 func (llm *dynExtServer) Encode(ctx context.Context, prompt string) ([]int, error) {
 	data, err := json.Marshal(TokenizeRequest{Content: prompt})
 	if err != nil {
@@ -357,8 +661,8 @@ func (llm *dynExtServer) Decode(ctx context.Context, tokens []int) (string, erro
 	return decoded.Content, err
 }
 
-func (llm *dynExtServer) Embedding(ctx context.Context, input string) ([]float64, error) {
-	data, err := json.Marshal(TokenizeRequest{Content: input})
+func (llm *dynExtServer) Embedding(ctx context.Context, embed EmbeddingOpts) ([]float64, error) {
+	data, err := json.Marshal(map[string]any{"content": embed.Input, "image_data": embed.Images})
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling embed data: %w", err)
 	}
@@ -379,7 +683,31 @@ func (llm *dynExtServer) Embedding(ctx context.Context, input string) ([]float64
 		return nil, fmt.Errorf("unmarshal tokenize response: %w", err)
 	}
 
-	return embedding.Embedding, nil
+	e := embedding.Embedding
+	if llm.options.Pooling != "" {
+		e, err = pool(embedding.Embeddings, llm.options.Pooling)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return embed.apply(e)
+}
+
+// Reconfigure changes the threads and batch size of the loaded model
+func (llm *dynExtServer) Reconfigure(numThread, numBatch int) error {
+	if numBatch > llm.options.NumBatch {
+		return fmt.Errorf("%w: num_batch %d is larger than the %d the model was loaded with", api.ErrInvalidOpts, numBatch, llm.options.NumBatch)
+	}
+
+	resp := newExtServerResp(128)
+	defer freeExtServerResp(resp)
+	C.dyn_llama_server_reconfigure(llm.s, C.uint32_t(max(numThread, 0)), C.uint32_t(max(numBatch, 0)), &resp)
+	if resp.id < 0 {
+		return extServerResponseToErr(resp)
+	}
+
+	return nil
 }
 
 func (llm *dynExtServer) Close() {
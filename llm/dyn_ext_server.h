@@ -25,6 +25,8 @@ struct dynamic_llama_server {
   void (*llama_server_embedding)(const char *json_req, char **json_resp,
                                  ext_server_resp_t *err);
   void (*llama_server_release_json_resp)(char **json_resp);
+  void (*llama_server_reconfigure)(uint32_t n_threads, uint32_t n_batch,
+                                   ext_server_resp_t *err);
 };
 
 void dyn_init(const char *libPath, struct dynamic_llama_server *s,
@@ -69,6 +71,10 @@ void dyn_llama_server_embedding(struct dynamic_llama_server s,
 void dyn_llama_server_release_json_resp(struct dynamic_llama_server s,
                                                  char **json_resp);
 
+void dyn_llama_server_reconfigure(struct dynamic_llama_server s,
+                                  uint32_t n_threads, uint32_t n_batch,
+                                  ext_server_resp_t *err);
+
 #ifdef __cplusplus
 }
 #endif
\ No newline at end of file
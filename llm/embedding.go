@@ -0,0 +1,93 @@
+package llm
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// Poolings are the ways the embeddings of each token can be combined into an
+// embedding of the input
+var Poolings = []string{"mean", "cls", "last"}
+
+type EmbeddingOpts struct {
+	Input string
+
+	// Images are embedded with the model's vision projector in place of the
+	// input. Only the first is embedded.
+	Images []ImageData
+
+	// Normalize scales the embedding to unit length
+	Normalize bool
+
+	// Dimensions truncates the embedding, which Matryoshka models are trained
+	// to support. 0 keeps every dimension.
+	Dimensions int
+}
+
+// apply truncates and normalizes an embedding. Truncating comes first so the
+// truncated embedding is unit length.
+func (opts EmbeddingOpts) apply(embedding []float64) ([]float64, error) {
+	if opts.Dimensions > 0 {
+		if opts.Dimensions > len(embedding) {
+			return nil, fmt.Errorf("%w: dimensions is %d but the model's embeddings have %d", api.ErrInvalidOpts, opts.Dimensions, len(embedding))
+		}
+
+		embedding = embedding[:opts.Dimensions]
+	}
+
+	if opts.Normalize {
+		embedding = normalize(embedding)
+	}
+
+	return embedding, nil
+}
+
+// pool combines the embeddings of each token of an input
+func pool(embeddings [][]float64, pooling string) ([]float64, error) {
+	if len(embeddings) == 0 {
+		return nil, fmt.Errorf("no token embeddings to pool")
+	}
+
+	switch pooling {
+	case "mean":
+		mean := make([]float64, len(embeddings[0]))
+		for _, e := range embeddings {
+			for i, v := range e {
+				mean[i] += v
+			}
+		}
+
+		for i := range mean {
+			mean[i] /= float64(len(embeddings))
+		}
+
+		return mean, nil
+	case "cls":
+		return embeddings[0], nil
+	case "last":
+		return embeddings[len(embeddings)-1], nil
+	default:
+		return nil, fmt.Errorf("%w: unknown pooling %q", api.ErrInvalidOpts, pooling)
+	}
+}
+
+func normalize(embedding []float64) []float64 {
+	var sum float64
+	for _, v := range embedding {
+		sum += v * v
+	}
+
+	norm := math.Sqrt(sum)
+	if norm == 0 {
+		return embedding
+	}
+
+	normalized := make([]float64, len(embedding))
+	for i, v := range embedding {
+		normalized[i] = v / norm
+	}
+
+	return normalized
+}
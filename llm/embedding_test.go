@@ -0,0 +1,50 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestPool(t *testing.T) {
+	embeddings := [][]float64{{1, 2}, {3, 4}, {5, 9}}
+
+	cases := map[string][]float64{
+		"mean": {3, 5},
+		"cls":  {1, 2},
+		"last": {5, 9},
+	}
+
+	for pooling, want := range cases {
+		t.Run(pooling, func(t *testing.T) {
+			got, err := pool(embeddings, pooling)
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+
+	_, err := pool(embeddings, "max")
+	assert.ErrorIs(t, err, api.ErrInvalidOpts)
+}
+
+func TestEmbeddingOptsApply(t *testing.T) {
+	embedding := []float64{3, 4, 12}
+
+	got, err := EmbeddingOpts{Normalize: true}.apply(embedding)
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{3.0 / 13, 4.0 / 13, 12.0 / 13}, got, 1e-9)
+
+	got, err = EmbeddingOpts{Normalize: true, Dimensions: 2}.apply(embedding)
+	require.NoError(t, err)
+	assert.InDeltaSlice(t, []float64{0.6, 0.8}, got, 1e-9)
+
+	got, err = EmbeddingOpts{}.apply(embedding)
+	require.NoError(t, err)
+	assert.Equal(t, embedding, got)
+
+	_, err = EmbeddingOpts{Dimensions: 4}.apply(embedding)
+	assert.ErrorIs(t, err, api.ErrInvalidOpts)
+}
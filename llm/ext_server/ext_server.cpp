@@ -31,6 +31,33 @@ std::thread ext_server_thread;
 bool shutting_down = false;
 std::atomic_int recv_counter;
 
+// Set if the main loop stopped from an exception, requests fail with the
+// reason instead of waiting for results which will never arrive
+std::atomic_bool crashed = false;
+std::string crash_reason;
+
+// fail_waiting_tasks sends an error result to every request waiting on the
+// main loop so they don't block forever once it has crashed
+static void fail_waiting_tasks(const std::string &reason) {
+  crash_reason = reason;
+  crashed = true;
+
+  std::set<int> task_ids;
+  {
+    std::unique_lock<std::mutex> lock(llama->queue_results.mutex_results);
+    task_ids = llama->queue_results.waiting_task_ids;
+  }
+
+  for (int task_id : task_ids) {
+    task_result result;
+    result.id = task_id;
+    result.stop = true;
+    result.error = true;
+    result.result_json = {{"content", ""}, {"error", "runner crashed: " + reason}};
+    llama->queue_results.send(result);
+  }
+}
+
 // RAII wrapper for tracking in-flight recv calls
 class atomicRecv {
   public:
@@ -67,6 +94,8 @@ void llama_server_init(ext_server_params *sparams, ext_server_resp_t *err) {
     params.n_parallel = sparams->n_parallel;
     params.rope_freq_base = sparams->rope_freq_base;
     params.rope_freq_scale = sparams->rope_freq_scale;
+    params.rope_scaling_type = (llama_rope_scaling_type)sparams->rope_scaling_type;
+    params.pooling_type = (llama_pooling_type)sparams->pooling_type;
 
     if (sparams->memory_f16) {
       params.cache_type_k = "f16";
@@ -95,6 +124,34 @@ void llama_server_init(ext_server_params *sparams, ext_server_resp_t *err) {
       params.use_mmap = false;
     }
 
+    if (sparams->kv_overrides != NULL) {
+      for (ext_server_kv_override *kv = sparams->kv_overrides; kv != NULL;
+          kv = kv->next) {
+        llama_model_kv_override override;
+        strncpy(override.key, kv->key, sizeof(override.key) - 1);
+        override.key[sizeof(override.key) - 1] = 0;
+        switch (kv->type) {
+          case 0:
+            override.tag = LLAMA_KV_OVERRIDE_TYPE_INT;
+            override.int_value = kv->int_value;
+            break;
+          case 1:
+            override.tag = LLAMA_KV_OVERRIDE_TYPE_FLOAT;
+            override.float_value = kv->float_value;
+            break;
+          default:
+            override.tag = LLAMA_KV_OVERRIDE_TYPE_BOOL;
+            override.bool_value = kv->bool_value;
+            break;
+        }
+        params.kv_overrides.push_back(override);
+      }
+
+      // llama.cpp reads overrides until one with an empty key
+      params.kv_overrides.emplace_back();
+      params.kv_overrides.back().key[0] = 0;
+    }
+
     if (sparams->mmproj != NULL) {
       params.mmproj = std::string(sparams->mmproj);
     }
@@ -155,8 +212,10 @@ void llama_server_start() {
       llama->queue_tasks.start_loop();
     } catch (std::exception &e) {
       LOG_TEE("caught exception in llama server main loop: %s\n", e.what());
+      fail_waiting_tasks(e.what());
     } catch (...) {
       LOG_TEE("caught unknown exception in llama server main loop\n");
+      fail_waiting_tasks("unknown exception");
     }
     LOG_TEE("\nllama server shutting down\n");
     llama_backend_free();
@@ -181,6 +240,7 @@ void llama_server_stop() {
   llama = NULL;
   LOG_TEE("llama server shutdown complete\n");
   shutting_down = false;
+  crashed = false;
 }
 
 void llama_server_completion(const char *json_req, ext_server_resp_t *resp) {
@@ -191,6 +251,10 @@ void llama_server_completion(const char *json_req, ext_server_resp_t *resp) {
     if (shutting_down) {
       throw std::runtime_error("server shutting down");
     }
+    if (crashed) {
+      snprintf(resp->msg, resp->msg_len, "runner crashed: %s", crash_reason.c_str());
+      return;
+    }
     json data = json::parse(json_req);
     resp->id = llama->queue_tasks.get_new_id();
     llama->queue_results.add_waiting_task_id(resp->id);
@@ -284,6 +348,11 @@ void llama_server_tokenize(const char *json_req, char **json_resp,
     if (shutting_down) {
       throw std::runtime_error("server shutting down");
     }
+    if (crashed) {
+      err->id = -1;
+      snprintf(err->msg, err->msg_len, "runner crashed: %s", crash_reason.c_str());
+      return;
+    }
     const json body = json::parse(json_req);
     std::vector<llama_token> tokens;
     if (body.count("content") != 0) {
@@ -340,6 +409,35 @@ void llama_server_detokenize(const char *json_req, char **json_resp,
   }
 }
 
+// llama_server_image_embedding embeds an image with the vision projector,
+// returning the embedding of each patch and their mean
+static void llama_server_image_embedding(const json &img, char **json_resp) {
+  if (llama->clp_ctx == nullptr) {
+    throw std::runtime_error("model has no vision projector");
+  }
+  const std::vector<uint8_t> buffer = base64_decode(img["data"].get<std::string>());
+  llava_image_embed *embed = llava_image_embed_make_with_bytes(
+      llama->clp_ctx, llama->params.n_threads, buffer.data(), buffer.size());
+  if (embed == nullptr) {
+    throw std::runtime_error("failed to load image");
+  }
+  const int n_embd = clip_n_mmproj_embd(llama->clp_ctx);
+  std::vector<float> mean(n_embd, 0.0f);
+  json embeddings = json::array();
+  for (int i = 0; i < embed->n_image_pos; i++) {
+    const float *patch = embed->embed + i * n_embd;
+    for (int j = 0; j < n_embd; j++) {
+      mean[j] += patch[j] / embed->n_image_pos;
+    }
+    embeddings.push_back(std::vector<float>(patch, patch + n_embd));
+  }
+  llava_image_embed_free(embed);
+  std::string result_json = json{{"embedding", mean}, {"embeddings", embeddings}}.dump();
+  const std::string::size_type size = result_json.size() + 1;
+  *json_resp = new char[size];
+  snprintf(*json_resp, size, "%s", result_json.c_str());
+}
+
 void llama_server_embedding(const char *json_req, char **json_resp,
                             ext_server_resp_t *err) {
   assert(llama != NULL && json_req != NULL && json_resp != NULL && err != NULL);
@@ -351,6 +449,10 @@ void llama_server_embedding(const char *json_req, char **json_resp,
       throw std::runtime_error("server shutting down");
     }
     const json body = json::parse(json_req);
+    if (body.count("image_data") != 0 && !body["image_data"].empty()) {
+      llama_server_image_embedding(body["image_data"][0], json_resp);
+      return;
+    }
     json prompt;
     if (body.count("content") != 0) {
       prompt = body["content"];
@@ -374,4 +476,29 @@ void llama_server_embedding(const char *json_req, char **json_resp,
     err->id = -1;
     snprintf(err->msg, err->msg_len, "Unknown exception during embedding");
   }
-}
\ No newline at end of file
+}
+
+void llama_server_reconfigure(uint32_t n_threads, uint32_t n_batch,
+                              ext_server_resp_t *err) {
+  assert(llama != NULL && err != NULL);
+  err->id = 0;
+  err->msg[0] = '\0';
+  try {
+    if (n_threads > 0) {
+      llama->params.n_threads = n_threads;
+      llama->params.n_threads_batch = n_threads;
+      llama_set_n_threads(llama->ctx, n_threads, n_threads);
+    }
+
+    if (n_batch > 0) {
+      llama->params.n_batch = n_batch;
+    }
+  } catch (std::exception &e) {
+    err->id = -1;
+    snprintf(err->msg, err->msg_len, "exception %s", e.what());
+  } catch (...) {
+    err->id = -1;
+    snprintf(err->msg, err->msg_len,
+             "Unknown exception reconfiguring llama server");
+  }
+}
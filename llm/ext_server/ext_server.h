@@ -27,6 +27,16 @@ typedef struct ext_server_lora_adapter {
   struct ext_server_lora_adapter *next;
 } ext_server_lora_adapter_t;
 
+// Allocated and freed by caller
+typedef struct ext_server_kv_override {
+  char *key;
+  int32_t type;  // 0 = int, 1 = float, 2 = bool
+  int64_t int_value;
+  double float_value;
+  bool bool_value;
+  struct ext_server_kv_override *next;
+} ext_server_kv_override_t;
+
 // Allocated and freed by caller
 typedef struct ext_server_params {
   char *model;
@@ -36,6 +46,8 @@ typedef struct ext_server_params {
   int32_t n_parallel;     // number of parallel sequences to decodewra
   float rope_freq_base;   // RoPE base frequency, 0 = from model
   float rope_freq_scale;  // RoPE frequency scaling factor, 0 = from model
+  int32_t rope_scaling_type;  // RoPE scaling type, -1 = from model, 0 = none, 1 = linear, 2 = yarn
+  int32_t pooling_type;   // embedding pooling type, -1 = from model, 0 = none, 1 = mean, 2 = cls
   bool memory_f16;        // use f16 instead of f32 for memory kv
   int32_t n_gpu_layers;  // number of layers to store in VRAM (-1 - use default)
   int32_t main_gpu;      // the GPU that is used for scratch and small tensors
@@ -44,6 +56,7 @@ typedef struct ext_server_params {
   int numa;              // attempt optimizations that help on some NUMA systems
   bool embedding;        // get only sentence embedding
   ext_server_lora_adapter_t *lora_adapters;
+  ext_server_kv_override_t *kv_overrides;  // replace values of the model's metadata
   char *mmproj;
   bool verbose_logging;  // Enable verbose logging of the server
 } ext_server_params_t;
@@ -87,6 +100,12 @@ void llama_server_embedding(const char *json_req, char **json_resp,
                             ext_server_resp_t *err);
 void llama_server_release_json_resp(char **json_resp);
 
+// Change the options which don't need the model to be loaded again between
+// requests. n_threads and n_batch are left as they are when they're 0, and
+// n_batch can't be larger than the batch size the model was loaded with.
+void llama_server_reconfigure(uint32_t n_threads, uint32_t n_batch,
+                              ext_server_resp_t *err);
+
 #ifdef __cplusplus
 }
 #endif
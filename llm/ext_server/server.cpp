@@ -150,6 +150,12 @@ struct server_slot {
     // multitasks
     int multitask_id = -1;
 
+    // choices of the same prompt are decoded in slots of their own, which
+    // share the cells of the prompt in the KV cache. The first choice waits
+    // for the others to be launched and evaluates the prompt for them all.
+    int n_choices = 1;  // the number of choices, for the first of them
+    int choice_of = -1; // the task of the first choice, for the others
+
     void reset() {
         n_prompt_tokens        = 0;
         generated_text         = "";
@@ -202,6 +208,10 @@ struct server_slot {
         return (state == IDLE && command == LOAD_PROMPT) || state == PROCESSING;
     }
 
+    bool shares_prompt() const {
+        return n_choices > 1 || choice_of != -1;
+    }
+
     void add_token_string(const completion_token_output &token) {
         if (command == RELEASE) {
             return;
@@ -557,6 +567,8 @@ struct llama_server_context
         slot->sparams.grammar           = json_value(data, "grammar",           default_sparams.grammar);
         slot->sparams.n_probs           = json_value(data, "n_probs",           default_sparams.n_probs);
         slot->sparams.min_keep          = json_value(data, "min_keep",          default_sparams.min_keep);
+        slot->n_choices                 = json_value(data, "n_choices",         1);
+        slot->choice_of                 = json_value(data, "choice_of",         -1);
 
         if (slot->n_predict > 0 && slot->params.n_predict > slot->n_predict) {
             // Might be better to reject the request with a 400 ?
@@ -1200,6 +1212,9 @@ struct llama_server_context
         }
         else
         {
+            // embeddings of each token, when they aren't pooled into one
+            std::vector<std::vector<float>> embds;
+
             for (int i = 0; i < batch.n_tokens; ++i) {
                 if (!batch.logits[i] || batch.seq_id[i][0] != slot.id) {
                     continue;
@@ -1216,6 +1231,8 @@ struct llama_server_context
                         };
                         continue;
                     }
+
+                    embds.push_back(std::vector<float>(embd, embd + n_embd));
                 }
 
                 res.result_json = json
@@ -1223,6 +1240,11 @@ struct llama_server_context
                     {"embedding", std::vector<float>(embd, embd + n_embd)},
                 };
             }
+
+            if (params.pooling_type == LLAMA_POOLING_TYPE_NONE)
+            {
+                res.result_json["embeddings"] = embds;
+            }
         }
         queue_results.send(res);
     }
@@ -1434,7 +1456,17 @@ struct llama_server_context
                 {
                     if (slot.task_id == task.target_id)
                     {
-                        slot.release();
+                        if (slot.state == IDLE && slot.command == LOAD_PROMPT)
+                        {
+                            // the prompt hasn't been loaded, such as by the
+                            // first of several choices waiting for the others
+                            slot.command = NONE;
+                            queue_tasks.notify_slot_changed();
+                        }
+                        else
+                        {
+                            slot.release();
+                        }
                         break;
                     }
                 }
@@ -1559,6 +1591,20 @@ struct llama_server_context
             {
                 if (slot.is_processing() && system_tokens.size() + slot.cache_tokens.size() >= (size_t) slot.n_ctx)
                 {
+                    // the cells of a prompt shared by choices can't be shifted
+                    // for one of them without moving them for the others, so
+                    // choices stop when their context is full
+                    if (slot.state == PROCESSING && slot.shares_prompt())
+                    {
+                        slot.stopped_limit  = true;
+                        slot.has_next_token = false;
+                        slot.release();
+                        slot.print_timings();
+                        send_final_response(slot);
+                        metrics.on_prediction(slot);
+                        continue;
+                    }
+
                     // Shift context
                     const int n_keep    = slot.params.n_keep + add_bos_token;
                     const int n_left    = (int) system_tokens.size() + slot.n_past - n_keep;
@@ -1655,6 +1701,30 @@ struct llama_server_context
                 // need process the prompt
                 if (slot.state == IDLE && slot.command == LOAD_PROMPT)
                 {
+                    // the other choices of a prompt are loaded by the first
+                    if (slot.choice_of != -1)
+                    {
+                        continue;
+                    }
+
+                    std::vector<server_slot *> choices;
+                    if (slot.n_choices > 1)
+                    {
+                        for (server_slot &other : slots)
+                        {
+                            if (other.state == IDLE && other.command == LOAD_PROMPT && other.choice_of == slot.task_id)
+                            {
+                                choices.push_back(&other);
+                            }
+                        }
+
+                        // wait for the other choices to be launched
+                        if ((int) choices.size() < slot.n_choices - 1)
+                        {
+                            continue;
+                        }
+                    }
+
                     slot.state = PROCESSING;
                     slot.command = NONE;
                     std::vector<llama_token> prompt_tokens;
@@ -1806,6 +1876,16 @@ struct llama_server_context
                     });
                     llama_kv_cache_seq_rm(ctx, slot.id, p0, -1);
 
+                    // the prompt is evaluated in the sequences of every choice,
+                    // which share the cached part of it as well
+                    std::vector<llama_seq_id> seq_ids = { slot.id };
+                    for (server_slot *choice : choices)
+                    {
+                        llama_kv_cache_seq_rm(ctx, choice->id, system_tokens.size(), -1);
+                        llama_kv_cache_seq_cp(ctx, slot.id, choice->id, system_tokens.size(), p0);
+                        seq_ids.push_back(choice->id);
+                    }
+
                     LOG_VERBOSE("prompt ingested", {
                                                     {"n_past",  slot.n_past},
                                                     {"cached",  tokens_to_str(ctx, slot.cache_tokens.cbegin(), slot.cache_tokens.cbegin() + slot.n_past)},
@@ -1833,7 +1913,7 @@ struct llama_server_context
                                 ga_i += ga_w/ga_n;
                             }
                         }
-                        llama_batch_add(batch, prefix_tokens[slot.n_past], system_tokens.size() + slot_npast, { slot.id }, false);
+                        llama_batch_add(batch, prefix_tokens[slot.n_past], system_tokens.size() + slot_npast, seq_ids, false);
                         slot_npast++;
                     }
 
@@ -1849,7 +1929,19 @@ struct llama_server_context
                         return false;
                     }
 
-                    // extract the logits only for the last token
+                    // extract the logits only for the last token, or for every
+                    // token when the embeddings are pooled by the caller
+                    if (slot.embedding && params.pooling_type == LLAMA_POOLING_TYPE_NONE)
+                    {
+                        for (int i = 0; i < batch.n_tokens; ++i)
+                        {
+                            if (batch.seq_id[i][0] == slot.id)
+                            {
+                                batch.logits[i] = true;
+                            }
+                        }
+                    }
+
                     if (batch.n_tokens > 0)
                     {
                         batch.logits[batch.n_tokens - 1] = true;
@@ -1857,6 +1949,32 @@ struct llama_server_context
 
                     slot.n_decoded = 0;
                     slot.i_batch   = batch.n_tokens - 1;
+
+                    // the other choices sample from the logits of the last
+                    // token of the prompt as well
+                    for (server_slot *choice : choices)
+                    {
+                        choice->state                     = PROCESSING;
+                        choice->command                   = NONE;
+                        choice->t_start_process_prompt    = slot.t_start_process_prompt;
+                        choice->t_start_genereration      = 0;
+                        choice->n_prompt_tokens           = slot.n_prompt_tokens;
+                        choice->n_prompt_tokens_processed = 0;
+                        choice->params.n_keep             = slot.params.n_keep;
+                        choice->truncated                 = slot.truncated;
+                        choice->cache_tokens              = prompt_tokens;
+                        choice->n_past                    = slot.n_past;
+                        choice->n_decoded                 = 0;
+                        choice->i_batch                   = slot.i_batch;
+
+                        if (choice->params.cache_prompt)
+                        {
+                            for (auto &token : prompt_tokens)
+                            {
+                                llama_sampling_accept(choice->ctx_sampling, ctx, token, false);
+                            }
+                        }
+                    }
                 }
             }
         }
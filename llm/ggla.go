@@ -15,7 +15,7 @@ func (c *ContainerGGLA) Name() string {
 	return "ggla"
 }
 
-func (c *ContainerGGLA) Decode(rs io.ReadSeeker) (model, error) {
+func (c *ContainerGGLA) Decode(rs io.ReadSeeker) (Model, error) {
 	binary.Read(rs, binary.LittleEndian, &c.version)
 
 	switch c.version {
@@ -160,3 +160,7 @@ func (*ModelGGLA) NumHeadKv() uint32 {
 func (*ModelGGLA) NumCtx() uint32 {
 	panic("not implemented")
 }
+
+func (*ModelGGLA) NumRopeDim() uint32 {
+	panic("not implemented")
+}
@@ -6,10 +6,14 @@ import (
 	"io"
 )
 
+// GGML is a decoded model file: its container format, and the metadata and
+// tensor table of the model in it
 type GGML struct {
-	container
-	model
+	Container
+	Model
 
+	// Size is the size of the model file, up to the end of the data of its
+	// tensors
 	Size int64
 }
 
@@ -89,7 +93,8 @@ func fileType(fileType uint32) string {
 	}
 }
 
-type model interface {
+// Model is the metadata of a model
+type Model interface {
 	ModelFamily() string
 	ModelType() string
 	FileType() string
@@ -99,11 +104,13 @@ type model interface {
 	NumHead() uint32
 	NumHeadKv() uint32
 	NumCtx() uint32
+	NumRopeDim() uint32
 }
 
-type container interface {
+// Container is a model file format, such as gguf
+type Container interface {
 	Name() string
-	Decode(io.ReadSeeker) (model, error)
+	Decode(io.ReadSeeker) (Model, error)
 }
 
 const (
@@ -123,12 +130,17 @@ const (
 var ErrUnsupportedFormat = errors.New("unsupported model format")
 
 func DecodeGGML(rs io.ReadSeeker) (*GGML, error) {
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
 	var magic uint32
 	if err := binary.Read(rs, binary.LittleEndian, &magic); err != nil {
 		return nil, err
 	}
 
-	var c container
+	var c Container
 	switch magic {
 	case FILE_MAGIC_GGML, FILE_MAGIC_GGMF, FILE_MAGIC_GGJT:
 		return nil, ErrUnsupportedFormat
@@ -154,10 +166,39 @@ func DecodeGGML(rs io.ReadSeeker) (*GGML, error) {
 		return nil, err
 	}
 
+	if gguf, ok := model.(*GGUFModel); ok {
+		gguf.tensorsOffset -= start
+		gguf.dataOffset -= start
+	}
+
 	// final model type
 	return &GGML{
-		container: c,
-		model:     model,
+		Container: c,
+		Model:     model,
 		Size:      offset,
 	}, nil
 }
+
+// KV returns the metadata of the model
+func (ggml *GGML) KV() KV {
+	switch m := ggml.Model.(type) {
+	case *GGUFModel:
+		return m.KV
+	case *ModelGGLA:
+		return m.KV()
+	default:
+		return KV{}
+	}
+}
+
+// Tensors returns the tensor table of the model
+func (ggml *GGML) Tensors() []Tensor {
+	switch m := ggml.Model.(type) {
+	case *GGUFModel:
+		return m.Tensors
+	case *ModelGGLA:
+		return m.Tensor()
+	default:
+		return nil
+	}
+}
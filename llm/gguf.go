@@ -43,7 +43,7 @@ func (c *ContainerGGUF) Name() string {
 	return "gguf"
 }
 
-func (c *ContainerGGUF) Decode(rs io.ReadSeeker) (model, error) {
+func (c *ContainerGGUF) Decode(rs io.ReadSeeker) (Model, error) {
 	binary.Read(rs, c.ByteOrder, &c.Version)
 
 	switch c.Version {
@@ -87,8 +87,10 @@ const (
 	GGUFTypeFloat64
 )
 
+// KV is the metadata of a model, keyed by names such as general.architecture
 type KV map[string]any
 
+// Tensor is an entry of the tensor table of a model
 type Tensor struct {
 	Name   string
 	Kind   uint32
@@ -207,6 +209,11 @@ type GGUFModel struct {
 	Tensors []Tensor
 
 	parameters uint64
+
+	// tensorsOffset is where the tensor table starts, and dataOffset is where
+	// the data of the tensors starts, from the start of the model
+	tensorsOffset int64
+	dataOffset    int64
 }
 
 func NewGGUFModel(container *ContainerGGUF) *GGUFModel {
@@ -689,6 +696,13 @@ func (llm *GGUFModel) Decode(rs io.ReadSeeker) error {
 		llm.KV[k] = v
 	}
 
+	tensorsOffset, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	llm.tensorsOffset = tensorsOffset
+
 	// decode tensors
 	for i := 0; uint64(i) < llm.NumTensor(); i++ {
 		name, err := llm.readString(rs)
@@ -715,22 +729,20 @@ func (llm *GGUFModel) Decode(rs io.ReadSeeker) error {
 		llm.parameters += tensor.Parameters()
 	}
 
-	alignment, ok := llm.KV["general.alignment"].(uint32)
-	if !ok {
-		alignment = 32
-	}
+	alignment := llm.alignment()
 
 	offset, err := rs.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return err
 	}
 
-	if _, err := rs.Seek(int64(alignment)-offset%int64(alignment), io.SeekCurrent); err != nil {
+	llm.dataOffset = offset + (alignment-offset%alignment)%alignment
+	if _, err := rs.Seek(llm.dataOffset, io.SeekStart); err != nil {
 		return err
 	}
 
 	for _, tensor := range llm.Tensors {
-		padded := (int64(tensor.Size()) + int64(alignment) - 1) & ^(int64(alignment) - 1)
+		padded := (int64(tensor.Size()) + alignment - 1) & ^(alignment - 1)
 		if _, err := rs.Seek(padded, io.SeekCurrent); err != nil {
 			return err
 		}
@@ -739,6 +751,16 @@ func (llm *GGUFModel) Decode(rs io.ReadSeeker) error {
 	return nil
 }
 
+// alignment returns what the data of the tensors is aligned to, which is 32
+// bytes unless the model sets general.alignment
+func (llm *GGUFModel) alignment() int64 {
+	if alignment, ok := llm.KV["general.alignment"].(uint32); ok {
+		return int64(alignment)
+	}
+
+	return 32
+}
+
 func (llm *GGUFModel) NumLayers() uint32 {
 	value, exists := llm.KV[fmt.Sprintf("%s.block_count", llm.ModelFamily())]
 	if !exists {
@@ -784,6 +806,15 @@ func (llm *GGUFModel) NumCtx() uint32 {
 	return value.(uint32)
 }
 
+func (llm *GGUFModel) NumRopeDim() uint32 {
+	value, exists := llm.KV[fmt.Sprintf("%s.rope.dimension_count", llm.ModelFamily())]
+	if !exists {
+		return 0
+	}
+
+	return value.(uint32)
+}
+
 func (llm *GGUFModel) NumGQA() uint32 {
 	numHeadKv := llm.NumHeadKv()
 	if numHeadKv == 0 {
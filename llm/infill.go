@@ -0,0 +1,76 @@
+package llm
+
+import (
+	"errors"
+	"slices"
+)
+
+// ErrInfillUnsupported is returned when a suffix is given for a model which
+// wasn't trained to fill in the middle
+var ErrInfillUnsupported = errors.New("model does not support fill-in-the-middle")
+
+// infill has the tokens which separate the prefix, suffix and middle of a
+// fill-in-the-middle prompt
+type infill struct {
+	prefix, suffix, middle int
+}
+
+// infillTokens are the fill-in-the-middle tokens of models which don't set
+// their ids in the model metadata
+var infillTokens = [][3]string{
+	{"▁<PRE>", "▁<SUF>", "▁<MID>"},                   // codellama
+	{"<fim_prefix>", "<fim_suffix>", "<fim_middle>"}, // starcoder
+	{"<｜fim▁begin｜>", "<｜fim▁hole｜>", "<｜fim▁end｜>"}, // deepseek-coder
+}
+
+// newInfill returns the fill-in-the-middle tokens of a model, or nil if it
+// doesn't have any
+func newInfill(ggml *GGML) *infill {
+	gguf, ok := ggml.Model.(*GGUFModel)
+	if !ok {
+		return nil
+	}
+
+	var ids []int
+	for _, key := range []string{"tokenizer.ggml.prefix_token_id", "tokenizer.ggml.suffix_token_id", "tokenizer.ggml.middle_token_id"} {
+		if id, ok := gguf.KV[key].(uint32); ok {
+			ids = append(ids, int(id))
+		}
+	}
+
+	if len(ids) == 3 {
+		return &infill{ids[0], ids[1], ids[2]}
+	}
+
+	tokens, ok := gguf.KV["tokenizer.ggml.tokens"].([]any)
+	if !ok {
+		return nil
+	}
+
+	for _, names := range infillTokens {
+		ids := make([]int, 0, len(names))
+		for _, name := range names {
+			if i := slices.Index(tokens, any(name)); i >= 0 {
+				ids = append(ids, i)
+			}
+		}
+
+		if len(ids) == len(names) {
+			return &infill{ids[0], ids[1], ids[2]}
+		}
+	}
+
+	return nil
+}
+
+// SupportsInfill reports whether the model has fill-in-the-middle tokens
+func (ggml *GGML) SupportsInfill() bool {
+	return newInfill(ggml) != nil
+}
+
+// prompt returns a prompt for the runner to generate the text between prefix
+// and suffix. The empty string lets the runner add the BOS token if the model
+// uses one.
+func (i *infill) prompt(prefix, suffix string) []any {
+	return []any{"", i.prefix, prefix, i.suffix, suffix, i.middle}
+}
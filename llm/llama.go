@@ -48,6 +48,7 @@ type prediction struct {
 	Model   string `json:"model"`
 	Prompt  string `json:"prompt"`
 	Stop    bool   `json:"stop"`
+	Error   string `json:"error"`
 
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
@@ -61,12 +62,26 @@ const maxRetries = 3
 
 type PredictOpts struct {
 	Prompt  string
+	Suffix  string // the text after the completion, to fill in the middle
 	Format  string
 	Images  []ImageData
 	Options api.Options
+
+	// N is the number of choices to generate for the prompt, which can't be
+	// more than the num_parallel the model was loaded with. 0 is one.
+	N int
+
+	// Slot is the slot of the runner which evaluates the prompt and keeps it
+	// cached, for the next prompt which starts with it. It must be less than
+	// the num_parallel the model was loaded with.
+	Slot int
 }
 
 type PredictResult struct {
+	// Index is the choice the result is of. Each choice ends with its own
+	// result with Done set.
+	Index int
+
 	Content            string
 	Done               bool
 	PromptEvalCount    int
@@ -97,4 +112,8 @@ type EmbeddingRequest struct {
 
 type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
+
+	// Embeddings are the embeddings of each token, when the runner doesn't
+	// pool them
+	Embeddings [][]float64 `json:"embeddings"`
 }
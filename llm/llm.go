@@ -1,29 +1,58 @@
+// Package llm reads model files and runs models. It can be used without the
+// server: DecodeGGML reads the metadata and tensor table of gguf and ggla
+// files, GGML.Memory and GGML.GPULayers estimate what a model needs to run,
+// and New starts a runner for a model.
 package llm
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"runtime"
 	"slices"
+	"strings"
 
 	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/format"
 	"github.com/jmorganca/ollama/gpu"
 )
 
 type LLM interface {
 	Predict(context.Context, PredictOpts, func(PredictResult)) error
-	Embedding(context.Context, string) ([]float64, error)
+	Embedding(context.Context, EmbeddingOpts) ([]float64, error)
 	Encode(context.Context, string) ([]int, error)
 	Decode(context.Context, []int) (string, error)
+	Library() string
 	Close()
 }
 
-var cpuOnlyFamilies = []string{
-	"mamba",
+// Reconfigurer is implemented by runners which can change the options that
+// don't affect the weights or the context between requests, without loading
+// the model again. 0 leaves an option as it is.
+type Reconfigurer interface {
+	Reconfigure(numThread, numBatch int) error
 }
 
+// Sizer is implemented by runners which know the memory the model was
+// estimated to need when it was loaded, and how much of it is in VRAM
+type Sizer interface {
+	Size() (total, vram int64)
+}
+
+var (
+	// ErrOutOfMemory is returned when there isn't enough memory to load the
+	// model or allocate its context
+	ErrOutOfMemory = errors.New("out of memory")
+
+	// ErrContextExceeded is returned when an input can't fit in the context window
+	ErrContextExceeded = errors.New("input exceeds the context window")
+
+	// ErrRunnerCrashed is returned when the runner stops unexpectedly
+	ErrRunnerCrashed = errors.New("runner crashed")
+)
+
 func New(model string, adapters, projectors []string, opts api.Options) (LLM, error) {
 	if _, err := os.Stat(model); err != nil {
 		return nil, err
@@ -40,28 +69,41 @@ func New(model string, adapters, projectors []string, opts api.Options) (LLM, er
 		return nil, err
 	}
 
-	if opts.NumCtx > int(ggml.NumCtx()) {
-		slog.Warn(fmt.Sprintf("requested context length is greater than model's max context length (%d > %d), using %d instead", opts.NumCtx, ggml.NumCtx(), ggml.NumCtx()))
-		opts.NumCtx = int(ggml.NumCtx())
+	// overrides are applied first, since they can change the trained context
+	if err := applyKVOverrides(ggml, opts.KVOverrides); err != nil {
+		return nil, err
+	}
+
+	if err := ggml.checkKeys(); err != nil {
+		return nil, err
+	}
+
+	if err := ropeScaling(ggml, &opts); err != nil {
+		return nil, err
 	}
 
 	if opts.NumCtx < 4 {
 		opts.NumCtx = 4
 	}
 
+	opts.NumParallel = max(opts.NumParallel, 1)
+
+	// each sequence has a context window of its own in the cache
 	vram, _ := gpu.CheckVRAM()
-	size := ggml.Size
+	mem := ggml.Memory(opts.NumCtx * opts.NumParallel)
 
-	// fp16 k,v matrices require = n_ctx * n_layer * n_embd / n_head * n_head_kv * 2 bytes each * 2 key and value
-	kv := 2 * 2 * int64(opts.NumCtx) * int64(ggml.NumLayers()) * int64(ggml.NumEmbed()) * int64(ggml.NumHeadKv()) / int64(max(ggml.NumHead(), 1))
+	if experts := ggml.NumExpert(); experts > 0 {
+		var shared, expert int64
+		for _, size := range ggml.layerSizes() {
+			shared += size.shared
+			expert += size.experts
+		}
 
-	// this amount is the overhead + tensors in memory
-	// TODO: get this from the llama.cpp's graph calculations instead of
-	// estimating it's 1/6 * kv_cache_size * num_gqa
-	graph := int64(ggml.NumGQA()) * kv / 6
+		slog.Info(fmt.Sprintf("mixture of experts: %d experts, %d used per token, %s of expert weights and %s shared", experts, ggml.NumExpertUsed(), format.HumanBytes(expert), format.HumanBytes(shared)))
+	}
 
 	// certain model architectures don't support gpu inference yet
-	if slices.Contains(cpuOnlyFamilies, ggml.ModelFamily()) {
+	if ggml.architecture().CPUOnly {
 		opts.NumGPU = 0
 	}
 
@@ -72,7 +114,7 @@ func New(model string, adapters, projectors []string, opts api.Options) (LLM, er
 			break
 		}
 
-		if size+kv+graph > vram {
+		if mem.Total() > vram {
 			slog.Info("not enough vram available, setting num_gpu=0")
 			opts.NumGPU = 0
 			break
@@ -103,19 +145,11 @@ func New(model string, adapters, projectors []string, opts api.Options) (LLM, er
 		// of how many layers can be loaded. It needs to fit:
 		// 1. the full compute graph allocation for all devices (graph)
 		// 2. the proportional kv cache for all devices (kv * % layers)
-		// 3. the proportional model (size * % layers / # devices)
-		// This estimates the number of layers
-		maxlayers := int64(ggml.NumLayers()) + 1
-		devices := int64(info.DeviceCount)
-		avg := vram / devices
-		layers := maxlayers * (avg - graph) / (kv + size/devices)
-		if layers > maxlayers {
-			layers = maxlayers
-		}
-
-		// 1 + 2 must fit on the main gpu
-		min := graph + kv*layers/maxlayers
-		if layers <= 0 || min > avg {
+		// 3. the weights of each offloaded layer split between devices
+		// Layers are sized from the tensor table, so the large expert
+		// layers of mixture-of-experts models are accounted for
+		layers := ggml.GPULayers(mem, vram, int64(info.DeviceCount))
+		if layers == 0 {
 			slog.Info("not enough vram available, falling back to CPU only")
 			info.Library = "cpu"
 			info.Variant = gpu.GetCPUVariant()
@@ -123,12 +157,104 @@ func New(model string, adapters, projectors []string, opts api.Options) (LLM, er
 			break
 		}
 
-		opts.NumGPU = int(layers)
+		opts.NumGPU = layers
+	}
+
+	srv, err := newLlmServer(info, model, newInfill(ggml), adapters, projectors, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := srv.(*dynExtServer); ok {
+		s.size, s.sizeVRAM = mem.Total(), vramSize(mem, int64(ggml.NumLayers())+1, info, opts.NumGPU)
+	}
+
+	return srv, nil
+}
+
+// vramSize estimates how much of the memory of a model with layers layers,
+// including the output layer, is in VRAM when numGPU of them are offloaded
+func vramSize(mem Memory, layers int64, info gpu.GpuInfo, numGPU int) int64 {
+	if info.Library == "cpu" || numGPU <= 0 {
+		return 0
+	}
+
+	return mem.Total() * min(int64(numGPU), layers) / layers
+}
+
+// applyKVOverrides replaces values of the metadata of a model with overrides,
+// so estimates made from the metadata match the model llama.cpp loads. Values
+// keep the type they're decoded with, since they're read with that type.
+func applyKVOverrides(ggml *GGML, overrides []string) error {
+	kv := ggml.KV()
+	for _, s := range overrides {
+		override, err := api.ParseKVOverride(s)
+		if err != nil {
+			return err
+		}
+
+		switch v := override.Value.(type) {
+		case int64:
+			switch kv[override.Key].(type) {
+			case int32:
+				kv[override.Key] = int32(v)
+			case uint64:
+				kv[override.Key] = uint64(v)
+			case int64:
+				kv[override.Key] = v
+			default:
+				kv[override.Key] = uint32(v)
+			}
+		case float64:
+			switch kv[override.Key].(type) {
+			case float64:
+				kv[override.Key] = v
+			default:
+				kv[override.Key] = float32(v)
+			}
+		case bool:
+			kv[override.Key] = v
+		}
+
+		slog.Info(fmt.Sprintf("overriding %s with %v", override.Key, override.Value))
+	}
+
+	return nil
+}
+
+// ropeScaling extends the context window the model was trained with using rope
+// scaling when a longer context is requested. Longer contexts are rejected for
+// models which don't use rope, or requests with rope_scaling_type "none",
+// rather than being truncated to the trained context.
+func ropeScaling(ggml *GGML, opts *api.Options) error {
+	if opts.RopeScalingType != "" && !slices.Contains(api.RopeScalingTypes, opts.RopeScalingType) {
+		return &api.OptionError{Option: "rope_scaling_type", Reason: fmt.Sprintf("must be one of %s", strings.Join(api.RopeScalingTypes, ", "))}
+	}
+
+	trained := int(ggml.NumCtx())
+	if trained == 0 || opts.NumCtx <= trained {
+		return nil
+	}
+
+	if ggml.NumRopeDim() == 0 {
+		return fmt.Errorf("%w: num_ctx %d is longer than the %d tokens the model was trained with, and the model doesn't support rope scaling", api.ErrInvalidOpts, opts.NumCtx, trained)
+	}
+
+	if opts.RopeScalingType == "none" {
+		return fmt.Errorf("%w: num_ctx %d is longer than the %d tokens the model was trained with, and rope_scaling_type is none", api.ErrInvalidOpts, opts.NumCtx, trained)
+	}
+
+	if opts.RopeScalingType == "" {
+		opts.RopeScalingType = "yarn"
+	}
+
+	// an explicit rope_frequency_scale takes precedence over the computed one
+	if opts.RopeFrequencyScale == 0 {
+		opts.RopeFrequencyScale = float32(trained) / float32(opts.NumCtx)
 	}
 
-	opts.RopeFrequencyBase = 0.0
-	opts.RopeFrequencyScale = 0.0
-	return newLlmServer(info, model, adapters, projectors, opts)
+	slog.Warn(fmt.Sprintf("requested context length is greater than model's max context length (%d > %d), using %s rope scaling with a factor of %.2f", opts.NumCtx, trained, opts.RopeScalingType, 1/opts.RopeFrequencyScale))
+	return nil
 }
 
 // Give any native cgo implementations an opportunity to initialize
@@ -136,7 +262,7 @@ func Init() error {
 	return nativeInit()
 }
 
-func newLlmServer(gpuInfo gpu.GpuInfo, model string, adapters, projectors []string, opts api.Options) (LLM, error) {
+func newLlmServer(gpuInfo gpu.GpuInfo, model string, infill *infill, adapters, projectors []string, opts api.Options) (LLM, error) {
 	dynLibs := getDynLibs(gpuInfo)
 
 	// Check to see if the user has requested a specific library instead of auto-detecting
@@ -163,7 +289,7 @@ func newLlmServer(gpuInfo gpu.GpuInfo, model string, adapters, projectors []stri
 
 	err2 := fmt.Errorf("unable to locate suitable llm library")
 	for _, dynLib := range dynLibs {
-		srv, err := newDynExtServer(dynLib, model, adapters, projectors, opts)
+		srv, err := newDynExtServer(dynLib, model, infill, adapters, projectors, opts)
 		if err == nil {
 			return srv, nil
 		}
@@ -0,0 +1,308 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/gpu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRopeScaling(t *testing.T) {
+	ggml := func(kv KV) *GGML {
+		kv["general.architecture"] = "llama"
+		return &GGML{Model: &GGUFModel{KV: kv}}
+	}
+
+	rope := KV{"llama.context_length": uint32(4096), "llama.rope.dimension_count": uint32(128)}
+
+	cases := []struct {
+		name      string
+		kv        KV
+		numCtx    int
+		ropeType  string
+		ropeScale float32
+		wantCtx   int
+		wantType  string
+		wantScale float32
+	}{
+		{"within trained context", rope, 2048, "", 0, 2048, "", 0},
+		{"auto yarn", rope, 16384, "", 0, 16384, "yarn", 0.25},
+		{"linear", rope, 8192, "linear", 0, 8192, "linear", 0.5},
+		{"explicit scale", rope, 8192, "", 0.125, 8192, "yarn", 0.125},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumCtx = tt.numCtx
+			opts.RopeScalingType = tt.ropeType
+			opts.RopeFrequencyScale = tt.ropeScale
+
+			require.NoError(t, ropeScaling(ggml(tt.kv), &opts))
+			assert.Equal(t, tt.wantCtx, opts.NumCtx)
+			assert.Equal(t, tt.wantType, opts.RopeScalingType)
+			assert.Equal(t, tt.wantScale, opts.RopeFrequencyScale)
+		})
+	}
+
+	// longer contexts which can't be scaled are rejected rather than truncated
+	for name, tt := range map[string]struct {
+		kv       KV
+		ropeType string
+	}{
+		"none":    {rope, "none"},
+		"no rope": {KV{"llama.context_length": uint32(4096)}, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts := api.DefaultOptions()
+			opts.NumCtx = 8192
+			opts.RopeScalingType = tt.ropeType
+
+			err := ropeScaling(ggml(tt.kv), &opts)
+			assert.ErrorIs(t, err, api.ErrInvalidOpts)
+			assert.Equal(t, 8192, opts.NumCtx)
+		})
+	}
+
+	t.Run("invalid type", func(t *testing.T) {
+		opts := api.DefaultOptions()
+		opts.RopeScalingType = "ntk"
+
+		var optErr *api.OptionError
+		err := ropeScaling(ggml(rope), &opts)
+		require.ErrorAs(t, err, &optErr)
+		assert.Equal(t, "rope_scaling_type", optErr.Option)
+		assert.ErrorIs(t, err, api.ErrInvalidOpts)
+	})
+}
+
+func TestApplyKVOverrides(t *testing.T) {
+	ggml := &GGML{Model: &GGUFModel{KV: KV{
+		"general.architecture":   "llama",
+		"llama.context_length":   uint32(4096),
+		"llama.rope.freq_base":   float32(10000),
+		"llama.expert_count":     int32(8),
+		"tokenizer.ggml.add_bos": true,
+	}}}
+
+	require.NoError(t, applyKVOverrides(ggml, []string{
+		"llama.context_length=int:8192",
+		"llama.rope.freq_base=float:500000",
+		"llama.expert_count=int:4",
+		"tokenizer.ggml.add_bos=bool:false",
+		"llama.rope.dimension_count=int:128",
+	}))
+
+	// overrides keep the type of the value they replace
+	kv := ggml.KV()
+	assert.Equal(t, uint32(8192), kv["llama.context_length"])
+	assert.Equal(t, float32(500000), kv["llama.rope.freq_base"])
+	assert.Equal(t, int32(4), kv["llama.expert_count"])
+	assert.Equal(t, false, kv["tokenizer.ggml.add_bos"])
+	assert.Equal(t, uint32(128), kv["llama.rope.dimension_count"])
+	assert.Equal(t, uint32(8192), ggml.NumCtx())
+
+	assert.ErrorIs(t, applyKVOverrides(ggml, []string{"llama.context_length=str:8192"}), api.ErrInvalidOpts)
+}
+
+func TestNewInfill(t *testing.T) {
+	ggml := func(kv KV) *GGML {
+		return &GGML{Model: &GGUFModel{KV: kv}}
+	}
+
+	cases := []struct {
+		name string
+		kv   KV
+		want *infill
+	}{
+		{
+			"metadata",
+			KV{"tokenizer.ggml.prefix_token_id": uint32(1), "tokenizer.ggml.suffix_token_id": uint32(2), "tokenizer.ggml.middle_token_id": uint32(3)},
+			&infill{1, 2, 3},
+		},
+		{
+			"codellama tokens",
+			KV{"tokenizer.ggml.tokens": []any{"<s>", "▁<PRE>", "▁<MID>", "▁<SUF>"}},
+			&infill{1, 3, 2},
+		},
+		{
+			"starcoder tokens",
+			KV{"tokenizer.ggml.tokens": []any{"<|endoftext|>", "<fim_prefix>", "<fim_middle>", "<fim_suffix>"}},
+			&infill{1, 3, 2},
+		},
+		{
+			"no infill",
+			KV{"tokenizer.ggml.tokens": []any{"<s>", "</s>", "<fim_prefix>"}},
+			nil,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newInfill(ggml(tt.kv)))
+		})
+	}
+}
+
+func TestLayerSizes(t *testing.T) {
+	// F32 tensors of n elements are 4n bytes
+	tensor := func(name string, n uint64) Tensor {
+		return Tensor{Name: name, Kind: 0, Shape: []uint64{n}}
+	}
+
+	ggml := &GGML{Model: &GGUFModel{
+		KV: KV{
+			"general.architecture":    "llama",
+			"llama.block_count":       uint32(2),
+			"llama.expert_count":      uint32(8),
+			"llama.expert_used_count": uint32(2),
+		},
+		Tensors: []Tensor{
+			tensor("token_embd.weight", 1000),
+			tensor("blk.0.attn_q.weight", 10),
+			tensor("blk.0.ffn_gate_inp.weight", 1),
+			tensor("blk.0.ffn_gate_exps.weight", 100),
+			tensor("blk.0.ffn_down_exps.weight", 100),
+			tensor("blk.1.attn_q.weight", 10),
+			tensor("blk.1.ffn_up.0.weight", 50),
+			tensor("blk.1.ffn_up.1.weight", 50),
+			tensor("output_norm.weight", 2),
+			tensor("output.weight", 20),
+		},
+	}}
+
+	assert.Equal(t, []layerSize{{44, 800}, {40, 400}, {88, 0}}, ggml.layerSizes())
+	assert.Equal(t, uint32(8), ggml.NumExpert())
+	assert.Equal(t, uint32(2), ggml.NumExpertUsed())
+}
+
+func TestGPULayers(t *testing.T) {
+	sizes := []layerSize{{10, 90}, {10, 90}, {10, 90}, {50, 0}}
+
+	cases := []struct {
+		name    string
+		avg     int64
+		devices int64
+		want    int
+	}{
+		{"none", 50, 1, 0},
+		{"one block", 120, 1, 1},
+		{"every block", 340, 1, 3},
+		{"everything", 400, 1, 4},
+		{"split between devices", 200, 2, 3},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			// a kv cache of 40 is 10 per layer
+			assert.Equal(t, tt.want, gpuLayers(sizes, 40, 10, tt.avg, tt.devices))
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	ggml := &GGML{Model: &GGUFModel{
+		KV: KV{
+			"general.architecture":          "llama",
+			"llama.block_count":             uint32(2),
+			"llama.embedding_length":        uint32(8),
+			"llama.attention.head_count":    uint32(2),
+			"llama.attention.head_count_kv": uint32(1),
+		},
+	}, Size: 1000}
+
+	// 2 bytes * (k, v) * 16 tokens * 2 layers * 8 / 2 heads * 1 kv head
+	mem := ggml.Memory(16)
+	assert.Equal(t, Memory{Weights: 1000, KV: 512, Graph: 170}, mem)
+	assert.Equal(t, int64(1682), mem.Total())
+
+	assert.Equal(t, 0, ggml.GPULayers(mem, 100, 1))
+	assert.Equal(t, 3, ggml.GPULayers(mem, 10000, 1))
+	assert.Equal(t, 0, ggml.GPULayers(mem, 10000, 0))
+
+	assert.Equal(t, "llama", ggml.KV()["general.architecture"])
+}
+
+func TestVRAMSize(t *testing.T) {
+	mem := Memory{Weights: 800, KV: 150, Graph: 50}
+	cuda := gpu.GpuInfo{Library: "cuda"}
+
+	assert.Equal(t, int64(0), vramSize(mem, 10, gpu.GpuInfo{Library: "cpu"}, 10))
+	assert.Equal(t, int64(0), vramSize(mem, 10, cuda, 0))
+	assert.Equal(t, int64(400), vramSize(mem, 10, cuda, 4))
+
+	// all the layers are offloaded on macOS
+	assert.Equal(t, int64(1000), vramSize(mem, 10, gpu.GpuInfo{Library: "metal"}, 999))
+}
+
+func TestArchitectures(t *testing.T) {
+	t.Run("head size", func(t *testing.T) {
+		ggml := &GGML{Model: &GGUFModel{KV: KV{
+			"general.architecture":           "gemma2",
+			"gemma2.context_length":          uint32(8192),
+			"gemma2.block_count":             uint32(2),
+			"gemma2.embedding_length":        uint32(8),
+			"gemma2.attention.head_count":    uint32(2),
+			"gemma2.attention.head_count_kv": uint32(1),
+			"gemma2.attention.key_length":    uint32(16),
+			"gemma2.attention.value_length":  uint32(16),
+		}}}
+
+		require.NoError(t, ggml.checkKeys())
+
+		// 2 bytes * 16 tokens * 2 layers * 1 kv head * (16 + 16)
+		assert.Equal(t, int64(2048), ggml.Memory(16).KV)
+	})
+
+	t.Run("missing keys", func(t *testing.T) {
+		ggml := &GGML{Model: &GGUFModel{KV: KV{
+			"general.architecture":        "gemma2",
+			"gemma2.context_length":       uint32(8192),
+			"gemma2.block_count":          uint32(2),
+			"gemma2.embedding_length":     uint32(8),
+			"gemma2.attention.head_count": uint32(2),
+		}}}
+
+		assert.ErrorContains(t, ggml.checkKeys(), "gemma2.attention.key_length")
+	})
+
+	t.Run("mamba", func(t *testing.T) {
+		ggml := &GGML{Model: &GGUFModel{KV: KV{
+			"general.architecture":  "mamba",
+			"mamba.block_count":     uint32(2),
+			"mamba.ssm.conv_kernel": uint32(4),
+			"mamba.ssm.inner_size":  uint32(8),
+			"mamba.ssm.state_size":  uint32(16),
+		}}}
+
+		// 4 bytes * 2 layers * 8 * (3 + 16), for any context window
+		assert.Equal(t, int64(1216), ggml.Memory(16).KV)
+		assert.Equal(t, int64(1216), ggml.Memory(4096).KV)
+		assert.True(t, ggml.architecture().CPUOnly)
+	})
+
+	t.Run("registered", func(t *testing.T) {
+		RegisterArchitecture("test", Architecture{
+			Keys: []string{"block_count"},
+			Memory: func(ggml *GGML, numCtx int) Memory {
+				return Memory{Weights: ggml.Size, KV: int64(numCtx)}
+			},
+		})
+		defer func() {
+			architectures.mu.Lock()
+			defer architectures.mu.Unlock()
+			delete(architectures.byName, "test")
+		}()
+
+		ggml := &GGML{Model: &GGUFModel{KV: KV{"general.architecture": "test"}}, Size: 10}
+		assert.ErrorContains(t, ggml.checkKeys(), "test.block_count")
+		assert.Equal(t, Memory{Weights: 10, KV: 16}, ggml.Memory(16))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		ggml := &GGML{Model: &GGUFModel{KV: KV{"general.architecture": "unknown"}}}
+		assert.NoError(t, ggml.checkKeys())
+	})
+}
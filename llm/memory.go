@@ -0,0 +1,164 @@
+package llm
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// layerSize is the size of the weights of a layer. The feed forward networks
+// of mixture-of-experts models are counted separately so how much of the model
+// they are can be reported. llama.cpp offloads whole layers, so the experts of
+// a layer are placed with the rest of it rather than kept in system memory.
+type layerSize struct {
+	shared  int64
+	experts int64
+}
+
+func (s layerSize) total() int64 {
+	return s.shared + s.experts
+}
+
+// expertTensor matches the weights of the experts of a layer, either all of
+// them (ffn_gate_exps) or one of them (ffn_gate.0). The router, ffn_gate_inp,
+// is shared.
+var expertTensor = regexp.MustCompile(`^ffn_(gate|up|down)(_exps|\.\d+)\.`)
+
+// layerSizes returns the size of each block of the model followed by the
+// output layer, in the order llama.cpp offloads them to the GPU. The token
+// embeddings stay on the CPU so they aren't included. Models without a tensor
+// table are assumed to have layers of equal size.
+func (ggml *GGML) layerSizes() []layerSize {
+	n := int(ggml.NumLayers())
+	sizes := make([]layerSize, n+1)
+
+	gguf, ok := ggml.Model.(*GGUFModel)
+	if !ok || len(gguf.Tensors) == 0 {
+		for i := range sizes {
+			sizes[i].shared = ggml.Size / int64(n+1)
+		}
+
+		return sizes
+	}
+
+	for _, t := range gguf.Tensors {
+		name, ok := strings.CutPrefix(t.Name, "blk.")
+		if !ok {
+			if !strings.HasPrefix(t.Name, "token_embd") {
+				sizes[n].shared += int64(t.Size())
+			}
+			continue
+		}
+
+		index, name, _ := strings.Cut(name, ".")
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= n {
+			continue
+		}
+
+		if expertTensor.MatchString(name) {
+			sizes[i].experts += int64(t.Size())
+		} else {
+			sizes[i].shared += int64(t.Size())
+		}
+	}
+
+	return sizes
+}
+
+// NumExpert returns the number of experts of a mixture-of-experts model, or
+// 0 for other models
+func (ggml *GGML) NumExpert() uint32 {
+	return ggml.kvUint32("expert_count")
+}
+
+// NumExpertUsed returns the number of experts used for each token
+func (ggml *GGML) NumExpertUsed() uint32 {
+	return ggml.kvUint32("expert_used_count")
+}
+
+func (ggml *GGML) kvUint32(key string) uint32 {
+	gguf, ok := ggml.Model.(*GGUFModel)
+	if !ok {
+		return 0
+	}
+
+	value, _ := gguf.KV[fmt.Sprintf("%s.%s", ggml.ModelFamily(), key)].(uint32)
+	return value
+}
+
+// Memory is an estimate of the memory a model needs to run
+type Memory struct {
+	// Weights is the size of the model's tensors
+	Weights int64
+
+	// KV is the size of the kv cache for the context window
+	KV int64
+
+	// Graph is the size of the compute graph
+	Graph int64
+}
+
+// Total is the memory needed to run the model entirely on one device
+func (m Memory) Total() int64 {
+	return m.Weights + m.KV + m.Graph
+}
+
+// Memory estimates the memory the model needs with a context window of
+// numCtx tokens, using the memory model of its architecture
+func (ggml *GGML) Memory(numCtx int) Memory {
+	if memory := ggml.architecture().Memory; memory != nil {
+		return memory(ggml, numCtx)
+	}
+
+	return transformerMemory(ggml, numCtx)
+}
+
+// GPULayers returns how many layers of the model fit on devices GPUs with
+// vram bytes of VRAM between them, or 0 if the compute graph and the kv
+// cache of the offloaded layers don't fit on the main GPU
+func (ggml *GGML) GPULayers(mem Memory, vram, devices int64) int {
+	if devices < 1 {
+		return 0
+	}
+
+	avg := vram / devices
+	layers := int64(gpuLayers(ggml.layerSizes(), mem.KV, mem.Graph, avg, devices))
+	if layers <= 0 || mem.Graph+mem.KV*layers/(int64(ggml.NumLayers())+1) > avg {
+		return 0
+	}
+
+	return int(layers)
+}
+
+// gpuLayers returns how many layers fit in the VRAM of each device, avg, when
+// the weights of each layer are split between devices. Layers are offloaded
+// from the last block as llama.cpp does, with the output layer last. kv is the
+// size of the whole kv cache, which is split by layer, and graph is the
+// compute graph, which has to fit on the main GPU.
+func gpuLayers(sizes []layerSize, kv, graph, avg, devices int64) int {
+	free := avg - graph
+	fits := func(size layerSize) bool {
+		free -= kv/int64(len(sizes)) + size.total()/devices
+		return free >= 0
+	}
+
+	blocks, output := sizes[:len(sizes)-1], sizes[len(sizes)-1]
+
+	var layers int
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if !fits(blocks[i]) {
+			return layers
+		}
+
+		layers++
+	}
+
+	// the output layer is offloaded once every block is
+	if fits(output) {
+		layers++
+	}
+
+	return layers
+}
@@ -0,0 +1,73 @@
+package llm
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jmorganca/ollama/gpu"
+)
+
+const prefetchChunk = 32 * 1024 * 1024
+
+// freeSystemMemory returns the bytes of system memory which are free, replaced
+// by tests
+var freeSystemMemory = gpu.FreeSystemMemory
+
+// Prefetch reads a model file ahead of loading it so the runner's mmap of it
+// is served from the page cache. Chunks of the file are read in parallel,
+// which large models on fast disks need to be read at the speed of the disk.
+// fn is called with the bytes read so far as each chunk is read. Files larger
+// than the free memory aren't read, as the end of the file would evict the
+// start from the page cache before it's loaded.
+func Prefetch(ctx context.Context, path string, fn func(completed, total int64)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	total := fi.Size()
+	if free := freeSystemMemory(); free > 0 && uint64(total) > free {
+		slog.Debug("not prefetching a model larger than the free memory", "path", path, "size", total, "free", free)
+		return nil
+	}
+
+	var mu sync.Mutex
+	var completed int64
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(min(runtime.NumCPU(), 8))
+	for offset := int64(0); offset < total; offset += prefetchChunk {
+		offset := offset
+		g.Go(func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			n, err := io.CopyBuffer(io.Discard, io.NewSectionReader(f, offset, min(prefetchChunk, total-offset)), make([]byte, 1024*1024))
+			if err != nil {
+				return err
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			completed += n
+			fn(completed, total)
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
@@ -0,0 +1,41 @@
+package llm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/gpu"
+)
+
+func TestPrefetch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model")
+	assert.Nil(t, os.WriteFile(path, make([]byte, 2*prefetchChunk+10), 0o644))
+
+	var calls int
+	var last int64
+	assert.Nil(t, Prefetch(context.Background(), path, func(completed, total int64) {
+		calls++
+		assert.Greater(t, completed, last)
+		assert.Equal(t, int64(2*prefetchChunk+10), total)
+		last = completed
+	}))
+
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, int64(2*prefetchChunk+10), last)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, Prefetch(ctx, path, func(int64, int64) {}), context.Canceled)
+
+	// models which don't fit in the free memory aren't read
+	freeSystemMemory = func() uint64 { return prefetchChunk }
+	t.Cleanup(func() { freeSystemMemory = gpu.FreeSystemMemory })
+
+	calls = 0
+	assert.Nil(t, Prefetch(context.Background(), path, func(int64, int64) { calls++ }))
+	assert.Zero(t, calls)
+}
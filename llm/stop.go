@@ -0,0 +1,122 @@
+package llm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// stopper finds stop sequences in streamed content. Text which could be the
+// start of a stop sequence is held back until it's ruled out, so clients never
+// see part of a stop sequence.
+//
+// Regular expressions can't be partially matched, so while regex stops are
+// set, text is held back until the end of each line.
+type stopper struct {
+	stops   []string
+	regexps []*regexp.Regexp
+	include bool
+
+	pending string
+}
+
+// newStopper returns a stopper for the options, or nil if the runner can
+// handle the stop sequences itself. decode converts stop tokens to text.
+func newStopper(opts api.Options, decode func([]int) (string, error)) (*stopper, error) {
+	if len(opts.StopRegex) == 0 && len(opts.StopTokens) == 0 && !opts.IncludeStop {
+		return nil, nil
+	}
+
+	s := stopper{include: opts.IncludeStop}
+	for _, stop := range opts.Stop {
+		if stop != "" {
+			s.stops = append(s.stops, stop)
+		}
+	}
+
+	for _, token := range opts.StopTokens {
+		stop, err := decode([]int{token})
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop token %d: %w", token, err)
+		}
+
+		if stop != "" {
+			s.stops = append(s.stops, stop)
+		}
+	}
+
+	for _, expr := range opts.StopRegex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stop regex %q: %w", expr, err)
+		}
+
+		s.regexps = append(s.regexps, re)
+	}
+
+	return &s, nil
+}
+
+// Write adds content and returns the text which can be sent to the client.
+// It reports true once a stop sequence has been found, after which the
+// returned text is the last to be sent.
+func (s *stopper) Write(content string) (string, bool) {
+	s.pending += content
+
+	start, end := -1, -1
+	for _, stop := range s.stops {
+		if i := strings.Index(s.pending, stop); i >= 0 && (start < 0 || i < start) {
+			start, end = i, i+len(stop)
+		}
+	}
+
+	for _, re := range s.regexps {
+		if loc := re.FindStringIndex(s.pending); loc != nil && loc[1] > loc[0] && (start < 0 || loc[0] < start) {
+			start, end = loc[0], loc[1]
+		}
+	}
+
+	if start >= 0 {
+		if s.include {
+			start = end
+		}
+
+		out := s.pending[:start]
+		s.pending = ""
+		return out, true
+	}
+
+	safe := len(s.pending)
+	for _, stop := range s.stops {
+		// hold back the longest suffix which is a prefix of the stop
+		for n := min(len(stop)-1, len(s.pending)); n > 0; n-- {
+			if strings.HasSuffix(s.pending, stop[:n]) {
+				safe = min(safe, len(s.pending)-n)
+				break
+			}
+		}
+	}
+
+	if len(s.regexps) > 0 {
+		safe = min(safe, strings.LastIndexByte(s.pending, '\n')+1)
+	}
+
+	// don't split a multi-byte character
+	for safe > 0 && safe < len(s.pending) && !utf8.RuneStart(s.pending[safe]) {
+		safe--
+	}
+
+	out := s.pending[:safe]
+	s.pending = s.pending[safe:]
+	return out, false
+}
+
+// Flush returns any text held back once generation has finished
+func (s *stopper) Flush() string {
+	out := s.pending
+	s.pending = ""
+	return out
+}
@@ -0,0 +1,103 @@
+package llm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestStopper(t *testing.T) {
+	decode := func(tokens []int) (string, error) {
+		return map[int]string{2: "</s>", 7: ""}[tokens[0]], nil
+	}
+
+	cases := []struct {
+		name    string
+		opts    api.Options
+		content []string
+		want    []string
+		stopped bool
+	}{
+		{
+			name:    "partial stop held back",
+			opts:    api.Options{Stop: []string{"User:"}, IncludeStop: false, StopTokens: []int{7}},
+			content: []string{"Hello", " Us", "e", "r: next"},
+			want:    []string{"Hello", " ", "", ""},
+			stopped: true,
+		},
+		{
+			name:    "partial stop released",
+			opts:    api.Options{Stop: []string{"User:"}, StopRegex: []string{`\d{3}`}},
+			content: []string{"Hi Us", "ually\n", "12", "3 ok"},
+			want:    []string{"", "Hi Usually\n", "", ""},
+			stopped: true,
+		},
+		{
+			name:    "include stop",
+			opts:    api.Options{Stop: []string{"END"}, IncludeStop: true},
+			content: []string{"done E", "ND more"},
+			want:    []string{"done ", "END"},
+			stopped: true,
+		},
+		{
+			name:    "stop token",
+			opts:    api.Options{StopTokens: []int{2}},
+			content: []string{"a</", "s>b"},
+			want:    []string{"a", ""},
+			stopped: true,
+		},
+		{
+			name:    "multi-byte",
+			opts:    api.Options{Stop: []string{"日本"}, IncludeStop: true},
+			content: []string{"こんにちは日", "曜日"},
+			want:    []string{"こんにちは", "日曜"},
+		},
+		{
+			name:    "regex",
+			opts:    api.Options{StopRegex: []string{`(?i)answer:`}},
+			content: []string{"line one\nthe ANS", "WER: 42"},
+			want:    []string{"line one\n", "the "},
+			stopped: true,
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newStopper(tt.opts, decode)
+			require.NoError(t, err)
+			require.NotNil(t, s)
+
+			var got []string
+			var stopped bool
+			for _, c := range tt.content {
+				var out string
+				out, stopped = s.Write(c)
+				got = append(got, out)
+				if stopped {
+					break
+				}
+			}
+
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.stopped, stopped)
+			if !stopped {
+				assert.Equal(t, strings.Join(tt.content, ""), strings.Join(got, "")+s.Flush())
+			}
+		})
+	}
+
+	t.Run("runner stops", func(t *testing.T) {
+		s, err := newStopper(api.Options{Stop: []string{"User:"}}, decode)
+		require.NoError(t, err)
+		assert.Nil(t, s)
+	})
+
+	t.Run("invalid regex", func(t *testing.T) {
+		_, err := newStopper(api.Options{StopRegex: []string{"("}}, decode)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,199 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// llamaTensorNames are the names Hugging Face and Meta checkpoints give the
+// tensors of llama models, and of the models with the same layout
+var llamaTensorNames = map[string]string{
+	"model.embed_tokens":       "token_embd",
+	"model.norm":               "output_norm",
+	"lm_head":                  "output",
+	"input_layernorm":          "attn_norm",
+	"self_attn.q_proj":         "attn_q",
+	"self_attn.k_proj":         "attn_k",
+	"self_attn.v_proj":         "attn_v",
+	"self_attn.o_proj":         "attn_output",
+	"post_attention_layernorm": "ffn_norm",
+	"mlp.gate_proj":            "ffn_gate",
+	"mlp.up_proj":              "ffn_up",
+	"mlp.down_proj":            "ffn_down",
+
+	"tok_embeddings":  "token_embd",
+	"norm":            "output_norm",
+	"attention_norm":  "attn_norm",
+	"attention.wq":    "attn_q",
+	"attention.wk":    "attn_k",
+	"attention.wv":    "attn_v",
+	"attention.wo":    "attn_output",
+	"feed_forward.w1": "ffn_gate",
+	"feed_forward.w2": "ffn_down",
+	"feed_forward.w3": "ffn_up",
+}
+
+// phi3TensorNames are the names Hugging Face checkpoints give the tensors of
+// phi3 models, which have their q, k and v, and gate and up, tensors fused
+var phi3TensorNames = map[string]string{
+	"model.embed_tokens":       "token_embd",
+	"model.norm":               "output_norm",
+	"lm_head":                  "output",
+	"input_layernorm":          "attn_norm",
+	"self_attn.qkv_proj":       "attn_qkv",
+	"self_attn.o_proj":         "attn_output",
+	"post_attention_layernorm": "ffn_norm",
+	"mlp.gate_up_proj":         "ffn_up",
+	"mlp.down_proj":            "ffn_down",
+}
+
+// blockTensor matches the name of a tensor of a block, with the prefixes
+// converters give blocks
+var blockTensor = regexp.MustCompile(`^(?:model\.layers|layers|transformer\.h|blk)\.(\d+)\.(.+)$`)
+
+// llamaCppTensor matches the names llama.cpp loads tensors by, including the
+// experts of older Mixtral conversions, which are numbered after their name
+// such as blk.0.ffn_gate.1.weight
+var llamaCppTensor = regexp.MustCompile(`^(?:token_embd|token_embd_norm|token_types|position_embd|output|output_norm|rope_freqs|rope_factors_long|rope_factors_short|blk\.\d+\.\w+(?:\.\d+)?)\.(?:weight|bias)$`)
+
+// MapTensorNames returns the llama.cpp names of the tensors of the model
+// which are named by another converter, and the tensors which aren't named
+// by llama.cpp but can't be renamed, which llama.cpp would fail to load. Only
+// models of architectures with TensorNames are mapped.
+func (ggml *GGML) MapTensorNames() (renames map[string]string, unmapped []string) {
+	names := ggml.architecture().TensorNames
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	tensors := ggml.Tensors()
+	exists := make(map[string]bool, len(tensors))
+	for _, t := range tensors {
+		exists[t.Name] = true
+	}
+
+	renames = make(map[string]string)
+	for _, t := range tensors {
+		if llamaCppTensor.MatchString(t.Name) {
+			continue
+		}
+
+		// a tensor renamed to one which exists already would be loaded twice
+		name, ok := mapTensorName(t.Name, names)
+		if !ok || exists[name] {
+			unmapped = append(unmapped, t.Name)
+			continue
+		}
+
+		renames[t.Name] = name
+		exists[name] = true
+	}
+
+	return renames, unmapped
+}
+
+// PermutedTensors returns the tensors of the model which are in the order
+// another converter stores them in, rather than the one llama.cpp loads them
+// in, so the model has to be converted again with llama.cpp
+func (ggml *GGML) PermutedTensors() []string {
+	permuted := ggml.architecture().PermutedTensors
+	if len(permuted) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, t := range ggml.Tensors() {
+		base := strings.TrimSuffix(strings.TrimSuffix(t.Name, ".weight"), ".bias")
+		if m := blockTensor.FindStringSubmatch(base); m != nil && slices.Contains(permuted, m[2]) {
+			names = append(names, t.Name)
+		}
+	}
+
+	return names
+}
+
+// mapTensorName returns the llama.cpp name of a tensor, keeping its block
+// number and whether it's a weight or a bias
+func mapTensorName(name string, names map[string]string) (string, bool) {
+	i := strings.LastIndex(name, ".")
+	if i < 0 {
+		return "", false
+	}
+
+	base, suffix := name[:i], name[i+1:]
+	if suffix != "weight" && suffix != "bias" {
+		return "", false
+	}
+
+	if m := blockTensor.FindStringSubmatch(base); m != nil {
+		block, base := m[1], m[2]
+		if to, ok := names[base]; ok {
+			return fmt.Sprintf("blk.%s.%s.%s", block, to, suffix), true
+		}
+
+		// only the prefix of the block is different
+		if !strings.Contains(base, ".") {
+			return fmt.Sprintf("blk.%s.%s.%s", block, base, suffix), true
+		}
+
+		return "", false
+	}
+
+	to, ok := names[base]
+	if !ok {
+		return "", false
+	}
+
+	return to + "." + suffix, true
+}
+
+// RenameTensors returns the model read from sr with its tensors renamed. Only
+// the tensor table changes, so the data of the tensors is copied as it is.
+func (ggml *GGML) RenameTensors(sr *io.SectionReader, renames map[string]string) (io.Reader, error) {
+	gguf, ok := ggml.Model.(*GGUFModel)
+	if !ok || gguf.Version < 2 {
+		return nil, errors.New("only the tensors of gguf v2 and later models can be renamed")
+	}
+
+	// the header and metadata are kept, the counts of tensors and metadata
+	// don't change
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, io.NewSectionReader(sr, 0, gguf.tensorsOffset)); err != nil {
+		return nil, err
+	}
+
+	r := io.NewSectionReader(sr, gguf.tensorsOffset, gguf.dataOffset-gguf.tensorsOffset)
+	for range gguf.Tensors {
+		name, err := gguf.readString(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if to, ok := renames[name]; ok {
+			name = to
+		}
+
+		// the shape, kind and offset of the tensor follow its dimensions
+		dims := gguf.readU32(r)
+		rest := make([]byte, 8*int64(dims)+4+8)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return nil, err
+		}
+
+		binary.Write(&b, gguf.ByteOrder, uint64(len(name)))
+		b.WriteString(name)
+		binary.Write(&b, gguf.ByteOrder, dims)
+		b.Write(rest)
+	}
+
+	alignment := gguf.alignment()
+	b.Write(make([]byte, (alignment-int64(b.Len())%alignment)%alignment))
+
+	return io.MultiReader(&b, io.NewSectionReader(sr, gguf.dataOffset, sr.Size()-gguf.dataOffset)), nil
+}
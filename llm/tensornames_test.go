@@ -0,0 +1,164 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestGGUF writes a gguf v3 model of arch with a 4 float tensor of each
+// of names
+func writeTestGGUF(t *testing.T, arch string, names ...string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	write := func(v any) {
+		require.NoError(t, binary.Write(&b, binary.LittleEndian, v))
+	}
+
+	writeString := func(s string) {
+		write(uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	b.WriteString("GGUF")
+	write(uint32(3))
+	write(uint64(len(names)))
+	write(uint64(1))
+
+	writeString("general.architecture")
+	write(GGUFTypeString)
+	writeString(arch)
+
+	for i, name := range names {
+		writeString(name)
+		write(uint32(1))
+		write(uint64(4))
+		write(uint32(0))
+		write(uint64(i * 32))
+	}
+
+	b.Write(make([]byte, (32-b.Len()%32)%32))
+	for i := range names {
+		write([]float32{float32(i), 1, 2, 3})
+		b.Write(make([]byte, 16))
+	}
+
+	return b.Bytes()
+}
+
+func TestMapTensorNames(t *testing.T) {
+	cases := []struct {
+		name     string
+		arch     string
+		tensors  []string
+		renames  map[string]string
+		unmapped []string
+	}{
+		{
+			name:    "llama.cpp names",
+			arch:    "llama",
+			tensors: []string{"token_embd.weight", "blk.0.attn_q.weight", "output_norm.weight"},
+			renames: map[string]string{},
+		},
+		{
+			name:    "numbered experts",
+			arch:    "llama",
+			tensors: []string{"blk.0.ffn_gate_inp.weight", "blk.0.ffn_gate.0.weight", "blk.0.ffn_down.7.weight"},
+			renames: map[string]string{},
+		},
+		{
+			name:    "hugging face names",
+			arch:    "llama",
+			tensors: []string{"model.embed_tokens.weight", "model.layers.0.self_attn.v_proj.weight", "model.layers.11.mlp.down_proj.weight", "lm_head.weight"},
+			renames: map[string]string{
+				"model.embed_tokens.weight":              "token_embd.weight",
+				"model.layers.0.self_attn.v_proj.weight": "blk.0.attn_v.weight",
+				"model.layers.11.mlp.down_proj.weight":   "blk.11.ffn_down.weight",
+				"lm_head.weight":                         "output.weight",
+			},
+		},
+		{
+			name:    "block prefix",
+			arch:    "qwen2",
+			tensors: []string{"model.layers.0.attn_q.bias", "blk.1.self_attn.k_proj.bias"},
+			renames: map[string]string{
+				"model.layers.0.attn_q.bias":  "blk.0.attn_q.bias",
+				"blk.1.self_attn.k_proj.bias": "blk.1.attn_k.bias",
+			},
+		},
+		{
+			name:     "unmapped",
+			arch:     "llama",
+			tensors:  []string{"model.layers.0.self_attn.rotary_emb.inv_freq", "model.embed_tokens.weight", "token_embd.weight"},
+			renames:  map[string]string{},
+			unmapped: []string{"model.layers.0.self_attn.rotary_emb.inv_freq", "model.embed_tokens.weight"},
+		},
+		{
+			name:    "unregistered architecture",
+			arch:    "bert",
+			tensors: []string{"embeddings.word_embeddings.weight"},
+		},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ggml, err := DecodeGGML(bytes.NewReader(writeTestGGUF(t, tt.arch, tt.tensors...)))
+			require.NoError(t, err)
+
+			renames, unmapped := ggml.MapTensorNames()
+			assert.Equal(t, tt.renames, renames)
+			assert.Equal(t, tt.unmapped, unmapped)
+		})
+	}
+}
+
+func TestPermutedTensors(t *testing.T) {
+	ggml, err := DecodeGGML(bytes.NewReader(writeTestGGUF(t, "llama", "model.layers.0.self_attn.q_proj.weight", "model.layers.0.self_attn.k_proj.weight", "model.layers.0.self_attn.v_proj.weight", "attention.wq.weight")))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"model.layers.0.self_attn.q_proj.weight", "model.layers.0.self_attn.k_proj.weight"}, ggml.PermutedTensors())
+
+	// qwen2 checkpoints aren't permuted
+	ggml, err = DecodeGGML(bytes.NewReader(writeTestGGUF(t, "qwen2", "model.layers.0.self_attn.q_proj.weight")))
+	require.NoError(t, err)
+	assert.Empty(t, ggml.PermutedTensors())
+}
+
+func TestRenameTensors(t *testing.T) {
+	b := writeTestGGUF(t, "llama", "model.embed_tokens.weight", "model.layers.0.self_attn.v_proj.weight")
+	ggml, err := DecodeGGML(bytes.NewReader(b))
+	require.NoError(t, err)
+
+	renames, unmapped := ggml.MapTensorNames()
+	require.Empty(t, unmapped)
+
+	sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+	r, err := ggml.RenameTensors(sr, renames)
+	require.NoError(t, err)
+
+	renamed, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	ggml, err = DecodeGGML(bytes.NewReader(renamed))
+	require.NoError(t, err)
+	assert.Equal(t, "llama", ggml.ModelFamily())
+
+	var names []string
+	for _, t := range ggml.Tensors() {
+		names = append(names, t.Name)
+	}
+	assert.Equal(t, []string{"token_embd.weight", "blk.0.attn_v.weight"}, names)
+
+	// the data of the tensors is the same, after the longer tensor table
+	gguf := ggml.Model.(*GGUFModel)
+	assert.Zero(t, gguf.dataOffset%32)
+	assert.Equal(t, b[len(b)-64:], renamed[gguf.dataOffset:])
+
+	renames, unmapped = ggml.MapTensorNames()
+	assert.Empty(t, renames)
+	assert.Empty(t, unmapped)
+}
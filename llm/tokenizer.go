@@ -0,0 +1,381 @@
+package llm
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrUnsupportedTokenizer = errors.New("unsupported tokenizer")
+
+// ErrInvalidToken is returned when decoding a token which isn't in the vocabulary
+var ErrInvalidToken = errors.New("invalid token")
+
+const (
+	tokenTypeNormal = iota + 1
+	tokenTypeUnknown
+	tokenTypeControl
+	tokenTypeUserDefined
+	tokenTypeUnused
+	tokenTypeByte
+)
+
+// Tokenizer converts between text and tokens using the vocabulary stored in a
+// model's GGUF metadata, so prompts can be measured without loading the model.
+// It supports SentencePiece ("llama") and byte-level BPE ("gpt2") vocabularies.
+type Tokenizer struct {
+	model  string
+	tokens []string
+	types  []int32
+	scores []float32
+	ids    map[string]int
+	merges map[string]int
+	unk    int
+}
+
+func NewTokenizer(kv KV) (*Tokenizer, error) {
+	model, _ := kv["tokenizer.ggml.model"].(string)
+	if model != "llama" && model != "gpt2" {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedTokenizer, model)
+	}
+
+	tokens, ok := kv["tokenizer.ggml.tokens"].([]any)
+	if !ok {
+		return nil, errors.New("tokenizer.ggml.tokens not found")
+	}
+
+	t := Tokenizer{
+		model:  model,
+		tokens: make([]string, len(tokens)),
+		types:  make([]int32, len(tokens)),
+		scores: make([]float32, len(tokens)),
+		ids:    make(map[string]int, len(tokens)),
+		merges: make(map[string]int),
+		unk:    -1,
+	}
+
+	for i, token := range tokens {
+		s, ok := token.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid token %d", i)
+		}
+
+		t.tokens[i] = s
+		t.types[i] = tokenTypeNormal
+		t.ids[s] = i
+	}
+
+	if types, ok := kv["tokenizer.ggml.token_type"].([]any); ok && len(types) == len(tokens) {
+		for i, v := range types {
+			if v, ok := v.(int32); ok {
+				t.types[i] = v
+			}
+		}
+	}
+
+	if scores, ok := kv["tokenizer.ggml.scores"].([]any); ok && len(scores) == len(tokens) {
+		for i, v := range scores {
+			if v, ok := v.(float32); ok {
+				t.scores[i] = v
+			}
+		}
+	}
+
+	if merges, ok := kv["tokenizer.ggml.merges"].([]any); ok {
+		for i, v := range merges {
+			if v, ok := v.(string); ok {
+				t.merges[v] = i
+			}
+		}
+	}
+
+	if unk, ok := kv["tokenizer.ggml.unknown_token_id"].(uint32); ok {
+		t.unk = int(unk)
+	}
+
+	return &t, nil
+}
+
+// Encode tokenizes s without adding a BOS token, the same as the runner's Encode
+func (t *Tokenizer) Encode(s string) ([]int, error) {
+	if s == "" {
+		return []int{}, nil
+	}
+
+	if t.model == "gpt2" {
+		var ids []int
+		for _, word := range splitGPT2(s) {
+			var sb strings.Builder
+			for _, b := range []byte(word) {
+				sb.WriteRune(gpt2ByteToRune[b])
+			}
+
+			encoded, err := t.merge(sb.String(), t.bpeRank, t.gpt2Fallback)
+			if err != nil {
+				return nil, err
+			}
+
+			ids = append(ids, encoded...)
+		}
+
+		return ids, nil
+	}
+
+	return t.merge("▁"+strings.ReplaceAll(s, " ", "▁"), t.spmScore, t.byteFallback)
+}
+
+// Decode converts tokens back into text
+func (t *Tokenizer) Decode(ids []int) (string, error) {
+	var sb strings.Builder
+	for _, id := range ids {
+		if id < 0 || id >= len(t.tokens) {
+			return "", fmt.Errorf("%w %d", ErrInvalidToken, id)
+		}
+
+		token := t.tokens[id]
+		switch t.types[id] {
+		case tokenTypeControl:
+		case tokenTypeUnknown:
+			sb.WriteString(" ⁇ ")
+		case tokenTypeByte:
+			var b byte
+			if _, err := fmt.Sscanf(token, "<0x%02X>", &b); err != nil {
+				return "", fmt.Errorf("invalid byte token %q", token)
+			}
+
+			sb.WriteByte(b)
+		default:
+			if t.model == "gpt2" {
+				for _, r := range token {
+					if b, ok := gpt2RuneToByte[r]; ok {
+						sb.WriteByte(b)
+					}
+				}
+			} else {
+				sb.WriteString(strings.ReplaceAll(token, "▁", " "))
+			}
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// spmScore ranks a SentencePiece merge by its token score, higher is better
+func (t *Tokenizer) spmScore(left, right string) (float32, bool) {
+	id, ok := t.ids[left+right]
+	if !ok {
+		return 0, false
+	}
+
+	return t.scores[id], true
+}
+
+// bpeRank ranks a BPE merge by its position in the merges list, earlier is better
+func (t *Tokenizer) bpeRank(left, right string) (float32, bool) {
+	rank, ok := t.merges[left+" "+right]
+	if !ok {
+		return 0, false
+	}
+
+	return -float32(rank), true
+}
+
+// byteFallback encodes a piece missing from a SentencePiece vocabulary as byte tokens
+func (t *Tokenizer) byteFallback(piece string) ([]int, error) {
+	var ids []int
+	for _, b := range []byte(piece) {
+		id, ok := t.ids[fmt.Sprintf("<0x%02X>", b)]
+		if !ok {
+			if t.unk < 0 {
+				return nil, fmt.Errorf("no token for byte 0x%02X", b)
+			}
+
+			id = t.unk
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// gpt2Fallback encodes a piece missing from a BPE vocabulary one byte at a time
+func (t *Tokenizer) gpt2Fallback(piece string) ([]int, error) {
+	var ids []int
+	for _, r := range piece {
+		id, ok := t.ids[string(r)]
+		if !ok {
+			if t.unk < 0 {
+				return nil, fmt.Errorf("no token for %q", r)
+			}
+
+			id = t.unk
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+type symbol struct {
+	text       string
+	prev, next int
+}
+
+type bigram struct {
+	left, right int
+	score       float32
+	size        int
+}
+
+type bigramQueue []bigram
+
+func (q bigramQueue) Len() int { return len(q) }
+
+func (q bigramQueue) Less(i, j int) bool {
+	if q[i].score == q[j].score {
+		return q[i].left < q[j].left
+	}
+
+	return q[i].score > q[j].score
+}
+
+func (q bigramQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *bigramQueue) Push(x any) { *q = append(*q, x.(bigram)) }
+
+func (q *bigramQueue) Pop() any {
+	old := *q
+	b := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return b
+}
+
+// merge splits s into characters and repeatedly merges the best ranked
+// adjacent pair until no more merges apply, the same as llama.cpp
+func (t *Tokenizer) merge(s string, rank func(string, string) (float32, bool), fallback func(string) ([]int, error)) ([]int, error) {
+	symbols := make([]symbol, 0, len(s))
+	for i, r := range s {
+		symbols = append(symbols, symbol{text: s[i : i+utf8.RuneLen(r)], prev: len(symbols) - 1, next: len(symbols) + 1})
+	}
+
+	if len(symbols) > 0 {
+		symbols[len(symbols)-1].next = -1
+	}
+
+	var q bigramQueue
+	tryAdd := func(left, right int) {
+		if left < 0 || right < 0 {
+			return
+		}
+
+		if score, ok := rank(symbols[left].text, symbols[right].text); ok {
+			heap.Push(&q, bigram{left: left, right: right, score: score, size: len(symbols[left].text) + len(symbols[right].text)})
+		}
+	}
+
+	for i := 1; i < len(symbols); i++ {
+		tryAdd(i-1, i)
+	}
+
+	for q.Len() > 0 {
+		b := heap.Pop(&q).(bigram)
+		left, right := &symbols[b.left], &symbols[b.right]
+
+		// skip pairs which have changed since they were queued
+		if left.text == "" || right.text == "" || len(left.text)+len(right.text) != b.size {
+			continue
+		}
+
+		left.text += right.text
+		right.text = ""
+		left.next = right.next
+		if right.next >= 0 {
+			symbols[right.next].prev = b.left
+		}
+
+		tryAdd(left.prev, b.left)
+		tryAdd(b.left, left.next)
+	}
+
+	var ids []int
+	for i := 0; i >= 0 && i < len(symbols); i = symbols[i].next {
+		if id, ok := t.ids[symbols[i].text]; ok {
+			ids = append(ids, id)
+			continue
+		}
+
+		fallback, err := fallback(symbols[i].text)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, fallback...)
+	}
+
+	return ids, nil
+}
+
+var gpt2Pattern = regexp.MustCompile(`'s|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+`)
+
+// splitGPT2 pre-tokenizes s with the GPT-2 pattern. Go's regexp doesn't support
+// lookahead so `\s+(?!\S)` is handled by leaving the last whitespace character
+// of a run for the word which follows it.
+func splitGPT2(s string) []string {
+	var words []string
+	for len(s) > 0 {
+		loc := gpt2Pattern.FindStringIndex(s)
+		if loc == nil || loc[0] != 0 {
+			// unreachable since every character matches the pattern
+			words = append(words, s)
+			break
+		}
+
+		end := loc[1]
+		if word := s[:end]; end < len(s) && strings.TrimFunc(word, unicode.IsSpace) == "" {
+			if _, size := utf8.DecodeLastRuneInString(word); size < len(word) {
+				end -= size
+			}
+		}
+
+		words = append(words, s[:end])
+		s = s[end:]
+	}
+
+	return words
+}
+
+var (
+	gpt2ByteToRune [256]rune
+	gpt2RuneToByte = make(map[rune]byte, 256)
+)
+
+func init() {
+	// printable bytes map to themselves, the rest are shifted past 255
+	n := 0
+	for b := 0; b < 256; b++ {
+		r := rune(b)
+		if !(b >= '!' && b <= '~') && !(b >= 0xa1 && b <= 0xac) && !(b >= 0xae && b <= 0xff) {
+			r = rune(256 + n)
+			n++
+		}
+
+		gpt2ByteToRune[b] = r
+		gpt2RuneToByte[r] = byte(b)
+	}
+}
+
+// Tokenizer returns a tokenizer for the vocabulary in the model's metadata
+func (ggml *GGML) Tokenizer() (*Tokenizer, error) {
+	gguf, ok := ggml.Model.(*GGUFModel)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedTokenizer, ggml.Name())
+	}
+
+	return NewTokenizer(gguf.KV)
+}
@@ -0,0 +1,84 @@
+package llm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tokenizerKV(model string, tokens []string, kv KV) KV {
+	values := make([]any, len(tokens))
+	for i, t := range tokens {
+		values[i] = t
+	}
+
+	kv["tokenizer.ggml.model"] = model
+	kv["tokenizer.ggml.tokens"] = values
+	return kv
+}
+
+func TestTokenizerSentencePiece(t *testing.T) {
+	tokens := []string{"<unk>", "<s>", "</s>", "▁", "h", "e", "l", "o", "▁h", "el", "ll", "lo", "▁he", "llo", "▁hello", "<0x21>"}
+	scores := map[string]float32{"▁h": -1, "el": -3, "ll": -2, "lo": -4, "▁he": -1.5, "llo": -1, "▁hello": -0.5}
+
+	types := make([]any, len(tokens))
+	values := make([]any, len(tokens))
+	for i, token := range tokens {
+		types[i] = int32(tokenTypeNormal)
+		values[i] = scores[token]
+	}
+	types[0] = int32(tokenTypeUnknown)
+	types[1] = int32(tokenTypeControl)
+	types[2] = int32(tokenTypeControl)
+	types[15] = int32(tokenTypeByte)
+
+	tokenizer, err := NewTokenizer(tokenizerKV("llama", tokens, KV{
+		"tokenizer.ggml.token_type": types,
+		"tokenizer.ggml.scores":     values,
+	}))
+	require.NoError(t, err)
+
+	ids, err := tokenizer.Encode("hello!")
+	require.NoError(t, err)
+	assert.Equal(t, []int{14, 15}, ids)
+
+	s, err := tokenizer.Decode(append([]int{1}, ids...))
+	require.NoError(t, err)
+	assert.Equal(t, " hello!", s)
+
+	_, err = tokenizer.Encode("?")
+	assert.Error(t, err)
+
+	_, err = tokenizer.Decode([]int{len(tokens)})
+	assert.Error(t, err)
+}
+
+func TestTokenizerBPE(t *testing.T) {
+	tokens := []string{"h", "e", "l", "o", "Ġ", "w", "r", "d", "he", "ll", "hell", "hello", "Ġw", "or", "Ġwor", "ld", "Ġworld"}
+	merges := []any{"h e", "l l", "he ll", "hell o", "Ġ w", "o r", "Ġw or", "l d", "Ġwor ld"}
+
+	tokenizer, err := NewTokenizer(tokenizerKV("gpt2", tokens, KV{"tokenizer.ggml.merges": merges}))
+	require.NoError(t, err)
+
+	ids, err := tokenizer.Encode("hello world")
+	require.NoError(t, err)
+	assert.Equal(t, []int{11, 16}, ids)
+
+	ids, err = tokenizer.Encode("hold")
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 3, 15}, ids)
+
+	s, err := tokenizer.Decode([]int{11, 16})
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", s)
+}
+
+func TestSplitGPT2(t *testing.T) {
+	assert.Equal(t, []string{"Hello", " ", " world", "'s", " 123", "!", "  "}, splitGPT2("Hello  world's 123!  "))
+}
+
+func TestTokenizerUnsupported(t *testing.T) {
+	_, err := NewTokenizer(tokenizerKV("bert", []string{"a"}, KV{}))
+	assert.ErrorIs(t, err, ErrUnsupportedTokenizer)
+}
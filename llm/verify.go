@@ -0,0 +1,208 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// TensorDigest is the digest of the data of a tensor. Offset is from the
+// start of the model.
+type TensorDigest struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// TensorError is returned for a tensor with data which is missing, invalid or
+// doesn't match its digest
+type TensorError struct {
+	Name string
+	Err  error
+}
+
+func (e *TensorError) Error() string {
+	return fmt.Sprintf("tensor %s: %v", e.Name, e.Err)
+}
+
+func (e *TensorError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	ErrTensorTruncated = errors.New("data is truncated")
+	ErrTensorNaN       = errors.New("data has NaN or infinite values")
+	ErrTensorDigest    = errors.New("digest mismatch")
+)
+
+// scaleOffsets are where the float16 scales are in each block of quantized
+// tensors. Quantized values can't be invalid but scales can be NaN or infinite.
+var scaleOffsets = map[uint32][]int{
+	2:  {0},      // Q4_0
+	3:  {0, 2},   // Q4_1
+	6:  {0},      // Q5_0
+	7:  {0, 2},   // Q5_1
+	8:  {0},      // Q8_0
+	10: {80, 82}, // Q2_K
+	11: {108},    // Q3_K
+	12: {0, 2},   // Q4_K
+	13: {0, 2},   // Q5_K
+	14: {208},    // Q6_K
+}
+
+// DigestTensors hashes the data of each tensor, in parallel, reading the
+// model from r. Tensors with data past the end of r, or with NaN or infinite
+// values, are reported with a TensorError so a bad conversion is caught
+// before the model is run.
+func (ggml *GGML) DigestTensors(ctx context.Context, r io.ReaderAt) ([]TensorDigest, error) {
+	gguf, ok := ggml.Model.(*GGUFModel)
+	if !ok {
+		return nil, nil
+	}
+
+	digests := make([]TensorDigest, len(gguf.Tensors))
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.NumCPU())
+	for i, t := range gguf.Tensors {
+		g.Go(func() error {
+			digest := TensorDigest{
+				Name:   t.Name,
+				Offset: gguf.dataOffset + int64(t.Offset),
+				Size:   int64(t.Size()),
+			}
+
+			d, err := checkTensor(ctx, r, digest, t.Kind, gguf.ByteOrder)
+			if err != nil {
+				return &TensorError{t.Name, err}
+			}
+
+			digest.Digest = d
+			digests[i] = digest
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// VerifyTensors checks the data of each tensor against the digests from
+// DigestTensors, in parallel. The first tensor found to be different is
+// reported with a TensorError.
+func VerifyTensors(ctx context.Context, r io.ReaderAt, digests []TensorDigest) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(runtime.NumCPU())
+	for _, digest := range digests {
+		g.Go(func() error {
+			d, err := checkTensor(ctx, r, digest, 0, nil)
+			if err != nil {
+				return &TensorError{digest.Name, err}
+			}
+
+			if d != digest.Digest {
+				return &TensorError{digest.Name, fmt.Errorf("%w: want %s, got %s", ErrTensorDigest, digest.Digest, d)}
+			}
+
+			return nil
+		})
+	}
+
+	return g.Wait()
+}
+
+// checkTensor returns the digest of the data of a tensor. If byteOrder is set,
+// the values of F32 and F16 tensors and the scales of quantized tensors of
+// kind are checked too.
+func checkTensor(ctx context.Context, r io.ReaderAt, digest TensorDigest, kind uint32, byteOrder binary.ByteOrder) (string, error) {
+	check := func([]byte) error { return nil }
+	if byteOrder != nil {
+		check = valueChecker(kind, byteOrder)
+	}
+
+	// read whole blocks at a time so values can be checked in each chunk
+	chunk := int64(1 << 20)
+	if t := (Tensor{Kind: kind}); byteOrder != nil && t.TypeSize() > 0 {
+		chunk -= chunk % int64(t.TypeSize())
+	}
+
+	h := sha256.New()
+	buf := make([]byte, chunk)
+	for n := int64(0); n < digest.Size; n += chunk {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		b := buf[:min(chunk, digest.Size-n)]
+		if _, err := r.ReadAt(b, digest.Offset+n); errors.Is(err, io.EOF) {
+			return "", ErrTensorTruncated
+		} else if err != nil {
+			return "", err
+		}
+
+		if err := check(b); err != nil {
+			return "", err
+		}
+
+		h.Write(b)
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// valueChecker returns a function which checks the values of a tensor of kind
+// aren't NaN or infinite
+func valueChecker(kind uint32, byteOrder binary.ByteOrder) func([]byte) error {
+	f16 := func(b []byte) bool {
+		// an exponent of all ones is NaN or infinity
+		return byteOrder.Uint16(b)&0x7c00 != 0x7c00
+	}
+
+	switch kind {
+	case 0: // F32
+		return func(b []byte) error {
+			for i := 0; i+4 <= len(b); i += 4 {
+				if byteOrder.Uint32(b[i:])&0x7f800000 == 0x7f800000 {
+					return ErrTensorNaN
+				}
+			}
+			return nil
+		}
+	case 1: // F16
+		return func(b []byte) error {
+			for i := 0; i+2 <= len(b); i += 2 {
+				if !f16(b[i:]) {
+					return ErrTensorNaN
+				}
+			}
+			return nil
+		}
+	}
+
+	offsets, ok := scaleOffsets[kind]
+	if !ok {
+		return func([]byte) error { return nil }
+	}
+
+	size := int(Tensor{Kind: kind}.TypeSize())
+	return func(b []byte) error {
+		for block := 0; block+size <= len(b); block += size {
+			for _, offset := range offsets {
+				if !f16(b[block+offset:]) {
+					return ErrTensorNaN
+				}
+			}
+		}
+		return nil
+	}
+}
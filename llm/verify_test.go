@@ -0,0 +1,72 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestTensors(t *testing.T) {
+	f32 := func(values ...float32) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, values)
+		return b.Bytes()
+	}
+
+	newGGML := func(data ...[]byte) (*GGML, []byte) {
+		gguf := &GGUFModel{ContainerGGUF: &ContainerGGUF{ByteOrder: binary.LittleEndian}, dataOffset: 32}
+		b := make([]byte, gguf.dataOffset)
+		for i, d := range data {
+			gguf.Tensors = append(gguf.Tensors, Tensor{
+				Name:   []string{"a.weight", "b.weight"}[i],
+				Kind:   0,
+				Offset: uint64(int64(len(b)) - gguf.dataOffset),
+				Shape:  []uint64{uint64(len(d) / 4)},
+			})
+			b = append(b, d...)
+		}
+
+		return &GGML{Model: gguf}, b
+	}
+
+	ggml, b := newGGML(f32(1, 2, 3), f32(4, 5))
+	digests, err := ggml.DigestTensors(context.Background(), bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Len(t, digests, 2)
+	assert.Equal(t, TensorDigest{"b.weight", 44, 8, digests[1].Digest}, digests[1])
+	require.NoError(t, VerifyTensors(context.Background(), bytes.NewReader(b), digests))
+
+	t.Run("mismatch", func(t *testing.T) {
+		corrupt := bytes.Clone(b)
+		corrupt[len(corrupt)-1] ^= 1
+
+		var tensorErr *TensorError
+		err := VerifyTensors(context.Background(), bytes.NewReader(corrupt), digests)
+		require.ErrorAs(t, err, &tensorErr)
+		assert.Equal(t, "b.weight", tensorErr.Name)
+		assert.ErrorIs(t, err, ErrTensorDigest)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		var tensorErr *TensorError
+		_, err := ggml.DigestTensors(context.Background(), bytes.NewReader(b[:len(b)-1]))
+		require.ErrorAs(t, err, &tensorErr)
+		assert.Equal(t, "b.weight", tensorErr.Name)
+		assert.ErrorIs(t, err, ErrTensorTruncated)
+	})
+
+	t.Run("nan", func(t *testing.T) {
+		ggml, b := newGGML(f32(1, float32(math.NaN()), 3), f32(4, 5))
+
+		var tensorErr *TensorError
+		_, err := ggml.DigestTensors(context.Background(), bytes.NewReader(b))
+		require.ErrorAs(t, err, &tensorErr)
+		assert.Equal(t, "a.weight", tensorErr.Name)
+		assert.ErrorIs(t, err, ErrTensorNaN)
+	})
+}
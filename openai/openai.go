@@ -48,6 +48,10 @@ type Usage struct {
 	TotalTokens      int `json:"total_tokens"`
 }
 
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
 type ResponseFormat struct {
 	Type string `json:"type"`
 }
@@ -56,6 +60,7 @@ type ChatCompletionRequest struct {
 	Model            string          `json:"model"`
 	Messages         []Message       `json:"messages"`
 	Stream           bool            `json:"stream"`
+	StreamOptions    *StreamOptions  `json:"stream_options"`
 	MaxTokens        *int            `json:"max_tokens"`
 	Seed             *int            `json:"seed"`
 	Stop             any             `json:"stop"`
@@ -64,6 +69,51 @@ type ChatCompletionRequest struct {
 	PresencePenalty  *float64        `json:"presence_penalty_penalty"`
 	TopP             *float64        `json:"top_p"`
 	ResponseFormat   *ResponseFormat `json:"response_format"`
+	N                *int            `json:"n"`
+}
+
+type CompletionRequest struct {
+	Model            string         `json:"model"`
+	Prompt           string         `json:"prompt"`
+	Suffix           string         `json:"suffix"`
+	Stream           bool           `json:"stream"`
+	StreamOptions    *StreamOptions `json:"stream_options"`
+	MaxTokens        *int           `json:"max_tokens"`
+	Seed             *int           `json:"seed"`
+	Stop             any            `json:"stop"`
+	Temperature      *float64       `json:"temperature"`
+	FrequencyPenalty *float64       `json:"frequency_penalty"`
+	PresencePenalty  *float64       `json:"presence_penalty"`
+	TopP             *float64       `json:"top_p"`
+}
+
+type CompleteChoice struct {
+	Index        int     `json:"index"`
+	Text         string  `json:"text"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type Completion struct {
+	Id                string           `json:"id"`
+	Object            string           `json:"object"`
+	Created           int64            `json:"created"`
+	Model             string           `json:"model"`
+	SystemFingerprint string           `json:"system_fingerprint"`
+	Choices           []CompleteChoice `json:"choices"`
+	Usage             Usage            `json:"usage,omitempty"`
+}
+
+type CompletionChunk struct {
+	Id                string           `json:"id"`
+	Object            string           `json:"object"`
+	Created           int64            `json:"created"`
+	Model             string           `json:"model"`
+	SystemFingerprint string           `json:"system_fingerprint"`
+	Choices           []CompleteChoice `json:"choices"`
+
+	// Usage and Timings are only set on the final chunk, when requested with stream_options
+	Usage   *Usage       `json:"usage,omitempty"`
+	Timings *api.Metrics `json:"timings,omitempty"`
 }
 
 type ChatCompletion struct {
@@ -83,6 +133,10 @@ type ChatCompletionChunk struct {
 	Model             string        `json:"model"`
 	SystemFingerprint string        `json:"system_fingerprint"`
 	Choices           []ChunkChoice `json:"choices"`
+
+	// Usage and Timings are only set on the final chunk, when requested with stream_options
+	Usage   *Usage       `json:"usage,omitempty"`
+	Timings *api.Metrics `json:"timings,omitempty"`
 }
 
 func NewError(code int, message string) ErrorResponse {
@@ -99,30 +153,61 @@ func NewError(code int, message string) ErrorResponse {
 	return ErrorResponse{Error{Type: etype, Message: message}}
 }
 
+func finishReason(done bool) *string {
+	if done {
+		reason := "stop"
+		return &reason
+	}
+	return nil
+}
+
 func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
+	messages := r.Choices
+	if len(messages) == 0 {
+		messages = []api.Message{r.Message}
+	}
+
+	choices := make([]Choice, len(messages))
+	for i, m := range messages {
+		choices[i] = Choice{
+			Index:        i,
+			Message:      Message{Role: m.Role, Content: m.Content},
+			FinishReason: finishReason(r.Done),
+		}
+	}
+
 	return ChatCompletion{
 		Id:                id,
 		Object:            "chat.completion",
 		Created:           r.CreatedAt.Unix(),
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
-		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content},
-			FinishReason: func(done bool) *string {
-				if done {
-					reason := "stop"
-					return &reason
-				}
-				return nil
-			}(r.Done),
-		}},
-		Usage: Usage{
-			// TODO: ollama returns 0 for prompt eval if the prompt was cached, but openai returns the actual count
-			PromptTokens:     r.PromptEvalCount,
-			CompletionTokens: r.EvalCount,
-			TotalTokens:      r.PromptEvalCount + r.EvalCount,
-		},
+		Choices:           choices,
+		Usage:             toUsage(r.Metrics),
+	}
+}
+
+func toUsage(m api.Metrics) Usage {
+	return Usage{
+		// TODO: ollama returns 0 for prompt eval if the prompt was cached, but openai returns the actual count
+		PromptTokens:     m.PromptEvalCount,
+		CompletionTokens: m.EvalCount,
+		TotalTokens:      m.PromptEvalCount + m.EvalCount,
+	}
+}
+
+// toUsageChunk returns the chunk sent after the last choice when usage was requested
+func toUsageChunk(id string, r api.ChatResponse) ChatCompletionChunk {
+	usage := toUsage(r.Metrics)
+	return ChatCompletionChunk{
+		Id:                id,
+		Object:            "chat.completion.chunk",
+		Created:           time.Now().Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices:           []ChunkChoice{},
+		Usage:             &usage,
+		Timings:           &r.Metrics,
 	}
 }
 
@@ -135,29 +220,102 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{
 			{
-				Index: 0,
-				Delta: Message{Role: "assistant", Content: r.Message.Content},
-				FinishReason: func(done bool) *string {
-					if done {
-						reason := "stop"
-						return &reason
-					}
-					return nil
-				}(r.Done),
+				Index:        r.Index,
+				Delta:        Message{Role: "assistant", Content: r.Message.Content},
+				FinishReason: finishReason(r.Done),
 			},
 		},
 	}
 }
 
+func toCompletion(id string, r api.GenerateResponse) Completion {
+	return Completion{
+		Id:                id,
+		Object:            "text_completion",
+		Created:           r.CreatedAt.Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices: []CompleteChoice{{
+			Index:        0,
+			Text:         r.Response,
+			FinishReason: finishReason(r.Done),
+		}},
+		Usage: toUsage(r.Metrics),
+	}
+}
+
+func toCompletionChunk(id string, r api.GenerateResponse) CompletionChunk {
+	return CompletionChunk{
+		Id:                id,
+		Object:            "text_completion",
+		Created:           time.Now().Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices: []CompleteChoice{{
+			Index:        0,
+			Text:         r.Response,
+			FinishReason: finishReason(r.Done),
+		}},
+	}
+}
+
+// toCompletionUsageChunk returns the chunk sent after the last choice when usage was requested
+func toCompletionUsageChunk(id string, r api.GenerateResponse) CompletionChunk {
+	usage := toUsage(r.Metrics)
+	return CompletionChunk{
+		Id:                id,
+		Object:            "text_completion",
+		Created:           time.Now().Unix(),
+		Model:             r.Model,
+		SystemFingerprint: "fp_ollama",
+		Choices:           []CompleteChoice{},
+		Usage:             &usage,
+		Timings:           &r.Metrics,
+	}
+}
+
 func fromRequest(r ChatCompletionRequest) api.ChatRequest {
 	var messages []api.Message
 	for _, msg := range r.Messages {
 		messages = append(messages, api.Message{Role: msg.Role, Content: msg.Content})
 	}
 
+	var format string
+	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
+		format = "json"
+	}
+
+	var n int
+	if r.N != nil {
+		n = *r.N
+	}
+
+	return api.ChatRequest{
+		Model:    r.Model,
+		Messages: messages,
+		Format:   format,
+		Options:  toOptions(r.Stop, r.MaxTokens, r.Seed, r.Temperature, r.FrequencyPenalty, r.PresencePenalty, r.TopP),
+		Stream:   &r.Stream,
+		N:        n,
+	}
+}
+
+func fromCompleteRequest(r CompletionRequest) api.GenerateRequest {
+	return api.GenerateRequest{
+		Model:   r.Model,
+		Prompt:  r.Prompt,
+		Suffix:  r.Suffix,
+		Raw:     true, // completions are of the prompt as is
+		Options: toOptions(r.Stop, r.MaxTokens, r.Seed, r.Temperature, r.FrequencyPenalty, r.PresencePenalty, r.TopP),
+		Stream:  &r.Stream,
+	}
+}
+
+// toOptions converts OpenAI's sampling parameters to options
+func toOptions(stop any, maxTokens, seed *int, temperature, frequencyPenalty, presencePenalty, topP *float64) map[string]interface{} {
 	options := make(map[string]interface{})
 
-	switch stop := r.Stop.(type) {
+	switch stop := stop.(type) {
 	case string:
 		options["stop"] = []string{stop}
 	case []interface{}:
@@ -170,58 +328,66 @@ func fromRequest(r ChatCompletionRequest) api.ChatRequest {
 		options["stop"] = stops
 	}
 
-	if r.MaxTokens != nil {
-		options["num_predict"] = *r.MaxTokens
+	if maxTokens != nil {
+		options["num_predict"] = *maxTokens
 	}
 
-	if r.Temperature != nil {
-		options["temperature"] = *r.Temperature * 2.0
+	if temperature != nil {
+		options["temperature"] = *temperature * 2.0
 	} else {
 		options["temperature"] = 1.0
 	}
 
-	if r.Seed != nil {
-		options["seed"] = *r.Seed
+	if seed != nil {
+		options["seed"] = *seed
 
 		// temperature=0 is required for reproducible outputs
 		options["temperature"] = 0.0
 	}
 
-	if r.FrequencyPenalty != nil {
-		options["frequency_penalty"] = *r.FrequencyPenalty * 2.0
+	if frequencyPenalty != nil {
+		options["frequency_penalty"] = *frequencyPenalty * 2.0
 	}
 
-	if r.PresencePenalty != nil {
-		options["presence_penalty"] = *r.PresencePenalty * 2.0
+	if presencePenalty != nil {
+		options["presence_penalty"] = *presencePenalty * 2.0
 	}
 
-	if r.TopP != nil {
-		options["top_p"] = *r.TopP
+	if topP != nil {
+		options["top_p"] = *topP
 	} else {
 		options["top_p"] = 1.0
 	}
 
-	var format string
-	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
-		format = "json"
-	}
+	return options
+}
 
-	return api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
-	}
+// baseWriter writes errors as OpenAI errors
+type baseWriter struct {
+	gin.ResponseWriter
 }
 
 type writer struct {
-	stream bool
-	id     string
-	gin.ResponseWriter
+	stream       bool
+	includeUsage bool
+	id           string
+	baseWriter
+
+	// choices is the number of choices streamed, each of which ends with a
+	// response with done set. metrics are those of the choices which are done.
+	choices int
+	done    int
+	metrics api.Metrics
+}
+
+type completeWriter struct {
+	stream       bool
+	includeUsage bool
+	id           string
+	baseWriter
 }
 
-func (w *writer) writeError(code int, data []byte) (int, error) {
+func (w *baseWriter) writeError(code int, data []byte) (int, error) {
 	var serr api.StatusError
 	err := json.Unmarshal(data, &serr)
 	if err != nil {
@@ -229,7 +395,13 @@ func (w *writer) writeError(code int, data []byte) (int, error) {
 	}
 
 	w.ResponseWriter.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w.ResponseWriter).Encode(NewError(http.StatusInternalServerError, serr.Error()))
+	resp := NewError(code, serr.Error())
+	if serr.Code != "" {
+		errorCode := string(serr.Code)
+		resp.Error.Code = &errorCode
+	}
+
+	err = json.NewEncoder(w.ResponseWriter).Encode(resp)
 	if err != nil {
 		return 0, err
 	}
@@ -259,6 +431,31 @@ func (w *writer) writeResponse(data []byte) (int, error) {
 		}
 
 		if chatResponse.Done {
+			// the usage is of every choice, and is sent after the last of
+			// them. The choices share the evaluation of the prompt, so its
+			// tokens are counted once.
+			promptEvalCount, evalCount := max(w.metrics.PromptEvalCount, chatResponse.PromptEvalCount), w.metrics.EvalCount+chatResponse.EvalCount
+			w.metrics = chatResponse.Metrics
+			w.metrics.PromptEvalCount, w.metrics.EvalCount = promptEvalCount, evalCount
+
+			w.done++
+			if w.done < w.choices {
+				return len(data), nil
+			}
+
+			chatResponse.Metrics = w.metrics
+			if w.includeUsage {
+				d, err := json.Marshal(toUsageChunk(w.id, chatResponse))
+				if err != nil {
+					return 0, err
+				}
+
+				_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+				if err != nil {
+					return 0, err
+				}
+			}
+
 			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
 			if err != nil {
 				return 0, err
@@ -287,6 +484,67 @@ func (w *writer) Write(data []byte) (int, error) {
 	return w.writeResponse(data)
 }
 
+func (w *completeWriter) writeResponse(data []byte) (int, error) {
+	var generateResponse api.GenerateResponse
+	err := json.Unmarshal(data, &generateResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	// completion chunk
+	if w.stream {
+		d, err := json.Marshal(toCompletionChunk(w.id, generateResponse))
+		if err != nil {
+			return 0, err
+		}
+
+		w.ResponseWriter.Header().Set("Content-Type", "text/event-stream")
+		_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+		if err != nil {
+			return 0, err
+		}
+
+		if generateResponse.Done {
+			if w.includeUsage {
+				d, err := json.Marshal(toCompletionUsageChunk(w.id, generateResponse))
+				if err != nil {
+					return 0, err
+				}
+
+				_, err = w.ResponseWriter.Write([]byte(fmt.Sprintf("data: %s\n\n", d)))
+				if err != nil {
+					return 0, err
+				}
+			}
+
+			_, err = w.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return len(data), nil
+	}
+
+	// completion
+	w.ResponseWriter.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w.ResponseWriter).Encode(toCompletion(w.id, generateResponse))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (w *completeWriter) Write(data []byte) (int, error) {
+	code := w.ResponseWriter.Status()
+	if code != http.StatusOK {
+		return w.writeError(code, data)
+	}
+
+	return w.writeResponse(data)
+}
+
 func Middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req ChatCompletionRequest
@@ -310,9 +568,51 @@ func Middleware() gin.HandlerFunc {
 		c.Request.Body = io.NopCloser(&b)
 
 		w := &writer{
-			ResponseWriter: c.Writer,
-			stream:         req.Stream,
-			id:             fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			baseWriter:   baseWriter{ResponseWriter: c.Writer},
+			stream:       req.Stream,
+			includeUsage: req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+			id:           fmt.Sprintf("chatcmpl-%d", rand.Intn(999)),
+			choices:      1,
+		}
+
+		if req.N != nil {
+			w.choices = max(*req.N, 1)
+		}
+
+		c.Writer = w
+
+		c.Next()
+	}
+}
+
+// CompletionsMiddleware converts /v1/completions requests to /api/generate
+// requests, and the responses back
+func CompletionsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req CompletionRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+
+		if req.Prompt == "" && req.Suffix == "" {
+			c.AbortWithStatusJSON(http.StatusBadRequest, NewError(http.StatusBadRequest, "prompt is required"))
+			return
+		}
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(fromCompleteRequest(req)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+
+		c.Request.Body = io.NopCloser(&b)
+
+		w := &completeWriter{
+			baseWriter:   baseWriter{ResponseWriter: c.Writer},
+			stream:       req.Stream,
+			includeUsage: req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage,
+			id:           fmt.Sprintf("cmpl-%d", rand.Intn(999)),
 		}
 
 		c.Writer = w
@@ -0,0 +1,166 @@
+package openai
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// respond returns a handler which writes each of the responses, as the
+// server does when streaming
+func respond[T any](t *testing.T, responses ...T) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for _, r := range responses {
+			b, err := json.Marshal(r)
+			require.NoError(t, err)
+
+			_, err = c.Writer.Write(append(b, '\n'))
+			require.NoError(t, err)
+		}
+	}
+}
+
+// events returns the data of the server-sent events of body, without the
+// final [DONE] event, which it checks is there
+func events(t *testing.T, body string) []string {
+	var data []string
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		if d, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			data = append(data, d)
+		}
+	}
+
+	require.NotEmpty(t, data)
+	require.Equal(t, "[DONE]", data[len(data)-1])
+	return data[:len(data)-1]
+}
+
+func TestChatIncludeUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	metrics := api.Metrics{PromptEvalCount: 10, EvalCount: 3, EvalDuration: time.Second}
+	router := gin.New()
+	router.POST("/v1/chat/completions", Middleware(), respond(t,
+		api.ChatResponse{Model: "test", Message: api.Message{Role: "assistant", Content: "Hello"}},
+		api.ChatResponse{Model: "test", Message: api.Message{Role: "assistant", Content: " there"}},
+		api.ChatResponse{Model: "test", Done: true, Metrics: metrics},
+	))
+
+	cases := []struct {
+		name  string
+		body  string
+		usage bool
+	}{
+		{"include", `{"model": "test", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "hi"}]}`, true},
+		{"exclude", `{"model": "test", "stream": true, "stream_options": {"include_usage": false}, "messages": [{"role": "user", "content": "hi"}]}`, false},
+		{"none", `{"model": "test", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			data := events(t, w.Body.String())
+			chunks := make([]ChatCompletionChunk, len(data))
+			for i, d := range data {
+				require.NoError(t, json.Unmarshal([]byte(d), &chunks[i]))
+			}
+
+			if !tt.usage {
+				require.Len(t, chunks, 3)
+				for _, c := range chunks {
+					assert.Nil(t, c.Usage)
+					assert.Nil(t, c.Timings)
+				}
+				return
+			}
+
+			// only the last chunk has the usage, and no choices
+			require.Len(t, chunks, 4)
+			for _, c := range chunks[:3] {
+				assert.Nil(t, c.Usage)
+				assert.Nil(t, c.Timings)
+				assert.Len(t, c.Choices, 1)
+			}
+
+			last := chunks[3]
+			assert.Empty(t, last.Choices)
+			assert.NotNil(t, last.Choices, "choices should be an empty list rather than null")
+			assert.Equal(t, &Usage{PromptTokens: 10, CompletionTokens: 3, TotalTokens: 13}, last.Usage)
+			require.NotNil(t, last.Timings)
+			assert.Equal(t, time.Second, last.Timings.EvalDuration)
+		})
+	}
+}
+
+func TestCompletionIncludeUsage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	metrics := api.Metrics{PromptEvalCount: 7, EvalCount: 2, EvalDuration: time.Second}
+	router := gin.New()
+	router.POST("/v1/completions", CompletionsMiddleware(), respond(t,
+		api.GenerateResponse{Model: "test", Response: "Hello"},
+		api.GenerateResponse{Model: "test", Done: true, Metrics: metrics},
+	))
+
+	cases := []struct {
+		name  string
+		body  string
+		usage bool
+	}{
+		{"include", `{"model": "test", "prompt": "hi", "stream": true, "stream_options": {"include_usage": true}}`, true},
+		{"none", `{"model": "test", "prompt": "hi", "stream": true}`, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			require.Equal(t, http.StatusOK, w.Code)
+
+			data := events(t, w.Body.String())
+			chunks := make([]CompletionChunk, len(data))
+			for i, d := range data {
+				require.NoError(t, json.Unmarshal([]byte(d), &chunks[i]))
+			}
+
+			if !tt.usage {
+				require.Len(t, chunks, 2)
+				for _, c := range chunks {
+					assert.Nil(t, c.Usage)
+					assert.Nil(t, c.Timings)
+				}
+				return
+			}
+
+			require.Len(t, chunks, 3)
+			for _, c := range chunks[:2] {
+				assert.Nil(t, c.Usage)
+				assert.Nil(t, c.Timings)
+				assert.Len(t, c.Choices, 1)
+			}
+
+			last := chunks[2]
+			assert.Empty(t, last.Choices)
+			assert.NotNil(t, last.Choices, "choices should be an empty list rather than null")
+			assert.Equal(t, &Usage{PromptTokens: 7, CompletionTokens: 2, TotalTokens: 9}, last.Usage)
+			require.NotNil(t, last.Timings)
+			assert.Equal(t, time.Second, last.Timings.EvalDuration)
+		})
+	}
+}
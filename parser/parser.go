@@ -55,6 +55,10 @@ func Parse(reader io.Reader) ([]Command, error) {
 
 			command.Name = string(fields[0])
 			command.Args = string(bytes.TrimSpace(fields[1]))
+		case "OVERRIDE":
+			// OVERRIDE key=type:value patches the model's metadata when it's loaded
+			command.Name = "kv_overrides"
+			command.Args = string(bytes.TrimSpace(fields[1]))
 		case "EMBED":
 			return nil, fmt.Errorf("deprecated command: EMBED is no longer supported, use the /embed API endpoint instead")
 		case "MESSAGE":
@@ -110,6 +114,10 @@ func scanModelfile(data []byte, atEOF bool) (advance int, token []byte, err erro
 
 func scan(openBytes, closeBytes, data []byte, atEOF bool) (advance int, token []byte, err error) {
 	newline := bytes.IndexByte(data, '\n')
+	if newline < 0 && atEOF {
+		// the last line may not end with a newline
+		newline = len(data)
+	}
 
 	if start := bytes.Index(data, openBytes); start >= 0 && start < newline {
 		end := bytes.Index(data[start+len(openBytes):], closeBytes)
@@ -15,6 +15,7 @@ ADAPTER adapter1
 LICENSE MIT
 PARAMETER param1 value1
 PARAMETER param2 value2
+OVERRIDE llama.context_length=int:8192
 TEMPLATE template1
 `
 
@@ -29,6 +30,7 @@ TEMPLATE template1
 		{Name: "license", Args: "MIT"},
 		{Name: "param1", Args: "value1"},
 		{Name: "param2", Args: "value2"},
+		{Name: "kv_overrides", Args: "llama.context_length=int:8192"},
 		{Name: "template", Args: "template1"},
 	}
 
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/gpu"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// defaultAlias is the alias of the model used by requests which don't name one
+const defaultAlias = "default"
+
+var errAliasNotFound = errors.New("alias not found")
+
+// aliasesMu guards aliases.json, which is in the models directory and maps
+// the short tag names of aliases to the models they point at
+var aliasesMu sync.Mutex
+
+// alias is an alias as it's kept in aliases.json
+type alias struct {
+	Target    string   `json:"target"`
+	Fallbacks []string `json:"fallbacks,omitempty"`
+	MaxQueue  int      `json:"max_queue,omitempty"`
+}
+
+func aliasesPath() (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "aliases.json"), nil
+}
+
+// cachedAliases are the aliases as they were last read from, or written to,
+// aliases.json at path, which is read again once its modification time or
+// size changes. It is guarded by aliasesMu.
+var cachedAliases struct {
+	path    string
+	modTime time.Time
+	size    int64
+	aliases map[string]alias
+}
+
+// readAliases reads the aliases. It is up to the caller to lock aliasesMu.
+func readAliases() (map[string]alias, error) {
+	fp, err := aliasesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return make(map[string]alias), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if cachedAliases.path == fp && cachedAliases.modTime.Equal(fi.ModTime()) && cachedAliases.size == fi.Size() {
+		return maps.Clone(cachedAliases.aliases), nil
+	}
+
+	bts, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := make(map[string]alias)
+	if err := json.Unmarshal(bts, &aliases); err != nil {
+		return nil, fmt.Errorf("%s: %w", fp, err)
+	}
+
+	cacheAliases(fp, fi, aliases)
+	return maps.Clone(aliases), nil
+}
+
+// cacheAliases sets the aliases read from, or written to, the file fp
+func cacheAliases(fp string, fi os.FileInfo, aliases map[string]alias) {
+	cachedAliases.path = fp
+	cachedAliases.modTime = fi.ModTime()
+	cachedAliases.size = fi.Size()
+	cachedAliases.aliases = aliases
+}
+
+// writeAliases replaces the aliases. It is up to the caller to lock aliasesMu.
+func writeAliases(aliases map[string]alias) error {
+	fp, err := aliasesPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return err
+	}
+
+	bts, err := json.MarshalIndent(aliases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write a temporary file first so the aliases aren't lost if it fails
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, bts, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, fp); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return err
+	}
+
+	cacheAliases(fp, fi, maps.Clone(aliases))
+	return nil
+}
+
+// lookupAlias returns the alias with the name, or the default alias if name
+// is empty
+func lookupAlias(name string) (alias, bool) {
+	if name == "" {
+		name = defaultAlias
+	}
+
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("couldn't read aliases: %v", err))
+		return alias{}, false
+	}
+
+	a, ok := aliases[ParseModelPath(name).GetShortTagname()]
+	return a, ok
+}
+
+// resolveAlias returns the model an alias points at, or name if it isn't an
+// alias. Requests without a model use the model of the default alias.
+func resolveAlias(name string) string {
+	if a, ok := lookupAlias(name); ok {
+		return a.Target
+	}
+
+	return name
+}
+
+// routeAlias is resolveAlias for requests which run a model. Models which
+// don't fit in VRAM fall back to the next model of the alias, and the last
+// model is used when more than the alias's max queue are waiting. It is up to
+// the caller to lock loaded.mu.
+func routeAlias(name string) string {
+	a, ok := lookupAlias(name)
+	if !ok {
+		return name
+	}
+
+	targets := append([]string{a.Target}, a.Fallbacks...)
+	if a.MaxQueue > 0 && requests.queued() > a.MaxQueue {
+		return targets[len(targets)-1]
+	}
+
+	for _, target := range targets[:len(targets)-1] {
+		if fitsVRAM(target) {
+			return target
+		}
+
+		slog.Debug(fmt.Sprintf("%s doesn't fit in VRAM, falling back", target))
+	}
+
+	return targets[len(targets)-1]
+}
+
+// fitsVRAM reports whether the model is loaded, or fits in the free VRAM and
+// the VRAM the loaded model frees when it's unloaded. Without a GPU, models
+// run in system memory, so they fit in the free system memory instead, or
+// always if it isn't known. It is up to the caller to lock loaded.mu.
+func fitsVRAM(name string) bool {
+	model, err := GetModel(name)
+	if err != nil {
+		return false
+	}
+
+	resident := loaded.runner != nil && !loaded.released
+	if resident && loaded.ModelPath == model.ModelPath {
+		return true
+	}
+
+	vram, err := gpu.CheckVRAM()
+	cpu := err != nil || vram <= 0
+	if cpu {
+		free := gpu.FreeSystemMemory()
+		if free == 0 {
+			return true
+		}
+
+		vram = int64(free)
+	}
+
+	if resident && (cpu || loaded.Options.NumGPU != 0) {
+		if mem, layers, err := modelMemory(loaded.ModelPath, loaded.Options.Runner); err == nil {
+			offloaded := loaded.Options.NumGPU
+			if cpu || offloaded < 0 || offloaded > layers {
+				offloaded = layers
+			}
+
+			vram += mem.Total() * int64(offloaded) / int64(layers)
+		}
+	}
+
+	opts, err := modelOptions(model, nil)
+	if err != nil {
+		return false
+	}
+
+	mem, _, err := modelMemory(model.ModelPath, opts.Runner)
+	return err == nil && mem.Total() <= vram
+}
+
+// maxMemoryEstimates is how many estimates of modelMemory are cached before
+// they're all dropped
+const maxMemoryEstimates = 64
+
+type memoryKey struct {
+	path   string
+	numCtx int
+}
+
+type memoryEstimate struct {
+	mem    llm.Memory
+	layers int
+}
+
+// memoryEstimates caches the estimates of modelMemory by the model file and
+// the context window. Model files are blobs named by their digests, so they
+// don't change.
+var memoryEstimates = struct {
+	mu        sync.Mutex
+	estimates map[memoryKey]memoryEstimate
+}{estimates: make(map[memoryKey]memoryEstimate)}
+
+// modelMemory estimates the memory of the model file at path loaded with the
+// runner options opts, and returns how many layers it has including the
+// output layer
+func modelMemory(path string, opts api.Runner) (llm.Memory, int, error) {
+	key := memoryKey{path, opts.NumCtx * max(opts.NumParallel, 1)}
+
+	memoryEstimates.mu.Lock()
+	defer memoryEstimates.mu.Unlock()
+
+	if e, ok := memoryEstimates.estimates[key]; ok {
+		return e.mem, e.layers, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return llm.Memory{}, 0, err
+	}
+	defer f.Close()
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		return llm.Memory{}, 0, err
+	}
+
+	if len(memoryEstimates.estimates) >= maxMemoryEstimates {
+		clear(memoryEstimates.estimates)
+	}
+
+	e := memoryEstimate{ggml.Memory(key.numCtx), int(ggml.NumLayers()) + 1}
+	memoryEstimates.estimates[key] = e
+	return e.mem, e.layers, nil
+}
+
+func ListAliasesHandler(c *gin.Context) {
+	aliasesMu.Lock()
+	aliases, err := readAliases()
+	aliasesMu.Unlock()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := api.ListAliasesResponse{Aliases: []api.Alias{}}
+	for name, a := range aliases {
+		resp.Aliases = append(resp.Aliases, api.Alias{Name: name, Target: a.Target, Fallbacks: a.Fallbacks, MaxQueue: a.MaxQueue})
+	}
+
+	slices.SortFunc(resp.Aliases, func(a, b api.Alias) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func SetAliasHandler(c *gin.Context) {
+	var req api.AliasRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	case req.Name == "" || req.Target == "":
+		abortWithError(c, http.StatusBadRequest, errors.New("name and target are required"))
+		return
+	case req.MaxQueue < 0:
+		abortWithError(c, http.StatusBadRequest, errors.New("max_queue must be positive"))
+		return
+	}
+
+	mp := ParseModelPath(req.Name)
+	if err := mp.Validate(); err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, _, err := GetManifest(mp); err == nil {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("'%s' is a model", req.Name))
+		return
+	}
+
+	var targets []string
+	for _, name := range append([]string{req.Target}, req.Fallbacks...) {
+		target := ParseModelPath(name)
+		if _, _, err := GetManifest(target); errors.Is(err, os.ErrNotExist) {
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", name)))
+			return
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		targets = append(targets, target.GetShortTagname())
+	}
+
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	aliases[mp.GetShortTagname()] = alias{Target: targets[0], Fallbacks: targets[1:], MaxQueue: req.MaxQueue}
+	if err := writeAliases(aliases); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
+func DeleteAliasHandler(c *gin.Context) {
+	var req api.DeleteAliasRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	case req.Name == "":
+		abortWithError(c, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+
+	aliasesMu.Lock()
+	defer aliasesMu.Unlock()
+
+	aliases, err := readAliases()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	name := ParseModelPath(req.Name).GetShortTagname()
+	if _, ok := aliases[name]; !ok {
+		abortWithError(c, http.StatusNotFound, errAliasNotFound)
+		return
+	}
+
+	delete(aliases, name)
+	if err := writeAliases(aliases); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
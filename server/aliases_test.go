@@ -0,0 +1,170 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/gpu"
+	"github.com/jmorganca/ollama/parser"
+)
+
+func TestAliases(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	createMockModel(t, "small", "")
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	send := func(method, body string) int {
+		req, err := http.NewRequest(method, srv.URL+"/api/alias", strings.NewReader(body))
+		assert.Nil(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, "", resolveAlias(""))
+	assert.Equal(t, "fast", resolveAlias("fast"))
+
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, `{"name": "fast", "target": "small"}`))
+	assert.Equal(t, http.StatusOK, send(http.MethodPost, `{"name": "default", "target": "small"}`))
+	assert.Equal(t, "small:latest", resolveAlias("fast"))
+	assert.Equal(t, "small:latest", resolveAlias("fast:latest"))
+	assert.Equal(t, "small:latest", resolveAlias(""))
+
+	assert.Equal(t, http.StatusNotFound, send(http.MethodPost, `{"name": "smart", "target": "missing"}`))
+	assert.Equal(t, http.StatusBadRequest, send(http.MethodPost, `{"name": "small", "target": "small"}`))
+
+	assert.Equal(t, http.StatusOK, send(http.MethodDelete, `{"name": "fast"}`))
+	assert.Equal(t, http.StatusNotFound, send(http.MethodDelete, `{"name": "fast"}`))
+	assert.Equal(t, "fast", resolveAlias("fast"))
+}
+
+func TestRouteAlias(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_MAX_VRAM", "16")
+
+	big := createMockModel(t, "big", "")
+	createMockModel(t, "small", "")
+
+	aliasesMu.Lock()
+	assert.Nil(t, writeAliases(map[string]alias{
+		"smart:latest": {Target: "big:latest", Fallbacks: []string{"small:latest"}, MaxQueue: 1},
+	}))
+	aliasesMu.Unlock()
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	// big doesn't fit in the VRAM
+	assert.Equal(t, "small:latest", routeAlias("smart"))
+	assert.Equal(t, "big:latest", resolveAlias("smart"))
+
+	// unless it's loaded already
+	big, err := GetModel("big")
+	assert.Nil(t, err)
+
+	loaded.runner = &MockLLM{}
+	loaded.Model = big
+	loaded.Options = &api.Options{}
+	t.Cleanup(func() {
+		loaded.runner = nil
+		loaded.Model = nil
+		loaded.Options = nil
+	})
+
+	assert.Equal(t, "big:latest", routeAlias("smart"))
+
+	// the last model is used when the queue is too deep
+	requests.mu.Lock()
+	requests.waiting = []*queued{{}, {}}
+	requests.mu.Unlock()
+	t.Cleanup(func() {
+		requests.mu.Lock()
+		defer requests.mu.Unlock()
+		requests.waiting = nil
+	})
+
+	assert.Equal(t, "small:latest", routeAlias("smart"))
+}
+
+func TestAliasesCache(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	aliasesMu.Lock()
+	require.NoError(t, writeAliases(map[string]alias{"fast:latest": {Target: "small:latest"}}))
+	aliasesMu.Unlock()
+
+	fp, err := aliasesPath()
+	require.NoError(t, err)
+
+	fi, err := os.Stat(fp)
+	require.NoError(t, err)
+
+	// a change which keeps the size and modification time isn't read
+	bts, err := os.ReadFile(fp)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(fp, []byte(strings.Replace(string(bts), "small", "other", 1)), 0o644))
+	require.NoError(t, os.Chtimes(fp, fi.ModTime(), fi.ModTime()))
+	assert.Equal(t, "small:latest", resolveAlias("fast"))
+
+	// but the file is read again once it's modified
+	require.NoError(t, os.Chtimes(fp, fi.ModTime(), fi.ModTime().Add(time.Second)))
+	assert.Equal(t, "other:latest", resolveAlias("fast"))
+
+	require.NoError(t, os.Remove(fp))
+	assert.Equal(t, "fast", resolveAlias("fast"))
+}
+
+func TestFitsSystemMemory(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_MAX_VRAM", "")
+
+	if vram, err := gpu.CheckVRAM(); err == nil && vram > 0 {
+		t.Skip("a GPU is detected")
+	}
+
+	f := filepath.Join(t.TempDir(), "model.gguf")
+	require.NoError(t, os.WriteFile(f, writeGGUF(t, map[string][]float32{"output.weight": {1, 2}}, "output.weight"), 0o644))
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + f))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(context.TODO(), "tiny", "", commands, func(api.ProgressResponse) {}))
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	// without a GPU, models fit in system memory
+	assert.True(t, fitsVRAM("tiny"))
+
+	model, err := GetModel("tiny")
+	require.NoError(t, err)
+
+	opts, err := modelOptions(model, nil)
+	require.NoError(t, err)
+
+	// and the estimate of its memory is cached, so the model file isn't
+	// decoded again
+	mem, layers, err := modelMemory(model.ModelPath, opts.Runner)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(model.ModelPath))
+	cached, cachedLayers, err := modelMemory(model.ModelPath, opts.Runner)
+	require.NoError(t, err)
+	assert.Equal(t, mem, cached)
+	assert.Equal(t, layers, cachedLayers)
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+var errInvalidArchive = errors.New("invalid model archive")
+
+var validDigest = regexp.MustCompile(`^sha256:[0-9a-f]{64}$`)
+
+// ExportModel writes a model to w as a tar archive, with the manifest and
+// blobs laid out as they are in the models directory
+func ExportModel(name string, w io.Writer) error {
+	mp := ParseModelPath(name)
+	manifest, _, err := GetManifest(mp)
+	if err != nil {
+		return err
+	}
+
+	manifestPath, err := mp.GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	// the manifest goes first so imports know which blobs to expect
+	if err := exportFile(tw, path.Join("manifests", mp.Registry, mp.Namespace, mp.Repository, mp.Tag), manifestPath); err != nil {
+		return err
+	}
+
+	for _, layer := range append([]*Layer{manifest.Config}, manifest.Layers...) {
+		fp, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		if err := exportFile(tw, path.Join("blobs", filepath.Base(fp)), fp); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func exportFile(tw *tar.Writer, name, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportModel creates a model from an archive written by ExportModel. The
+// model is named as it was exported unless name is set. Blobs which are
+// stored already are skipped, and every other blob has to match its digest.
+func ImportModel(r io.Reader, name string) (string, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+
+	parts := strings.Split(hdr.Name, "/")
+	if len(parts) != 5 || parts[0] != "manifests" || slices.ContainsFunc(parts, func(part string) bool {
+		return part == "" || part == "." || part == ".."
+	}) {
+		return "", fmt.Errorf("%w: expected a manifest, got %s", errInvalidArchive, hdr.Name)
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("%s/%s/%s:%s", parts[1], parts[2], parts[3], parts[4])
+	}
+
+	mp := ParseModelPath(name)
+	if err := mp.Validate(); err != nil {
+		return "", err
+	}
+
+	manifestJSON, err := io.ReadAll(tr)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest ManifestV2
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return "", fmt.Errorf("%w: %w", errInvalidArchive, err)
+	}
+
+	if manifest.Config == nil {
+		return "", fmt.Errorf("%w: manifest has no config", errInvalidArchive)
+	}
+
+	layers := append([]*Layer{manifest.Config}, manifest.Layers...)
+	expected := make(map[string]bool)
+	for _, layer := range layers {
+		if !validDigest.MatchString(layer.Digest) {
+			return "", fmt.Errorf("%w: invalid digest %q", errInvalidArchive, layer.Digest)
+		}
+
+		fp, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return "", err
+		}
+
+		expected[path.Join("blobs", filepath.Base(fp))] = true
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+
+		if !expected[hdr.Name] {
+			return "", fmt.Errorf("%w: unexpected file %s", errInvalidArchive, hdr.Name)
+		}
+
+		digest := strings.Replace(path.Base(hdr.Name), "-", ":", 1)
+		if _, err := NewLayerFromLayer(digest, "", ""); err == nil {
+			// the blob is stored already
+			continue
+		}
+
+		layer, err := NewLayer(tr, "")
+		if err != nil {
+			return "", err
+		}
+
+		if layer.Digest != digest {
+			os.Remove(layer.tempFileName)
+			return "", fmt.Errorf("%w: want %s, got %s", errDigestMismatch, digest, layer.Digest)
+		}
+
+		if _, err := layer.Commit(); err != nil {
+			return "", err
+		}
+	}
+
+	for _, layer := range layers {
+		if _, err := NewLayerFromLayer(layer.Digest, layer.MediaType, ""); err != nil {
+			return "", fmt.Errorf("%w: missing blob %s", errInvalidArchive, layer.Digest)
+		}
+	}
+
+	// write the manifest as it was exported so its digest is the same
+	manifestPath, err := mp.GetManifestPath()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(manifestPath), 0o755); err != nil {
+		return "", err
+	}
+
+	if err := os.WriteFile(manifestPath, manifestJSON, 0o644); err != nil {
+		return "", err
+	}
+
+	return mp.GetShortTagname(), nil
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/parser"
+)
+
+func TestExportImport(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	fname := t.TempDir() + "/model.gguf"
+	require.NoError(t, os.WriteFile(fname, []byte("GGUF\x02\x00"), 0o644))
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + fname + "\nPARAMETER seed 42"))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(context.TODO(), "test", "", commands, func(api.ProgressResponse) {}))
+
+	var archive bytes.Buffer
+	require.NoError(t, ExportModel("test", &archive))
+
+	manifestPath, err := ParseModelPath("test").GetManifestPath()
+	require.NoError(t, err)
+
+	manifest, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+
+	t.Run("new models directory", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		name, err := ImportModel(bytes.NewReader(archive.Bytes()), "")
+		require.NoError(t, err)
+		assert.Equal(t, "test:latest", name)
+
+		importedPath, err := ParseModelPath("test").GetManifestPath()
+		require.NoError(t, err)
+		assert.NotEqual(t, manifestPath, importedPath)
+
+		imported, err := os.ReadFile(importedPath)
+		require.NoError(t, err)
+		assert.Equal(t, manifest, imported)
+
+		model, err := GetModel("test")
+		require.NoError(t, err)
+		assert.Equal(t, float64(42), model.Options["seed"])
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		name, err := ImportModel(bytes.NewReader(archive.Bytes()), "example/renamed:v1")
+		require.NoError(t, err)
+		assert.Equal(t, "example/renamed:v1", name)
+
+		_, err = GetModel("example/renamed:v1")
+		require.NoError(t, err)
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+		// rewrite the archive with the model blob changed
+		var corrupt bytes.Buffer
+		tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+		tw := tar.NewWriter(&corrupt)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+
+			var b bytes.Buffer
+			_, err = b.ReadFrom(tr)
+			require.NoError(t, err)
+
+			data := b.Bytes()
+			if string(data) == "GGUF\x02\x00" {
+				data = []byte("GGUF\x03\x00")
+			}
+
+			require.NoError(t, tw.WriteHeader(hdr))
+			_, err = tw.Write(data)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+
+		_, err := ImportModel(&corrupt, "")
+		assert.ErrorIs(t, err, errDigestMismatch)
+	})
+
+	t.Run("not an archive", func(t *testing.T) {
+		_, err := ImportModel(strings.NewReader("hello"), "")
+		assert.ErrorIs(t, err, errInvalidArchive)
+	})
+}
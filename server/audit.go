@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// auditMu guards audit.jsonl, which is in the models directory and has an
+// api.AuditEntry per line. Entries are only appended to it.
+var auditMu sync.Mutex
+
+func auditPath() (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "audit.jsonl"), nil
+}
+
+// audit appends an entry for an operation requested by c
+func audit(c *gin.Context, entry api.AuditEntry, err error) {
+	entry.Client = c.ClientIP()
+	entry.UserAgent = c.Request.UserAgent()
+	recordAudit(entry, err)
+}
+
+// recordAudit appends an entry for an operation. The digest of the model's
+// manifest is added if it isn't set, the model exists and err is nil.
+func recordAudit(entry api.AuditEntry, err error) {
+	entry.Time = time.Now().UTC()
+	if err != nil {
+		entry.Error = err.Error()
+	} else if entry.Digest == "" {
+		if _, digest, err := GetManifest(ParseModelPath(entry.Model)); err == nil {
+			entry.Digest = "sha256:" + digest
+		}
+	}
+
+	if err := writeAudit(entry); err != nil {
+		slog.Warn(fmt.Sprintf("couldn't write audit log: %v", err))
+	}
+}
+
+func writeAudit(entry api.AuditEntry) error {
+	fp, err := auditPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(fp, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(bts, '\n'))
+	return err
+}
+
+func AuditHandler(c *gin.Context) {
+	var since time.Time
+	if s := c.Query("since"); s != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("invalid since %q", s))
+			return
+		}
+	}
+
+	var model string
+	if m := c.Query("model"); m != "" {
+		model = ParseModelPath(m).GetShortTagname()
+	}
+
+	operation := c.Query("operation")
+
+	fp, err := auditPath()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	resp := api.AuditResponse{Entries: []api.AuditEntry{}}
+	f, err := os.Open(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		c.JSON(http.StatusOK, resp)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry api.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			abortWithError(c, http.StatusInternalServerError, fmt.Errorf("%s: %w", fp, err))
+			return
+		}
+
+		switch {
+		case model != "" && ParseModelPath(entry.Model).GetShortTagname() != model:
+		case operation != "" && entry.Operation != operation:
+		case entry.Time.Before(since):
+		default:
+			resp.Entries = append(resp.Entries, entry)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestAudit(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	createMockModel(t, "source", "")
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	send := func(method, path, body string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		assert.Nil(t, err)
+		req.Header.Set("User-Agent", "audit-test")
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+	}
+
+	send(http.MethodPost, "/api/copy", `{"source": "source", "destination": "copy"}`)
+	send(http.MethodPost, "/api/copy", `{"source": "missing", "destination": "other"}`)
+	send(http.MethodDelete, "/api/delete", `{"model": "copy"}`)
+
+	get := func(query string) []api.AuditEntry {
+		resp, err := http.Get(srv.URL + "/api/audit" + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var audit api.AuditResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&audit))
+		return audit.Entries
+	}
+
+	entries := get("")
+	assert.Len(t, entries, 3)
+
+	copied, failed, deleted := entries[0], entries[1], entries[2]
+	assert.Equal(t, "copy", copied.Operation)
+	assert.Equal(t, "copy", copied.Model)
+	assert.Equal(t, "source", copied.Source)
+	assert.Equal(t, "audit-test", copied.UserAgent)
+	assert.NotEmpty(t, copied.Client)
+	assert.True(t, strings.HasPrefix(copied.Digest, "sha256:"))
+	assert.Empty(t, copied.Error)
+
+	assert.NotEmpty(t, failed.Error)
+	assert.Empty(t, failed.Digest)
+
+	// deletes record the digest of the model which was deleted
+	assert.Equal(t, "delete", deleted.Operation)
+	assert.Equal(t, copied.Digest, deleted.Digest)
+
+	assert.Len(t, get("?operation=delete"), 1)
+	assert.Len(t, get("?model=copy:latest"), 2)
+	assert.Len(t, get("?since="+deleted.Time.Add(1).Format(time.RFC3339Nano)), 0)
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+// infills caches whether model files have fill-in-the-middle tokens by model
+// path
+var infills sync.Map
+
+// Capabilities returns the kinds of requests the model supports
+func (m *Model) Capabilities() []string {
+	switch {
+	case m.IsEmbedding():
+		return []string{"embedding"}
+	case m.IsWhisper():
+		return []string{}
+	}
+
+	capabilities := append([]string{"completion"}, templateCapabilities(m.Template)...)
+
+	if len(m.ProjectorPaths) > 0 {
+		capabilities = append(capabilities, "vision")
+	}
+
+	if supportsInfill(m.ModelPath) {
+		capabilities = append(capabilities, "fim")
+	}
+
+	return capabilities
+}
+
+func supportsInfill(modelPath string) bool {
+	if ok, loaded := infills.Load(modelPath); loaded {
+		return ok.(bool)
+	}
+
+	f, err := os.Open(modelPath)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("couldn't read %s: %v", modelPath, err))
+		return false
+	}
+	defer f.Close()
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		slog.Debug(fmt.Sprintf("couldn't read %s: %v", modelPath, err))
+		return false
+	}
+
+	ok := ggml.SupportsInfill()
+	infills.Store(modelPath, ok)
+	return ok
+}
+
+// templateVars returns the variables a template uses, such as "Prompt" for
+// .Prompt. Fields in the body of range and with actions are of the value
+// they set dot to, so only the variables those use through $ are counted.
+func templateVars(tmpl string) (map[string]bool, error) {
+	parsed, err := template.New("").Option("missingkey=zero").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]bool)
+	var walk func(node parse.Node, dot bool)
+	walk = func(node parse.Node, dot bool) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, node := range n.Nodes {
+					walk(node, dot)
+				}
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe, dot)
+		case *parse.PipeNode:
+			if n != nil {
+				for _, cmd := range n.Cmds {
+					walk(cmd, dot)
+				}
+			}
+		case *parse.CommandNode:
+			for _, arg := range n.Args {
+				walk(arg, dot)
+			}
+		case *parse.FieldNode:
+			if dot {
+				vars[n.Ident[0]] = true
+			}
+		case *parse.VariableNode:
+			if len(n.Ident) > 1 && n.Ident[0] == "$" {
+				vars[n.Ident[1]] = true
+			}
+		case *parse.IfNode:
+			walk(n.Pipe, dot)
+			walk(n.List, dot)
+			walk(n.ElseList, dot)
+		case *parse.RangeNode:
+			walk(n.Pipe, dot)
+			walk(n.List, false)
+			walk(n.ElseList, dot)
+		case *parse.WithNode:
+			walk(n.Pipe, dot)
+			walk(n.List, false)
+			walk(n.ElseList, dot)
+		}
+	}
+
+	for _, t := range parsed.Templates() {
+		if t.Tree != nil {
+			walk(t.Tree.Root, true)
+		}
+	}
+
+	return vars, nil
+}
+
+// templateCapabilities returns the capabilities of a template. Chat messages
+// are rendered through .Prompt one turn at a time, so templates which use it
+// support chat, even when they pass the prompt to the model as it is.
+// Templates which use .Tools support tools.
+func templateCapabilities(tmpl string) []string {
+	vars, err := templateVars(tmpl)
+	if err != nil {
+		return nil
+	}
+
+	var capabilities []string
+	if vars["Prompt"] {
+		capabilities = append(capabilities, "chat")
+	}
+
+	if vars["Tools"] {
+		capabilities = append(capabilities, "tools")
+	}
+
+	return capabilities
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateCapabilities(t *testing.T) {
+	cases := map[string][]string{
+		"{{ .Prompt }}":                {"chat"},
+		"  {{ .Prompt }}\n":            {"chat"},
+		"[INST] {{ .Prompt }} [/INST]": {"chat"},
+		"{{ if .System }}{{ .System }} {{ end }}{{ .Prompt }}":          {"chat"},
+		"{{ range .Tools }}{{ .Function.Name }} {{ end }}{{ .Prompt }}": {"chat", "tools"},
+		"{{ .System }}": nil,
+		"{{ .Prompt":    nil,
+	}
+
+	for tmpl, want := range cases {
+		assert.Equal(t, want, templateCapabilities(tmpl), tmpl)
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// zstdSuffix is appended to the media type of layers which are compressed
+// with zstd in the registry
+const zstdSuffix = "+zstd"
+
+var errUnsupportedCompression = errors.New("unsupported compression")
+
+// compressible are the media types of layers which are worth compressing
+var compressible = []string{
+	"application/vnd.ollama.image.model",
+	"application/vnd.ollama.image.projector",
+	"application/vnd.ollama.image.adapter",
+}
+
+func isCompressed(layer *Layer) bool {
+	return strings.HasSuffix(layer.MediaType, zstdSuffix)
+}
+
+// compressLayer compresses a layer with zstd into a new blob. The compressed
+// layer is only used to push, so the caller removes its blob after.
+func compressLayer(layer *Layer) (*Layer, error) {
+	fp, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := zstd.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		if _, err := io.Copy(w, f); err != nil {
+			w.Close()
+			pw.CloseWithError(err)
+			return
+		}
+
+		pw.CloseWithError(w.Close())
+	}()
+
+	compressed, err := NewLayer(pr, layer.MediaType+zstdSuffix)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := compressed.Commit(); err != nil {
+		return nil, err
+	}
+
+	compressed.From = layer.From
+	compressed.DecompressedSize = layer.Size
+	return compressed, nil
+}
+
+// decompressLayer decompresses a pulled layer into the blob it's stored as
+// locally, removing the compressed blob. diffID is the digest of the layer
+// once decompressed, if the config of the model has it.
+func decompressLayer(layer *Layer, diffID string) (*Layer, error) {
+	fp, err := GetBlobsPath(layer.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decompressed, err := NewLayer(r, strings.TrimSuffix(layer.MediaType, zstdSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	if diffID != "" && decompressed.Digest != diffID {
+		os.Remove(decompressed.tempFileName)
+		return nil, fmt.Errorf("%w: want %s, got %s", errDigestMismatch, diffID, decompressed.Digest)
+	}
+
+	if _, err := decompressed.Commit(); err != nil {
+		return nil, err
+	}
+
+	f.Close()
+	if err := os.Remove(fp); err != nil {
+		return nil, err
+	}
+
+	return decompressed, nil
+}
+
+// compressManifest compresses the layers of a manifest to push. Layers which
+// don't get smaller are pushed as they are. It returns the manifest to push
+// and the blobs of the compressed layers, to remove once they're pushed.
+func compressManifest(manifest *ManifestV2, compression string, fn func(api.ProgressResponse)) (*ManifestV2, []string, error) {
+	switch compression {
+	case "":
+		return manifest, nil, nil
+	case "zstd":
+	default:
+		return nil, nil, fmt.Errorf("%w: %s", errUnsupportedCompression, compression)
+	}
+
+	compressed := ManifestV2{
+		SchemaVersion: manifest.SchemaVersion,
+		// clients which don't request OCI manifests can't decompress layers
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Config:    manifest.Config,
+		Layers:    slices.Clone(manifest.Layers),
+	}
+
+	var blobs []string
+	for i, layer := range compressed.Layers {
+		if !slices.Contains(compressible, layer.MediaType) {
+			continue
+		}
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("compressing %s", layer.Digest[7:19])})
+		c, err := compressLayer(layer)
+		if err != nil {
+			return nil, blobs, err
+		}
+
+		fp, err := GetBlobsPath(c.Digest)
+		if err != nil {
+			return nil, blobs, err
+		}
+
+		blobs = append(blobs, fp)
+		if c.Size < layer.Size {
+			compressed.Layers[i] = c
+		}
+	}
+
+	return &compressed, blobs, nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestCompressManifest(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	var layers []*Layer
+	for _, mediatype := range []string{"application/vnd.ollama.image.model", "application/vnd.ollama.image.template"} {
+		layer, err := NewLayer(bytes.NewReader(bytes.Repeat([]byte(mediatype), 1000)), mediatype)
+		require.NoError(t, err)
+
+		_, err = layer.Commit()
+		require.NoError(t, err)
+
+		layers = append(layers, layer)
+	}
+
+	manifest := &ManifestV2{
+		SchemaVersion: 2,
+		MediaType:     "application/vnd.docker.distribution.manifest.v2+json",
+		Layers:        layers,
+	}
+
+	compressed, blobs, err := compressManifest(manifest, "zstd", func(api.ProgressResponse) {})
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+
+	assert.Equal(t, "application/vnd.oci.image.manifest.v1+json", compressed.MediaType)
+	assert.Equal(t, "application/vnd.ollama.image.model+zstd", compressed.Layers[0].MediaType)
+	assert.Less(t, compressed.Layers[0].Size, layers[0].Size)
+	assert.Equal(t, layers[1], compressed.Layers[1])
+
+	// the manifest to push is a copy
+	assert.Equal(t, layers[0], manifest.Layers[0])
+
+	t.Run("decompress", func(t *testing.T) {
+		_, err := decompressLayer(compressed.Layers[0], layers[1].Digest)
+		assert.ErrorIs(t, err, errDigestMismatch)
+
+		layer, err := decompressLayer(compressed.Layers[0], layers[0].Digest)
+		require.NoError(t, err)
+		assert.Equal(t, layers[0].Digest, layer.Digest)
+		assert.Equal(t, layers[0].MediaType, layer.MediaType)
+
+		_, err = os.Stat(blobs[0])
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, _, err := compressManifest(manifest, "gzip", func(api.ProgressResponse) {})
+		assert.ErrorIs(t, err, errUnsupportedCompression)
+	})
+}
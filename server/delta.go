@@ -0,0 +1,350 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+const deltaMediaType = "application/vnd.ollama.image.model.delta"
+
+var errNoDelta = errors.New("no tensors in common")
+
+// deltaHeader starts a delta layer, after its length as a little endian
+// uint64. The data of the ops which don't copy from the base follows it.
+type deltaHeader struct {
+	Base   string    `json:"base"`
+	Target string    `json:"target"`
+	Ops    []deltaOp `json:"ops"`
+}
+
+// deltaOp writes Size bytes of the target, copied from Offset in the base or
+// read from the data of the delta
+type deltaOp struct {
+	Copy   bool  `json:"copy,omitempty"`
+	Offset int64 `json:"offset,omitempty"`
+	Size   int64 `json:"size"`
+}
+
+func (h *deltaHeader) add(op deltaOp) {
+	if op.Size == 0 {
+		return
+	}
+
+	if n := len(h.Ops); n > 0 {
+		last := &h.Ops[n-1]
+		if last.Copy == op.Copy && (!op.Copy || last.Offset+last.Size == op.Offset) {
+			last.Size += op.Size
+			return
+		}
+	}
+
+	h.Ops = append(h.Ops, op)
+}
+
+func blobTensorDigests(ctx context.Context, digest string) ([]llm.TensorDigest, error) {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return ggml.DigestTensors(ctx, f)
+}
+
+// createDelta creates a layer which rebuilds target from base. Tensors which
+// are the same in both, such as those which quantizations of the same model
+// keep at the same type, are copied from the base; everything else is stored
+// in the delta.
+func createDelta(ctx context.Context, target, base *Layer) (*Layer, error) {
+	targetTensors, err := blobTensorDigests(ctx, target.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	baseTensors, err := blobTensorDigests(ctx, base.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	inBase := make(map[string]llm.TensorDigest)
+	for _, t := range baseTensors {
+		inBase[t.Digest] = t
+	}
+
+	sort.Slice(targetTensors, func(i, j int) bool {
+		return targetTensors[i].Offset < targetTensors[j].Offset
+	})
+
+	header := deltaHeader{Base: base.Digest, Target: target.Digest}
+
+	var copied, offset int64
+	for _, t := range targetTensors {
+		header.add(deltaOp{Size: t.Offset - offset})
+		if b, ok := inBase[t.Digest]; ok {
+			header.add(deltaOp{Copy: true, Offset: b.Offset, Size: t.Size})
+			copied += t.Size
+		} else {
+			header.add(deltaOp{Size: t.Size})
+		}
+
+		offset = t.Offset + t.Size
+	}
+
+	header.add(deltaOp{Size: target.Size - offset})
+
+	if copied == 0 {
+		return nil, errNoDelta
+	}
+
+	fp, err := GetBlobsPath(target.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(header); err != nil {
+		return nil, err
+	}
+
+	readers := []io.Reader{bytes.NewReader(binary.LittleEndian.AppendUint64(nil, uint64(b.Len()))), &b}
+	offset = 0
+	for _, op := range header.Ops {
+		if !op.Copy {
+			readers = append(readers, io.NewSectionReader(f, offset, op.Size))
+		}
+
+		offset += op.Size
+	}
+
+	layer, err := NewLayer(io.MultiReader(readers...), deltaMediaType)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := layer.Commit(); err != nil {
+		return nil, err
+	}
+
+	layer.Base = base.Digest
+	return layer, nil
+}
+
+// applyDelta rebuilds the model layer a pulled delta layer was created from,
+// removing the delta
+func applyDelta(delta *Layer) (*Layer, error) {
+	fp, err := GetBlobsPath(delta.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var n uint64
+	if err := binary.Read(f, binary.LittleEndian, &n); err != nil {
+		return nil, err
+	}
+
+	var header deltaHeader
+	if err := json.NewDecoder(io.LimitReader(f, int64(n))).Decode(&header); err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(int64(8+n), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	baseFile, err := GetBlobsPath(header.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := os.Open(baseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer base.Close()
+
+	var readers []io.Reader
+	for _, op := range header.Ops {
+		if op.Copy {
+			readers = append(readers, io.NewSectionReader(base, op.Offset, op.Size))
+		} else {
+			readers = append(readers, io.LimitReader(f, op.Size))
+		}
+	}
+
+	layer, err := NewLayer(io.MultiReader(readers...), "application/vnd.ollama.image.model")
+	if err != nil {
+		return nil, err
+	}
+
+	if layer.Digest != header.Target {
+		os.Remove(layer.tempFileName)
+		return nil, fmt.Errorf("%w: want %s, got %s", errDigestMismatch, header.Target, layer.Digest)
+	}
+
+	if _, err := layer.Commit(); err != nil {
+		return nil, err
+	}
+
+	f.Close()
+	if err := os.Remove(fp); err != nil {
+		return nil, err
+	}
+
+	return layer, nil
+}
+
+// deltaManifest adds a delta layer from the model layer of base to a manifest
+// to push, so clients which have base only pull the difference. The model
+// layer is still pushed for clients which don't. It returns the blob of the
+// delta, to remove once it's pushed.
+func deltaManifest(ctx context.Context, manifest *ManifestV2, base string, fn func(api.ProgressResponse)) (*ManifestV2, []string, error) {
+	if base == "" {
+		return manifest, nil, nil
+	}
+
+	baseManifest, _, err := GetManifest(ParseModelPath(base))
+	if err != nil {
+		return nil, nil, fmt.Errorf("base model %s: %w", base, err)
+	}
+
+	isModel := func(l *Layer) bool { return l.MediaType == "application/vnd.ollama.image.model" }
+
+	i := slices.IndexFunc(manifest.Layers, isModel)
+	j := slices.IndexFunc(baseManifest.Layers, isModel)
+	if i < 0 || j < 0 {
+		return nil, nil, errors.New("delta needs a model layer in both models")
+	}
+
+	target, baseLayer := manifest.Layers[i], baseManifest.Layers[j]
+	if target.Digest == baseLayer.Digest {
+		return manifest, nil, nil
+	}
+
+	fn(api.ProgressResponse{Status: fmt.Sprintf("creating delta from %s", base)})
+	delta, err := createDelta(ctx, target, baseLayer)
+	if errors.Is(err, errNoDelta) {
+		slog.Info(fmt.Sprintf("not pushing a delta from %s: %v", base, err))
+		return manifest, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	fp, err := GetBlobsPath(delta.Digest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &ManifestV2{
+		SchemaVersion: manifest.SchemaVersion,
+		// clients which don't request OCI manifests can't apply deltas
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Config:    manifest.Config,
+		Layers:    append(slices.Clone(manifest.Layers), delta),
+	}, []string{fp}, nil
+}
+
+// splitDeltas removes the delta layers from a pulled manifest
+func splitDeltas(manifest *ManifestV2) []*Layer {
+	var deltas []*Layer
+	manifest.Layers = slices.DeleteFunc(manifest.Layers, func(l *Layer) bool {
+		if l.MediaType == deltaMediaType {
+			deltas = append(deltas, l)
+			return true
+		}
+
+		return false
+	})
+
+	return deltas
+}
+
+// usableDelta returns the first delta with a base which is stored locally,
+// unless the model layer it rebuilds is stored already. diffIDs are the
+// digests of compressed layers once they're decompressed, if they're known.
+func usableDelta(manifest *ManifestV2, deltas []*Layer, diffIDs []string) *Layer {
+	for i, l := range manifest.Layers {
+		if strings.TrimSuffix(l.MediaType, zstdSuffix) != "application/vnd.ollama.image.model" {
+			continue
+		}
+
+		digest := l.Digest
+		if isCompressed(l) && diffIDs != nil {
+			digest = diffIDs[i]
+		}
+
+		if _, err := NewLayerFromLayer(digest, l.MediaType, ""); err == nil {
+			return nil
+		}
+	}
+
+	for _, delta := range deltas {
+		if _, err := NewLayerFromLayer(delta.Base, "application/vnd.ollama.image.model", ""); err == nil {
+			return delta
+		}
+	}
+
+	return nil
+}
+
+// replaceModelLayer replaces the model layer of a pulled manifest with the
+// layer rebuilt from a delta, checking it's the same as the model layer
+func replaceModelLayer(manifest *ManifestV2, layer *Layer, diffIDs []string) error {
+	for i, l := range manifest.Layers {
+		if strings.TrimSuffix(l.MediaType, zstdSuffix) != layer.MediaType {
+			continue
+		}
+
+		want := l.Digest
+		if isCompressed(l) {
+			want = ""
+			if diffIDs != nil {
+				want = diffIDs[i]
+			}
+		}
+
+		if want != "" && want != layer.Digest {
+			return fmt.Errorf("%w: want %s, got %s", errDigestMismatch, want, layer.Digest)
+		}
+
+		manifest.Layers[i] = layer
+		return nil
+	}
+
+	return errors.New("delta for a model without a model layer")
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeGGUF writes a GGUF model with an F32 tensor for each name, in order
+func writeGGUF(t *testing.T, tensors map[string][]float32, names ...string) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	write := func(v any) {
+		require.NoError(t, binary.Write(&b, binary.LittleEndian, v))
+	}
+
+	writeString := func(s string) {
+		write(uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	b.WriteString("GGUF")
+	write(uint32(3))
+	write(uint64(len(names)))
+	write(uint64(1))
+
+	writeString("general.architecture")
+	write(uint32(8))
+	writeString("llama")
+
+	var offset uint64
+	for _, name := range names {
+		writeString(name)
+		write(uint32(1))
+		write(uint64(len(tensors[name])))
+		write(uint32(0))
+		write(offset)
+		offset += uint64(32 * ((len(tensors[name])*4 + 31) / 32))
+	}
+
+	for b.Len()%32 != 0 {
+		b.WriteByte(0)
+	}
+
+	for _, name := range names {
+		write(tensors[name])
+		for b.Len()%32 != 0 {
+			b.WriteByte(0)
+		}
+	}
+
+	return b.Bytes()
+}
+
+func TestDelta(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	newLayer := func(b []byte) *Layer {
+		layer, err := NewLayer(bytes.NewReader(b), "application/vnd.ollama.image.model")
+		require.NoError(t, err)
+
+		_, err = layer.Commit()
+		require.NoError(t, err)
+		return layer
+	}
+
+	shared := make([]float32, 256)
+	for i := range shared {
+		shared[i] = float32(i)
+	}
+
+	base := newLayer(writeGGUF(t, map[string][]float32{
+		"token_embd.weight":   shared,
+		"blk.0.attn_q.weight": {5, 6, 7, 8},
+	}, "token_embd.weight", "blk.0.attn_q.weight"))
+
+	b := writeGGUF(t, map[string][]float32{
+		"token_embd.weight":   shared,
+		"blk.0.attn_q.weight": {9, 10, 11, 12},
+		"output.weight":       {13, 14},
+	}, "blk.0.attn_q.weight", "token_embd.weight", "output.weight")
+	target := newLayer(b)
+
+	delta, err := createDelta(context.Background(), target, base)
+	require.NoError(t, err)
+	assert.Equal(t, deltaMediaType, delta.MediaType)
+	assert.Equal(t, base.Digest, delta.Base)
+	assert.Less(t, delta.Size, target.Size)
+
+	// rebuild the target from the base and the delta
+	fp, err := GetBlobsPath(target.Digest)
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(fp))
+
+	layer, err := applyDelta(delta)
+	require.NoError(t, err)
+	assert.Equal(t, target.Digest, layer.Digest)
+
+	rebuilt, err := os.ReadFile(fp)
+	require.NoError(t, err)
+	assert.Equal(t, b, rebuilt)
+
+	t.Run("no tensors in common", func(t *testing.T) {
+		other := newLayer(writeGGUF(t, map[string][]float32{"output.weight": {15, 16}}, "output.weight"))
+		_, err := createDelta(context.Background(), other, base)
+		assert.ErrorIs(t, err, errNoDelta)
+	})
+}
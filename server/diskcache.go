@@ -0,0 +1,253 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// diskCache is an LRU cache kept in a directory of the models directory,
+// with a file for each entry. The files are ordered by when they were last
+// used by their modification times, so the order is kept across restarts.
+type diskCache struct {
+	// name is the directory the cache is kept in, and env is the environment
+	// variable which sets how many bytes it can use
+	name string
+	env  string
+
+	mu sync.Mutex
+
+	// dir is the directory entries were read from, which is read again if
+	// the models directory changes
+	dir string
+
+	// entries are the keys from the most to the least recently used, and
+	// size is the size of their files
+	entries *list.List
+	byKey   map[string]*list.Element
+	size    int64
+
+	hits, misses, evictions uint64
+}
+
+type diskCacheEntry struct {
+	key  string
+	size int64
+}
+
+// diskCacheKey hashes v into a key
+func diskCacheKey(v any) string {
+	bts, _ := json.Marshal(v)
+	sum := sha256.Sum256(bts)
+	return hex.EncodeToString(sum[:])
+}
+
+// limit returns how many bytes the cache can use. Nothing is cached when
+// its environment variable isn't set.
+func (dc *diskCache) limit() (int64, bool) {
+	n, err := strconv.ParseInt(os.Getenv(dc.env), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+func (dc *diskCache) path() (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, dc.name), nil
+}
+
+// open reads the entries of the cache if they haven't been read from the
+// current models directory. It is up to the caller to lock dc.mu.
+func (dc *diskCache) open() (string, error) {
+	dir, err := dc.path()
+	if err != nil {
+		return "", err
+	}
+
+	if dc.entries != nil && dc.dir == dir {
+		return dir, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.Type().IsRegular() || filepath.Ext(entry.Name()) != "" {
+			continue
+		}
+
+		infos = append(infos, info)
+	}
+
+	slices.SortFunc(infos, func(a, b os.FileInfo) int {
+		return b.ModTime().Compare(a.ModTime())
+	})
+
+	dc.dir = dir
+	dc.entries = list.New()
+	dc.byKey = make(map[string]*list.Element)
+	dc.size = 0
+	for _, info := range infos {
+		dc.byKey[info.Name()] = dc.entries.PushBack(&diskCacheEntry{key: info.Name(), size: info.Size()})
+		dc.size += info.Size()
+	}
+
+	return dir, nil
+}
+
+// remove removes an entry and its file. It is up to the caller to lock
+// dc.mu.
+func (dc *diskCache) remove(dir string, e *list.Element) {
+	entry := dc.entries.Remove(e).(*diskCacheEntry)
+	delete(dc.byKey, entry.key)
+	dc.size -= entry.size
+
+	if err := os.Remove(filepath.Join(dir, entry.key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn(fmt.Sprintf("couldn't remove %s cache entry: %v", dc.name, err))
+	}
+}
+
+// get decodes the entry with the key into v, and reports whether it's cached
+func (dc *diskCache) get(key string, v any) bool {
+	if _, ok := dc.limit(); !ok {
+		return false
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	dir, err := dc.open()
+	if err != nil {
+		slog.Warn(fmt.Sprintf("couldn't read %s cache: %v", dc.name, err))
+		return false
+	}
+
+	e, ok := dc.byKey[key]
+	if !ok {
+		dc.misses++
+		return false
+	}
+
+	fp := filepath.Join(dir, key)
+
+	bts, err := os.ReadFile(fp)
+	if err == nil {
+		err = json.Unmarshal(bts, v)
+	}
+
+	if err != nil {
+		slog.Warn(fmt.Sprintf("couldn't read %s cache entry: %v", dc.name, err))
+		dc.remove(dir, e)
+		dc.misses++
+		return false
+	}
+
+	now := time.Now()
+	if err := os.Chtimes(fp, now, now); err != nil {
+		slog.Debug(fmt.Sprintf("couldn't update %s cache entry: %v", dc.name, err))
+	}
+
+	dc.entries.MoveToFront(e)
+	dc.hits++
+	return true
+}
+
+// put adds v to the cache with the key, removing the least recently used
+// entries while the cache is larger than its limit
+func (dc *diskCache) put(key string, v any) {
+	limit, ok := dc.limit()
+	if !ok {
+		return
+	}
+
+	if err := dc.write(key, v, limit); err != nil {
+		slog.Warn(fmt.Sprintf("couldn't add to %s cache: %v", dc.name, err))
+	}
+}
+
+func (dc *diskCache) write(key string, v any, limit int64) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	dir, err := dc.open()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	// write a temporary file first so partial entries aren't read
+	fp := filepath.Join(dir, key)
+	if err := os.WriteFile(fp+".tmp", bts, 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(fp+".tmp", fp); err != nil {
+		return err
+	}
+
+	if e, ok := dc.byKey[key]; ok {
+		dc.size -= e.Value.(*diskCacheEntry).size
+		e.Value.(*diskCacheEntry).size = int64(len(bts))
+		dc.entries.MoveToFront(e)
+	} else {
+		dc.byKey[key] = dc.entries.PushFront(&diskCacheEntry{key: key, size: int64(len(bts))})
+	}
+
+	dc.size += int64(len(bts))
+	for dc.size > limit {
+		dc.remove(dir, dc.entries.Back())
+		dc.evictions++
+	}
+
+	return nil
+}
+
+// diskCacheStats are the statistics of a cache reported in /metrics
+type diskCacheStats struct {
+	hits, misses, evictions uint64
+	entries                 int
+	size                    int64
+}
+
+func (dc *diskCache) stats() diskCacheStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	stats := diskCacheStats{hits: dc.hits, misses: dc.misses, evictions: dc.evictions}
+	if _, ok := dc.limit(); ok {
+		if _, err := dc.open(); err == nil {
+			stats.entries, stats.size = dc.entries.Len(), dc.size
+		}
+	}
+
+	return stats
+}
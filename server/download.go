@@ -43,6 +43,9 @@ type blobDownload struct {
 
 	context.CancelFunc
 
+	// limiters limit the rate the parts are downloaded at
+	limiters []*rateLimiter
+
 	done       bool
 	err        error
 	references atomic.Int32
@@ -153,8 +156,10 @@ func (b *blobDownload) run(ctx context.Context, requestURL *url.URL, opts *regis
 
 	_ = file.Truncate(b.Total)
 
+	b.limiters = []*rateLimiter{downloadLimiter, requestLimiter(opts.RateLimit)}
+
 	g, inner := errgroup.WithContext(ctx)
-	g.SetLimit(numDownloadParts)
+	g.SetLimit(transferParts(numDownloadParts, transferRate(b.limiters...)))
 	for i := range b.Parts {
 		part := b.Parts[i]
 		if part.Completed == part.Size {
@@ -221,7 +226,7 @@ func (b *blobDownload) downloadChunk(ctx context.Context, requestURL *url.URL, w
 		}
 		defer resp.Body.Close()
 
-		n, err := io.Copy(w, io.TeeReader(resp.Body, part))
+		n, err := io.Copy(w, io.TeeReader(newRateLimitedReader(ctx, resp.Body, b.limiters...), part))
 		if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, io.ErrUnexpectedEOF) {
 			// rollback progress
 			b.Completed.Add(-n)
@@ -364,7 +369,7 @@ func downloadBlob(ctx context.Context, opts downloadOpts) error {
 	data, ok := blobDownloadManager.LoadOrStore(opts.digest, &blobDownload{Name: fp, Digest: opts.digest})
 	download := data.(*blobDownload)
 	if !ok {
-		requestURL := opts.mp.BaseURL()
+		requestURL := opts.mp.PullURL()
 		requestURL = requestURL.JoinPath("v2", opts.mp.GetNamespaceRepository(), "blobs", opts.digest)
 		if err := download.Prepare(ctx, requestURL, opts.regOpts); err != nil {
 			blobDownloadManager.Delete(opts.digest)
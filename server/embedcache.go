@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/jmorganca/ollama/api"
+)
+
+// embeddingCache caches embeddings when OLLAMA_EMBEDDING_CACHE is set to how
+// many bytes it can use
+var embeddingCache = &diskCache{name: "embeddings", env: "OLLAMA_EMBEDDING_CACHE"}
+
+// embeddingKey identifies the embedding of a request to a model with its
+// manifest digest, the input and the options which change the embedding
+func embeddingKey(model *Model, req api.EmbeddingRequest, pooling string) string {
+	return diskCacheKey(struct {
+		Digest     string          `json:"digest"`
+		Prompt     string          `json:"prompt"`
+		Images     []api.ImageData `json:"images"`
+		Pooling    string          `json:"pooling"`
+		Normalize  bool            `json:"normalize"`
+		Dimensions int             `json:"dimensions"`
+	}{model.Digest, req.Prompt, req.Images, pooling, req.Normalize, req.Dimensions})
+}
+
+// cachedEmbedding returns the embedding with the key if it's cached
+func cachedEmbedding(key string) ([]float64, bool) {
+	var embedding []float64
+	ok := embeddingCache.get(key, &embedding)
+	return embedding, ok
+}
+
+// cacheEmbedding adds an embedding to the cache
+func cacheEmbedding(key string, embedding []float64) {
+	embeddingCache.put(key, embedding)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestEmbeddingCache(t *testing.T) {
+	t.Setenv("OLLAMA_EMBEDDING_CACHE", "1000")
+
+	var inputs []string
+	loadMockModel(t, "embed", "", &MockLLM{embed: func(embed llm.EmbeddingOpts) ([]float64, error) {
+		inputs = append(inputs, embed.Input)
+		return []float64{float64(len(embed.Input))}, nil
+	}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	embed := func(req api.EmbeddingRequest) []float64 {
+		bts, err := json.Marshal(req)
+		assert.Nil(t, err)
+
+		resp, err := http.Post(srv.URL+"/api/embeddings", "application/json", bytes.NewReader(bts))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var embedding api.EmbeddingResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&embedding))
+		return embedding.Embedding
+	}
+
+	assert.Equal(t, []float64{5}, embed(api.EmbeddingRequest{Model: "embed", Prompt: "hello"}))
+	assert.Equal(t, []float64{5}, embed(api.EmbeddingRequest{Model: "embed", Prompt: "hello"}))
+	assert.Equal(t, []float64{5}, embed(api.EmbeddingRequest{Model: "embed", Prompt: "hello", Normalize: true}))
+	assert.Equal(t, []string{"hello", "hello"}, inputs)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	bts, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(bts), "# TYPE ollama_embedding_cache_hits_total counter\n")
+	assert.Contains(t, string(bts), "\nollama_embedding_cache_entries 2\n")
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// errorStatus is the status each error code is reported with
+var errorStatus = map[api.ErrorCode]int{
+	api.ErrorCodeInvalidRequest:      http.StatusBadRequest,
+	api.ErrorCodeNotFound:            http.StatusNotFound,
+	api.ErrorCodeModelNotFound:       http.StatusNotFound,
+	api.ErrorCodeOutOfMemory:         http.StatusServiceUnavailable,
+	api.ErrorCodeContextExceeded:     http.StatusBadRequest,
+	api.ErrorCodeRunnerCrashed:       http.StatusInternalServerError,
+	api.ErrorCodeUnauthorized:        http.StatusUnauthorized,
+	api.ErrorCodeForbidden:           http.StatusForbidden,
+	api.ErrorCodeQueueFull:           http.StatusTooManyRequests,
+	api.ErrorCodeInsufficientStorage: http.StatusInsufficientStorage,
+	api.ErrorCodeBudgetExceeded:      http.StatusTooManyRequests,
+	api.ErrorCodeTTFTExceeded:        http.StatusBadRequest,
+	api.ErrorCodeInternal:            http.StatusInternalServerError,
+}
+
+// codeError attaches a code to an error which can't be classified otherwise
+type codeError struct {
+	code api.ErrorCode
+	error
+}
+
+func (e codeError) Unwrap() error {
+	return e.error
+}
+
+func errModelNotFound(err error) error {
+	return codeError{api.ErrorCodeModelNotFound, err}
+}
+
+// errorCode classifies err. Errors which aren't recognized are classified by
+// the status they would otherwise be reported with.
+func errorCode(status int, err error) api.ErrorCode {
+	var cErr codeError
+	switch {
+	case errors.As(err, &cErr):
+		return cErr.code
+	case errors.Is(err, llm.ErrOutOfMemory):
+		return api.ErrorCodeOutOfMemory
+	case errors.Is(err, llm.ErrContextExceeded):
+		return api.ErrorCodeContextExceeded
+	case errors.Is(err, llm.ErrRunnerCrashed):
+		return api.ErrorCodeRunnerCrashed
+	case errors.Is(err, errUnauthorized):
+		return api.ErrorCodeUnauthorized
+	case errors.Is(err, errReadOnly):
+		return api.ErrorCodeForbidden
+	case errors.Is(err, errQueueFull):
+		return api.ErrorCodeQueueFull
+	case errors.Is(err, errInsufficientStorage):
+		return api.ErrorCodeInsufficientStorage
+	case errors.Is(err, errBudgetExceeded):
+		return api.ErrorCodeBudgetExceeded
+	case errors.Is(err, errTTFTExceeded):
+		return api.ErrorCodeTTFTExceeded
+	case errors.Is(err, api.ErrInvalidOpts), errors.Is(err, llm.ErrInfillUnsupported), errors.Is(err, errUnsupportedCompression):
+		return api.ErrorCodeInvalidRequest
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return api.ErrorCodeInvalidRequest
+	case http.StatusUnauthorized:
+		return api.ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return api.ErrorCodeForbidden
+	case http.StatusNotFound:
+		return api.ErrorCodeNotFound
+	default:
+		return api.ErrorCodeInternal
+	}
+}
+
+// errorBody returns the body for err with its code, and the option or field
+// of the request it's about, if any
+func errorBody(err error, code api.ErrorCode) gin.H {
+	h := gin.H{"error": err.Error(), "code": code}
+
+	var optErr *api.OptionError
+	if errors.As(err, &optErr) {
+		h["param"] = optErr.Option
+	}
+
+	return h
+}
+
+// errorResponse returns the body for an error, for streams where the status
+// has already been sent
+func errorResponse(err error) gin.H {
+	return errorBody(err, errorCode(http.StatusInternalServerError, err))
+}
+
+// abortWithError responds with err and its code. status is used unless err
+// has a code which is reported with a different status.
+func abortWithError(c *gin.Context, status int, err error) {
+	code := errorCode(status, err)
+	if s, ok := errorStatus[code]; ok && code != api.ErrorCodeInternal {
+		status = s
+	}
+
+	c.AbortWithStatusJSON(status, errorBody(err, code))
+}
+
+// abortWithErrorResponse responds with an error from a stream once it's known
+// the response won't be streamed
+func abortWithErrorResponse(c *gin.Context, r gin.H) {
+	code, ok := r["code"].(api.ErrorCode)
+	if !ok {
+		code = api.ErrorCodeInternal
+	}
+
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+
+	c.AbortWithStatusJSON(status, r)
+}
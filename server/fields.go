@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// jsonFields returns the names of the JSON fields of the struct v
+func jsonFields(v any) []string {
+	var names []string
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(v)) {
+		if field.Anonymous || !field.IsExported() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch name {
+		case "-":
+			continue
+		case "":
+			name = field.Name
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// unknownFields returns the fields of the JSON object body which aren't one
+// of names, which are ignored when it's unmarshaled. Like unmarshaling, names
+// are matched without case.
+func unknownFields(body []byte, names []string) []string {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(body, &m); err != nil {
+		// the handler reports the body as invalid
+		return nil
+	}
+
+	var unknown []string
+	for key := range m {
+		if !slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, key) }) {
+			unknown = append(unknown, key)
+		}
+	}
+
+	slices.Sort(unknown)
+	return unknown
+}
+
+// fieldsMiddleware warns of fields of the request body which aren't fields of
+// the request v, which are most often misspelled, in the log and the
+// X-Ollama-Warning header. They're rejected if OLLAMA_STRICT_REQUESTS is set.
+func fieldsMiddleware(v any) gin.HandlerFunc {
+	names := jsonFields(v)
+	return func(c *gin.Context) {
+		if c.Request.Body == nil {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		unknown := unknownFields(body, names)
+		if len(unknown) == 0 {
+			c.Next()
+			return
+		}
+
+		if strict, _ := strconv.ParseBool(os.Getenv("OLLAMA_STRICT_REQUESTS")); strict {
+			abortWithError(c, http.StatusBadRequest, api.UnknownOptionsError(unknown, names))
+			return
+		}
+
+		for _, field := range unknown {
+			err := api.UnknownOptionError(field, names)
+			warning := fmt.Sprintf("ignoring %s, which %s", err.Option, err.Reason)
+			slog.Warn(fmt.Sprintf("%s: %s", c.FullPath(), warning))
+			c.Writer.Header().Add("X-Ollama-Warning", warning)
+		}
+
+		c.Next()
+	}
+}
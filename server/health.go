@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// warmup tracks loading the models a server is started with
+type warmup struct {
+	mu    sync.Mutex
+	model string // the model being loaded
+	done  bool
+	err   error
+}
+
+// warmupModels loads each model to preload and generates a token with it to
+// check it works. Only one model can be loaded at a time, so the last model
+// stays loaded. It returns the error of the first model which failed to load,
+// which /readyz reports.
+func (s *Server) warmupModels(ctx context.Context) error {
+	for _, name := range s.preload {
+		s.warmup.mu.Lock()
+		s.warmup.model = name
+		s.warmup.mu.Unlock()
+
+		slog.Info(fmt.Sprintf("preloading %s", name))
+		if err := warmupModel(ctx, name); err != nil {
+			slog.Error(fmt.Sprintf("failed to preload %s: %v", name, err))
+
+			err = fmt.Errorf("failed to preload %s: %w", name, err)
+			s.warmup.mu.Lock()
+			s.warmup.err = err
+			s.warmup.mu.Unlock()
+			return err
+		}
+	}
+
+	s.warmup.mu.Lock()
+	s.warmup.model = ""
+	s.warmup.done = true
+	s.warmup.mu.Unlock()
+	return nil
+}
+
+func warmupModel(ctx context.Context, name string) error {
+	model, err := GetModel(name)
+	if err != nil {
+		return err
+	}
+
+	opts, err := modelOptions(model, nil)
+	if err != nil {
+		return err
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	return warmupLoaded(ctx, model, opts, getDefaultSessionDuration())
+}
+
+// warmupLoaded loads the model with opts for sessionDuration, and generates a
+// token with it to check it works. It is up to the caller to lock loaded.mu.
+func warmupLoaded(ctx context.Context, model *Model, opts api.Options, sessionDuration time.Duration) error {
+	if err := load(nil, model, opts, sessionDuration, nil); err != nil {
+		return err
+	}
+
+	if model.IsEmbedding() {
+		_, err := loaded.runner.Embedding(ctx, llm.EmbeddingOpts{Input: "hello"})
+		return err
+	}
+
+	opts.NumPredict = 1
+	return loaded.runner.Predict(ctx, llm.PredictOpts{Prompt: "hello", Options: opts}, func(llm.PredictResult) {})
+}
+
+func HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyHandler reports whether the models the server was started with have
+// been loaded and can generate
+func (s *Server) ReadyHandler(c *gin.Context) {
+	s.warmup.mu.Lock()
+	defer s.warmup.mu.Unlock()
+
+	switch {
+	case len(s.preload) == 0, s.warmup.done:
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	case s.warmup.err != nil:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "failed", "error": s.warmup.err.Error()})
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "loading", "model": s.warmup.model})
+	}
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// Hook inspects and changes the text of requests and responses, such as to
+// redact personal information or filter content
+type Hook interface {
+	// Prompt is called with each message of a request before it's templated.
+	// It returns the content to use in its place, or an error to reject the
+	// request.
+	Prompt(ctx context.Context, model, role, content string) (string, error)
+
+	// Completion is called with each piece of a response as it's decoded,
+	// returning the content to send in its place. Responses are streamed, so
+	// text which spans pieces is seen a piece at a time.
+	Completion(ctx context.Context, model, content string) (string, error)
+}
+
+var hooks = struct {
+	mu sync.RWMutex
+
+	// byModel has the hooks of each model, and the hooks of every model
+	// under ""
+	byModel map[string][]Hook
+}{byModel: make(map[string][]Hook)}
+
+// RegisterHook adds a hook for the named model, or for every model if name is
+// empty. Hooks for every model run before the hooks of the model, in the
+// order they're registered.
+func RegisterHook(name string, h Hook) {
+	if name != "" {
+		name = ParseModelPath(name).GetShortTagname()
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+
+	hooks.byModel[name] = append(hooks.byModel[name], h)
+}
+
+func modelHooks(model string) []Hook {
+	hooks.mu.RLock()
+	defer hooks.mu.RUnlock()
+
+	return append(append([]Hook{}, hooks.byModel[""]...), hooks.byModel[ParseModelPath(model).GetShortTagname()]...)
+}
+
+// errHookRejected wraps the errors returned by prompt hooks
+var errHookRejected = errors.New("rejected by hook")
+
+func hookPrompt(ctx context.Context, model, role, content string) (string, error) {
+	if content == "" {
+		return content, nil
+	}
+
+	for _, h := range modelHooks(model) {
+		var err error
+		if content, err = h.Prompt(ctx, model, role, content); err != nil {
+			return "", fmt.Errorf("%w: %w", errHookRejected, err)
+		}
+	}
+
+	return content, nil
+}
+
+func hookMessages(ctx context.Context, model string, messages []api.Message) error {
+	for i := range messages {
+		content, err := hookPrompt(ctx, model, messages[i].Role, messages[i].Content)
+		if err != nil {
+			return err
+		}
+
+		messages[i].Content = content
+	}
+
+	return nil
+}
+
+func hookCompletion(ctx context.Context, model, content string) (string, error) {
+	if content == "" {
+		return content, nil
+	}
+
+	for _, h := range modelHooks(model) {
+		var err error
+		if content, err = h.Completion(ctx, model, content); err != nil {
+			return "", err
+		}
+	}
+
+	return content, nil
+}
+
+var defaultHookTimeout = 10 * time.Second
+
+// getHookTimeout returns how long a hook program has to respond to each
+// message, set by OLLAMA_HOOK_TIMEOUT
+func getHookTimeout() time.Duration {
+	if t, exists := os.LookupEnv("OLLAMA_HOOK_TIMEOUT"); exists {
+		if v, err := strconv.Atoi(t); err == nil && v > 0 {
+			return time.Duration(v) * time.Second
+		}
+
+		if d, err := time.ParseDuration(t); err == nil && d > 0 {
+			return d
+		}
+	}
+
+	return defaultHookTimeout
+}
+
+// execHook is a hook run by a program, set by OLLAMA_HOOK. The program is
+// started once and kept running. It's sent a JSON object per line on stdin,
+// with the stage ("prompt" or "completion"), model, role and content, and
+// writes a JSON object per line to stdout with the content to use and an
+// error to reject the request prompt. The program is killed, and started
+// again for the next message, when it doesn't respond within the timeout or
+// the request is cancelled.
+type execHook struct {
+	command string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	stdout *bufio.Scanner
+}
+
+type execHookRequest struct {
+	Stage   string `json:"stage"`
+	Model   string `json:"model"`
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content"`
+}
+
+type execHookResponse struct {
+	Content string `json:"content"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (h *execHook) Prompt(ctx context.Context, model, role, content string) (string, error) {
+	return h.call(ctx, execHookRequest{Stage: "prompt", Model: model, Role: role, Content: content})
+}
+
+func (h *execHook) Completion(ctx context.Context, model, content string) (string, error) {
+	return h.call(ctx, execHookRequest{Stage: "completion", Model: model, Content: content})
+}
+
+func (h *execHook) call(ctx context.Context, req execHookRequest) (string, error) {
+	timeout := h.timeout
+	if timeout <= 0 {
+		timeout = getHookTimeout()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.start(); err != nil {
+		return "", err
+	}
+
+	type result struct {
+		resp *execHookResponse
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		resp, err := h.roundTrip(req)
+		done <- result{resp, err}
+	}()
+
+	var r result
+	select {
+	case r = <-done:
+	case <-ctx.Done():
+		// killing the program ends the round trip
+		h.cancel()
+		<-done
+		r.err = ctx.Err()
+	}
+
+	resp, err := r.resp, r.err
+	if err != nil {
+		// start it again for the next request
+		h.stop()
+		return "", fmt.Errorf("hook %s: %w", h.command, err)
+	}
+
+	if resp.Error != "" {
+		return "", errors.New(resp.Error)
+	}
+
+	return resp.Content, nil
+}
+
+func (h *execHook) roundTrip(req execHookRequest) (*execHookResponse, error) {
+	if err := json.NewEncoder(h.stdin).Encode(req); err != nil {
+		return nil, err
+	}
+
+	if !h.stdout.Scan() {
+		if err := h.stdout.Err(); err != nil {
+			return nil, err
+		}
+
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var resp execHookResponse
+	if err := json.Unmarshal(h.stdout.Bytes(), &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// start starts the program if it isn't running. It is up to the caller to
+// lock h.mu.
+func (h *execHook) start() error {
+	if h.cmd != nil {
+		return nil
+	}
+
+	args := strings.Fields(h.command)
+	if len(args) == 0 {
+		return errors.New("empty hook command")
+	}
+
+	// the program outlives the requests it's called for, so it's only killed
+	// by its own context
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return fmt.Errorf("hook %s: %w", h.command, err)
+	}
+
+	h.cmd, h.cancel, h.stdin = cmd, cancel, stdin
+	h.stdout = bufio.NewScanner(stdout)
+	h.stdout.Buffer(nil, 16*1024*1024)
+	return nil
+}
+
+// stop stops the program. It is up to the caller to lock h.mu.
+func (h *execHook) stop() {
+	if h.cmd == nil {
+		return
+	}
+
+	h.stdin.Close()
+	h.cancel()
+	if err := h.cmd.Wait(); err != nil {
+		slog.Debug(fmt.Sprintf("hook %s: %v", h.command, err))
+	}
+
+	h.cmd = nil
+}
+
+// Close stops the program
+func (h *execHook) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stop()
+}
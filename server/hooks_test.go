@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+type redactHook struct{}
+
+func (redactHook) Prompt(_ context.Context, _, _, content string) (string, error) {
+	if strings.Contains(content, "forbidden") {
+		return "", errors.New("forbidden content")
+	}
+
+	return strings.ReplaceAll(content, "555-0100", "[phone]"), nil
+}
+
+func (redactHook) Completion(_ context.Context, _, content string) (string, error) {
+	return strings.ReplaceAll(content, "secret", "[redacted]"), nil
+}
+
+func TestHooks(t *testing.T) {
+	var prompt string
+	loadMockModel(t, "hooked", "TEMPLATE \"[INST] {{ .Prompt }} [/INST]\"", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		prompt = p.Prompt
+		fn(llm.PredictResult{Content: "the secret is out", Done: true})
+		return nil
+	}})
+
+	RegisterHook("hooked", redactHook{})
+
+	t.Cleanup(func() {
+		hooks.mu.Lock()
+		defer hooks.mu.Unlock()
+		delete(hooks.byModel, "hooked:latest")
+	})
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"model": "hooked", "messages": [{"role": "user", "content": "call 555-0100"}], "stream": false}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var chat api.ChatResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&chat))
+	assert.Equal(t, "[INST] call [phone] [/INST]", prompt)
+	assert.Equal(t, "the [redacted] is out", chat.Message.Content)
+
+	resp, err = http.Post(srv.URL+"/api/generate", "application/json", strings.NewReader(`{"model": "hooked", "prompt": "something forbidden"}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestExecHook(t *testing.T) {
+	for _, program := range []string{"cat", "sleep"} {
+		if _, err := exec.LookPath(program); err != nil {
+			t.Skipf("%s isn't available", program)
+		}
+	}
+
+	// cat echoes each request back, which has the content to use
+	h := &execHook{command: "cat", timeout: time.Second}
+	t.Cleanup(h.Close)
+
+	content, err := h.Prompt(context.TODO(), "model", "user", "hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", content)
+
+	// programs which don't respond are killed
+	h = &execHook{command: "sleep 10", timeout: 100 * time.Millisecond}
+	t.Cleanup(h.Close)
+
+	start := time.Now()
+	_, err = h.Prompt(context.TODO(), "model", "user", "hello")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Nil(t, h.cmd)
+
+	// and so are the programs of cancelled requests
+	ctx, cancel := context.WithCancel(context.TODO())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	h.timeout = time.Minute
+	_, err = h.Completion(ctx, "model", "hello")
+	assert.ErrorIs(t, err, context.Canceled)
+}
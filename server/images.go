@@ -36,6 +36,11 @@ type registryOptions struct {
 	Username string
 	Password string
 	Token    string
+
+	// RateLimit is the most bytes per second the blobs of the request are
+	// transferred at, as well as OLLAMA_MAX_DOWNLOAD_RATE or
+	// OLLAMA_MAX_UPLOAD_RATE
+	RateLimit int64
 }
 
 type Model struct {
@@ -59,6 +64,12 @@ func (m *Model) IsEmbedding() bool {
 	return slices.Contains(m.Config.ModelFamilies, "bert") || slices.Contains(m.Config.ModelFamilies, "nomic-bert")
 }
 
+// IsWhisper reports whether the model is a whisper speech to text model,
+// which the llama.cpp runner can't load
+func (m *Model) IsWhisper() bool {
+	return slices.Contains(m.Config.ModelFamilies, "whisper")
+}
+
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
@@ -258,6 +269,33 @@ func GetModel(name string) (*Model, error) {
 	return model, nil
 }
 
+// tensorList returns the first of the names of tensors, and how many more
+// there are, for errors
+func tensorList(tensors []string) string {
+	const most = 10
+
+	names := strings.Join(tensors[:min(len(tensors), most)], ", ")
+	if len(tensors) > most {
+		names += fmt.Sprintf(" and %d more", len(tensors)-most)
+	}
+
+	return names
+}
+
+// unmappedTensorsError returns an error naming the tensors of a model which
+// llama.cpp wouldn't load, so it's rejected when it's created rather than
+// when it's run
+func unmappedTensorsError(family string, unmapped []string) error {
+	return fmt.Errorf("invalid model: %d tensors of the %s model have names llama.cpp doesn't load and couldn't be renamed: %s", len(unmapped), family, tensorList(unmapped))
+}
+
+// permutedTensorsError returns an error naming the tensors of a model which
+// are stored in the order of another converter, which llama.cpp would load
+// but produce garbage with
+func permutedTensorsError(family string, permuted []string) error {
+	return fmt.Errorf("invalid model: %d tensors of the %s model are in the order of the Hugging Face checkpoint rather than llama.cpp's, convert it again with llama.cpp's convert script: %s", len(permuted), family, tensorList(permuted))
+}
+
 func realpath(mfDir, from string) string {
 	abspath, err := filepath.Abs(from)
 	if err != nil {
@@ -304,13 +342,17 @@ func CreateModel(ctx context.Context, name, modelFileDir string, commands []pars
 
 	params := make(map[string][]string)
 	fromParams := make(map[string]any)
+	tensors := make(tensorDigests)
+	var tensorsChanged bool
 
 	for _, c := range commands {
 		mediatype := fmt.Sprintf("application/vnd.ollama.image.%s", c.Name)
 
 		switch c.Name {
 		case "model":
-			if strings.HasPrefix(c.Args, "@") {
+			// blobs from the blob store don't need more storage
+			stored := strings.HasPrefix(c.Args, "@")
+			if stored {
 				blobPath, err := GetBlobsPath(strings.TrimPrefix(c.Args, "@"))
 				if err != nil {
 					return err
@@ -405,6 +447,17 @@ func CreateModel(ctx context.Context, name, modelFileDir string, commands []pars
 						}
 					}
 
+					if layer.MediaType == "application/vnd.ollama.image.tensors" {
+						fromTensors, err := readTensorDigests(layer.Digest)
+						if err != nil {
+							return err
+						}
+
+						for digest, t := range fromTensors {
+							tensors[digest] = t
+						}
+					}
+
 					layer, err := NewLayerFromLayer(layer.Digest, layer.MediaType, modelpath.GetShortTagname())
 					if err != nil {
 						return err
@@ -418,6 +471,14 @@ func CreateModel(ctx context.Context, name, modelFileDir string, commands []pars
 			}
 			defer bin.Close()
 
+			if !stored {
+				if fi, err := bin.Stat(); err == nil {
+					if err := checkStorage(fi.Size()); err != nil {
+						return err
+					}
+				}
+			}
+
 			var offset int64
 		CREATE:
 			for {
@@ -446,15 +507,64 @@ func CreateModel(ctx context.Context, name, modelFileDir string, commands []pars
 					mediatype = "application/vnd.ollama.image.projector"
 				}
 
-				sr := io.NewSectionReader(bin, offset, ggml.Size)
-				layer, err := NewLayer(sr, mediatype)
+				size := ggml.Size
+				sr := io.NewSectionReader(bin, offset, size)
+
+				// tensors named by other converters are renamed so llama.cpp
+				// can load them, unless they're also in another order
+				if permuted := ggml.PermutedTensors(); len(permuted) > 0 {
+					return permutedTensorsError(ggml.ModelFamily(), permuted)
+				}
+
+				renames, unmapped := ggml.MapTensorNames()
+				if len(unmapped) > 0 {
+					return unmappedTensorsError(ggml.ModelFamily(), unmapped)
+				}
+
+				var r io.Reader = sr
+				if len(renames) > 0 {
+					fn(api.ProgressResponse{Status: fmt.Sprintf("renaming %d tensors", len(renames))})
+					if r, err = ggml.RenameTensors(sr, renames); err != nil {
+						return err
+					}
+				}
+
+				layer, err := NewLayer(r, mediatype)
 				if err != nil {
 					return err
 				}
 
+				// the renamed model has its own tensor table, so it's the one
+				// verified
+				var data io.ReaderAt = sr
+				if len(renames) > 0 {
+					f, err := os.Open(layer.tempFileName)
+					if err != nil {
+						return err
+					}
+					defer f.Close()
+
+					if ggml, err = llm.DecodeGGML(f); err != nil {
+						return err
+					}
+
+					data = f
+				}
+
+				fn(api.ProgressResponse{Status: "verifying tensors"})
+				digests, err := ggml.DigestTensors(ctx, data)
+				if err != nil {
+					return fmt.Errorf("invalid model: %w", err)
+				}
+
+				if digests != nil {
+					tensors[layer.Digest] = digests
+					tensorsChanged = true
+				}
+
 				layers.Add(layer)
 
-				offset += ggml.Size
+				offset += size
 			}
 		case "adapter":
 			if strings.HasPrefix(c.Args, "@") {
@@ -512,6 +622,22 @@ func CreateModel(ctx context.Context, name, modelFileDir string, commands []pars
 		}
 	}
 
+	if tensorsChanged {
+		fn(api.ProgressResponse{Status: "creating tensors layer"})
+
+		var b bytes.Buffer
+		if err := json.NewEncoder(&b).Encode(tensors); err != nil {
+			return err
+		}
+
+		layer, err := NewLayer(&b, "application/vnd.ollama.image.tensors")
+		if err != nil {
+			return err
+		}
+
+		layers.Replace(layer)
+	}
+
 	if len(messages) > 0 {
 		fn(api.ProgressResponse{Status: "creating parameters layer"})
 
@@ -539,6 +665,12 @@ func CreateModel(ctx context.Context, name, modelFileDir string, commands []pars
 	if len(params) > 0 {
 		fn(api.ProgressResponse{Status: "creating parameters layer"})
 
+		for _, s := range params["kv_overrides"] {
+			if _, err := api.ParseKVOverride(s); err != nil {
+				return err
+			}
+		}
+
 		formattedParams, err := api.FormatParams(params)
 		if err != nil {
 			return err
@@ -720,6 +852,130 @@ func CopyModel(src, dest string) error {
 	return nil
 }
 
+// UpdateModelOptions merges options into the default options of a model,
+// removing any which are nil, and returns the result. Only the params layer
+// is rewritten so the model's other layers are left as they are.
+func UpdateModelOptions(name string, options map[string]interface{}) (map[string]interface{}, error) {
+	mp := ParseModelPath(name)
+	manifest, _, err := GetManifest(mp)
+	if err != nil {
+		return nil, err
+	}
+
+	model, err := GetModel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string]interface{})
+	for k, v := range model.Options {
+		merged[k] = v
+	}
+
+	for k, v := range options {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = v
+		}
+	}
+
+	opts := api.DefaultOptions()
+	if err := opts.FromMap(merged); err != nil {
+		return nil, codeError{api.ErrorCodeInvalidRequest, err}
+	}
+
+	if err := opts.ValidateSampling(); err != nil {
+		return nil, codeError{api.ErrorCodeInvalidRequest, err}
+	}
+
+	if err := opts.ValidateRunner(); err != nil {
+		return nil, codeError{api.ErrorCodeInvalidRequest, err}
+	}
+
+	if err := opts.ValidateKVOverrides(); err != nil {
+		return nil, codeError{api.ErrorCodeInvalidRequest, err}
+	}
+
+	if err := opts.ValidateTTFT(); err != nil {
+		return nil, codeError{api.ErrorCodeInvalidRequest, err}
+	}
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(merged); err != nil {
+		return nil, err
+	}
+
+	paramsLayer, err := NewLayer(&b, "application/vnd.ollama.image.params")
+	if err != nil {
+		return nil, err
+	}
+
+	deleteMap := make(map[string]struct{})
+	layers := Layers{items: manifest.Layers}
+	for _, layer := range layers.items {
+		if layer.MediaType == paramsLayer.MediaType {
+			deleteMap[layer.Digest] = struct{}{}
+		}
+	}
+
+	layers.Replace(paramsLayer)
+
+	// the config lists the digest of every layer so it changes with the params
+	configPath, err := GetBlobsPath(manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	configFile, err := os.Open(configPath)
+	if err != nil {
+		return nil, err
+	}
+	defer configFile.Close()
+
+	var config ConfigV2
+	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+		return nil, err
+	}
+
+	config.RootFS.DiffIDs = make([]string, len(layers.items))
+	for i, layer := range layers.items {
+		config.RootFS.DiffIDs[i] = layer.Digest
+	}
+
+	b.Reset()
+	if err := json.NewEncoder(&b).Encode(config); err != nil {
+		return nil, err
+	}
+
+	configLayer, err := NewLayer(&b, "application/vnd.docker.container.image.v1+json")
+	if err != nil {
+		return nil, err
+	}
+
+	deleteMap[manifest.Config.Digest] = struct{}{}
+
+	for _, layer := range []*Layer{paramsLayer, configLayer} {
+		if _, err := layer.Commit(); err != nil {
+			return nil, err
+		}
+
+		delete(deleteMap, layer.Digest)
+	}
+
+	if err := WriteManifest(name, configLayer, layers.items); err != nil {
+		return nil, err
+	}
+
+	if noprune := os.Getenv("OLLAMA_NOPRUNE"); noprune == "" {
+		if err := deleteUnusedLayers(nil, deleteMap, false); err != nil {
+			return nil, err
+		}
+	}
+
+	return merged, nil
+}
+
 func deleteUnusedLayers(skipModelPath *ModelPath, deleteMap map[string]struct{}, dryRun bool) error {
 	fp, err := GetManifestPath()
 	if err != nil {
@@ -880,12 +1136,18 @@ func DeleteModel(name string) error {
 func ShowModelfile(model *Model) (string, error) {
 	var mt struct {
 		*Model
-		From       string
-		Parameters map[string][]any
+		From        string
+		Parameters  map[string][]any
+		KVOverrides []any
 	}
 
 	mt.Parameters = make(map[string][]any)
 	for k, v := range model.Options {
+		if k == "kv_overrides" {
+			mt.KVOverrides, _ = v.([]any)
+			continue
+		}
+
 		if s, ok := v.([]any); ok {
 			mt.Parameters[k] = s
 			continue
@@ -906,7 +1168,10 @@ func ShowModelfile(model *Model) (string, error) {
 # FROM {{ .ShortName }}
 
 FROM {{ .From }}
+
+{{- if .Template }}
 TEMPLATE """{{ .Template }}"""
+{{- end }}
 
 {{- if .System }}
 SYSTEM """{{ .System }}"""
@@ -918,11 +1183,23 @@ ADAPTER {{ $adapter }}
 
 {{- range $k, $v := .Parameters }}
 {{- range $parameter := $v }}
-PARAMETER {{ $k }} {{ printf "%#v" $parameter }}
+PARAMETER {{ $k }} {{ quote $parameter }}
 {{- end }}
+{{- end }}
+
+{{- range $override := .KVOverrides }}
+OVERRIDE {{ $override }}
+{{- end }}
+
+{{- range $license := .License }}
+LICENSE """{{ $license }}"""
+{{- end }}
+
+{{- range $message := .Messages }}
+MESSAGE {{ $message.Role }} """{{ $message.Content }}"""
 {{- end }}`
 
-	tmpl, err := template.New("").Parse(modelFile)
+	tmpl, err := template.New("").Funcs(template.FuncMap{"quote": quoteParameter}).Parse(modelFile)
 	if err != nil {
 		slog.Info(fmt.Sprintf("error parsing template: %q", err))
 		return "", err
@@ -938,7 +1215,22 @@ PARAMETER {{ $k }} {{ printf "%#v" $parameter }}
 	return buf.String(), nil
 }
 
-func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
+// quoteParameter formats a parameter value so it's parsed back to the same
+// value, using triple quotes for strings which contain quotes or newlines
+func quoteParameter(v any) string {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprintf("%v", v)
+	}
+
+	if strings.ContainsAny(s, "\"\n") {
+		return `"""` + s + `"""`
+	}
+
+	return `"` + s + `"`
+}
+
+func PushModel(ctx context.Context, name, base, compression string, regOpts *registryOptions, fn func(api.ProgressResponse)) error {
 	mp := ParseModelPath(name)
 	fn(api.ProgressResponse{Status: "retrieving manifest"})
 
@@ -952,6 +1244,28 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return err
 	}
 
+	// blobs of the layers which are only created to push
+	var blobs []string
+	defer func() {
+		for _, blob := range blobs {
+			if err := os.Remove(blob); err != nil {
+				slog.Info(fmt.Sprintf("couldn't remove blob '%s': %v", blob, err))
+			}
+		}
+	}()
+
+	manifest, deltaBlobs, err := deltaManifest(ctx, manifest, base, fn)
+	blobs = append(blobs, deltaBlobs...)
+	if err != nil {
+		return err
+	}
+
+	manifest, compressedBlobs, err := compressManifest(manifest, compression, fn)
+	blobs = append(blobs, compressedBlobs...)
+	if err != nil {
+		return err
+	}
+
 	var layers []*Layer
 	layers = append(layers, manifest.Layers...)
 	layers = append(layers, manifest.Config)
@@ -960,7 +1274,7 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		if err := uploadBlob(ctx, mp, layer, regOpts, fn); err != nil {
 			slog.Info(fmt.Sprintf("error uploading blob: %v", err))
 			if errors.Is(err, errUnauthorized) {
-				return fmt.Errorf("unable to push %s, make sure this namespace exists and you are authorized to push to it", ParseModelPath(name).GetNamespaceRepository())
+				return codeError{api.ErrorCodeUnauthorized, fmt.Errorf("unable to push %s, make sure this namespace exists and you are authorized to push to it", ParseModelPath(name).GetNamespaceRepository())}
 			}
 			return err
 		}
@@ -976,7 +1290,7 @@ func PushModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	}
 
 	headers := make(http.Header)
-	headers.Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+	headers.Set("Content-Type", manifest.MediaType)
 	resp, err := makeRequestWithRetry(ctx, http.MethodPut, requestURL, headers, bytes.NewReader(manifestJSON), regOpts)
 	if err != nil {
 		return err
@@ -1023,11 +1337,90 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		return fmt.Errorf("pull model manifest: %s", err)
 	}
 
+	deltas := splitDeltas(manifest)
+
+	// diffIDs are the digests of compressed layers once they're decompressed
+	var diffIDs []string
+	if slices.ContainsFunc(manifest.Layers, isCompressed) {
+		if err := downloadBlob(ctx, downloadOpts{mp: mp, digest: manifest.Config.Digest, regOpts: regOpts, fn: fn}); err != nil {
+			return err
+		}
+
+		configPath, err := GetBlobsPath(manifest.Config.Digest)
+		if err != nil {
+			return err
+		}
+
+		configFile, err := os.Open(configPath)
+		if err != nil {
+			return err
+		}
+		defer configFile.Close()
+
+		var config ConfigV2
+		if err := json.NewDecoder(configFile).Decode(&config); err != nil {
+			return err
+		}
+
+		diffIDs = config.RootFS.DiffIDs
+		if len(diffIDs) != len(manifest.Layers) {
+			diffIDs = nil
+		}
+	}
+
+	// only the deltas which are used are downloaded, and the layers they
+	// rebuild are stored decompressed
+	delta := usableDelta(manifest, deltas, diffIDs)
+	download, store := pullSize(manifest, diffIDs, delta)
+	if err := checkStorage(store); err != nil {
+		return err
+	}
+
+	if err := waitForOffHours(ctx, download, fn); err != nil {
+		return err
+	}
+
+	if delta != nil {
+		if err := downloadBlob(ctx, downloadOpts{mp: mp, digest: delta.Digest, regOpts: regOpts, fn: fn}); err != nil {
+			return err
+		}
+
+		if err := verifyBlob(delta.Digest); err != nil {
+			return err
+		}
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("applying delta %s", delta.Digest[7:19])})
+		layer, err := applyDelta(delta)
+		if err != nil {
+			return err
+		}
+
+		if err := replaceModelLayer(manifest, layer, diffIDs); err != nil {
+			return err
+		}
+	}
+
 	var layers []*Layer
 	layers = append(layers, manifest.Layers...)
 	layers = append(layers, manifest.Config)
 
-	for _, layer := range layers {
+	for i, layer := range layers {
+		if isCompressed(layer) && diffIDs != nil {
+			// the layer has been pulled and decompressed already
+			if l, err := NewLayerFromLayer(diffIDs[i], strings.TrimSuffix(layer.MediaType, zstdSuffix), ""); err == nil {
+				fn(api.ProgressResponse{
+					Status:    fmt.Sprintf("pulling %s", layer.Digest[7:19]),
+					Digest:    layer.Digest,
+					Total:     layer.Size,
+					Completed: layer.Size,
+				})
+
+				layers[i], manifest.Layers[i] = l, l
+				delete(deleteMap, l.Digest)
+				continue
+			}
+		}
+
 		if err := downloadBlob(
 			ctx,
 			downloadOpts{
@@ -1046,6 +1439,11 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 	for _, layer := range layers {
 		if err := verifyBlob(layer.Digest); err != nil {
 			if errors.Is(err, errDigestMismatch) {
+				// name the corrupt tensor if the model has tensor digests
+				if tErr := verifyLayerTensors(ctx, manifest, layer); tErr != nil {
+					err = fmt.Errorf("%w: %w", err, tErr)
+				}
+
 				// something went wrong, delete the blob
 				fp, err := GetBlobsPath(layer.Digest)
 				if err != nil {
@@ -1060,6 +1458,30 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 		}
 	}
 
+	for i, layer := range manifest.Layers {
+		if !isCompressed(layer) {
+			continue
+		}
+
+		fn(api.ProgressResponse{Status: fmt.Sprintf("decompressing %s", layer.Digest[7:19])})
+
+		var diffID string
+		if diffIDs != nil {
+			diffID = diffIDs[i]
+		}
+
+		l, err := decompressLayer(layer, diffID)
+		if err != nil {
+			return err
+		}
+
+		manifest.Layers[i] = l
+		delete(deleteMap, l.Digest)
+	}
+
+	// layers are stored decompressed, so the manifest is too
+	manifest.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
 	fn(api.ProgressResponse{Status: "writing manifest"})
 
 	manifestJSON, err := json.Marshal(manifest)
@@ -1095,10 +1517,11 @@ func PullModel(ctx context.Context, name string, regOpts *registryOptions, fn fu
 }
 
 func pullModelManifest(ctx context.Context, mp ModelPath, regOpts *registryOptions) (*ManifestV2, error) {
-	requestURL := mp.BaseURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
+	requestURL := mp.PullURL().JoinPath("v2", mp.GetNamespaceRepository(), "manifests", mp.Tag)
 
 	headers := make(http.Header)
-	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	// OCI manifests may have compressed layers
+	headers.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.oci.image.manifest.v1+json")
 	resp, err := makeRequestWithRetry(ctx, http.MethodGet, requestURL, headers, nil, regOpts)
 	if err != nil {
 		return nil, err
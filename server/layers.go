@@ -15,7 +15,9 @@ type Layers struct {
 }
 
 func (ls *Layers) Add(layer *Layer) {
-	if layer.Size > 0 {
+	if layer.Size > 0 && !slices.ContainsFunc(ls.items, func(l *Layer) bool {
+		return l.Digest == layer.Digest
+	}) {
 		ls.items = append(ls.items, layer)
 	}
 }
@@ -37,6 +39,13 @@ type Layer struct {
 	Size      int64  `json:"size"`
 	From      string `json:"from,omitempty"`
 
+	// Base is the digest of the layer a delta layer rebuilds its layer from
+	Base string `json:"base,omitempty"`
+
+	// DecompressedSize is the size of a compressed layer once it's
+	// decompressed
+	DecompressedSize int64 `json:"decompressedSize,omitempty"`
+
 	tempFileName string
 }
 
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// liveOptions are the options of the loaded model changed with
+// /api/models/{model}/reload-options. Requests to the model run with them
+// until it's unloaded, overriding the model's own options. They have their
+// own lock since options are merged before loaded.mu is locked.
+var liveOptions struct {
+	mu      sync.Mutex
+	model   string
+	options map[string]interface{}
+}
+
+// liveRunnerOptions are the runner options which can be changed while a model
+// is loaded. The others change the weights or the context.
+var liveRunnerOptions = []string{"num_thread", "num_batch"}
+
+// getLiveOptions returns the live options of the model, if it's the loaded one
+func getLiveOptions(model *Model) map[string]interface{} {
+	liveOptions.mu.Lock()
+	defer liveOptions.mu.Unlock()
+
+	if liveOptions.model != model.Name {
+		return nil
+	}
+
+	return liveOptions.options
+}
+
+func setLiveOptions(model *Model, options map[string]interface{}) {
+	liveOptions.mu.Lock()
+	defer liveOptions.mu.Unlock()
+
+	liveOptions.model, liveOptions.options = model.Name, options
+}
+
+// clearLiveOptions removes the live options when the loaded model is unloaded
+func clearLiveOptions() {
+	liveOptions.mu.Lock()
+	defer liveOptions.mu.Unlock()
+
+	liveOptions.model, liveOptions.options = "", nil
+}
+
+// isRunnerOption reports whether key is an option of the runner, rather than
+// of predictions
+func isRunnerOption(key string) bool {
+	for _, field := range reflect.VisibleFields(reflect.TypeOf(api.Runner{})) {
+		if strings.Split(field.Tag.Get("json"), ",")[0] == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ReloadOptionsHandler(c *gin.Context) {
+	name, ok := modelPathName(c, "/reload-options")
+	if !ok {
+		abortWithError(c, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	var req api.ReloadOptionsRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	model, err := GetModel(routeAlias(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", name)))
+		} else {
+			abortWithError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	if loaded.runner == nil || loaded.Name != model.Name {
+		abortWithError(c, http.StatusNotFound, fmt.Errorf("model '%s' isn't loaded", name))
+		return
+	}
+
+	options := maps.Clone(getLiveOptions(model))
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+
+	for key, value := range req.Options {
+		if isRunnerOption(key) && !slices.Contains(liveRunnerOptions, key) {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("%w: %s can't be changed without loading the model again", api.ErrInvalidOpts, key))
+			return
+		}
+
+		if value == nil {
+			delete(options, key)
+		} else {
+			options[key] = value
+		}
+	}
+
+	opts, err := mergeOptions(model, options, nil)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if opts.NumThread != loaded.Options.NumThread || opts.NumBatch != loaded.Options.NumBatch {
+		runner, ok := loaded.runner.(llm.Reconfigurer)
+		if !ok {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("%w: the %s runner can't change num_thread or num_batch without loading the model again", api.ErrInvalidOpts, loaded.runner.Library()))
+			return
+		}
+
+		if err := runner.Reconfigure(opts.NumThread, opts.NumBatch); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		// the runner options are compared with the loaded ones by requests, so
+		// they run without loading the model again
+		loaded.Options.NumThread, loaded.Options.NumBatch = opts.NumThread, opts.NumBatch
+	}
+
+	setLiveOptions(model, options)
+
+	if req.KeepAlive != nil {
+		keepLoaded(req.KeepAlive.Duration)
+	}
+
+	c.JSON(http.StatusOK, api.ReloadOptionsResponse{Options: options, ExpiresAt: loaded.expireAt})
+}
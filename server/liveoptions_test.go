@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+type reconfigurableLLM struct {
+	MockLLM
+	numThread, numBatch int
+}
+
+func (llm *reconfigurableLLM) Reconfigure(numThread, numBatch int) error {
+	llm.numThread, llm.numBatch = numThread, numBatch
+	return nil
+}
+
+func TestReloadOptions(t *testing.T) {
+	runner := &reconfigurableLLM{}
+	model := loadMockModel(t, "live", "PARAMETER temperature 0.5", runner)
+	createMockModel(t, "other", "PARAMETER temperature 0.5")
+	t.Cleanup(clearLiveOptions)
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	reload := func(name string, req any) (int, api.ReloadOptionsResponse) {
+		bts, err := json.Marshal(req)
+		assert.Nil(t, err)
+
+		resp, err := http.Post(srv.URL+"/api/models/"+name+"/reload-options", "application/json", bytes.NewReader(bts))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		var r api.ReloadOptionsResponse
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&r))
+		}
+
+		return resp.StatusCode, r
+	}
+
+	status, resp := reload("live", map[string]any{
+		"options":    map[string]interface{}{"num_thread": 4, "num_batch": 256, "temperature": 0.1},
+		"keep_alive": "1h",
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]interface{}{"num_thread": 4.0, "num_batch": 256.0, "temperature": 0.1}, resp.Options)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), resp.ExpiresAt, time.Minute)
+
+	assert.Equal(t, 4, runner.numThread)
+	assert.Equal(t, 256, runner.numBatch)
+
+	// requests run with the live options without loading the model again
+	opts, err := modelOptions(model, nil)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.1, opts.Temperature, 1e-6)
+	assert.False(t, runnerChanged(loaded.Options.Runner, opts.Runner))
+	assert.True(t, hasOption(model, nil, "temperature"))
+
+	// live options are only used by the loaded model
+	other, err := GetModel("other")
+	assert.Nil(t, err)
+	opts, err = modelOptions(other, nil)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.5, opts.Temperature, 1e-6)
+
+	// null resets an option to the model's own
+	status, resp = reload("live", api.ReloadOptionsRequest{Options: map[string]interface{}{"temperature": nil}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]interface{}{"num_thread": 4.0, "num_batch": 256.0}, resp.Options)
+
+	opts, err = modelOptions(model, nil)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.5, opts.Temperature, 1e-6)
+
+	// options which change the context need the model to be loaded again
+	status, _ = reload("live", api.ReloadOptionsRequest{Options: map[string]interface{}{"num_ctx": 4096}})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = reload("live", api.ReloadOptionsRequest{Options: map[string]interface{}{"temperature": "hot"}})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = reload("other", api.ReloadOptionsRequest{Options: map[string]interface{}{"num_thread": 2}})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	status, _ = reload("missing", api.ReloadOptionsRequest{})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// live options are removed when the model is unloaded
+	clearLiveOptions()
+	assert.Nil(t, getLiveOptions(model))
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// loading is the progress of the model being loaded. It has its own lock
+// since loaded.mu is held for as long as the model loads.
+var loading struct {
+	mu       sync.Mutex
+	progress *api.LoadProgress
+}
+
+func setLoadProgress(p *api.LoadProgress) {
+	loading.mu.Lock()
+	defer loading.mu.Unlock()
+
+	loading.progress = p
+}
+
+// loadProgress returns the progress of loading the named model, or nil if
+// it isn't being loaded
+func loadProgress(name string) *api.LoadProgress {
+	loading.mu.Lock()
+	defer loading.mu.Unlock()
+
+	if loading.progress == nil || loading.progress.Model != ParseModelPath(name).GetShortTagname() {
+		return nil
+	}
+
+	p := *loading.progress
+	return &p
+}
+
+// writeLoadProgress streams a response while the model loads, before the
+// response is streamed by streamResponse
+func writeLoadProgress(c *gin.Context, resp any) {
+	if !c.Writer.Written() {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+
+	bts, err := json.Marshal(resp)
+	if err != nil {
+		slog.Info(fmt.Sprintf("writeLoadProgress: json.Marshal failed with %s", err))
+		return
+	}
+
+	bts = append(bts, '\n')
+	if _, err := c.Writer.Write(bts); err != nil {
+		slog.Info(fmt.Sprintf("writeLoadProgress: failed to write: %s", err))
+		return
+	}
+
+	c.Writer.Flush()
+}
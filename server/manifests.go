@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 func WriteManifest(name string, config *Layer, layers []*Layer) error {
@@ -32,3 +33,23 @@ func WriteManifest(name string, config *Layer, layers []*Layer) error {
 
 	return os.WriteFile(manifestPath, b.Bytes(), 0o644)
 }
+
+// walkManifests calls fn with the name and file info of each manifest in the
+// models directory
+func walkManifests(fn func(name string, info os.FileInfo) error) error {
+	manifestsPath, err := GetManifestPath()
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(manifestsPath, func(path string, info os.FileInfo, _ error) error {
+		if info == nil || info.IsDir() {
+			return nil
+		}
+
+		path, tag := filepath.Split(path)
+		model := strings.Trim(strings.TrimPrefix(path, manifestsPath), string(os.PathSeparator))
+		modelPath := strings.Join([]string{model, tag}, ":")
+		return fn(strings.ReplaceAll(modelPath, string(os.PathSeparator), "/"), info)
+	})
+}
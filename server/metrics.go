@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeMetric writes a metric in the Prometheus text format
+func writeMetric(w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// MetricsHandler reports the server's metrics in the Prometheus text format
+func MetricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	writeCacheMetrics(c.Writer, "embedding", "Embeddings", embeddingCache.stats())
+	writeCacheMetrics(c.Writer, "response", "Responses", responseCache.stats())
+}
+
+// writeCacheMetrics writes the metrics of a disk cache of what, such as
+// "Embeddings"
+func writeCacheMetrics(w io.Writer, name, what string, stats diskCacheStats) {
+	prefix := "ollama_" + name + "_cache"
+	writeMetric(w, prefix+"_hits_total", "counter", what+" served from the cache.", stats.hits)
+	writeMetric(w, prefix+"_misses_total", "counter", what+" which weren't in the cache.", stats.misses)
+	writeMetric(w, prefix+"_evictions_total", "counter", what+" removed to keep the cache within its size.", stats.evictions)
+	writeMetric(w, prefix+"_entries", "gauge", what+" in the cache.", stats.entries)
+	writeMetric(w, prefix+"_bytes", "gauge", "Bytes the cached "+strings.ToLower(what)+" use.", stats.size)
+}
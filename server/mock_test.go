@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+	"github.com/jmorganca/ollama/parser"
+)
+
+type MockLLM struct {
+	encoding []int
+	predict  func(llm.PredictOpts, func(llm.PredictResult)) error
+	embed    func(llm.EmbeddingOpts) ([]float64, error)
+}
+
+func (llm *MockLLM) Predict(ctx context.Context, pred llm.PredictOpts, fn func(llm.PredictResult)) error {
+	if llm.predict != nil {
+		return llm.predict(pred, fn)
+	}
+
+	return nil
+}
+
+func (llm *MockLLM) Encode(ctx context.Context, prompt string) ([]int, error) {
+	return llm.encoding, nil
+}
+
+func (llm *MockLLM) Decode(ctx context.Context, tokens []int) (string, error) {
+	return "", nil
+}
+
+func (llm *MockLLM) Embedding(ctx context.Context, embed llm.EmbeddingOpts) ([]float64, error) {
+	if llm.embed != nil {
+		return llm.embed(embed)
+	}
+
+	return []float64{}, nil
+}
+
+func (llm *MockLLM) Library() string {
+	return "mock"
+}
+
+func (llm *MockLLM) Close() {
+	// do nothing
+}
+
+// mockModelFile writes a placeholder model file with the given content after
+// its magic, so models created from different files have different blobs
+func mockModelFile(t *testing.T, content string) string {
+	t.Helper()
+
+	name := filepath.Join(t.TempDir(), "ollama-model")
+	require.NoError(t, os.WriteFile(name, []byte("GGUF\x02\x00"+content), 0o644))
+	return name
+}
+
+// createMockModel creates a model from a placeholder model file and the rest
+// of modelfile, in the models directory the caller has set OLLAMA_MODELS to
+func createMockModel(t *testing.T, name, modelfile string) *Model {
+	t.Helper()
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + mockModelFile(t, name) + "\n" + modelfile))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(context.TODO(), name, "", commands, func(api.ProgressResponse) {}))
+
+	model, err := GetModel(name)
+	require.NoError(t, err)
+	return model
+}
+
+// loadMockModel creates a model in a temporary models directory and loads it
+// with runner, until the test is cleaned up
+func loadMockModel(t *testing.T, name, modelfile string, runner llm.LLM) *Model {
+	t.Helper()
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	model := createMockModel(t, name, modelfile)
+
+	opts, err := modelOptions(model, nil)
+	require.NoError(t, err)
+
+	loaded.mu.Lock()
+	loaded.runner = runner
+	loaded.Model = model
+	loaded.Options = &opts
+	loaded.mu.Unlock()
+
+	t.Cleanup(func() {
+		loaded.mu.Lock()
+		defer loaded.mu.Unlock()
+		loaded.runner = nil
+		loaded.Model = nil
+		loaded.Options = nil
+		if loaded.expireTimer != nil {
+			loaded.expireTimer.Stop()
+		}
+	})
+
+	return model
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -129,6 +130,27 @@ func (mp ModelPath) BaseURL() *url.URL {
 	}
 }
 
+// PullURL returns the base URL to pull from, which is the registry's mirror
+// if one is set in OLLAMA_REGISTRY_MIRRORS
+func (mp ModelPath) PullURL() *url.URL {
+	for _, pair := range strings.Split(os.Getenv("OLLAMA_REGISTRY_MIRRORS"), ",") {
+		registry, mirror, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(registry) != mp.Registry {
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimSpace(mirror))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			slog.Warn(fmt.Sprintf("invalid mirror for %s: %q", mp.Registry, mirror))
+			break
+		}
+
+		return u
+	}
+
+	return mp.BaseURL()
+}
+
 func GetManifestPath() (string, error) {
 	dir, err := modelsDir()
 	if err != nil {
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package server
+
+func notifyReady() {}
+
+func notifyStopping() {}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// sdNotify sends a state change to systemd when running as a Type=notify
+// service, see sd_notify(3)
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to notify systemd: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn(fmt.Sprintf("failed to notify systemd: %v", err))
+	}
+}
+
+func notifyReady() {
+	sdNotify("READY=1")
+}
+
+func notifyStopping() {
+	sdNotify("STOPPING=1")
+}
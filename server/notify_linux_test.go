@@ -0,0 +1,46 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	for name, socket := range map[string]string{
+		"path":     filepath.Join(t.TempDir(), "notify"),
+		"abstract": fmt.Sprintf("@ollama-notify-%d", os.Getpid()),
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+			require.NoError(t, err)
+			defer conn.Close()
+
+			t.Setenv("NOTIFY_SOCKET", socket)
+
+			read := func() string {
+				require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+				b := make([]byte, 64)
+				n, err := conn.Read(b)
+				require.NoError(t, err)
+				return string(b[:n])
+			}
+
+			notifyReady()
+			assert.Equal(t, "READY=1", read())
+
+			notifyStopping()
+			assert.Equal(t, "STOPPING=1", read())
+		})
+	}
+
+	// without a socket, as when it isn't run by systemd, there's nothing to notify
+	t.Setenv("NOTIFY_SOCKET", "")
+	notifyReady()
+}
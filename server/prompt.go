@@ -54,6 +54,11 @@ func formatTemplateForResponse(tmpl *template.Template, generate bool) {
 // Prompt renders a prompt from a template. If generate is set to true,
 // the response and parts of the template following it are not rendered
 func Prompt(tmpl, system, prompt, response string, generate bool) (string, error) {
+	return toolsPrompt(tmpl, system, prompt, response, nil, generate)
+}
+
+// toolsPrompt is Prompt with tools, which are rendered as .Tools
+func toolsPrompt(tmpl, system, prompt, response string, tools []api.Tool, generate bool) (string, error) {
 	parsed, err := template.New("").Option("missingkey=zero").Parse(tmpl)
 	if err != nil {
 		return "", err
@@ -65,6 +70,7 @@ func Prompt(tmpl, system, prompt, response string, generate bool) (string, error
 		"System":   system,
 		"Prompt":   prompt,
 		"Response": response,
+		"Tools":    tools,
 	}
 
 	var sb strings.Builder
@@ -75,8 +81,8 @@ func Prompt(tmpl, system, prompt, response string, generate bool) (string, error
 	return sb.String(), nil
 }
 
-func countTokens(tmpl string, system string, prompt string, response string, encode func(string) ([]int, error)) (int, error) {
-	rendered, err := Prompt(tmpl, system, prompt, response, false)
+func countTokens(tmpl string, system string, prompt string, response string, tools []api.Tool, encode func(string) ([]int, error)) (int, error) {
+	rendered, err := toolsPrompt(tmpl, system, prompt, response, tools, false)
 	if err != nil {
 		return 0, err
 	}
@@ -90,8 +96,44 @@ func countTokens(tmpl string, system string, prompt string, response string, enc
 	return len(tokens), err
 }
 
+// KeepTokens returns the number of tokens at the start of the rendered prompt
+// which belong to the system message. The runner keeps these tokens when it
+// shifts the context window so the system message is never discarded.
+func KeepTokens(tmpl, system, prompt string, encode func(string) ([]int, error)) (int, error) {
+	if system == "" {
+		return 0, nil
+	}
+
+	prefix, err := Prompt(tmpl, system, "", "", true)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for n < len(prefix) && n < len(prompt) && prefix[n] == prompt[n] {
+		n++
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	tokens, err := encode(prompt[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	return len(tokens), nil
+}
+
 // ChatPrompt builds up a prompt from a series of messages, truncating based on context window size
 func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(string) ([]int, error)) (string, error) {
+	return chatToolsPrompt(tmpl, messages, nil, window, encode)
+}
+
+// chatToolsPrompt is ChatPrompt with tools, which are rendered in the last
+// prompt, the one the response is generated for
+func chatToolsPrompt(tmpl string, messages []api.Message, tools []api.Tool, window int, encode func(string) ([]int, error)) (string, error) {
 	type prompt struct {
 		System   string
 		Prompt   string
@@ -147,9 +189,17 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 		prompts = append(prompts, p)
 	}
 
+	toolsOf := func(i int) []api.Tool {
+		if i == len(prompts)-1 {
+			return tools
+		}
+
+		return nil
+	}
+
 	// calculate token lengths for each prompt, estimating 768 tokens per images
 	for i, p := range prompts {
-		tokens, err := countTokens(tmpl, p.System, p.Prompt, p.Response, encode)
+		tokens, err := countTokens(tmpl, p.System, p.Prompt, p.Response, toolsOf(i), encode)
 		if err != nil {
 			return "", err
 		}
@@ -192,7 +242,7 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 			if system != "" && prompts[0].System == "" {
 				prompts[0].System = system
 
-				tokens, err := countTokens(tmpl, prompts[0].System, prompts[0].Prompt, prompts[0].Response, encode)
+				tokens, err := countTokens(tmpl, prompts[0].System, prompts[0].Prompt, prompts[0].Response, toolsOf(0), encode)
 				if err != nil {
 					return "", err
 				}
@@ -210,7 +260,7 @@ func ChatPrompt(tmpl string, messages []api.Message, window int, encode func(str
 	var sb strings.Builder
 	for i, p := range prompts {
 		// last prompt should leave the response unrendered (for completion)
-		rendered, err := Prompt(tmpl, p.System, p.Prompt, p.Response, i == len(prompts)-1)
+		rendered, err := toolsPrompt(tmpl, p.System, p.Prompt, p.Response, toolsOf(i), i == len(prompts)-1)
 		if err != nil {
 			return "", err
 		}
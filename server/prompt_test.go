@@ -203,3 +203,52 @@ func TestChatPrompt(t *testing.T) {
 		})
 	}
 }
+
+func TestKeepTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		system   string
+		prompt   string
+		want     int
+	}{
+		{
+			name:     "no system",
+			template: "[INST] {{ .Prompt }} [/INST]",
+			prompt:   "[INST] Hello [/INST]",
+			want:     0,
+		},
+		{
+			name:     "system",
+			template: "[INST] {{ if .System }}<<SYS>> {{ .System }} <</SYS>> {{ end }}{{ .Prompt }} [/INST]",
+			system:   "You are a Wizard.",
+			prompt:   "[INST] <<SYS>> You are a Wizard. <</SYS>> Hello [/INST]",
+			want:     7,
+		},
+		{
+			name:     "system after prompt",
+			template: "{{ .Prompt }} {{ .System }}",
+			system:   "You are a Wizard.",
+			prompt:   "Hello You are a Wizard.",
+			want:     0,
+		},
+	}
+
+	encode := func(s string) ([]int, error) {
+		words := strings.Fields(s)
+		return make([]int, len(words)), nil
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := KeepTokens(tc.template, tc.system, tc.prompt, encode)
+			if err != nil {
+				t.Errorf("error = %v", err)
+			}
+
+			if got != tc.want {
+				t.Errorf("got: %d, want: %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const defaultMaxQueue = 512
+
+var errQueueFull = errors.New("server busy, too many requests queued")
+
+// requests is the queue of requests waiting for the loaded model. Only one
+// request uses it at a time, so the rest wait in order of priority, and then
+// in the order they arrived.
+var requests queue
+
+type queue struct {
+	mu      sync.Mutex
+	running bool
+	waiting []*queued
+	seq     uint64
+
+	// average is a moving average of how long requests run for
+	average time.Duration
+}
+
+type queued struct {
+	path     string
+	priority int
+	since    time.Time
+	seq      uint64
+	ready    chan struct{}
+}
+
+// getMaxQueue returns how many requests can wait, set by OLLAMA_MAX_QUEUE
+func getMaxQueue() int {
+	if n, err := strconv.Atoi(os.Getenv("OLLAMA_MAX_QUEUE")); err == nil && n >= 0 {
+		return n
+	}
+
+	return defaultMaxQueue
+}
+
+// acquire waits for the request's turn. It returns errQueueFull without
+// waiting if too many requests are waiting already.
+func (q *queue) acquire(ctx context.Context, path string, priority int) error {
+	q.mu.Lock()
+	if !q.running && len(q.waiting) == 0 {
+		q.running = true
+		q.mu.Unlock()
+		return nil
+	}
+
+	if len(q.waiting) >= getMaxQueue() {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+
+	q.seq++
+	r := &queued{path: path, priority: priority, since: time.Now(), seq: q.seq, ready: make(chan struct{})}
+	i, _ := slices.BinarySearchFunc(q.waiting, r, func(a, b *queued) int {
+		if a.priority != b.priority {
+			return cmp.Compare(b.priority, a.priority)
+		}
+
+		return cmp.Compare(a.seq, b.seq)
+	})
+
+	q.waiting = slices.Insert(q.waiting, i, r)
+	q.mu.Unlock()
+
+	select {
+	case <-r.ready:
+		return nil
+	case <-ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		select {
+		case <-r.ready:
+			// it was the request's turn already, so pass it on
+			q.next()
+		default:
+			q.waiting = slices.DeleteFunc(q.waiting, func(w *queued) bool { return w == r })
+		}
+
+		return ctx.Err()
+	}
+}
+
+// release ends a request which started at start, letting the next one run
+func (q *queue) release(start time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	elapsed := time.Since(start)
+	if q.average == 0 {
+		q.average = elapsed
+	} else {
+		q.average = (q.average*9 + elapsed) / 10
+	}
+
+	q.next()
+}
+
+// next starts the next request, if there is one. It is up to the caller to
+// lock q.mu.
+func (q *queue) next() {
+	if len(q.waiting) == 0 {
+		q.running = false
+		return
+	}
+
+	r := q.waiting[0]
+	q.waiting = q.waiting[1:]
+	close(r.ready)
+}
+
+// queued returns how many requests are waiting
+func (q *queue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.waiting)
+}
+
+// retryAfter estimates how many seconds until the queue has room
+func (q *queue) retryAfter() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return max(1, int(math.Ceil(q.average.Seconds())))
+}
+
+func (q *queue) status() api.QueueResponse {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	resp := api.QueueResponse{Running: q.running, MaxQueue: getMaxQueue(), Queued: []api.QueuedRequest{}}
+	for _, r := range q.waiting {
+		resp.Queued = append(resp.Queued, api.QueuedRequest{Path: r.path, Priority: r.priority, QueuedAt: r.since})
+	}
+
+	return resp
+}
+
+// queueRequest waits for the request's turn, like queueMiddleware, for
+// handlers which only sometimes use the model. It returns the func which ends
+// the request's turn. If the request can't wait the response is written and
+// false is returned.
+func queueRequest(c *gin.Context) (func(), bool) {
+	var priority int
+	if p := c.GetHeader("X-Ollama-Priority"); p != "" {
+		var err error
+		if priority, err = strconv.Atoi(p); err != nil {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("invalid priority %q", p))
+			return nil, false
+		}
+	}
+
+	if err := requests.acquire(c.Request.Context(), c.Request.URL.Path, priority); errors.Is(err, errQueueFull) {
+		c.Header("Retry-After", strconv.Itoa(requests.retryAfter()))
+		abortWithError(c, http.StatusTooManyRequests, err)
+		return nil, false
+	} else if err != nil {
+		// the client went away
+		c.Abort()
+		return nil, false
+	}
+
+	start := time.Now()
+	return func() { requests.release(start) }, true
+}
+
+// queueMiddleware holds requests until it's their turn. Priority is set with
+// the X-Ollama-Priority header, higher first.
+func queueMiddleware(c *gin.Context) {
+	release, ok := queueRequest(c)
+	if !ok {
+		return
+	}
+	defer release()
+
+	c.Next()
+}
+
+func QueueHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, requests.status())
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestQueue(t *testing.T) {
+	var q queue
+	require.NoError(t, q.acquire(context.Background(), "/api/generate", 0))
+
+	order := make(chan string, 3)
+	wait := func(name string, priority int) {
+		go func() {
+			if err := q.acquire(context.Background(), name, priority); err == nil {
+				order <- name
+				q.release(time.Now())
+			}
+		}()
+
+		// wait for the request to be queued so arrival order is deterministic
+		require.Eventually(t, func() bool {
+			return strings.Contains(strings.Join(queuedPaths(&q), ","), name)
+		}, time.Second, time.Millisecond)
+	}
+
+	wait("low", 0)
+	wait("high", 10)
+	wait("low-later", 0)
+
+	assert.Equal(t, []string{"high", "low", "low-later"}, queuedPaths(&q))
+
+	q.release(time.Now())
+	assert.Equal(t, "high", <-order)
+	assert.Equal(t, "low", <-order)
+	assert.Equal(t, "low-later", <-order)
+
+	assert.Eventually(t, func() bool { return !q.status().Running }, time.Second, time.Millisecond)
+
+	t.Run("cancel", func(t *testing.T) {
+		require.NoError(t, q.acquire(context.Background(), "/api/generate", 0))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- q.acquire(ctx, "cancelled", 0) }()
+
+		require.Eventually(t, func() bool { return len(queuedPaths(&q)) == 1 }, time.Second, time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+		assert.Empty(t, queuedPaths(&q))
+
+		q.release(time.Now())
+		assert.False(t, q.status().Running)
+	})
+
+	t.Run("full", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_QUEUE", "0")
+
+		require.NoError(t, q.acquire(context.Background(), "/api/generate", 0))
+		defer q.release(time.Now())
+
+		assert.ErrorIs(t, q.acquire(context.Background(), "/api/generate", 0), errQueueFull)
+	})
+}
+
+func queuedPaths(q *queue) []string {
+	var paths []string
+	for _, r := range q.status().Queued {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func TestQueueFullResponse(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_QUEUE", "0")
+
+	require.NoError(t, requests.acquire(context.Background(), "/api/generate", 0))
+	defer requests.release(time.Now())
+
+	var s Server
+	srv := httptest.NewServer(s.GenerateRoutes())
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/generate", "application/json", strings.NewReader(`{"model": "test"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	var body struct {
+		Code api.ErrorCode `json:"code"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, api.ErrorCodeQueueFull, body.Code)
+
+	resp, err = http.Get(srv.URL + "/api/queue")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	var queue api.QueueResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&queue))
+	assert.True(t, queue.Running)
+	assert.Equal(t, 0, queue.MaxQueue)
+}
+
+func TestTokenizeQueue(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_MAX_QUEUE", "0")
+
+	cached := createMockModel(t, "cached", "")
+	createMockModel(t, "runner", "")
+
+	tok, err := llm.NewTokenizer(llm.KV{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.tokens": []any{"a", "b"}})
+	require.NoError(t, err)
+	storeTokenizer(filepath.Base(cached.ModelPath), tok)
+	t.Cleanup(resetTokenizers)
+
+	require.NoError(t, requests.acquire(context.Background(), "/api/generate", 0))
+	defer requests.release(time.Now())
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	defer srv.Close()
+
+	tokenize := func(model string) *http.Response {
+		resp, err := http.Post(srv.URL+"/api/tokenize", "application/json", strings.NewReader(`{"model": "`+model+`", "prompt": "ab"}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// models tokenized from their vocabulary don't wait for the queue
+	assert.Equal(t, http.StatusOK, tokenize("cached").StatusCode)
+
+	// the rest use the runner once it's their turn
+	assert.Equal(t, http.StatusTooManyRequests, tokenize("runner").StatusCode)
+}
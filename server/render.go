@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// templateFields are the fields a prompt template is rendered with
+var templateFields = []string{"System", "Prompt", "Response", "Tools"}
+
+// lintTemplate parses a template and returns warnings for what it's likely
+// to render wrong
+func lintTemplate(tmpl string) ([]string, error) {
+	used, err := templateVars(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	if !used["Prompt"] {
+		warnings = append(warnings, "the template doesn't use .Prompt, so prompts aren't rendered")
+	}
+
+	if !used["Response"] {
+		warnings = append(warnings, "the template doesn't use .Response, so responses are added at the end")
+	}
+
+	var unknown []string
+	for field := range used {
+		if !slices.Contains(templateFields, field) {
+			unknown = append(unknown, field)
+		}
+	}
+
+	slices.Sort(unknown)
+	for _, field := range unknown {
+		warnings = append(warnings, fmt.Sprintf("the template uses .%s, which isn't a template variable", field))
+	}
+
+	return warnings, nil
+}
+
+// RenderTemplateHandler renders the prompt a generate or chat request would
+// be run with, without running it. The prompt of a chat request is truncated
+// to the context window like it would be when a model is given.
+func RenderTemplateHandler(c *gin.Context) {
+	var req api.RenderTemplateRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	case req.Model == "" && req.Template == "":
+		abortWithError(c, http.StatusBadRequest, errors.New("model or template is required"))
+		return
+	case len(req.Messages) > 0 && (req.System != "" || req.Prompt != ""):
+		abortWithError(c, http.StatusBadRequest, errors.New("system and prompt can't be used with messages"))
+		return
+	}
+
+	tmpl, system := req.Template, req.System
+	numCtx := math.MaxInt
+	encode := func(string) ([]int, error) { return nil, nil }
+
+	var tokenizer tokenizer
+	if req.Model != "" {
+		model, err := GetModel(resolveAlias(req.Model))
+		if err != nil {
+			var pErr *fs.PathError
+			if errors.As(err, &pErr) {
+				abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found, try pulling it first", req.Model)))
+				return
+			}
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		if tmpl == "" {
+			tmpl = model.Template
+		}
+
+		if system == "" {
+			system = model.System
+		}
+
+		opts, err := modelOptions(model, req.Options)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		var release func()
+		var ok bool
+		if tokenizer, release, ok = requestTokenizer(c, req.Model, req.Options, req.KeepAlive); !ok {
+			return
+		}
+		defer release()
+
+		numCtx, encode = opts.NumCtx, tokenizer.Encode
+	}
+
+	warnings, err := lintTemplate(tmpl)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("invalid template: %w", err))
+		return
+	}
+
+	if len(req.Tools) > 0 && !slices.Contains(templateCapabilities(tmpl), "tools") {
+		abortWithError(c, http.StatusBadRequest, errors.New("the template doesn't use .Tools, so tools can't be rendered"))
+		return
+	}
+
+	var prompt string
+	if len(req.Messages) > 0 {
+		messages := req.Messages
+		if messages[0].Role != "system" {
+			messages = append([]api.Message{{Role: "system", Content: system}}, messages...)
+		}
+
+		system = messages[0].Content
+
+		prompt, err = chatToolsPrompt(tmpl, messages, req.Tools, numCtx, encode)
+	} else {
+		prompt, err = toolsPrompt(tmpl, system, req.Prompt, "", req.Tools, true)
+	}
+
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if system != "" && !strings.Contains(prompt, system) {
+		warnings = append(warnings, "the system message isn't in the prompt")
+	}
+
+	resp := api.RenderTemplateResponse{Prompt: prompt, Warnings: warnings}
+	if tokenizer != nil {
+		tokens, err := tokenizer.Encode(prompt)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		resp.TokenCount = len(tokens)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	loadMockModel(t, "render", "TEMPLATE \"{{ if .System }}<<{{ .System }}>> {{ end }}[INST] {{ .Prompt }} [/INST]{{ .Response }}\"\nSYSTEM \"Be brief.\"", &MockLLM{encoding: []int{1, 2, 3}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	render := func(req api.RenderTemplateRequest) (int, api.RenderTemplateResponse) {
+		bts, err := json.Marshal(req)
+		assert.Nil(t, err)
+
+		resp, err := http.Post(srv.URL+"/api/template/render", "application/json", bytes.NewReader(bts))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		var body api.RenderTemplateResponse
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+		}
+
+		return resp.StatusCode, body
+	}
+
+	status, resp := render(api.RenderTemplateRequest{Model: "render", Prompt: "Hi"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "<<Be brief.>> [INST] Hi [/INST]", resp.Prompt)
+	assert.Equal(t, 3, resp.TokenCount)
+	assert.Empty(t, resp.Warnings)
+
+	status, resp = render(api.RenderTemplateRequest{Model: "render", Messages: []api.Message{
+		{Role: "user", Content: "Hi"},
+		{Role: "assistant", Content: "Hello"},
+		{Role: "user", Content: "Bye"},
+	}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "<<Be brief.>> [INST] Hi [/INST]Hello[INST] Bye [/INST]", resp.Prompt)
+
+	// a raw template is rendered without a model, so it isn't tokenized
+	status, resp = render(api.RenderTemplateRequest{Template: "{{ .System }} {{ .Promt }}", System: "sys", Prompt: "Hi"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "sys <no value>", resp.Prompt)
+	assert.Equal(t, 0, resp.TokenCount)
+	assert.Equal(t, []string{
+		"the template doesn't use .Prompt, so prompts aren't rendered",
+		"the template doesn't use .Response, so responses are added at the end",
+		"the template uses .Promt, which isn't a template variable",
+	}, resp.Warnings)
+
+	// tools are rendered with the last message
+	tools := []api.Tool{{Type: "function", Function: api.ToolFunction{Name: "weather"}}}
+	status, resp = render(api.RenderTemplateRequest{
+		Template: "{{ range .Tools }}<{{ .Function.Name }}>{{ end }}[INST] {{ .Prompt }} [/INST]{{ .Response }}",
+		Messages: []api.Message{
+			{Role: "user", Content: "Hi"},
+			{Role: "assistant", Content: "Hello"},
+			{Role: "user", Content: "Weather?"},
+		},
+		Tools: tools,
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "[INST] Hi [/INST]Hello<weather>[INST] Weather? [/INST]", resp.Prompt)
+	assert.Empty(t, resp.Warnings)
+
+	// and templates which don't use them can't render them
+	status, _ = render(api.RenderTemplateRequest{Model: "render", Prompt: "Hi", Tools: tools})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = render(api.RenderTemplateRequest{Template: "{{ .Prompt "})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = render(api.RenderTemplateRequest{Prompt: "Hi"})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = render(api.RenderTemplateRequest{Model: "missing", Prompt: "Hi"})
+	assert.Equal(t, http.StatusNotFound, status)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+	"github.com/jmorganca/ollama/version"
+)
+
+// responseCache caches the responses of deterministic generate requests when
+// OLLAMA_RESPONSE_CACHE is set to how many bytes it can use
+var responseCache = &diskCache{name: "responses", env: "OLLAMA_RESPONSE_CACHE"}
+
+// cachedResponse is a generate response as it's cached
+type cachedResponse struct {
+	Response        string `json:"response"`
+	Context         []int  `json:"context,omitempty"`
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+}
+
+// deterministic reports whether requests with the options generate the same
+// response each time they're run: sampling is greedy and the seed is fixed
+func deterministic(opts api.Options) bool {
+	return opts.Temperature == 0 && opts.Seed >= 0
+}
+
+// responseKey identifies the response of a request with the manifest digest
+// of the model, the runner it's run with, and everything the runner is sent.
+// The context of the request is part of the response's context.
+func responseKey(model *Model, library string, predict llm.PredictOpts, context []int, raw bool) string {
+	return diskCacheKey(struct {
+		Version string          `json:"version"`
+		Library string          `json:"library"`
+		Digest  string          `json:"digest"`
+		Prompt  string          `json:"prompt"`
+		Suffix  string          `json:"suffix"`
+		Format  string          `json:"format"`
+		Images  []llm.ImageData `json:"images"`
+		Options api.Options     `json:"options"`
+		Context []int           `json:"context"`
+		Raw     bool            `json:"raw"`
+	}{version.Version, library, model.Digest, predict.Prompt, predict.Suffix, predict.Format, predict.Images, predict.Options, context, raw})
+}
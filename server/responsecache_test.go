@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestResponseCache(t *testing.T) {
+	t.Setenv("OLLAMA_RESPONSE_CACHE", "1000")
+
+	var prompts []string
+	loadMockModel(t, "cached", "", &MockLLM{encoding: []int{1, 2}, predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		prompts = append(prompts, p.Prompt)
+		fn(llm.PredictResult{Content: "hello"})
+		fn(llm.PredictResult{Content: " there", Done: true, PromptEvalCount: 2, EvalCount: 2})
+		return nil
+	}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	generate := func(req api.GenerateRequest) (*http.Response, []api.GenerateResponse) {
+		bts, err := json.Marshal(req)
+		assert.Nil(t, err)
+
+		resp, err := http.Post(srv.URL+"/api/generate", "application/json", bytes.NewReader(bts))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var responses []api.GenerateResponse
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var r api.GenerateResponse
+			assert.Nil(t, json.Unmarshal(scanner.Bytes(), &r))
+			responses = append(responses, r)
+		}
+
+		return resp, responses
+	}
+
+	stream := false
+	greedy := map[string]interface{}{"temperature": 0, "seed": 42}
+
+	resp, responses := generate(api.GenerateRequest{Model: "cached", Prompt: "hi", Stream: &stream, Options: greedy})
+	assert.Empty(t, resp.Header.Get("X-Ollama-Cache"))
+	assert.Equal(t, "hello there", responses[0].Response)
+
+	resp, responses = generate(api.GenerateRequest{Model: "cached", Prompt: "hi", Stream: &stream, Options: greedy})
+	assert.Equal(t, "hit", resp.Header.Get("X-Ollama-Cache"))
+	assert.Equal(t, "hello there", responses[0].Response)
+	assert.Equal(t, []int{1, 2}, responses[0].Context)
+	assert.Equal(t, 2, responses[0].EvalCount)
+
+	// streamed requests are sent the response at once
+	resp, responses = generate(api.GenerateRequest{Model: "cached", Prompt: "hi", Options: greedy})
+	assert.Equal(t, "hit", resp.Header.Get("X-Ollama-Cache"))
+	assert.Len(t, responses, 1)
+	assert.True(t, responses[0].Done)
+	assert.Equal(t, "hello there", responses[0].Response)
+
+	// other prompts and options aren't the same request
+	generate(api.GenerateRequest{Model: "cached", Prompt: "hey", Stream: &stream, Options: greedy})
+	generate(api.GenerateRequest{Model: "cached", Prompt: "hi", Stream: &stream, Options: map[string]interface{}{"temperature": 0, "seed": 42, "num_predict": 8}})
+	assert.Len(t, prompts, 3)
+
+	// requests which aren't deterministic aren't cached
+	for range 2 {
+		resp, _ := generate(api.GenerateRequest{Model: "cached", Prompt: "hi", Stream: &stream, Options: map[string]interface{}{"seed": 42}})
+		assert.Empty(t, resp.Header.Get("X-Ollama-Cache"))
+		generate(api.GenerateRequest{Model: "cached", Prompt: "hi", Stream: &stream, Options: map[string]interface{}{"temperature": 0}})
+	}
+
+	assert.Len(t, prompts, 7)
+	assert.Equal(t, uint64(2), responseCache.stats().hits)
+}
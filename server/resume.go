@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxResumeLines is how many of the last lines of a response are kept
+	// to resume it from
+	maxResumeLines = 4096
+
+	// resumeExpiry is how long a response can be resumed after it's done
+	resumeExpiry = 5 * time.Minute
+)
+
+var (
+	// maxResumables is how many responses are kept to resume
+	maxResumables = 1024
+
+	// resumeGrace is how long a request keeps running without a client
+	// following its response, before it's cancelled
+	resumeGrace = time.Minute
+)
+
+var (
+	errResumeNotFound   = errors.New("request not found")
+	errTooManyResumable = errors.New("too many requests are running to be resumed")
+)
+
+// resumables keeps the responses of requests sent with X-Ollama-Request-Id,
+// so a client which loses its connection can resume the response with
+// X-Ollama-Resume-From rather than starting again. The request keeps running
+// when the client goes away.
+var resumables = struct {
+	mu   sync.Mutex
+	byID map[string]*resumable
+}{byID: make(map[string]*resumable)}
+
+type resumable struct {
+	mu sync.Mutex
+
+	status      int
+	contentType string
+
+	// lines are the lines of the response with their new lines, without the
+	// first offset lines which were dropped to keep maxResumeLines
+	lines   [][]byte
+	offset  int
+	partial []byte
+
+	done    bool
+	expires time.Time
+
+	// changed is closed when there are more lines or the response is done
+	changed chan struct{}
+
+	// followers is how many clients are receiving the response, including
+	// the client which sent the request until it goes away. The request is
+	// cancelled when it has had none for resumeGrace.
+	followers int
+	cancel    context.CancelFunc
+	idle      *time.Timer
+}
+
+// addResumable starts keeping the response of a request, which cancel stops.
+// Responses which are done are removed once they expire, or from the oldest
+// when maxResumables are kept. It returns nil if there is a request with the
+// id already.
+func addResumable(id string, cancel context.CancelFunc) (*resumable, error) {
+	resumables.mu.Lock()
+	defer resumables.mu.Unlock()
+
+	now := time.Now()
+	var oldest string
+	var oldestExpires time.Time
+	for k, r := range resumables.byID {
+		r.mu.Lock()
+		switch {
+		case r.done && now.After(r.expires):
+			delete(resumables.byID, k)
+		case r.done && (oldest == "" || r.expires.Before(oldestExpires)):
+			oldest, oldestExpires = k, r.expires
+		}
+		r.mu.Unlock()
+	}
+
+	if _, ok := resumables.byID[id]; ok {
+		return nil, nil
+	}
+
+	if len(resumables.byID) >= maxResumables {
+		if oldest == "" {
+			return nil, errTooManyResumable
+		}
+
+		delete(resumables.byID, oldest)
+	}
+
+	r := &resumable{changed: make(chan struct{}), cancel: cancel}
+	resumables.byID[id] = r
+	return r, nil
+}
+
+func getResumable(id string) (*resumable, bool) {
+	resumables.mu.Lock()
+	defer resumables.mu.Unlock()
+
+	r, ok := resumables.byID[id]
+	return r, ok
+}
+
+// notify wakes the requests resuming r. It is up to the caller to lock r.mu.
+func (r *resumable) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// follow adds a client receiving the response
+func (r *resumable) follow() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.followers++
+	if r.idle != nil {
+		r.idle.Stop()
+		r.idle = nil
+	}
+}
+
+// unfollow removes a client receiving the response. Once there are none, the
+// request is cancelled if it isn't resumed within resumeGrace.
+func (r *resumable) unfollow() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.followers--
+	if r.followers == 0 && !r.done && r.idle == nil {
+		r.idle = time.AfterFunc(resumeGrace, r.cancel)
+	}
+}
+
+func (r *resumable) write(w gin.ResponseWriter, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == 0 {
+		r.status, r.contentType = w.Status(), w.Header().Get("Content-Type")
+	}
+
+	r.partial = append(r.partial, b...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		r.lines = append(r.lines, bytes.Clone(r.partial[:i+1]))
+		r.partial = r.partial[i+1:]
+	}
+
+	if n := len(r.lines) - maxResumeLines; n > 0 {
+		r.lines = r.lines[n:]
+		r.offset += n
+	}
+
+	r.notify()
+}
+
+func (r *resumable) finish(w gin.ResponseWriter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == 0 {
+		r.status, r.contentType = w.Status(), w.Header().Get("Content-Type")
+	}
+
+	// a response which isn't streamed doesn't end with a new line
+	if len(r.partial) > 0 {
+		r.lines = append(r.lines, append(r.partial, '\n'))
+		r.partial = nil
+	}
+
+	r.done = true
+	r.expires = time.Now().Add(resumeExpiry)
+	if r.idle != nil {
+		r.idle.Stop()
+		r.idle = nil
+	}
+
+	r.notify()
+}
+
+// resumeWriter keeps what's written to the response, and carries on once the
+// client has gone away so the response can be resumed
+type resumeWriter struct {
+	gin.ResponseWriter
+
+	r    *resumable
+	gone bool
+}
+
+func (w *resumeWriter) Write(b []byte) (int, error) {
+	w.r.write(w.ResponseWriter, b)
+	if !w.gone {
+		if _, err := w.ResponseWriter.Write(b); err != nil {
+			w.gone = true
+		}
+	}
+
+	return len(b), nil
+}
+
+func (w *resumeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *resumeWriter) Flush() {
+	if !w.gone {
+		w.ResponseWriter.Flush()
+	}
+}
+
+// CloseNotify never fires, so streams carry on without the client
+func (w *resumeWriter) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// resumeMiddleware keeps the responses of requests with X-Ollama-Request-Id,
+// and resumes them from the line in X-Ollama-Resume-From
+func resumeMiddleware(c *gin.Context) {
+	id := c.GetHeader("X-Ollama-Request-Id")
+	if id == "" {
+		c.Next()
+		return
+	}
+
+	if from := c.GetHeader("X-Ollama-Resume-From"); from != "" {
+		n, err := strconv.Atoi(from)
+		if err != nil || n < 0 {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("invalid resume offset %q", from))
+			return
+		}
+
+		if r, ok := getResumable(id); ok {
+			resumeResponse(c, r, n)
+			c.Abort()
+			return
+		}
+
+		// the request never arrived, so it's started now
+		if n > 0 {
+			abortWithError(c, http.StatusNotFound, errResumeNotFound)
+			return
+		}
+	}
+
+	// the request carries on when the client goes away, until it hasn't been
+	// resumed for resumeGrace
+	ctx, cancel := context.WithCancel(context.WithoutCancel(c.Request.Context()))
+	defer cancel()
+
+	r, err := addResumable(id, cancel)
+	switch {
+	case err != nil:
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	case r == nil:
+		abortWithError(c, http.StatusConflict, fmt.Errorf("request %s exists already", id))
+		return
+	}
+
+	r.follow()
+	stop := context.AfterFunc(c.Request.Context(), r.unfollow)
+	defer stop()
+
+	w := &resumeWriter{ResponseWriter: c.Writer, r: r}
+	c.Writer = w
+	c.Request = c.Request.WithContext(ctx)
+
+	defer r.finish(w.ResponseWriter)
+	c.Next()
+}
+
+// resumeResponse writes the lines of r from line from, and follows it until
+// it's done
+func resumeResponse(c *gin.Context, r *resumable, from int) {
+	r.follow()
+	defer r.unfollow()
+
+	wroteHeader := false
+	for {
+		r.mu.Lock()
+		if from < r.offset {
+			r.mu.Unlock()
+			if !wroteHeader {
+				abortWithError(c, http.StatusGone, fmt.Errorf("line %d is no longer kept", from))
+			}
+			return
+		}
+
+		var lines [][]byte
+		if i := from - r.offset; i < len(r.lines) {
+			lines = r.lines[i:]
+		}
+
+		status, contentType, done, changed := r.status, r.contentType, r.done, r.changed
+		r.mu.Unlock()
+
+		if !wroteHeader && status != 0 {
+			if contentType != "" {
+				c.Header("Content-Type", contentType)
+			}
+
+			c.Status(status)
+			wroteHeader = true
+		}
+
+		for _, line := range lines {
+			if _, err := c.Writer.Write(line); err != nil {
+				return
+			}
+		}
+
+		from += len(lines)
+		if len(lines) > 0 {
+			c.Writer.Flush()
+		}
+
+		if done {
+			c.Writer.WriteHeaderNow()
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
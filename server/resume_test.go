@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResumeMiddleware(t *testing.T) {
+	r := gin.New()
+	r.POST("/", resumeMiddleware, func(c *gin.Context) {
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			for _, s := range []string{"a", "b", "c"} {
+				ch <- gin.H{"response": s, "done": s == "c"}
+			}
+		}()
+
+		streamResponse(c, ch)
+	})
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	send := func(id, from string) (int, []string) {
+		req, err := http.NewRequest(http.MethodPost, srv.URL, nil)
+		assert.Nil(t, err)
+		req.Header.Set("X-Ollama-Request-Id", id)
+		if from != "" {
+			req.Header.Set("X-Ollama-Resume-From", from)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		var lines []string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+
+		return resp.StatusCode, lines
+	}
+
+	status, lines := send("first", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, lines, 3)
+
+	status, resumed := send("first", "1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, lines[1:], resumed)
+
+	status, _ = send("first", "")
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, _ = send("missing", "1")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// a request which never arrived is started
+	status, lines = send("second", "0")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, lines, 3)
+
+	t.Cleanup(func() {
+		resumables.mu.Lock()
+		defer resumables.mu.Unlock()
+		delete(resumables.byID, "first")
+		delete(resumables.byID, "second")
+	})
+}
+
+func TestResumeGrace(t *testing.T) {
+	grace := resumeGrace
+	resumeGrace = 50 * time.Millisecond
+	t.Cleanup(func() { resumeGrace = grace })
+
+	cancelled := make(chan struct{})
+	r := gin.New()
+	r.POST("/", resumeMiddleware, func(c *gin.Context) {
+		c.Writer.WriteString("started\n")
+		c.Writer.Flush()
+
+		<-c.Request.Context().Done()
+		close(cancelled)
+	})
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		resumables.mu.Lock()
+		defer resumables.mu.Unlock()
+		delete(resumables.byID, "abandoned")
+	})
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, nil)
+	assert.Nil(t, err)
+	req.Header.Set("X-Ollama-Request-Id", "abandoned")
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+
+	// the request carries on without the client, until it isn't resumed
+	cancel()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request wasn't cancelled")
+	}
+}
+
+func TestAddResumable(t *testing.T) {
+	maxResumable := maxResumables
+	maxResumables = 2
+
+	resumables.mu.Lock()
+	byID := resumables.byID
+	resumables.byID = make(map[string]*resumable)
+	resumables.mu.Unlock()
+
+	t.Cleanup(func() {
+		maxResumables = maxResumable
+		resumables.mu.Lock()
+		defer resumables.mu.Unlock()
+		resumables.byID = byID
+	})
+
+	a, err := addResumable("a", func() {})
+	assert.Nil(t, err)
+	_, err = addResumable("b", func() {})
+	assert.Nil(t, err)
+
+	// requests which are running aren't removed to keep another
+	_, err = addResumable("c", func() {})
+	assert.ErrorIs(t, err, errTooManyResumable)
+
+	a.mu.Lock()
+	a.done, a.expires = true, time.Now().Add(time.Minute)
+	a.mu.Unlock()
+
+	_, err = addResumable("c", func() {})
+	assert.Nil(t, err)
+
+	_, ok := getResumable("a")
+	assert.False(t, ok)
+}
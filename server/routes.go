@@ -39,6 +39,10 @@ var mode string = gin.DebugMode
 
 type Server struct {
 	addr net.Addr
+
+	// preload is the models to load before the server is ready
+	preload []string
+	warmup  warmup
 }
 
 func init() {
@@ -61,35 +65,100 @@ var loaded struct {
 	expireAt    time.Time
 	expireTimer *time.Timer
 
+	// released is set when an idle model's layers have been moved off the
+	// GPU, so the next request reloads it
+	vramTimer       *time.Timer
+	sessionDuration time.Duration
+	released        bool
+
+	// releasing is closed once the model's layers have been moved off the
+	// GPU, while they're being moved
+	releasing chan struct{}
+
 	*Model
 	*api.Options
 }
 
 var defaultSessionDuration = 5 * time.Minute
 
-// load a model into memory if it is not already loaded, it is up to the caller to lock loaded.mu before calling this function
-func load(c *gin.Context, model *Model, opts api.Options, sessionDuration time.Duration) error {
+// newRunner starts a runner for a model, replaced by tests
+var newRunner = llm.New
+
+// runnerChanged reports whether a model loaded with the runner options loaded
+// has to be reloaded to run a request with the runner options opts. Requests
+// with a smaller context window than the loaded model's run with the loaded
+// model, and their prompts are truncated to their own context window by
+// chatPrompt and fitContext. So do requests which decode fewer sequences at
+// once.
+func runnerChanged(loaded, opts api.Runner) bool {
+	if opts.NumCtx < loaded.NumCtx {
+		opts.NumCtx = loaded.NumCtx
+	}
+
+	if opts.NumParallel < loaded.NumParallel {
+		opts.NumParallel = loaded.NumParallel
+	}
+
+	return !reflect.DeepEqual(loaded, opts)
+}
+
+// load a model into memory if it is not already loaded, it is up to the caller to lock loaded.mu before calling this function.
+// progress, if it's set, is called with the progress of loading the model.
+func load(c *gin.Context, model *Model, opts api.Options, sessionDuration time.Duration, progress func(api.LoadProgress)) error {
+	// the runner can't be changed while the model is reloaded without its
+	// layers on the GPU
+	waitReleased()
+
 	needLoad := loaded.runner == nil || // is there a model loaded?
 		loaded.ModelPath != model.ModelPath || // has the base model changed?
 		!reflect.DeepEqual(loaded.AdapterPaths, model.AdapterPaths) || // have the adapters changed?
-		!reflect.DeepEqual(loaded.Options.Runner, opts.Runner) // have the runner options changed?
+		runnerChanged(loaded.Options.Runner, opts.Runner) || // have the runner options changed?
+		loaded.released // have the model's layers been moved off the GPU?
 
 	if needLoad {
 		if loaded.runner != nil {
 			slog.Info("changing loaded model")
+			if loaded.Name != model.Name {
+				clearLiveOptions()
+			}
+
 			loaded.runner.Close()
 			loaded.runner = nil
 			loaded.Model = nil
 			loaded.Options = nil
 		}
 
-		llmRunner, err := llm.New(model.ModelPath, model.AdapterPaths, model.ProjectorPaths, opts)
+		report := func(p api.LoadProgress) {
+			setLoadProgress(&p)
+			if progress != nil {
+				progress(p)
+			}
+		}
+		defer setLoadProgress(nil)
+
+		// models are preloaded without a request
+		ctx := context.Background()
+		if c != nil {
+			ctx = c.Request.Context()
+		}
+
+		if err := llm.Prefetch(ctx, model.ModelPath, func(completed, total int64) {
+			report(api.LoadProgress{Model: model.ShortName, Status: "reading model", Completed: completed, Total: total})
+		}); ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			slog.Warn(fmt.Sprintf("couldn't prefetch %s: %v", model.ModelPath, err))
+		}
+
+		report(api.LoadProgress{Model: model.ShortName, Status: "starting runner"})
+
+		llmRunner, err := newRunner(model.ModelPath, model.AdapterPaths, model.ProjectorPaths, opts)
 		if err != nil {
 			// some older models are not compatible with newer versions of llama.cpp
 			// show a generalized compatibility error until there is a better way to
 			// check for model compatibility
 			if errors.Is(llm.ErrUnsupportedFormat, err) || strings.Contains(err.Error(), "failed to load model") {
-				err = fmt.Errorf("%v: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, model.ShortName)
+				err = fmt.Errorf("%w: this model may be incompatible with your version of Ollama. If you previously pulled this model, try updating it by running `ollama pull %s`", err, model.ShortName)
 			}
 
 			return err
@@ -98,8 +167,18 @@ func load(c *gin.Context, model *Model, opts api.Options, sessionDuration time.D
 		loaded.Model = model
 		loaded.runner = llmRunner
 		loaded.Options = &opts
+		loaded.released = false
 	}
 
+	keepLoaded(sessionDuration)
+	return nil
+}
+
+// keepLoaded keeps the loaded model in memory for sessionDuration from now.
+// It is up to the caller to lock loaded.mu.
+func keepLoaded(sessionDuration time.Duration) {
+	scheduleReleaseVRAM(sessionDuration)
+
 	loaded.expireAt = time.Now().Add(sessionDuration)
 
 	if loaded.expireTimer == nil {
@@ -118,26 +197,90 @@ func load(c *gin.Context, model *Model, opts api.Options, sessionDuration time.D
 			loaded.runner = nil
 			loaded.Model = nil
 			loaded.Options = nil
+			clearLiveOptions()
 		})
 	}
 
 	loaded.expireTimer.Reset(sessionDuration)
-	return nil
+}
+
+// unloadCrashed stops the runner if err is from it crashing, so the model is
+// reloaded by the next request. It is up to the caller to lock loaded.mu.
+func unloadCrashed(err error) {
+	if !errors.Is(err, llm.ErrRunnerCrashed) || loaded.runner == nil {
+		return
+	}
+
+	slog.Error(fmt.Sprintf("%v, the model will be reloaded by the next request", err))
+	loaded.runner.Close()
+	loaded.runner = nil
+	loaded.Model = nil
+	loaded.Options = nil
+	clearLiveOptions()
 }
 
 func modelOptions(model *Model, requestOpts map[string]interface{}) (api.Options, error) {
+	return mergeOptions(model, getLiveOptions(model), requestOpts)
+}
+
+// mergeOptions returns the options of a request, which override the live
+// options of the loaded model, which override the model's own options
+func mergeOptions(model *Model, liveOpts, requestOpts map[string]interface{}) (api.Options, error) {
 	opts := api.DefaultOptions()
 	if err := opts.FromMap(model.Options); err != nil {
 		return api.Options{}, err
 	}
 
+	if err := opts.FromMap(liveOpts); err != nil {
+		return api.Options{}, err
+	}
+
 	if err := opts.FromMap(requestOpts); err != nil {
 		return api.Options{}, err
 	}
 
+	if err := opts.ValidateSampling(); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := opts.ValidateRunner(); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := opts.ValidateKVOverrides(); err != nil {
+		return api.Options{}, err
+	}
+
+	if err := opts.ValidateTTFT(); err != nil {
+		return api.Options{}, err
+	}
+
+	if opts.Deterministic {
+		// threads can reduce in any order so results are only reproducible with one
+		opts.NumThread = 1
+		if opts.Seed < 0 {
+			opts.Seed = 0
+		}
+	}
+
 	return opts, nil
 }
 
+// hasOption reports whether an option has been set explicitly by the
+// Modelfile, the live options of the loaded model or the request
+func hasOption(model *Model, requestOpts map[string]interface{}, key string) bool {
+	if _, ok := model.Options[key]; ok {
+		return true
+	}
+
+	if _, ok := getLiveOptions(model)[key]; ok {
+		return true
+	}
+
+	_, ok := requestOpts[key]
+	return ok
+}
+
 func isSupportedImageType(image []byte) bool {
 	contentType := http.DetectContentType(image)
 	allowedTypes := []string{"image/jpeg", "image/jpg", "image/png"}
@@ -154,29 +297,34 @@ func GenerateHandler(c *gin.Context) {
 
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
+	req.Model = routeAlias(req.Model)
+
 	// validate the request
 	switch {
 	case req.Model == "":
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	case len(req.Format) > 0 && req.Format != "json":
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be json"})
+		abortWithError(c, http.StatusBadRequest, errors.New("format must be json"))
 		return
 	case req.Raw && (req.Template != "" || req.System != "" || len(req.Context) > 0):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "raw mode does not support template, system, or context"})
+		abortWithError(c, http.StatusBadRequest, errors.New("raw mode does not support template, system, or context"))
+		return
+	case req.Suffix != "" && (req.Template != "" || req.System != "" || len(req.Context) > 0 || len(req.Images) > 0):
+		abortWithError(c, http.StatusBadRequest, errors.New("suffix does not support template, system, context, or images"))
 		return
 	}
 
 	for _, img := range req.Images {
 		if !isSupportedImageType(img) {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported image format"})
+			abortWithError(c, http.StatusBadRequest, errors.New("unsupported image format"))
 			return
 		}
 	}
@@ -185,25 +333,26 @@ func GenerateHandler(c *gin.Context) {
 	if err != nil {
 		var pErr *fs.PathError
 		if errors.As(err, &pErr) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", req.Model)})
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found, try pulling it first", req.Model)))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
 	if model.IsEmbedding() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "embedding models do not support generate"})
+		abortWithError(c, http.StatusBadRequest, errors.New("embedding models do not support generate"))
+		return
+	}
+
+	if model.IsWhisper() {
+		abortWithError(c, http.StatusBadRequest, errors.New("whisper models do not support generate"))
 		return
 	}
 
 	opts, err := modelOptions(model, req.Options)
 	if err != nil {
-		if errors.Is(err, api.ErrInvalidOpts) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -214,15 +363,34 @@ func GenerateHandler(c *gin.Context) {
 		sessionDuration = req.KeepAlive.Duration
 	}
 
-	if err := load(c, model, opts, sessionDuration); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	var progress func(api.LoadProgress)
+	if req.Stream == nil || *req.Stream {
+		progress = func(p api.LoadProgress) {
+			writeLoadProgress(c, api.GenerateResponse{
+				Model:     req.Model,
+				CreatedAt: time.Now().UTC(),
+				Status:    p.Status,
+				Completed: p.Completed,
+				Total:     p.Total,
+			})
+		}
+	}
+
+	if err := load(c, model, opts, sessionDuration, progress); err != nil {
+		if c.Writer.Written() {
+			// the progress has been sent already
+			writeLoadProgress(c, errorResponse(err))
+			return
+		}
+
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
 	// an empty request loads the model
 	// note: for a short while template was used in lieu
 	// of `raw` mode so we need to check for it too
-	if req.Prompt == "" && req.Template == "" && req.System == "" {
+	if req.Prompt == "" && req.Suffix == "" && req.Template == "" && req.System == "" {
 		c.JSON(http.StatusOK, api.GenerateResponse{
 			CreatedAt: time.Now().UTC(),
 			Model:     req.Model,
@@ -233,9 +401,21 @@ func GenerateHandler(c *gin.Context) {
 
 	checkpointLoaded := time.Now()
 
+	if req.System, err = hookPrompt(c.Request.Context(), req.Model, "system", req.System); err == nil {
+		if req.Prompt, err = hookPrompt(c.Request.Context(), req.Model, "user", req.Prompt); err == nil {
+			req.Suffix, err = hookPrompt(c.Request.Context(), req.Model, "user", req.Suffix)
+		}
+	}
+
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
 	var prompt string
 	switch {
-	case req.Raw:
+	case req.Raw, req.Suffix != "":
+		// fill-in-the-middle prompts are built by the runner from the model's tokens
 		prompt = req.Prompt
 	case req.Prompt != "":
 		if req.Template == "" {
@@ -250,36 +430,94 @@ func GenerateHandler(c *gin.Context) {
 		slog.Debug("generate handler", "template", req.Template)
 		slog.Debug("generate handler", "system", req.System)
 
-		var sb strings.Builder
-		for i := range req.Images {
-			fmt.Fprintf(&sb, "[img-%d] ", i)
+		if prompt, err = generatePrompt(c.Request.Context(), req); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
 		}
 
-		sb.WriteString(req.Prompt)
+		if !hasOption(model, req.Options, "num_keep") && req.Context == nil {
+			if opts.NumKeep, err = keepTokens(c.Request.Context(), req.Template, req.System, prompt); err != nil {
+				abortWithError(c, http.StatusInternalServerError, err)
+				return
+			}
+		}
+	}
 
-		p, err := Prompt(req.Template, req.System, sb.String(), "", true)
+	if prompt != "" {
+		if prompt, err = fitContext(c.Request.Context(), req, prompt, opts.NumCtx); err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		prompt, err = fitTTFT(c, opts, prompt, len(req.Images), func(tokens int) (string, error) {
+			return truncateGenerate(c.Request.Context(), req, tokens, opts.TTFTStrategy)
+		})
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, http.StatusInternalServerError, err)
 			return
 		}
+	}
 
-		sb.Reset()
-		if req.Context != nil {
-			prev, err := loaded.runner.Decode(c.Request.Context(), req.Context)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	slog.Debug("generate handler", "prompt", prompt)
+
+	var images []llm.ImageData
+	for i := range req.Images {
+		images = append(images, llm.ImageData{
+			ID:   i,
+			Data: req.Images[i],
+		})
+	}
+
+	predictReq := llm.PredictOpts{
+		Prompt:  prompt,
+		Suffix:  req.Suffix,
+		Format:  req.Format,
+		Images:  images,
+		Options: opts,
+	}
+
+	// deterministic requests which have been run before are served from the
+	// response cache
+	var key string
+	if deterministic(opts) {
+		key = responseKey(model, loaded.runner.Library(), predictReq, req.Context, req.Raw)
+
+		var cached cachedResponse
+		if responseCache.get(key, &cached) {
+			c.Header("X-Ollama-Cache", "hit")
+
+			thinking, content := newThinkingParser(opts, prompt).next(cached.Response, true)
+			resp := api.GenerateResponse{
+				Model:     req.Model,
+				CreatedAt: time.Now().UTC(),
+				Response:  content,
+				Thinking:  thinking,
+				Done:      true,
+				Context:   cached.Context,
+				Build:     buildInfo(opts),
+				Metrics: api.Metrics{
+					TotalDuration:   time.Since(checkpointStart),
+					LoadDuration:    checkpointLoaded.Sub(checkpointStart),
+					PromptEvalCount: cached.PromptEvalCount,
+					EvalCount:       cached.EvalCount,
+				},
+			}
+
+			if req.Stream != nil && !*req.Stream {
+				c.JSON(http.StatusOK, resp)
 				return
 			}
 
-			sb.WriteString(prev)
+			ch := make(chan any, 1)
+			ch <- resp
+			close(ch)
+			streamResponse(c, ch)
+			return
 		}
-
-		sb.WriteString(p)
-
-		prompt = sb.String()
 	}
 
-	slog.Debug("generate handler", "prompt", prompt)
+	think := newThinkingParser(opts, prompt)
+	setEvaluated(predictReq)
 
 	ch := make(chan any)
 	var generated strings.Builder
@@ -291,17 +529,27 @@ func GenerateHandler(c *gin.Context) {
 			loaded.expireAt = time.Now().Add(sessionDuration)
 			loaded.expireTimer.Reset(sessionDuration)
 
+			content, err := hookCompletion(c.Request.Context(), req.Model, r.Content)
+			if err != nil {
+				ch <- errorResponse(err)
+				return
+			}
+
+			r.Content = content
+
 			// Build up the full response
 			if _, err := generated.WriteString(r.Content); err != nil {
-				ch <- gin.H{"error": err.Error()}
+				ch <- errorResponse(err)
 				return
 			}
 
+			thinking, content := think.next(r.Content, r.Done)
 			resp := api.GenerateResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Done:      r.Done,
-				Response:  r.Content,
+				Response:  content,
+				Thinking:  thinking,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
@@ -313,72 +561,82 @@ func GenerateHandler(c *gin.Context) {
 			if r.Done {
 				resp.TotalDuration = time.Since(checkpointStart)
 				resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				resp.Build = buildInfo(opts)
+				recordUsage(c, r.PromptEvalCount, r.EvalCount)
+				recordPromptRate(loaded.ModelPath, r.PromptEvalCount, r.PromptEvalDuration)
 
-				if !req.Raw {
+				if !req.Raw && req.Suffix == "" {
 					p, err := Prompt(req.Template, req.System, req.Prompt, generated.String(), false)
 					if err != nil {
-						c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+						ch <- errorResponse(err)
 						return
 					}
 
 					// TODO (jmorganca): encode() should not strip special tokens
 					tokens, err := loaded.runner.Encode(c.Request.Context(), p)
 					if err != nil {
-						ch <- gin.H{"error": err.Error()}
+						ch <- errorResponse(err)
 						return
 					}
 
 					resp.Context = append(req.Context, tokens...)
 				}
+
+				if key != "" {
+					responseCache.put(key, cachedResponse{
+						Response:        generated.String(),
+						Context:         resp.Context,
+						PromptEvalCount: r.PromptEvalCount,
+						EvalCount:       r.EvalCount,
+					})
+				}
 			}
 
 			ch <- resp
 		}
 
-		var images []llm.ImageData
-		for i := range req.Images {
-			images = append(images, llm.ImageData{
-				ID:   i,
-				Data: req.Images[i],
-			})
-		}
-
 		// Start prediction
-		predictReq := llm.PredictOpts{
-			Prompt:  prompt,
-			Format:  req.Format,
-			Images:  images,
-			Options: opts,
-		}
 		if err := loaded.runner.Predict(c.Request.Context(), predictReq, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			unloadCrashed(err)
+			ch <- errorResponse(err)
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		// Accumulate responses into the final response
 		var final api.GenerateResponse
-		var sb strings.Builder
+		var sb, thinking strings.Builder
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(r.Response)
+				thinking.WriteString(r.Thinking)
 				final = r
 			case gin.H:
-				if errorMsg, ok := r["error"].(string); ok {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": errorMsg})
+				if _, ok := r["error"].(string); ok {
+					// include what was generated before the error
+					if sb.Len() > 0 {
+						r["response"] = sb.String()
+					}
+
+					if thinking.Len() > 0 {
+						r["thinking"] = thinking.String()
+					}
+
+					abortWithErrorResponse(c, r)
 					return
 				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error format in response"})
+					abortWithError(c, http.StatusInternalServerError, errors.New("unexpected error format in response"))
 					return
 				}
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error"})
+				abortWithError(c, http.StatusInternalServerError, errors.New("unexpected error"))
 				return
 			}
 		}
 
 		final.Response = sb.String()
+		final.Thinking = thinking.String()
 		c.JSON(http.StatusOK, final)
 		return
 	}
@@ -386,30 +644,78 @@ func GenerateHandler(c *gin.Context) {
 	streamResponse(c, ch)
 }
 
+// generatePrompt renders the prompt of a generate request with its template,
+// after the context of the request it continues, if any
+func generatePrompt(ctx context.Context, req api.GenerateRequest) (string, error) {
+	var sb strings.Builder
+	for i := range req.Images {
+		fmt.Fprintf(&sb, "[img-%d] ", i)
+	}
+
+	sb.WriteString(req.Prompt)
+
+	p, err := Prompt(req.Template, req.System, sb.String(), "", true)
+	if err != nil {
+		return "", err
+	}
+
+	if req.Context == nil {
+		return p, nil
+	}
+
+	prev, err := loaded.runner.Decode(ctx, req.Context)
+	if err != nil {
+		return "", err
+	}
+
+	return prev + p, nil
+}
+
+// buildInfo returns the runner and options used for deterministic responses
+func buildInfo(opts api.Options) *api.BuildInfo {
+	if !opts.Deterministic {
+		return nil
+	}
+
+	return &api.BuildInfo{
+		Version: version.Version,
+		Library: loaded.runner.Library(),
+		Options: opts,
+	}
+}
+
 func getDefaultSessionDuration() time.Duration {
 	if t, exists := os.LookupEnv("OLLAMA_KEEP_ALIVE"); exists {
-		v, err := strconv.Atoi(t)
-		if err != nil {
-			d, err := time.ParseDuration(t)
-			if err != nil {
-				return defaultSessionDuration
-			}
+		if d, ok := parseKeepAlive(t); ok {
+			return d
+		}
+	}
 
-			if d < 0 {
-				return time.Duration(math.MaxInt64)
-			}
+	return defaultSessionDuration
+}
 
-			return d
+// parseKeepAlive parses a duration, or a number of seconds. Negative durations
+// are forever.
+func parseKeepAlive(t string) (time.Duration, bool) {
+	v, err := strconv.Atoi(t)
+	if err != nil {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return 0, false
 		}
 
-		d := time.Duration(v) * time.Second
 		if d < 0 {
-			return time.Duration(math.MaxInt64)
+			return time.Duration(math.MaxInt64), true
 		}
-		return d
+
+		return d, true
 	}
 
-	return defaultSessionDuration
+	d := time.Duration(v) * time.Second
+	if d < 0 {
+		return time.Duration(math.MaxInt64), true
+	}
+	return d, true
 }
 
 func EmbeddingsHandler(c *gin.Context) {
@@ -420,15 +726,16 @@ func EmbeddingsHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
+	req.Model = routeAlias(req.Model)
 	if req.Model == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	}
 
@@ -436,23 +743,60 @@ func EmbeddingsHandler(c *gin.Context) {
 	if err != nil {
 		var pErr *fs.PathError
 		if errors.As(err, &pErr) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", req.Model)})
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found, try pulling it first", req.Model)))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if model.IsWhisper() {
+		abortWithError(c, http.StatusBadRequest, errors.New("whisper models do not support embeddings"))
 		return
 	}
 
 	opts, err := modelOptions(model, req.Options)
 	if err != nil {
-		if errors.Is(err, api.ErrInvalidOpts) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if req.Pooling != "" {
+		if !slices.Contains(llm.Poolings, req.Pooling) {
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("pooling must be one of %s", strings.Join(llm.Poolings, ", ")))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+
+		opts.Pooling = req.Pooling
+	}
+
+	if req.Dimensions < 0 {
+		abortWithError(c, http.StatusBadRequest, errors.New("dimensions must not be negative"))
 		return
 	}
 
+	switch {
+	case len(req.Images) > 1:
+		abortWithError(c, http.StatusBadRequest, errors.New("only one image can be embedded at a time"))
+		return
+	case len(req.Images) > 0 && req.Prompt != "":
+		abortWithError(c, http.StatusBadRequest, errors.New("prompt and images can't be embedded together"))
+		return
+	case len(req.Images) > 0 && len(model.ProjectorPaths) == 0:
+		abortWithError(c, http.StatusBadRequest, errors.New("model does not support images"))
+		return
+	}
+
+	// cached embeddings are served without loading the model
+	var key string
+	if req.Prompt != "" || len(req.Images) > 0 {
+		key = embeddingKey(model, req, opts.Pooling)
+		if embedding, ok := cachedEmbedding(key); ok {
+			c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: embedding})
+			return
+		}
+	}
+
 	var sessionDuration time.Duration
 	if req.KeepAlive == nil {
 		sessionDuration = getDefaultSessionDuration()
@@ -460,39 +804,128 @@ func EmbeddingsHandler(c *gin.Context) {
 		sessionDuration = req.KeepAlive.Duration
 	}
 
-	if err := load(c, model, opts, sessionDuration); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := load(c, model, opts, sessionDuration, nil); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
+	var images []llm.ImageData
+	for i, img := range req.Images {
+		images = append(images, llm.ImageData{Data: img, ID: i})
+	}
+
 	// an empty request loads the model
-	if req.Prompt == "" {
+	if req.Prompt == "" && len(images) == 0 {
 		c.JSON(http.StatusOK, api.EmbeddingResponse{Embedding: []float64{}})
 		return
 	}
 
-	embedding, err := loaded.runner.Embedding(c.Request.Context(), req.Prompt)
+	// llama.cpp can't embed an input longer than the context window
+	tokens, err := loaded.runner.Encode(c.Request.Context(), req.Prompt)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if len(tokens) > opts.NumCtx {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("%w: prompt is %d tokens but num_ctx is %d", llm.ErrContextExceeded, len(tokens), opts.NumCtx))
+		return
+	}
+
+	embedding, err := loaded.runner.Embedding(c.Request.Context(), llm.EmbeddingOpts{
+		Input:      req.Prompt,
+		Images:     images,
+		Normalize:  req.Normalize,
+		Dimensions: req.Dimensions,
+	})
 	if err != nil {
 		slog.Info(fmt.Sprintf("embedding generation failed: %v", err))
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate embedding"})
+		unloadCrashed(err)
+		abortWithError(c, http.StatusInternalServerError, fmt.Errorf("failed to generate embedding: %w", err))
 		return
 	}
 
+	cacheEmbedding(key, embedding)
+	recordUsage(c, len(tokens), 0)
+
 	resp := api.EmbeddingResponse{
 		Embedding: embedding,
 	}
 	c.JSON(http.StatusOK, resp)
 }
 
+func TokenizeHandler(c *gin.Context) {
+	var req api.TokenizeRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tokenizer, release, ok := requestTokenizer(c, req.Model, req.Options, req.KeepAlive)
+	if !ok {
+		return
+	}
+	defer release()
+
+	tokens := []int{}
+	if req.Prompt != "" {
+		tokens, err = tokenizer.Encode(req.Prompt)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.TokenizeResponse{Tokens: tokens})
+}
+
+func DetokenizeHandler(c *gin.Context) {
+	var req api.DetokenizeRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tokenizer, release, ok := requestTokenizer(c, req.Model, req.Options, req.KeepAlive)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var prompt string
+	if len(req.Tokens) > 0 {
+		prompt, err = tokenizer.Decode(req.Tokens)
+		if errors.Is(err, llm.ErrInvalidToken) {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, api.DetokenizeResponse{Prompt: prompt})
+}
+
 func PullModelHandler(c *gin.Context) {
 	var req api.PullRequest
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -502,7 +935,7 @@ func PullModelHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	}
 
@@ -514,15 +947,19 @@ func PullModelHandler(c *gin.Context) {
 		}
 
 		regOpts := &registryOptions{
-			Insecure: req.Insecure,
+			Insecure:  req.Insecure,
+			RateLimit: req.RateLimit,
 		}
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		if err := PullModel(ctx, model, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		err := PullModel(ctx, model, regOpts, fn)
+		if err != nil {
+			ch <- errorResponse(err)
 		}
+
+		audit(c, api.AuditEntry{Operation: "pull", Model: model, Source: ParseModelPath(model).GetFullTagname()}, err)
 	}()
 
 	if req.Stream != nil && !*req.Stream {
@@ -538,10 +975,10 @@ func PushModelHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -551,7 +988,7 @@ func PushModelHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	}
 
@@ -563,15 +1000,19 @@ func PushModelHandler(c *gin.Context) {
 		}
 
 		regOpts := &registryOptions{
-			Insecure: req.Insecure,
+			Insecure:  req.Insecure,
+			RateLimit: req.RateLimit,
 		}
 
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		if err := PushModel(ctx, model, regOpts, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		err := PushModel(ctx, model, req.Base, req.Compression, regOpts, fn)
+		if err != nil {
+			ch <- errorResponse(err)
 		}
+
+		audit(c, api.AuditEntry{Operation: "push", Model: model}, err)
 	}()
 
 	if req.Stream != nil && !*req.Stream {
@@ -587,10 +1028,10 @@ func CreateModelHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -600,17 +1041,17 @@ func CreateModelHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	}
 
 	if err := ParseModelPath(model).Validate(); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	if req.Path == "" && req.Modelfile == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "path or modelfile are required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("path or modelfile are required"))
 		return
 	}
 
@@ -618,7 +1059,7 @@ func CreateModelHandler(c *gin.Context) {
 	if req.Path != "" && req.Modelfile == "" {
 		mf, err := os.Open(req.Path)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("error reading modelfile: %s", err)})
+			abortWithError(c, http.StatusBadRequest, fmt.Errorf("error reading modelfile: %s", err))
 			return
 		}
 		defer mf.Close()
@@ -628,7 +1069,7 @@ func CreateModelHandler(c *gin.Context) {
 
 	commands, err := parser.Parse(modelfile)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -642,9 +1083,19 @@ func CreateModelHandler(c *gin.Context) {
 		ctx, cancel := context.WithCancel(c.Request.Context())
 		defer cancel()
 
-		if err := CreateModel(ctx, model, filepath.Dir(req.Path), commands, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+		err := CreateModel(ctx, model, filepath.Dir(req.Path), commands, fn)
+		if err != nil {
+			ch <- errorResponse(err)
+		}
+
+		var from string
+		for _, command := range commands {
+			if command.Name == "model" {
+				from = command.Args
+			}
 		}
+
+		audit(c, api.AuditEntry{Operation: "create", Model: model, Source: from}, err)
 	}()
 
 	if req.Stream != nil && !*req.Stream {
@@ -660,10 +1111,10 @@ func DeleteModelHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -673,27 +1124,35 @@ func DeleteModelHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	}
 
-	if err := DeleteModel(model); err != nil {
+	// the digest has to be read before the manifest is deleted
+	entry := api.AuditEntry{Operation: "delete", Model: model}
+	if _, digest, err := GetManifest(ParseModelPath(model)); err == nil {
+		entry.Digest = "sha256:" + digest
+	}
+
+	err = DeleteModel(model)
+	audit(c, entry, err)
+	if err != nil {
 		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", model)})
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", model)))
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, http.StatusInternalServerError, err)
 		}
 		return
 	}
 
 	manifestsPath, err := GetManifestPath()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
 	if err := PruneDirectory(manifestsPath); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -705,10 +1164,10 @@ func ShowModelHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
@@ -717,20 +1176,23 @@ func ShowModelHandler(c *gin.Context) {
 	} else if req.Name != "" {
 		req.Model = req.Name
 	} else {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	}
 
+	req.Model = resolveAlias(req.Model)
 	resp, err := GetModelInfo(req)
 	if err != nil {
 		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", req.Model)))
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, http.StatusInternalServerError, err)
 		}
 		return
 	}
 
+	resp.Loading = loadProgress(req.Model)
+
 	c.JSON(http.StatusOK, resp)
 }
 
@@ -763,11 +1225,12 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	}
 
 	resp := &api.ShowResponse{
-		License:  strings.Join(model.License, "\n"),
-		System:   model.System,
-		Template: model.Template,
-		Details:  modelDetails,
-		Messages: msgs,
+		License:      strings.Join(model.License, "\n"),
+		System:       model.System,
+		Template:     model.Template,
+		Details:      modelDetails,
+		Messages:     msgs,
+		Capabilities: model.Capabilities(),
 	}
 
 	var params []string
@@ -800,13 +1263,33 @@ func GetModelInfo(req api.ShowRequest) (*api.ShowResponse, error) {
 	return resp, nil
 }
 
+// ListRunningHandler lists the loaded model, with how much of its memory is
+// in VRAM
+func ListRunningHandler(c *gin.Context) {
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	resp := api.ProcessResponse{Models: []api.ProcessModelResponse{}}
+	if loaded.runner != nil && loaded.Model != nil {
+		m := api.ProcessModelResponse{
+			Name:      loaded.ShortName,
+			Model:     loaded.ShortName,
+			Digest:    loaded.Digest,
+			ExpiresAt: loaded.expireAt,
+		}
+
+		if s, ok := loaded.runner.(llm.Sizer); ok {
+			m.Size, m.SizeVRAM = s.Size()
+		}
+
+		resp.Models = append(resp.Models, m)
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
 func ListModelsHandler(c *gin.Context) {
 	models := make([]api.ModelResponse, 0)
-	manifestsPath, err := GetManifestPath()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
 
 	modelResponse := func(modelName string) (api.ModelResponse, error) {
 		model, err := GetModel(modelName)
@@ -823,37 +1306,30 @@ func ListModelsHandler(c *gin.Context) {
 		}
 
 		return api.ModelResponse{
-			Model:   model.ShortName,
-			Name:    model.ShortName,
-			Size:    model.Size,
-			Digest:  model.Digest,
-			Details: modelDetails,
+			Model:           model.ShortName,
+			Name:            model.ShortName,
+			Size:            model.Size,
+			Digest:          model.Digest,
+			Details:         modelDetails,
+			UpdateAvailable: updateAvailable(model.ShortName),
 		}, nil
 	}
 
-	walkFunc := func(path string, info os.FileInfo, _ error) error {
-		if !info.IsDir() {
-			path, tag := filepath.Split(path)
-			model := strings.Trim(strings.TrimPrefix(path, manifestsPath), string(os.PathSeparator))
-			modelPath := strings.Join([]string{model, tag}, ":")
-			canonicalModelPath := strings.ReplaceAll(modelPath, string(os.PathSeparator), "/")
-
-			resp, err := modelResponse(canonicalModelPath)
-			if err != nil {
-				slog.Info(fmt.Sprintf("skipping file: %s", canonicalModelPath))
-				// nolint: nilerr
-				return nil
-			}
-
-			resp.ModifiedAt = info.ModTime()
-			models = append(models, resp)
+	walkFunc := func(canonicalModelPath string, info os.FileInfo) error {
+		resp, err := modelResponse(canonicalModelPath)
+		if err != nil {
+			slog.Info(fmt.Sprintf("skipping file: %s", canonicalModelPath))
+			// nolint: nilerr
+			return nil
 		}
 
+		resp.ModifiedAt = info.ModTime()
+		models = append(models, resp)
 		return nil
 	}
 
-	if err := filepath.Walk(manifestsPath, walkFunc); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := walkManifests(walkFunc); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -865,62 +1341,186 @@ func CopyModelHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	if req.Source == "" || req.Destination == "" {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "source add destination are required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("source add destination are required"))
 		return
 	}
 
 	if err := ParseModelPath(req.Destination).Validate(); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	if err := CopyModel(req.Source, req.Destination); err != nil {
+	err = CopyModel(req.Source, req.Destination)
+	audit(c, api.AuditEntry{Operation: "copy", Model: req.Destination, Source: req.Source}, err)
+	if err != nil {
 		if os.IsNotExist(err) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Source)})
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", req.Source)))
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			abortWithError(c, http.StatusInternalServerError, err)
 		}
 		return
 	}
 }
 
+// modelPathName returns the model from a /api/models/{model}/{suffix} path,
+// such as /options. Model names can contain slashes so the path is matched as
+// a wildcard.
+func modelPathName(c *gin.Context, suffix string) (string, bool) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(c.Param("path"), "/"), suffix)
+	return name, ok && name != ""
+}
+
+func ModelOptionsHandler(c *gin.Context) {
+	name, ok := modelPathName(c, "/options")
+	if !ok {
+		abortWithError(c, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	model, err := GetModel(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", name)))
+		} else {
+			abortWithError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	options := model.Options
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+
+	c.JSON(http.StatusOK, api.ModelOptionsResponse{Options: options})
+}
+
+func UpdateModelOptionsHandler(c *gin.Context) {
+	name, ok := modelPathName(c, "/options")
+	if !ok {
+		abortWithError(c, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	var req api.ModelOptionsRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	options, err := UpdateModelOptions(name, req.Options)
+	if err != nil {
+		if os.IsNotExist(err) {
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", name)))
+		} else {
+			abortWithError(c, http.StatusInternalServerError, err)
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ModelOptionsResponse{Options: options})
+}
+
 func HeadBlobHandler(c *gin.Context) {
 	path, err := GetBlobsPath(c.Param("digest"))
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
 	if _, err := os.Stat(path); err != nil {
-		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("blob %q not found", c.Param("digest"))})
+		abortWithError(c, http.StatusNotFound, fmt.Errorf("blob %q not found", c.Param("digest")))
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+func ExportModelHandler(c *gin.Context) {
+	var req api.ExportRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Model == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
+		return
+	}
+
+	if _, _, err := GetManifest(ParseModelPath(req.Model)); errors.Is(err, os.ErrNotExist) {
+		abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found", req.Model)))
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
+	c.Header("Content-Type", "application/x-tar")
 	c.Status(http.StatusOK)
+	if err := ExportModel(req.Model, c.Writer); err != nil {
+		// the archive is incomplete so importing it fails
+		slog.Error(fmt.Sprintf("failed to export %s: %v", req.Model, err))
+	}
+}
+
+func ImportModelHandler(c *gin.Context) {
+	name, err := ImportModel(c.Request.Body, c.Query("model"))
+	model := name
+	if err != nil {
+		model = c.Query("model")
+	}
+
+	audit(c, api.AuditEntry{Operation: "import", Model: model, Source: "archive"}, err)
+	switch {
+	case errors.Is(err, errInvalidArchive), errors.Is(err, errDigestMismatch), errors.Is(err, errModelPathInvalid):
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	case err != nil:
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.ImportResponse{Model: name})
 }
 
 func CreateBlobHandler(c *gin.Context) {
+	if err := checkStorage(c.Request.ContentLength); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
 	layer, err := NewLayer(c.Request.Body, "")
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
 	if layer.Digest != c.Param("digest") {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest)})
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("digest mismatch, expected %q, got %q", c.Param("digest"), layer.Digest))
 		return
 	}
 
 	if _, err := layer.Commit(); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -981,7 +1581,8 @@ func allowedHost(host string) bool {
 
 func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if addr == nil {
+		// browsers can't connect to unix sockets or named pipes
+		if addr == nil || addr.Network() != "tcp" {
 			c.Next()
 			return
 		}
@@ -1012,6 +1613,19 @@ func allowedHostsMiddleware(addr net.Addr) gin.HandlerFunc {
 	}
 }
 
+var errReadOnly = errors.New("server is read-only")
+
+// readOnlyMiddleware rejects requests which change the models when
+// OLLAMA_READONLY is set, so clients of a shared server can only use them
+func readOnlyMiddleware(c *gin.Context) {
+	if readOnly, _ := strconv.ParseBool(os.Getenv("OLLAMA_READONLY")); readOnly {
+		abortWithError(c, http.StatusForbidden, errReadOnly)
+		return
+	}
+
+	c.Next()
+}
+
 func (s *Server) GenerateRoutes() http.Handler {
 	var origins []string
 	if o := os.Getenv("OLLAMA_ORIGINS"); o != "" {
@@ -1038,27 +1652,61 @@ func (s *Server) GenerateRoutes() http.Handler {
 		allowedHostsMiddleware(s.addr),
 	)
 
-	r.POST("/api/pull", PullModelHandler)
-	r.POST("/api/generate", GenerateHandler)
-	r.POST("/api/chat", ChatHandler)
-	r.POST("/api/embeddings", EmbeddingsHandler)
-	r.POST("/api/create", CreateModelHandler)
-	r.POST("/api/push", PushModelHandler)
-	r.POST("/api/copy", CopyModelHandler)
-	r.DELETE("/api/delete", DeleteModelHandler)
+	r.POST("/api/pull", readOnlyMiddleware, PullModelHandler)
+	r.POST("/api/generate", sseMiddleware, resumeMiddleware, fieldsMiddleware(api.GenerateRequest{}), usageMiddleware, queueMiddleware, GenerateHandler)
+	r.POST("/api/chat", sseMiddleware, resumeMiddleware, fieldsMiddleware(api.ChatRequest{}), usageMiddleware, queueMiddleware, ChatHandler)
+	r.POST("/api/embeddings", fieldsMiddleware(api.EmbeddingRequest{}), usageMiddleware, queueMiddleware, EmbeddingsHandler)
+	r.POST("/api/tokenize", TokenizeHandler)
+	r.POST("/api/detokenize", DetokenizeHandler)
+	r.POST("/api/template/render", RenderTemplateHandler)
+	r.POST("/api/alias", readOnlyMiddleware, SetAliasHandler)
+	r.DELETE("/api/alias", readOnlyMiddleware, DeleteAliasHandler)
+	r.POST("/api/sessions", CreateSessionHandler)
+	r.DELETE("/api/sessions/:id", DeleteSessionHandler)
+	r.POST("/api/sessions/:id/chat", sessionChatMiddleware, usageMiddleware, queueMiddleware, ChatHandler)
+	r.POST("/api/create", readOnlyMiddleware, CreateModelHandler)
+	r.POST("/api/push", readOnlyMiddleware, PushModelHandler)
+	r.POST("/api/copy", readOnlyMiddleware, CopyModelHandler)
+	r.DELETE("/api/delete", readOnlyMiddleware, DeleteModelHandler)
 	r.POST("/api/show", ShowModelHandler)
-	r.POST("/api/blobs/:digest", CreateBlobHandler)
+	r.POST("/api/updates", UpdatesHandler)
+	r.GET("/api/models/*path", ModelOptionsHandler)
+	r.PATCH("/api/models/*path", readOnlyMiddleware, UpdateModelOptionsHandler)
+	r.POST("/api/models/*path", readOnlyMiddleware, queueMiddleware, ReloadOptionsHandler)
+	r.POST("/api/snapshot", readOnlyMiddleware, SaveSnapshotHandler)
+	r.POST("/api/snapshot/restore", readOnlyMiddleware, RestoreSnapshotHandler)
+	r.POST("/api/export", ExportModelHandler)
+	r.POST("/api/import", readOnlyMiddleware, ImportModelHandler)
+	r.POST("/api/blobs/:digest", readOnlyMiddleware, CreateBlobHandler)
 	r.HEAD("/api/blobs/:digest", HeadBlobHandler)
+	r.GET("/api/ws", websocketHandler(r))
+
+	// EventSource can only send GET requests
+	r.GET("/api/generate", sseMiddleware, fieldsMiddleware(api.GenerateRequest{}), usageMiddleware, queueMiddleware, GenerateHandler)
+	r.GET("/api/chat", sseMiddleware, fieldsMiddleware(api.ChatRequest{}), usageMiddleware, queueMiddleware, ChatHandler)
 
 	// Compatibility endpoints
-	r.POST("/v1/chat/completions", openai.Middleware(), ChatHandler)
+	r.POST("/v1/chat/completions", openai.Middleware(), usageMiddleware, queueMiddleware, ChatHandler)
+	r.POST("/v1/completions", openai.CompletionsMiddleware(), usageMiddleware, queueMiddleware, GenerateHandler)
 
 	for _, method := range []string{http.MethodGet, http.MethodHead} {
 		r.Handle(method, "/", func(c *gin.Context) {
 			c.String(http.StatusOK, "Ollama is running")
 		})
 
+		r.Handle(method, "/healthz", HealthHandler)
+		r.Handle(method, "/readyz", s.ReadyHandler)
+		r.Handle(method, "/metrics", MetricsHandler)
+
 		r.Handle(method, "/api/tags", ListModelsHandler)
+		r.Handle(method, "/api/ps", ListRunningHandler)
+		r.Handle(method, "/api/queue", QueueHandler)
+		r.Handle(method, "/api/usage", UsageHandler)
+		r.Handle(method, "/api/alias", ListAliasesHandler)
+		r.Handle(method, "/api/audit", AuditHandler)
+		r.Handle(method, "/api/sessions", ListSessionsHandler)
+		r.Handle(method, "/api/sessions/:id", GetSessionHandler)
+		r.Handle(method, "/api/snapshot", GetSnapshotHandler)
 		r.Handle(method, "/api/version", func(c *gin.Context) {
 			c.JSON(http.StatusOK, gin.H{"version": version.Version})
 		})
@@ -1067,7 +1715,9 @@ func (s *Server) GenerateRoutes() http.Handler {
 	return r
 }
 
-func Serve(ln net.Listener) error {
+// Serve serves the API on ln, loading the preload models once started. The
+// server shuts down when it's sent an interrupt or ctx is done.
+func Serve(ctx context.Context, ln net.Listener, preload []string) error {
 	level := slog.LevelInfo
 	if debug := os.Getenv("OLLAMA_DEBUG"); debug != "" {
 		level = slog.LevelDebug
@@ -1112,7 +1762,19 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
-	s := &Server{addr: ln.Addr()}
+	if command := os.Getenv("OLLAMA_HOOK"); command != "" {
+		hook := &execHook{command: command}
+		RegisterHook("", hook)
+		defer hook.Close()
+	}
+
+	if interval, ok := getUpdateInterval(); ok {
+		go scheduleUpdates(ctx, interval)
+	}
+
+	go scheduleUsageFlush(ctx)
+
+	s := &Server{addr: ln.Addr(), preload: preload}
 	r := s.GenerateRoutes()
 
 	slog.Info(fmt.Sprintf("Listening on %s (version %s)", ln.Addr(), version.Version))
@@ -1120,16 +1782,25 @@ func Serve(ln net.Listener) error {
 		Handler: r,
 	}
 
-	// listen for a ctrl+c and stop any loaded llm
-	signals := make(chan os.Signal, 1)
+	// listen for a ctrl+c and drain requests before stopping any loaded llm,
+	// a second ctrl+c stops immediately
+	signals := make(chan os.Signal, 2)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	stopped := make(chan struct{})
 	go func() {
-		<-signals
-		if loaded.runner != nil {
-			loaded.runner.Close()
+		select {
+		case <-signals:
+		case <-ctx.Done():
 		}
-		gpu.Cleanup()
-		os.Exit(0)
+
+		go func() {
+			<-signals
+			slog.Info("stopping without waiting for requests")
+			os.Exit(1)
+		}()
+
+		shutdown(srvr)
+		close(stopped)
 	}()
 
 	if err := llm.Init(); err != nil {
@@ -1142,7 +1813,73 @@ func Serve(ln net.Listener) error {
 		}
 	}
 
-	return srvr.Serve(ln)
+	go func() {
+		// systemd isn't told the server is ready when a model failed to
+		// preload, so it fails to start the service
+		if err := s.warmupModels(ctx); err == nil {
+			notifyReady()
+		}
+	}()
+
+	if err := srvr.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	<-stopped
+	return nil
+}
+
+var defaultDrainTimeout = 30 * time.Second
+
+func getDrainTimeout() time.Duration {
+	if t, exists := os.LookupEnv("OLLAMA_DRAIN_TIMEOUT"); exists {
+		if v, err := strconv.Atoi(t); err == nil && v >= 0 {
+			return time.Duration(v) * time.Second
+		}
+
+		if d, err := time.ParseDuration(t); err == nil && d >= 0 {
+			return d
+		}
+	}
+
+	return defaultDrainTimeout
+}
+
+// shutdown stops accepting requests and waits for in-flight requests to
+// finish, up to the drain timeout, before stopping the loaded llm
+func shutdown(srvr *http.Server) {
+	notifyStopping()
+
+	timeout := getDrainTimeout()
+	slog.Info(fmt.Sprintf("shutting down, waiting up to %s for requests to finish", timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := srvr.Shutdown(ctx); err != nil {
+		// closing the connections cancels the remaining requests
+		slog.Warn(fmt.Sprintf("requests didn't finish in time, cancelling them: %v", err))
+		srvr.Close()
+	}
+
+	// requests hold the lock while using the runner so it isn't stopped mid-response
+	loaded.mu.Lock()
+	waitReleased()
+	if loaded.runner != nil {
+		loaded.runner.Close()
+	}
+
+	loaded.runner = nil
+	loaded.Model = nil
+	loaded.Options = nil
+	clearLiveOptions()
+	loaded.mu.Unlock()
+
+	if err := flushUsage(); err != nil {
+		slog.Warn(fmt.Sprintf("couldn't write token usage: %v", err))
+	}
+
+	gpu.Cleanup()
 }
 
 func waitForStream(c *gin.Context, ch chan interface{}) {
@@ -1155,19 +1892,19 @@ func waitForStream(c *gin.Context, ch chan interface{}) {
 				return
 			}
 		case gin.H:
-			if errorMsg, ok := r["error"].(string); ok {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": errorMsg})
+			if _, ok := r["error"].(string); ok {
+				abortWithErrorResponse(c, r)
 				return
 			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error format in progress response"})
+				abortWithError(c, http.StatusInternalServerError, errors.New("unexpected error format in progress response"))
 				return
 			}
 		default:
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected progress response"})
+			abortWithError(c, http.StatusInternalServerError, errors.New("unexpected progress response"))
 			return
 		}
 	}
-	c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected end of progress response"})
+	abortWithError(c, http.StatusInternalServerError, errors.New("unexpected end of progress response"))
 }
 
 func streamResponse(c *gin.Context, ch chan any) {
@@ -1209,6 +1946,52 @@ func chatPrompt(ctx context.Context, template string, messages []api.Message, nu
 	return prompt, nil
 }
 
+// keepTokens counts the system message tokens of a prompt for the currently `loaded` model
+func keepTokens(ctx context.Context, template, system, prompt string) (int, error) {
+	encode := func(s string) ([]int, error) {
+		return loaded.runner.Encode(ctx, s)
+	}
+
+	return KeepTokens(template, system, prompt, encode)
+}
+
+// fitContext truncates the prompt of a generate request to the context window
+// numCtx of the request when the loaded model has a larger one, which the
+// runner would otherwise let the prompt fill. The middle of the prompt is
+// dropped, like the runner drops it from prompts longer than its own window.
+func fitContext(ctx context.Context, req api.GenerateRequest, prompt string, numCtx int) (string, error) {
+	if loaded.NumCtx <= numCtx {
+		return prompt, nil
+	}
+
+	n, err := promptTokens(ctx, prompt, len(req.Images))
+	if err != nil {
+		return "", err
+	}
+
+	if n <= numCtx {
+		return prompt, nil
+	}
+
+	truncated, err := truncateGenerate(ctx, req, numCtx, api.TTFTStrategyDropMiddle)
+	if err != nil {
+		return "", err
+	}
+
+	after, err := promptTokens(ctx, truncated, len(req.Images))
+	if err != nil {
+		return "", err
+	}
+
+	// the context of earlier responses and the images aren't truncated
+	if after > numCtx {
+		return "", fmt.Errorf("%w: the prompt has %d tokens, more than the num_ctx of %d", api.ErrInvalidOpts, after, numCtx)
+	}
+
+	slog.Debug("truncated the prompt to the context window of the request", "from", n, "to", after, "num_ctx", numCtx)
+	return truncated, nil
+}
+
 func ChatHandler(c *gin.Context) {
 	loaded.mu.Lock()
 	defer loaded.mu.Unlock()
@@ -1219,20 +2002,25 @@ func ChatHandler(c *gin.Context) {
 	err := c.ShouldBindJSON(&req)
 	switch {
 	case errors.Is(err, io.EOF):
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing request body"})
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
 		return
 	case err != nil:
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
+	req.Model = routeAlias(req.Model)
+
 	// validate the request
 	switch {
 	case req.Model == "":
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "model is required"})
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
 		return
 	case len(req.Format) > 0 && req.Format != "json":
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "format must be json"})
+		abortWithError(c, http.StatusBadRequest, errors.New("format must be json"))
+		return
+	case req.N < 0:
+		abortWithError(c, http.StatusBadRequest, errors.New("n must be 1 or more"))
 		return
 	}
 
@@ -1240,25 +2028,40 @@ func ChatHandler(c *gin.Context) {
 	if err != nil {
 		var pErr *fs.PathError
 		if errors.As(err, &pErr) {
-			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found, try pulling it first", req.Model)})
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found, try pulling it first", req.Model)))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
 	if model.IsEmbedding() {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "embedding models do not support chat"})
+		abortWithError(c, http.StatusBadRequest, errors.New("embedding models do not support chat"))
+		return
+	}
+
+	if model.IsWhisper() {
+		abortWithError(c, http.StatusBadRequest, errors.New("whisper models do not support chat"))
 		return
 	}
 
 	opts, err := modelOptions(model, req.Options)
 	if err != nil {
-		if errors.Is(err, api.ErrInvalidOpts) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// each choice is decoded in a sequence of its own, so there can't be more
+	// than the model decodes at once. Loading it again with more would grow
+	// its context, which other requests share.
+	n := max(req.N, 1)
+	numParallel := opts.NumParallel
+	if loaded.runner != nil && loaded.Options != nil && loaded.ModelPath == model.ModelPath {
+		numParallel = max(numParallel, loaded.NumParallel)
+	}
+
+	if n > numParallel {
+		abortWithError(c, http.StatusBadRequest, fmt.Errorf("%w: n of %d is more than the num_parallel of %d the model decodes at once", api.ErrInvalidOpts, n, numParallel))
 		return
 	}
 
@@ -1269,13 +2072,18 @@ func ChatHandler(c *gin.Context) {
 		sessionDuration = req.KeepAlive.Duration
 	}
 
-	if err := load(c, model, opts, sessionDuration); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := load(c, model, opts, sessionDuration, nil); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
 		return
 	}
 
 	checkpointLoaded := time.Now()
 
+	if err := hookMessages(c.Request.Context(), req.Model, req.Messages); err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
 	// if the first message is not a system message, then add the model's default system message
 	if len(req.Messages) > 0 && req.Messages[0].Role != "system" {
 		req.Messages = append([]api.Message{
@@ -1288,10 +2096,17 @@ func ChatHandler(c *gin.Context) {
 
 	prompt, err := chatPrompt(c.Request.Context(), model.Template, req.Messages, opts.NumCtx)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, http.StatusBadRequest, err)
 		return
 	}
 
+	if !hasOption(model, req.Options, "num_keep") && len(req.Messages) > 0 && req.Messages[0].Role == "system" {
+		if opts.NumKeep, err = keepTokens(c.Request.Context(), model.Template, req.Messages[0].Content, prompt); err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
 	// an empty request loads the model
 	if len(req.Messages) == 0 || prompt == "" {
 		resp := api.ChatResponse{
@@ -1304,13 +2119,21 @@ func ChatHandler(c *gin.Context) {
 		return
 	}
 
+	prompt, err = fitTTFT(c, opts, prompt, countImages(prompt), func(tokens int) (string, error) {
+		return truncateChat(c.Request.Context(), model.Template, req.Messages, min(opts.NumCtx, tokens), opts.TTFTStrategy)
+	})
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
 	// only send images that are in the prompt
 	var i int
 	var images []llm.ImageData
 	for _, m := range req.Messages {
 		for _, img := range m.Images {
 			if !isSupportedImageType(img) {
-				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported image format"})
+				abortWithError(c, http.StatusBadRequest, errors.New("unsupported image format"))
 				return
 			}
 
@@ -1323,20 +2146,61 @@ func ChatHandler(c *gin.Context) {
 
 	slog.Debug("chat handler", "prompt", prompt, "images", len(images))
 
+	thinks := make([]*thinkingParser, n)
+	for i := range thinks {
+		thinks[i] = newThinkingParser(opts, prompt)
+	}
+
+	predictReq := llm.PredictOpts{
+		Prompt:  prompt,
+		Format:  req.Format,
+		Images:  images,
+		Options: opts,
+		N:       n,
+		Slot:    cacheSlot(c),
+	}
+	setEvaluated(predictReq)
+
 	ch := make(chan any)
 
 	go func() {
 		defer close(ch)
 
+		// the usage of the request is recorded once every choice is done
+		var usage api.Metrics
+		var done int
+
+		// once a response is an error, the rest aren't sent
+		var failed bool
+
 		fn := func(r llm.PredictResult) {
+			if failed {
+				return
+			}
+
 			// Update model expiration
 			loaded.expireAt = time.Now().Add(sessionDuration)
 			loaded.expireTimer.Reset(sessionDuration)
 
+			content, err := hookCompletion(c.Request.Context(), req.Model, r.Content)
+			if err != nil {
+				failed = true
+				ch <- errorResponse(err)
+				return
+			}
+
+			if r.Index < 0 || r.Index >= n {
+				failed = true
+				ch <- errorResponse(fmt.Errorf("the runner returned choice %d of a request for %d", r.Index, n))
+				return
+			}
+
+			thinking, content := thinks[r.Index].next(content, r.Done)
 			resp := api.ChatResponse{
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
-				Message:   api.Message{Role: "assistant", Content: r.Content},
+				Message:   api.Message{Role: "assistant", Content: content, Thinking: thinking},
+				Index:     r.Index,
 				Done:      r.Done,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
@@ -1349,50 +2213,95 @@ func ChatHandler(c *gin.Context) {
 			if r.Done {
 				resp.TotalDuration = time.Since(checkpointStart)
 				resp.LoadDuration = checkpointLoaded.Sub(checkpointStart)
+				resp.Build = buildInfo(opts)
+
+				mergeMetrics(&usage, resp.Metrics)
+				if done++; done == n {
+					recordUsage(c, usage.PromptEvalCount, usage.EvalCount)
+					recordPromptRate(loaded.ModelPath, usage.PromptEvalCount, usage.PromptEvalDuration)
+				}
 			}
 
 			ch <- resp
 		}
 
 		// Start prediction
-		predictReq := llm.PredictOpts{
-			Prompt:  prompt,
-			Format:  req.Format,
-			Images:  images,
-			Options: opts,
-		}
 		if err := loaded.runner.Predict(c.Request.Context(), predictReq, fn); err != nil {
-			ch <- gin.H{"error": err.Error()}
+			unloadCrashed(err)
+			ch <- errorResponse(err)
 		}
 	}()
 
 	if req.Stream != nil && !*req.Stream {
 		// Accumulate responses into the final response
 		var final api.ChatResponse
-		var sb strings.Builder
+		var metrics api.Metrics
+		sb, thinking := make([]strings.Builder, n), make([]strings.Builder, n)
+		messages := func() []api.Message {
+			messages := make([]api.Message, n)
+			for i := range messages {
+				messages[i] = api.Message{Role: "assistant", Content: sb[i].String(), Thinking: thinking[i].String()}
+			}
+
+			return messages
+		}
+
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.ChatResponse:
-				sb.WriteString(r.Message.Content)
+				sb[r.Index].WriteString(r.Message.Content)
+				thinking[r.Index].WriteString(r.Message.Thinking)
+				if r.Done {
+					mergeMetrics(&metrics, r.Metrics)
+				}
+
 				final = r
 			case gin.H:
-				if errorMsg, ok := r["error"].(string); ok {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": errorMsg})
+				if _, ok := r["error"].(string); ok {
+					// include what was generated before the error
+					if sb[0].Len() > 0 || thinking[0].Len() > 0 {
+						r["message"] = messages()[0]
+					}
+
+					if n > 1 {
+						r["choices"] = messages()
+					}
+
+					abortWithErrorResponse(c, r)
 					return
 				} else {
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error format in response"})
+					abortWithError(c, http.StatusInternalServerError, errors.New("unexpected error format in response"))
 					return
 				}
 			default:
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "unexpected error"})
+				abortWithError(c, http.StatusInternalServerError, errors.New("unexpected error"))
 				return
 			}
 		}
 
-		final.Message = api.Message{Role: "assistant", Content: sb.String()}
+		final.Message = messages()[0]
+		if n > 1 {
+			final.Index = 0
+			final.Choices = messages()
+			final.Metrics = metrics
+		}
+
 		c.JSON(http.StatusOK, final)
 		return
 	}
 
 	streamResponse(c, ch)
 }
+
+// mergeMetrics adds the metrics of a choice to those of the other choices of
+// a request. The choices are decoded at once, so the durations are those of
+// the longest, and they share the evaluation of the prompt, so its tokens
+// are counted once.
+func mergeMetrics(m *api.Metrics, choice api.Metrics) {
+	m.TotalDuration = max(m.TotalDuration, choice.TotalDuration)
+	m.LoadDuration = max(m.LoadDuration, choice.LoadDuration)
+	m.PromptEvalCount = max(m.PromptEvalCount, choice.PromptEvalCount)
+	m.PromptEvalDuration = max(m.PromptEvalDuration, choice.PromptEvalDuration)
+	m.EvalCount += choice.EvalCount
+	m.EvalDuration = max(m.EvalDuration, choice.EvalDuration)
+}
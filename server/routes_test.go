@@ -6,14 +6,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/jmorganca/ollama/api"
 	"github.com/jmorganca/ollama/llm"
@@ -71,6 +76,25 @@ func Test_Routes(t *testing.T) {
 				assert.Equal(t, fmt.Sprintf(`{"version":"%s"}`, version.Version), string(body))
 			},
 		},
+		{
+			Name:   "Health Handler",
+			Method: http.MethodGet,
+			Path:   "/healthz",
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			},
+		},
+		{
+			Name:   "Ready Handler (no preload)",
+			Method: http.MethodGet,
+			Path:   "/readyz",
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				body, err := io.ReadAll(resp.Body)
+				assert.Nil(t, err)
+				assert.Equal(t, `{"status":"ready"}`, string(body))
+			},
+		},
 		{
 			Name:   "Tags Handler (no tags)",
 			Method: http.MethodGet,
@@ -163,6 +187,23 @@ func Test_Routes(t *testing.T) {
 				assert.Equal(t, "beefsteak:latest", model.ShortName)
 			},
 		},
+		{
+			Name:   "Copy Model Handler (read-only)",
+			Method: http.MethodPost,
+			Path:   "/api/copy",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "readonly")
+				t.Setenv("OLLAMA_READONLY", "1")
+				req.Body = io.NopCloser(strings.NewReader(`{"source": "readonly", "destination": "readonly-copy"}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				os.Unsetenv("OLLAMA_READONLY")
+				assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+				_, err := GetModel("readonly-copy")
+				assert.NotNil(t, err)
+			},
+		},
 		{
 			Name:   "Show Model Handler",
 			Method: http.MethodPost,
@@ -199,6 +240,159 @@ func Test_Routes(t *testing.T) {
 				assert.Equal(t, expectedParams, params)
 			},
 		},
+		{
+			Name:   "Show Model Handler (not found)",
+			Method: http.MethodPost,
+			Path:   "/api/show",
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "missing-model"}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+				var serr api.StatusError
+				err := json.NewDecoder(resp.Body).Decode(&serr)
+				assert.Nil(t, err)
+				assert.Equal(t, api.ErrorCodeModelNotFound, serr.Code)
+				assert.Equal(t, "model 'missing-model' not found", serr.ErrorMessage)
+			},
+		},
+		{
+			Name:   "Generate Handler (invalid options)",
+			Method: http.MethodPost,
+			Path:   "/api/generate",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "options-model")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "options-model", "options": {"top_p": 2}}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				var serr api.StatusError
+				err := json.NewDecoder(resp.Body).Decode(&serr)
+				assert.Nil(t, err)
+				assert.Equal(t, api.ErrorCodeInvalidRequest, serr.Code)
+				assert.Equal(t, "top_p", serr.Param)
+			},
+		},
+		{
+			Name:   "Generate Handler (invalid rope_scaling_type)",
+			Method: http.MethodPost,
+			Path:   "/api/generate",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "rope-model")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "rope-model", "options": {"rope_scaling_type": "ntk"}}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				var serr api.StatusError
+				err := json.NewDecoder(resp.Body).Decode(&serr)
+				assert.Nil(t, err)
+				assert.Equal(t, api.ErrorCodeInvalidRequest, serr.Code)
+				assert.Equal(t, "rope_scaling_type", serr.Param)
+				assert.Equal(t, "invalid options: rope_scaling_type must be one of none, linear, yarn", serr.ErrorMessage)
+			},
+		},
+		{
+			Name:   "Generate Handler (misspelled option)",
+			Method: http.MethodPost,
+			Path:   "/api/generate",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "misspelled-model")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "misspelled-model", "options": {"temprature": 0.1}}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				var serr api.StatusError
+				err := json.NewDecoder(resp.Body).Decode(&serr)
+				assert.Nil(t, err)
+				assert.Equal(t, api.ErrorCodeInvalidRequest, serr.Code)
+				assert.Equal(t, "temprature", serr.Param)
+				assert.Equal(t, "invalid options: temprature is unknown, did you mean temperature?", serr.ErrorMessage)
+			},
+		},
+		{
+			Name:   "Embeddings Handler (unknown field)",
+			Method: http.MethodPost,
+			Path:   "/api/embeddings",
+			Setup: func(t *testing.T, req *http.Request) {
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "missing-model", "Prompt": "hello", "input": "hello"}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				// unknown fields are only warned of, so the request runs
+				assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+				assert.Equal(t, []string{"ignoring input, which is unknown"}, resp.Header.Values("X-Ollama-Warning"))
+			},
+		},
+		{
+			Name:   "Update Model Options Handler",
+			Method: http.MethodPatch,
+			Path:   "/api/models/update-options/options",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "update-options")
+				req.Body = io.NopCloser(strings.NewReader(`{"options": {"temperature": 0.5, "seed": null}}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+				var optionsResp api.ModelOptionsResponse
+				err := json.NewDecoder(resp.Body).Decode(&optionsResp)
+				assert.Nil(t, err)
+
+				expected := map[string]interface{}{
+					"temperature": 0.5,
+					"top_p":       0.9,
+					"stop":        []interface{}{"foo", "bar"},
+				}
+				assert.Equal(t, expected, optionsResp.Options)
+
+				model, err := GetModel("update-options")
+				assert.Nil(t, err)
+				assert.Equal(t, expected, model.Options)
+
+				opts, err := modelOptions(model, map[string]interface{}{"temperature": 0.2})
+				assert.Nil(t, err)
+				assert.Equal(t, float32(0.2), opts.Temperature)
+				assert.Equal(t, float32(0.9), opts.TopP)
+			},
+		},
+		{
+			Name:   "Update Model Options Handler (invalid options)",
+			Method: http.MethodPatch,
+			Path:   "/api/models/invalid-options/options",
+			Setup: func(t *testing.T, req *http.Request) {
+				createTestModel(t, "invalid-options")
+				req.Body = io.NopCloser(strings.NewReader(`{"options": {"top_k": "many"}}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				model, err := GetModel("invalid-options")
+				assert.Nil(t, err)
+				assert.Equal(t, 42.0, model.Options["seed"])
+			},
+		},
+		{
+			Name:   "Generate Handler (unknown field, strict)",
+			Method: http.MethodPost,
+			Path:   "/api/generate",
+			Setup: func(t *testing.T, req *http.Request) {
+				t.Setenv("OLLAMA_STRICT_REQUESTS", "1")
+				req.Body = io.NopCloser(strings.NewReader(`{"model": "missing-model", "promt": "hello", "sytem": "be brief"}`))
+			},
+			Expected: func(t *testing.T, resp *http.Response) {
+				assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+				var serr api.StatusError
+				err := json.NewDecoder(resp.Body).Decode(&serr)
+				assert.Nil(t, err)
+				assert.Equal(t, api.ErrorCodeInvalidRequest, serr.Code)
+				assert.Equal(t, "promt", serr.Param)
+				assert.Contains(t, serr.ErrorMessage, "sytem is unknown, did you mean system?")
+			},
+		},
 	}
 
 	s := Server{}
@@ -213,46 +407,593 @@ func Test_Routes(t *testing.T) {
 	os.Setenv("OLLAMA_MODELS", workDir)
 
 	for _, tc := range testCases {
-		t.Logf("Running Test: [%s]", tc.Name)
-		u := httpSrv.URL + tc.Path
-		req, err := http.NewRequestWithContext(context.TODO(), tc.Method, u, nil)
-		assert.Nil(t, err)
+		// each case is a subtest so the environment its setup sets is reset
+		// before the next runs
+		t.Run(tc.Name, func(t *testing.T) {
+			u := httpSrv.URL + tc.Path
+			req, err := http.NewRequestWithContext(context.TODO(), tc.Method, u, nil)
+			assert.Nil(t, err)
+
+			if tc.Setup != nil {
+				tc.Setup(t, req)
+			}
+
+			resp, err := httpSrv.Client().Do(req)
+			assert.Nil(t, err)
+			defer resp.Body.Close()
+
+			if tc.Expected != nil {
+				tc.Expected(t, resp)
+			}
+		})
+	}
+}
+
+// sizedLLM is a runner which knows how much of the model is in VRAM
+type sizedLLM struct {
+	MockLLM
+	size, vram int64
+}
+
+func (l *sizedLLM) Size() (int64, int64) {
+	return l.size, l.vram
+}
+
+func TestListRunning(t *testing.T) {
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	running := func() api.ProcessResponse {
+		resp, err := http.Get(srv.URL + "/api/ps")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var ps api.ProcessResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&ps))
+		return ps
+	}
+
+	assert.Empty(t, running().Models)
+
+	model := loadMockModel(t, "running", "", &sizedLLM{size: 400, vram: 100})
+	ps := running()
+	if assert.Len(t, ps.Models, 1) {
+		assert.Equal(t, "running:latest", ps.Models[0].Name)
+		assert.Equal(t, model.Digest, ps.Models[0].Digest)
+		assert.Equal(t, int64(400), ps.Models[0].Size)
+		assert.Equal(t, int64(100), ps.Models[0].SizeVRAM)
+	}
+}
+
+func TestServeDrain(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+	loadMockModel(t, "slow", "", &MockLLM{predict: func(_ llm.PredictOpts, fn func(llm.PredictResult)) error {
+		close(started)
+		<-finish
+		fn(llm.PredictResult{Content: "done", Done: true})
+		return nil
+	}})
+
+	t.Setenv("OLLAMA_NOPRUNE", "1")
+	t.Setenv("OLLAMA_DRAIN_TIMEOUT", "10s")
 
-		if tc.Setup != nil {
-			tc.Setup(t, req)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	url := "http://" + ln.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() { served <- Serve(ctx, ln, nil) }()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Head(url)
+		if err != nil {
+			return false
 		}
+		resp.Body.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
 
-		resp, err := httpSrv.Client().Do(req)
-		assert.Nil(t, err)
+	type result struct {
+		resp api.GenerateResponse
+		err  error
+	}
+
+	slow := make(chan result, 1)
+	go func() {
+		// a new connection, so it isn't one of the idle connections the
+		// server closes as it shuts down
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Post(url+"/api/generate", "application/json", strings.NewReader(`{"model": "slow", "prompt": "hi", "stream": false}`))
+		if err != nil {
+			slow <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		var r result
+		r.err = json.NewDecoder(resp.Body).Decode(&r.resp)
+		slow <- r
+	}()
+
+	<-started
+	cancel()
+
+	// the server stops accepting requests while the slow one is running
+	require.Eventually(t, func() bool {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Get(url + "/api/version")
+		if err != nil {
+			return true
+		}
+		resp.Body.Close()
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+
+	select {
+	case err := <-served:
+		t.Fatalf("the server stopped before the request finished: %v", err)
+	default:
+	}
+
+	close(finish)
+
+	r := <-slow
+	require.NoError(t, r.err)
+	assert.Equal(t, "done", r.resp.Response)
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the server didn't stop after the request finished")
+	}
+
+	// the runner is stopped once the requests are drained
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	assert.Nil(t, loaded.runner)
+}
+
+func TestGenerateRunnerCrashed(t *testing.T) {
+	loadMockModel(t, "crash", "", &MockLLM{predict: func(_ llm.PredictOpts, fn func(llm.PredictResult)) error {
+		fn(llm.PredictResult{Content: "partial"})
+		return fmt.Errorf("%w: exception", llm.ErrRunnerCrashed)
+	}})
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Post(srv.URL+"/api/generate", "application/json", strings.NewReader(`{"model": "crash", "prompt": "hi", "stream": false}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	var body struct {
+		Error    string        `json:"error"`
+		Code     api.ErrorCode `json:"code"`
+		Response string        `json:"response"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, api.ErrorCodeRunnerCrashed, body.Code)
+	assert.Equal(t, "runner crashed: exception", body.Error)
+	assert.Equal(t, "partial", body.Response)
+
+	// the runner is unloaded so the next request reloads the model
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	assert.Nil(t, loaded.runner)
+}
+
+func TestCompletionsSuffix(t *testing.T) {
+	var predict llm.PredictOpts
+	loadMockModel(t, "coder", "TEMPLATE \"[INST] {{ .Prompt }} [/INST]\"", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		predict = p
+		fn(llm.PredictResult{Content: "return a + b", Done: true, EvalCount: 4})
+		return nil
+	}})
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Post(srv.URL+"/v1/completions", "application/json", strings.NewReader(`{"model": "coder", "prompt": "def add(a, b):\n    ", "suffix": "\n\nprint(add(1, 2))"}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the prompt isn't templated so the runner can build the infill prompt
+	assert.Equal(t, "def add(a, b):\n    ", predict.Prompt)
+	assert.Equal(t, "\n\nprint(add(1, 2))", predict.Suffix)
+
+	var completion struct {
+		Object  string `json:"object"`
+		Choices []struct {
+			Text string `json:"text"`
+		} `json:"choices"`
+		Usage struct {
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&completion))
+	assert.Equal(t, "text_completion", completion.Object)
+	assert.Len(t, completion.Choices, 1)
+	assert.Equal(t, "return a + b", completion.Choices[0].Text)
+	assert.Equal(t, 4, completion.Usage.CompletionTokens)
+}
+
+func TestChatChoices(t *testing.T) {
+	// the model was loaded for two choices
+	var predict llm.PredictOpts
+	model := loadMockModel(t, "choices", "TEMPLATE \"[INST] {{ .Prompt }} [/INST]\"\nPARAMETER num_parallel 2", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		predict = p
+		fn(llm.PredictResult{Index: 1, Content: "{\"answer\":"})
+		fn(llm.PredictResult{Index: 0, Content: "{\"answer\": 4}"})
+		fn(llm.PredictResult{Index: 0, Done: true, PromptEvalCount: 10, EvalCount: 5})
+		fn(llm.PredictResult{Index: 1, Content: " 5}"})
+		fn(llm.PredictResult{Index: 1, Done: true, EvalCount: 6})
+		return nil
+	}})
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"model": "choices", "messages": [{"role": "user", "content": "2+2?"}], "format": "json", "n": 2, "stream": false}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// both choices are of the same prompt, which isn't evaluated again
+	assert.Equal(t, 2, predict.N)
+	assert.Equal(t, "json", predict.Format)
+	assert.Same(t, model, loaded.Model)
+
+	var chat api.ChatResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&chat))
+	assert.True(t, chat.Done)
+	assert.Equal(t, `{"answer": 4}`, chat.Message.Content)
+	if assert.Len(t, chat.Choices, 2) {
+		assert.Equal(t, `{"answer": 4}`, chat.Choices[0].Content)
+		assert.Equal(t, `{"answer": 5}`, chat.Choices[1].Content)
+	}
+	assert.Equal(t, 10, chat.PromptEvalCount)
+	assert.Equal(t, 11, chat.EvalCount)
+
+	// streamed choices each end with a response with done set
+	resp, err = http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"model": "choices", "messages": [{"role": "user", "content": "2+2?"}], "n": 2}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var indexes []int
+	var done int
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var chunk api.ChatResponse
+		assert.Nil(t, dec.Decode(&chunk))
+		indexes = append(indexes, chunk.Index)
+		if chunk.Done {
+			done++
+		}
+	}
+	assert.Equal(t, []int{1, 0, 0, 1, 1}, indexes)
+	assert.Equal(t, 2, done)
+
+	resp, err = http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(`{"model": "choices", "messages": [{"role": "user", "content": "2+2?"}], "n": 2}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var completion struct {
+		Choices []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&completion))
+	if assert.Len(t, completion.Choices, 2) {
+		assert.Equal(t, 1, completion.Choices[1].Index)
+		assert.Equal(t, `{"answer": 5}`, completion.Choices[1].Message.Content)
+	}
+	assert.Equal(t, 10, completion.Usage.PromptTokens)
+	assert.Equal(t, 11, completion.Usage.CompletionTokens)
+
+	resp, err = http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"model": "choices", "messages": [{"role": "user", "content": "2+2?"}], "n": -1}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// the model isn't loaded again to decode more choices than num_parallel
+	resp, err = http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"model": "choices", "messages": [{"role": "user", "content": "2+2?"}], "n": 3}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var serr api.StatusError
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&serr))
+	assert.Equal(t, api.ErrorCodeInvalidRequest, serr.Code)
+	assert.Contains(t, serr.ErrorMessage, "num_parallel of 2")
+	assert.Equal(t, 2, loaded.NumParallel)
+}
+
+func TestChatChoicesPromptEval(t *testing.T) {
+	// each choice reports the prompt they share
+	loadMockModel(t, "shared", "TEMPLATE \"[INST] {{ .Prompt }} [/INST]\"\nPARAMETER num_parallel 3", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		for i := range p.N {
+			fn(llm.PredictResult{Index: i, Content: "4"})
+			fn(llm.PredictResult{Index: i, Done: true, PromptEvalCount: 10, EvalCount: 2})
+		}
+		return nil
+	}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	usage := func() api.Usage {
+		resp, err := http.Get(srv.URL + "/api/usage")
+		require.NoError(t, err)
 		defer resp.Body.Close()
 
-		if tc.Expected != nil {
-			tc.Expected(t, resp)
+		var usage api.UsageResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&usage))
+		if len(usage.Usage) == 0 {
+			return api.Usage{}
 		}
 
+		return usage.Usage[0]
+	}
+
+	for _, n := range []int{1, 3} {
+		before := usage()
+
+		resp, err := http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(fmt.Sprintf(`{"model": "shared", "messages": [{"role": "user", "content": "2+2?"}], "n": %d, "stream": false}`, n)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var chat api.ChatResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&chat))
+		assert.Equal(t, 10, chat.PromptEvalCount, n)
+		assert.Equal(t, 2*n, chat.EvalCount, n)
+
+		// the prompt is recorded once, with the tokens of every choice
+		after := usage()
+		assert.Equal(t, int64(10), after.PromptTokens-before.PromptTokens, n)
+		assert.Equal(t, int64(2*n), after.CompletionTokens-before.CompletionTokens, n)
+
+		resp, err = http.Post(srv.URL+"/v1/chat/completions", "application/json", strings.NewReader(fmt.Sprintf(`{"model": "shared", "messages": [{"role": "user", "content": "2+2?"}], "n": %d, "stream": true, "stream_options": {"include_usage": true}}`, n)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), fmt.Sprintf(`"prompt_tokens":10,"completion_tokens":%d`, 2*n), n)
 	}
 }
 
-type MockLLM struct {
-	encoding []int
+func TestChatChoiceOutOfRange(t *testing.T) {
+	loadMockModel(t, "range", "TEMPLATE \"[INST] {{ .Prompt }} [/INST]\"", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		fn(llm.PredictResult{Index: 1, Content: "4"})
+		fn(llm.PredictResult{Index: 0, Done: true})
+		return nil
+	}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	// a choice the request didn't ask for is an error of the runner
+	resp, err := http.Post(srv.URL+"/api/chat", "application/json", strings.NewReader(`{"model": "range", "messages": [{"role": "user", "content": "2+2?"}], "stream": false}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	var serr api.StatusError
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&serr))
+	assert.Contains(t, serr.ErrorMessage, "choice 1 of a request for 1")
 }
 
-func (llm *MockLLM) Predict(ctx context.Context, pred llm.PredictOpts, fn func(llm.PredictResult)) error {
-	return nil
+func TestShowModelfileRoundTrip(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	f := mockModelFile(t, "")
+
+	create := func(name, modelfile string) *ManifestV2 {
+		commands, err := parser.Parse(strings.NewReader(modelfile))
+		assert.Nil(t, err)
+		assert.Nil(t, CreateModel(context.TODO(), name, "", commands, func(api.ProgressResponse) {}))
+
+		manifest, _, err := GetManifest(ParseModelPath(name))
+		assert.Nil(t, err)
+		return manifest
+	}
+
+	base := create("base", fmt.Sprintf("FROM %s\nTEMPLATE \"\"\"{{ .Prompt }}\"\"\"\nLICENSE \"\"\"some license\"\"\"\nPARAMETER stop \"\"\"<\"end\">\"\"\"\nPARAMETER stop \"\"\"line\nbreak\"\"\"", f))
+	derived := create("derived", "FROM base\nSYSTEM \"\"\"You are a helpful assistant.\"\"\"\nPARAMETER temperature 0.5\nMESSAGE user \"\"\"hi there\"\"\"")
+
+	// the derived model reuses the weights and layers it didn't change
+	digests := func(m *ManifestV2) map[string]string {
+		d := make(map[string]string)
+		for _, layer := range m.Layers {
+			d[layer.MediaType] = layer.Digest
+		}
+		return d
+	}
+
+	assert.Equal(t, digests(base)["application/vnd.ollama.image.model"], digests(derived)["application/vnd.ollama.image.model"])
+	assert.Equal(t, digests(base)["application/vnd.ollama.image.template"], digests(derived)["application/vnd.ollama.image.template"])
+	assert.Equal(t, digests(base)["application/vnd.ollama.image.license"], digests(derived)["application/vnd.ollama.image.license"])
+
+	model, err := GetModel("derived")
+	assert.Nil(t, err)
+
+	modelfile, err := ShowModelfile(model)
+	assert.Nil(t, err)
+
+	roundtrip := create("roundtrip", modelfile)
+	assert.Equal(t, digests(derived), digests(roundtrip))
 }
 
-func (llm *MockLLM) Encode(ctx context.Context, prompt string) ([]int, error) {
-	return llm.encoding, nil
+func TestParseKeepAlive(t *testing.T) {
+	cases := map[string]time.Duration{
+		"10m":  10 * time.Minute,
+		"3600": time.Hour,
+		"0":    0,
+		"-1":   time.Duration(math.MaxInt64),
+		"-1m":  time.Duration(math.MaxInt64),
+	}
+
+	for s, expected := range cases {
+		d, ok := parseKeepAlive(s)
+		assert.True(t, ok, s)
+		assert.Equal(t, expected, d, s)
+	}
+
+	_, ok := parseKeepAlive("forever")
+	assert.False(t, ok)
 }
 
-func (llm *MockLLM) Decode(ctx context.Context, tokens []int) (string, error) {
-	return "", nil
+func TestRunnerChanged(t *testing.T) {
+	loaded := api.DefaultOptions().Runner
+	loaded.NumCtx = 8192
+
+	opts := loaded
+	assert.False(t, runnerChanged(loaded, opts))
+
+	// a smaller context window uses the loaded model
+	opts.NumCtx = 2048
+	assert.False(t, runnerChanged(loaded, opts))
+
+	opts.NumCtx = 16384
+	assert.True(t, runnerChanged(loaded, opts))
+
+	opts.NumCtx = 2048
+	opts.NumBatch = 1024
+	assert.True(t, runnerChanged(loaded, opts))
+
+	// so do fewer sequences at once, but not more
+	opts.NumBatch = loaded.NumBatch
+	loaded.NumParallel = 4
+	opts.NumParallel = 2
+	assert.False(t, runnerChanged(loaded, opts))
+
+	opts.NumParallel = 8
+	assert.True(t, runnerChanged(loaded, opts))
+}
+
+func TestGenerateSmallerContext(t *testing.T) {
+	var prompt string
+	model := loadMockModel(t, "context", "", &wordLLM{MockLLM: MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		prompt = p.Prompt
+		fn(llm.PredictResult{Done: true})
+		return nil
+	}}})
+
+	// the model was loaded by a request with a larger context window
+	loaded.mu.Lock()
+	loaded.Options.NumCtx = 4096
+	loaded.mu.Unlock()
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	words := make([]string, 100)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+
+	generate := func(req api.GenerateRequest) int {
+		req.Model, req.Raw = "context", true
+		bts, err := json.Marshal(req)
+		assert.Nil(t, err)
+
+		resp, err := http.Post(srv.URL+"/api/generate", "application/json", bytes.NewReader(bts))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the prompt is truncated to the request's context window, without
+	// loading the model again
+	assert.Equal(t, http.StatusOK, generate(api.GenerateRequest{Prompt: strings.Join(words, " "), Options: map[string]interface{}{"num_ctx": 64.0}}))
+	assert.Same(t, model, loaded.Model)
+	assert.Len(t, strings.Fields(prompt), 64)
+	assert.True(t, strings.HasPrefix(prompt, "w0 w1 "))
+	assert.True(t, strings.HasSuffix(prompt, " w98 w99"))
+
+	assert.Equal(t, http.StatusOK, generate(api.GenerateRequest{Prompt: strings.Join(words, " ")}))
+	assert.Len(t, strings.Fields(prompt), 100)
+
+	// prompts which can't be truncated are rejected
+	assert.Equal(t, http.StatusBadRequest, generate(api.GenerateRequest{Prompt: "hi", Images: []api.ImageData{{}}, Options: map[string]interface{}{"num_ctx": 64.0}}))
 }
 
-func (llm *MockLLM) Embedding(ctx context.Context, input string) ([]float64, error) {
-	return []float64{}, nil
+func TestWarmupFailed(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	s := &Server{preload: []string{"missing"}}
+	assert.NotNil(t, s.warmupModels(context.TODO()))
+
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/readyz")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	var body struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "failed", body.Status)
+	assert.Contains(t, body.Error, "failed to preload missing")
 }
 
-func (llm *MockLLM) Close() {
-	// do nothing
+func TestWhisperRejected(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	// a gguf model of the whisper architecture, without tensors, padded
+	// again to where its data starts
+	b := bytes.Replace(writeGGUF(t, nil), []byte("\x05\x00\x00\x00\x00\x00\x00\x00llama"), []byte("\x07\x00\x00\x00\x00\x00\x00\x00whisper"), 1)
+	b = b[:bytes.Index(b, []byte("whisper"))+len("whisper")]
+	b = append(b, make([]byte, (32-len(b)%32)%32)...)
+	f := filepath.Join(t.TempDir(), "whisper.gguf")
+	require.NoError(t, os.WriteFile(f, b, 0o644))
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + f))
+	require.NoError(t, err)
+	require.NoError(t, CreateModel(context.TODO(), "whisper", "", commands, func(api.ProgressResponse) {}))
+
+	model, err := GetModel("whisper")
+	require.NoError(t, err)
+	assert.True(t, model.IsWhisper())
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	for path, body := range map[string]string{
+		"/api/generate":   `{"model": "whisper", "prompt": "hi"}`,
+		"/api/chat":       `{"model": "whisper", "messages": [{"role": "user", "content": "hi"}]}`,
+		"/api/embeddings": `{"model": "whisper", "prompt": "hi"}`,
+		"/api/sessions":   `{"model": "whisper"}`,
+	} {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		var serr api.StatusError
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&serr))
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+		assert.Contains(t, serr.ErrorMessage, "whisper models do not support", path)
+	}
 }
@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errTooManySessions = errors.New("too many sessions are answering messages")
+)
+
+// sessions keeps the messages of conversations so clients only send the next
+// message. They're kept in memory, so they're gone when the server restarts.
+var sessions = struct {
+	mu   sync.Mutex
+	byID map[string]*session
+
+	// created is the number of sessions which have been created, which
+	// picks the cache slot of the next one
+	created int
+}{byID: make(map[string]*session)}
+
+var (
+	defaultMaxSessions    = 256
+	defaultSessionTimeout = time.Hour
+)
+
+// getMaxSessions returns how many sessions are kept, set by
+// OLLAMA_MAX_SESSIONS
+func getMaxSessions() int {
+	if n, err := strconv.Atoi(os.Getenv("OLLAMA_MAX_SESSIONS")); err == nil && n > 0 {
+		return n
+	}
+
+	return defaultMaxSessions
+}
+
+// getSessionTimeout returns how long sessions are kept after their last
+// message, set by OLLAMA_SESSION_TIMEOUT
+func getSessionTimeout() time.Duration {
+	if t, exists := os.LookupEnv("OLLAMA_SESSION_TIMEOUT"); exists {
+		if v, err := strconv.Atoi(t); err == nil && v > 0 {
+			return time.Duration(v) * time.Second
+		}
+
+		if d, err := time.ParseDuration(t); err == nil && d > 0 {
+			return d
+		}
+	}
+
+	return defaultSessionTimeout
+}
+
+type session struct {
+	id        string
+	model     string
+	options   map[string]interface{}
+	keepAlive *api.Duration
+	messages  []api.Message
+	createdAt time.Time
+
+	// usedAt is when the session was created or last answered a message
+	usedAt time.Time
+
+	// slot picks the slot of the runner which keeps the prompt of the
+	// session cached between messages, see cacheSlot
+	slot int
+
+	// busy is set while a message is being answered, since the next message
+	// depends on the answer
+	busy bool
+}
+
+// expireSessions removes the sessions which have been idle for longer than
+// the session timeout. It is up to the caller to lock sessions.mu.
+func expireSessions() {
+	timeout := getSessionTimeout()
+	for id, s := range sessions.byID {
+		if !s.busy && time.Since(s.usedAt) > timeout {
+			delete(sessions.byID, id)
+		}
+	}
+}
+
+// addSession adds s, replacing the session with the same ID. The least
+// recently used session is removed if there are too many. It is up to the
+// caller to lock sessions.mu.
+func addSession(s *session) error {
+	expireSessions()
+	if _, ok := sessions.byID[s.id]; !ok && len(sessions.byID) >= getMaxSessions() {
+		var oldest *session
+		for _, old := range sessions.byID {
+			if !old.busy && (oldest == nil || old.usedAt.Before(oldest.usedAt)) {
+				oldest = old
+			}
+		}
+
+		if oldest == nil {
+			return errTooManySessions
+		}
+
+		slog.Info(fmt.Sprintf("removing session %s, which was used least recently, to keep %d sessions", oldest.id, getMaxSessions()))
+		delete(sessions.byID, oldest.id)
+	}
+
+	s.usedAt = time.Now()
+	s.slot = sessions.created
+	sessions.created++
+	sessions.byID[s.id] = s
+	return nil
+}
+
+// sessionSlotKey is the key of the cache slot of a session's message in the
+// gin context of its chat request
+const sessionSlotKey = "session_slot"
+
+// cacheSlot returns the slot of the loaded runner a chat request evaluates its
+// prompt in. Requests outside of sessions use the first slot, and sessions
+// share the rest, if the model was loaded with a num_parallel of more than
+// one, so their prompts stay cached between their messages.
+func cacheSlot(c *gin.Context) int {
+	slot, ok := c.Get(sessionSlotKey)
+	if !ok || loaded.NumParallel <= 1 {
+		return 0
+	}
+
+	return 1 + slot.(int)%(loaded.NumParallel-1)
+}
+
+func (s *session) response() api.SessionResponse {
+	return api.SessionResponse{
+		ID:        s.id,
+		Model:     s.model,
+		Messages:  slices.Clone(s.messages),
+		CreatedAt: s.createdAt,
+	}
+}
+
+func CreateSessionHandler(c *gin.Context) {
+	var req api.SessionRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Model == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
+		return
+	}
+
+	// aliases are resolved by each message, so the session follows them
+	model, err := GetModel(resolveAlias(req.Model))
+	if err != nil {
+		var pErr *fs.PathError
+		if errors.As(err, &pErr) {
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found, try pulling it first", req.Model)))
+			return
+		}
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if model.IsEmbedding() {
+		abortWithError(c, http.StatusBadRequest, errors.New("embedding models do not support chat"))
+		return
+	}
+
+	if model.IsWhisper() {
+		abortWithError(c, http.StatusBadRequest, errors.New("whisper models do not support chat"))
+		return
+	}
+
+	s := &session{
+		id:        uuid.New().String(),
+		model:     req.Model,
+		options:   req.Options,
+		keepAlive: req.KeepAlive,
+		messages:  []api.Message{},
+		createdAt: time.Now().UTC(),
+	}
+
+	if req.System != "" {
+		s.messages = append(s.messages, api.Message{Role: "system", Content: req.System})
+	}
+
+	sessions.mu.Lock()
+	err = addSession(s)
+	resp := s.response()
+	sessions.mu.Unlock()
+
+	if err != nil {
+		abortWithError(c, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func ListSessionsHandler(c *gin.Context) {
+	sessions.mu.Lock()
+	expireSessions()
+	resp := api.ListSessionsResponse{Sessions: []api.SessionResponse{}}
+	for _, s := range sessions.byID {
+		resp.Sessions = append(resp.Sessions, s.response())
+	}
+	sessions.mu.Unlock()
+
+	slices.SortFunc(resp.Sessions, func(a, b api.SessionResponse) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
+
+func GetSessionHandler(c *gin.Context) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	expireSessions()
+	s, ok := sessions.byID[c.Param("id")]
+	if !ok {
+		abortWithError(c, http.StatusNotFound, errSessionNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, s.response())
+}
+
+func DeleteSessionHandler(c *gin.Context) {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	expireSessions()
+	if _, ok := sessions.byID[c.Param("id")]; !ok {
+		abortWithError(c, http.StatusNotFound, errSessionNotFound)
+		return
+	}
+
+	delete(sessions.byID, c.Param("id"))
+	c.JSON(http.StatusOK, nil)
+}
+
+// sessionWriter collects the answer the chat handler writes so it can be
+// added to the session
+type sessionWriter struct {
+	gin.ResponseWriter
+
+	content strings.Builder
+	done    bool
+	failed  bool
+}
+
+func (w *sessionWriter) Write(data []byte) (int, error) {
+	var resp struct {
+		api.ChatResponse
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(data, &resp); err != nil || resp.Error != "" {
+		w.failed = true
+	} else {
+		w.content.WriteString(resp.Message.Content)
+	}
+
+	w.done = w.done || resp.Done
+	return w.ResponseWriter.Write(data)
+}
+
+// sessionChatMiddleware turns the next message of a session into a chat
+// request with the messages before it. The message and the answer are added
+// to the session once the answer is done.
+func sessionChatMiddleware(c *gin.Context) {
+	var req api.SessionChatRequest
+	err := c.ShouldBindJSON(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, errors.New("missing request body"))
+		return
+	case err != nil:
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if req.Content == "" && len(req.Images) == 0 {
+		abortWithError(c, http.StatusBadRequest, errors.New("content is required"))
+		return
+	}
+
+	sessions.mu.Lock()
+	expireSessions()
+	s, ok := sessions.byID[c.Param("id")]
+	switch {
+	case !ok:
+		sessions.mu.Unlock()
+		abortWithError(c, http.StatusNotFound, errSessionNotFound)
+		return
+	case s.busy:
+		sessions.mu.Unlock()
+		abortWithError(c, http.StatusConflict, errors.New("session is answering another message"))
+		return
+	}
+
+	s.busy = true
+	c.Set(sessionSlotKey, s.slot)
+	message := api.Message{Role: "user", Content: req.Content, Images: req.Images}
+
+	chatReq := api.ChatRequest{
+		Model:     s.model,
+		Messages:  append(slices.Clone(s.messages), message),
+		Stream:    req.Stream,
+		Format:    req.Format,
+		KeepAlive: s.keepAlive,
+		Options:   maps.Clone(s.options),
+	}
+	sessions.mu.Unlock()
+
+	defer func() {
+		sessions.mu.Lock()
+		s.busy = false
+		s.usedAt = time.Now()
+		sessions.mu.Unlock()
+	}()
+
+	if req.KeepAlive != nil {
+		chatReq.KeepAlive = req.KeepAlive
+	}
+
+	if chatReq.Options == nil {
+		chatReq.Options = make(map[string]interface{})
+	}
+
+	maps.Copy(chatReq.Options, req.Options)
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(chatReq); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Request.Body = io.NopCloser(&b)
+
+	w := &sessionWriter{ResponseWriter: c.Writer}
+	c.Writer = w
+
+	c.Next()
+
+	if w.Status() != http.StatusOK || !w.done || w.failed {
+		return
+	}
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	// the session may have been deleted while it was answering
+	if _, ok := sessions.byID[s.id]; ok {
+		s.messages = append(s.messages, message, api.Message{Role: "assistant", Content: w.content.String()})
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestSessionChat(t *testing.T) {
+	var prompts []string
+	loadMockModel(t, "chat", "TEMPLATE \"{{ .System }} [INST] {{ .Prompt }} [/INST] {{ .Response }}\"", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		prompts = append(prompts, p.Prompt)
+		fn(llm.PredictResult{Content: "hello"})
+		fn(llm.PredictResult{Content: " there", Done: true})
+		return nil
+	}})
+
+	s := Server{}
+	srv := httptest.NewServer(s.GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Post(srv.URL+"/api/sessions", "application/json", strings.NewReader(`{"model": "chat", "system": "be brief"}`))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var session api.SessionResponse
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&session))
+	assert.NotEmpty(t, session.ID)
+	t.Cleanup(func() {
+		sessions.mu.Lock()
+		defer sessions.mu.Unlock()
+		delete(sessions.byID, session.ID)
+	})
+
+	for _, content := range []string{"hi", "how are you?"} {
+		resp, err := http.Post(srv.URL+"/api/sessions/"+session.ID+"/chat", "application/json", strings.NewReader(`{"content": "`+content+`"}`))
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the second prompt has the first message and answer before it
+	assert.Len(t, prompts, 2)
+	assert.Contains(t, prompts[1], "[INST] hi [/INST] hello there")
+	assert.Contains(t, prompts[1], "how are you?")
+
+	resp, err = http.Get(srv.URL + "/api/sessions/" + session.ID)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&session))
+	assert.Equal(t, []api.Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hello there"},
+		{Role: "user", Content: "how are you?"},
+		{Role: "assistant", Content: "hello there"},
+	}, session.Messages)
+
+	resp, err = http.Post(srv.URL+"/api/sessions/missing/chat", "application/json", strings.NewReader(`{"content": "hi"}`))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestSessionSlots(t *testing.T) {
+	var slots []int
+	loadMockModel(t, "slots", "TEMPLATE \"[INST] {{ .Prompt }} [/INST]\"\nPARAMETER num_parallel 3", &MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		slots = append(slots, p.Slot)
+		fn(llm.PredictResult{Content: "hello", Done: true})
+		return nil
+	}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	post := func(path, body string) *http.Response {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		assert.Nil(t, err)
+		t.Cleanup(func() { resp.Body.Close() })
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	for range 3 {
+		var session api.SessionResponse
+		assert.Nil(t, json.NewDecoder(post("/api/sessions", `{"model": "slots"}`).Body).Decode(&session))
+		t.Cleanup(func() {
+			sessions.mu.Lock()
+			defer sessions.mu.Unlock()
+			delete(sessions.byID, session.ID)
+		})
+
+		post("/api/sessions/"+session.ID+"/chat", `{"content": "hi", "stream": false}`)
+	}
+
+	post("/api/chat", `{"model": "slots", "messages": [{"role": "user", "content": "hi"}], "stream": false}`)
+
+	// sessions share the slots after the first, which the other requests use
+	if assert.Len(t, slots, 4) {
+		assert.NotZero(t, slots[0])
+		assert.NotEqual(t, slots[0], slots[1])
+		assert.Equal(t, slots[0], slots[2])
+		assert.Zero(t, slots[3])
+	}
+}
+
+func TestAddSession(t *testing.T) {
+	t.Setenv("OLLAMA_MAX_SESSIONS", "2")
+	t.Setenv("OLLAMA_SESSION_TIMEOUT", "1h")
+
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+
+	byID := sessions.byID
+	sessions.byID = make(map[string]*session)
+	t.Cleanup(func() { sessions.byID = byID })
+
+	assert.Nil(t, addSession(&session{id: "a"}))
+	assert.Nil(t, addSession(&session{id: "b"}))
+	sessions.byID["a"].usedAt = time.Now().Add(-time.Minute)
+
+	// the least recently used session is removed to keep the most sessions
+	assert.Nil(t, addSession(&session{id: "c"}))
+	assert.NotContains(t, sessions.byID, "a")
+	assert.Len(t, sessions.byID, 2)
+
+	// unless all of them are answering messages
+	sessions.byID["b"].busy = true
+	sessions.byID["c"].busy = true
+	assert.ErrorIs(t, addSession(&session{id: "d"}), errTooManySessions)
+
+	// idle sessions expire
+	sessions.byID["c"].busy = false
+	sessions.byID["c"].usedAt = time.Now().Add(-2 * time.Hour)
+	expireSessions()
+	assert.NotContains(t, sessions.byID, "c")
+	assert.Contains(t, sessions.byID, "b")
+}
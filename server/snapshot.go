@@ -0,0 +1,328 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+var errSnapshotNotFound = errors.New("no snapshot has been saved")
+
+// snapshotMu guards snapshot.json, which is in the models directory and has
+// the snapshot saved last
+var snapshotMu sync.Mutex
+
+func snapshotPath() (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "snapshot.json"), nil
+}
+
+// readSnapshot reads the snapshot saved last. It is up to the caller to lock
+// snapshotMu.
+func readSnapshot() (api.Snapshot, error) {
+	fp, err := snapshotPath()
+	if err != nil {
+		return api.Snapshot{}, err
+	}
+
+	bts, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return api.Snapshot{}, errSnapshotNotFound
+	} else if err != nil {
+		return api.Snapshot{}, err
+	}
+
+	var snap api.Snapshot
+	if err := json.Unmarshal(bts, &snap); err != nil {
+		return api.Snapshot{}, fmt.Errorf("%s: %w", fp, err)
+	}
+
+	return snap, nil
+}
+
+// writeSnapshot replaces the saved snapshot. It is up to the caller to lock
+// snapshotMu.
+func writeSnapshot(snap api.Snapshot) error {
+	fp, err := snapshotPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	// write a temporary file first so the last snapshot isn't lost if it fails
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, bts, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fp)
+}
+
+// changedRunnerOptions returns the runner options of opts which are different
+// from base, by their names
+func changedRunnerOptions(opts, base api.Runner) map[string]interface{} {
+	changed := make(map[string]interface{})
+
+	v, b := reflect.ValueOf(opts), reflect.ValueOf(base)
+	for _, field := range reflect.VisibleFields(v.Type()) {
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		value := v.FieldByIndex(field.Index).Interface()
+		if !reflect.DeepEqual(value, b.FieldByIndex(field.Index).Interface()) {
+			changed[name] = value
+		}
+	}
+
+	return changed
+}
+
+// takeSnapshot returns the state of the server. The loaded model is only
+// snapshotted once the request it's running, if any, is done.
+func takeSnapshot(withSessions bool) (api.Snapshot, error) {
+	snap := api.Snapshot{CreatedAt: time.Now().UTC(), Aliases: []api.Alias{}}
+
+	aliasesMu.Lock()
+	aliases, err := readAliases()
+	aliasesMu.Unlock()
+	if err != nil {
+		return api.Snapshot{}, err
+	}
+
+	for name, a := range aliases {
+		snap.Aliases = append(snap.Aliases, api.Alias{Name: name, Target: a.Target, Fallbacks: a.Fallbacks, MaxQueue: a.MaxQueue})
+	}
+
+	slices.SortFunc(snap.Aliases, func(a, b api.Alias) int {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	loaded.mu.Lock()
+	if loaded.runner != nil && loaded.Model != nil {
+		live := getLiveOptions(loaded.Model)
+
+		// the runner options of the request which loaded the model
+		base, err := mergeOptions(loaded.Model, live, nil)
+		if err != nil {
+			loaded.mu.Unlock()
+			return api.Snapshot{}, err
+		}
+
+		snap.Model = &api.SnapshotModel{
+			Name:        loaded.ShortName,
+			Options:     changedRunnerOptions(loaded.Options.Runner, base.Runner),
+			LiveOptions: maps.Clone(live),
+			ExpiresAt:   loaded.expireAt.UTC(),
+		}
+	}
+	loaded.mu.Unlock()
+
+	if withSessions {
+		sessions.mu.Lock()
+		for _, s := range sessions.byID {
+			ss := api.SnapshotSession{SessionResponse: s.response(), Options: maps.Clone(s.options)}
+			if s.keepAlive != nil {
+				ss.KeepAlive = s.keepAlive.Duration.String()
+			}
+
+			snap.Sessions = append(snap.Sessions, ss)
+		}
+		sessions.mu.Unlock()
+
+		slices.SortFunc(snap.Sessions, func(a, b api.SnapshotSession) int {
+			return a.CreatedAt.Compare(b.CreatedAt)
+		})
+	}
+
+	return snap, nil
+}
+
+// restoreSnapshot sets the aliases and sessions of the snapshot, replacing
+// those with the same names, and loads the model which was loaded. The model
+// is kept loaded for as long as it had left when the snapshot was taken.
+func restoreSnapshot(ctx context.Context, snap api.Snapshot) error {
+	if len(snap.Aliases) > 0 {
+		aliasesMu.Lock()
+		aliases, err := readAliases()
+		if err == nil {
+			for _, a := range snap.Aliases {
+				aliases[ParseModelPath(a.Name).GetShortTagname()] = alias{Target: a.Target, Fallbacks: a.Fallbacks, MaxQueue: a.MaxQueue}
+			}
+
+			err = writeAliases(aliases)
+		}
+		aliasesMu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	restored := make([]*session, 0, len(snap.Sessions))
+	for _, ss := range snap.Sessions {
+		s := &session{
+			id:        ss.ID,
+			model:     ss.Model,
+			options:   ss.Options,
+			messages:  ss.Messages,
+			createdAt: ss.CreatedAt,
+		}
+
+		if ss.KeepAlive != "" {
+			d, err := time.ParseDuration(ss.KeepAlive)
+			if err != nil {
+				return codeError{api.ErrorCodeInvalidRequest, fmt.Errorf("session %s has an invalid keep_alive %q", ss.ID, ss.KeepAlive)}
+			}
+
+			s.keepAlive = &api.Duration{Duration: d}
+		}
+
+		if s.messages == nil {
+			s.messages = []api.Message{}
+		}
+
+		restored = append(restored, s)
+	}
+
+	sessions.mu.Lock()
+	for _, s := range restored {
+		if err := addSession(s); err != nil {
+			sessions.mu.Unlock()
+			return err
+		}
+	}
+	sessions.mu.Unlock()
+
+	if snap.Model == nil {
+		return nil
+	}
+
+	model, err := GetModel(snap.Model.Name)
+	if errors.Is(err, os.ErrNotExist) {
+		return errModelNotFound(fmt.Errorf("model '%s' not found", snap.Model.Name))
+	} else if err != nil {
+		return err
+	}
+
+	opts, err := mergeOptions(model, snap.Model.LiveOptions, snap.Model.Options)
+	if err != nil {
+		return err
+	}
+
+	sessionDuration := snap.Model.ExpiresAt.Sub(snap.CreatedAt)
+	if sessionDuration <= 0 {
+		sessionDuration = getDefaultSessionDuration()
+	}
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	if err := warmupLoaded(ctx, model, opts, sessionDuration); err != nil {
+		return err
+	}
+
+	if len(snap.Model.LiveOptions) > 0 {
+		setLiveOptions(model, maps.Clone(snap.Model.LiveOptions))
+	}
+
+	return nil
+}
+
+func SaveSnapshotHandler(c *gin.Context) {
+	var req api.SnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	snap, err := takeSnapshot(req.Sessions)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	snapshotMu.Lock()
+	err = writeSnapshot(snap)
+	snapshotMu.Unlock()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, snap)
+}
+
+func GetSnapshotHandler(c *gin.Context) {
+	snapshotMu.Lock()
+	snap, err := readSnapshot()
+	snapshotMu.Unlock()
+	if errors.Is(err, errSnapshotNotFound) {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, snap)
+}
+
+func RestoreSnapshotHandler(c *gin.Context) {
+	var req api.RestoreSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	snap := req.Snapshot
+	if snap == nil {
+		snapshotMu.Lock()
+		saved, err := readSnapshot()
+		snapshotMu.Unlock()
+		if errors.Is(err, errSnapshotNotFound) {
+			abortWithError(c, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err)
+			return
+		}
+
+		snap = &saved
+	}
+
+	if err := restoreSnapshot(c.Request.Context(), *snap); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, snap)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestSnapshot(t *testing.T) {
+	var warmedUp bool
+	runner := &MockLLM{predict: func(pred llm.PredictOpts, fn func(llm.PredictResult)) error {
+		warmedUp = true
+		return nil
+	}}
+
+	model := loadMockModel(t, "snapshot", "PARAMETER temperature 0.5", runner)
+
+	// the model was loaded by a request with a larger context window
+	loaded.mu.Lock()
+	loaded.Options.NumCtx = 4096
+	keepLoaded(time.Hour)
+	loaded.mu.Unlock()
+	setLiveOptions(model, map[string]interface{}{"temperature": 0.1})
+
+	t.Cleanup(func() {
+		clearLiveOptions()
+
+		sessions.mu.Lock()
+		delete(sessions.byID, "c0ffee")
+		sessions.mu.Unlock()
+	})
+
+	aliasesMu.Lock()
+	require.NoError(t, writeAliases(map[string]alias{"default:latest": {Target: "snapshot:latest"}}))
+	aliasesMu.Unlock()
+
+	sessions.mu.Lock()
+	sessions.byID["c0ffee"] = &session{
+		id:        "c0ffee",
+		model:     "snapshot",
+		keepAlive: &api.Duration{Duration: 10 * time.Minute},
+		messages:  []api.Message{{Role: "user", Content: "hello"}, {Role: "assistant", Content: "hi"}},
+		createdAt: time.Now().UTC(),
+	}
+	sessions.mu.Unlock()
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	post := func(path string, req any) (int, api.Snapshot) {
+		bts, err := json.Marshal(req)
+		require.NoError(t, err)
+
+		resp, err := http.Post(srv.URL+path, "application/json", bytes.NewReader(bts))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var snap api.Snapshot
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&snap))
+		}
+
+		return resp.StatusCode, snap
+	}
+
+	status, _ := post("/api/snapshot/restore", api.RestoreSnapshotRequest{})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// a snapshot is written to the models directory, so it can't be saved
+	// on a read-only server
+	t.Setenv("OLLAMA_READONLY", "1")
+	status, _ = post("/api/snapshot", api.SnapshotRequest{Sessions: true})
+	assert.Equal(t, http.StatusForbidden, status)
+	t.Setenv("OLLAMA_READONLY", "")
+
+	status, snap := post("/api/snapshot", api.SnapshotRequest{Sessions: true})
+	require.Equal(t, http.StatusOK, status)
+
+	require.NotNil(t, snap.Model)
+	assert.Equal(t, "snapshot:latest", snap.Model.Name)
+	assert.Equal(t, map[string]interface{}{"num_ctx": 4096.0}, snap.Model.Options)
+	assert.Equal(t, map[string]interface{}{"temperature": 0.1}, snap.Model.LiveOptions)
+	assert.InDelta(t, time.Hour.Seconds(), snap.Model.ExpiresAt.Sub(snap.CreatedAt).Seconds(), 60)
+	assert.Equal(t, []api.Alias{{Name: "default:latest", Target: "snapshot:latest"}}, snap.Aliases)
+	require.Len(t, snap.Sessions, 1)
+	assert.Equal(t, "c0ffee", snap.Sessions[0].ID)
+	assert.Equal(t, "10m0s", snap.Sessions[0].KeepAlive)
+	assert.Len(t, snap.Sessions[0].Messages, 2)
+
+	// the state is lost, such as when the server restarts
+	aliasesMu.Lock()
+	require.NoError(t, writeAliases(map[string]alias{}))
+	aliasesMu.Unlock()
+
+	sessions.mu.Lock()
+	delete(sessions.byID, "c0ffee")
+	sessions.mu.Unlock()
+
+	clearLiveOptions()
+
+	status, _ = post("/api/snapshot/restore", api.RestoreSnapshotRequest{})
+	require.Equal(t, http.StatusOK, status)
+
+	// the model is loaded with the same options, so it isn't loaded again
+	assert.Same(t, runner, loaded.runner)
+	assert.True(t, warmedUp)
+	assert.Equal(t, 4096, loaded.Options.NumCtx)
+	assert.Equal(t, map[string]interface{}{"temperature": 0.1}, getLiveOptions(model))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), loaded.expireAt, time.Minute)
+
+	a, ok := lookupAlias("default")
+	assert.True(t, ok)
+	assert.Equal(t, "snapshot:latest", a.Target)
+
+	sessions.mu.Lock()
+	s, ok := sessions.byID["c0ffee"]
+	sessions.mu.Unlock()
+	require.True(t, ok)
+	assert.Equal(t, 10*time.Minute, s.keepAlive.Duration)
+	assert.Len(t, s.messages, 2)
+
+	// snapshots of models which have been removed can't be restored
+	snap.Model.Name = "missing"
+	status, _ = post("/api/snapshot/restore", api.RestoreSnapshotRequest{Snapshot: &snap})
+	assert.Equal(t, http.StatusNotFound, status)
+}
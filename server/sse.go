@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// acceptsEventStream reports whether the client asked for server-sent events
+func acceptsEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediatype, _, err := mime.ParseMediaType(accept); err == nil && mediatype == "text/event-stream" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sseWriter writes each line of a stream as a server-sent event. Responses
+// which aren't streamed, such as errors before the stream starts, are
+// written as they are.
+type sseWriter struct {
+	gin.ResponseWriter
+
+	events  bool
+	partial []byte
+}
+
+func (w *sseWriter) Write(b []byte) (int, error) {
+	if !w.events {
+		if w.Header().Get("Content-Type") != "application/x-ndjson" {
+			return w.ResponseWriter.Write(b)
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.events = true
+	}
+
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		if err := w.writeEvent(w.partial[:i]); err != nil {
+			return 0, err
+		}
+
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(b), nil
+}
+
+func (w *sseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// writeEvent writes a line as a message event, or an error event if it's an
+// error
+func (w *sseWriter) writeEvent(line []byte) error {
+	var buf bytes.Buffer
+
+	var resp struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(line, &resp); err == nil && resp.Error != "" {
+		buf.WriteString("event: error\n")
+	}
+
+	buf.WriteString("data: ")
+	buf.Write(line)
+	buf.WriteString("\n\n")
+
+	_, err := w.ResponseWriter.Write(buf.Bytes())
+	return err
+}
+
+var errEventSourceOnly = errors.New("GET requests must be sent by an EventSource of an allowed origin")
+
+// sseMiddleware streams the response as server-sent events if the client
+// accepts text/event-stream. GET requests, which are the only requests
+// EventSource sends, have the body of the request in the request query
+// parameter.
+//
+// Unlike POST requests with a JSON body, any page can send a GET request
+// without a preflight, such as with an image, so GET requests must accept
+// text/event-stream and have an Origin, which the CORS middleware has
+// checked is allowed.
+func sseMiddleware(c *gin.Context) {
+	if c.Request.Method == http.MethodGet {
+		if !acceptsEventStream(c.Request) || c.GetHeader("Origin") == "" {
+			abortWithError(c, http.StatusForbidden, errEventSourceOnly)
+			return
+		}
+
+		body := c.Query("request")
+		c.Request.Body = io.NopCloser(strings.NewReader(body))
+		c.Request.ContentLength = int64(len(body))
+	}
+
+	if !acceptsEventStream(c.Request) {
+		c.Next()
+		return
+	}
+
+	c.Writer = &sseWriter{ResponseWriter: c.Writer}
+	c.Next()
+}
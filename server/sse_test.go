@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestSSEMiddleware(t *testing.T) {
+	handler := func(c *gin.Context) {
+		var req api.GenerateRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abortWithError(c, http.StatusBadRequest, err)
+			return
+		}
+
+		if req.Stream != nil && !*req.Stream {
+			c.JSON(http.StatusOK, gin.H{"response": "ab", "done": true})
+			return
+		}
+
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			ch <- gin.H{"response": "a"}
+			ch <- gin.H{"error": "runner crashed"}
+		}()
+
+		streamResponse(c, ch)
+	}
+
+	r := gin.New()
+	r.POST("/api/generate", sseMiddleware, handler)
+	r.GET("/api/generate", sseMiddleware, handler)
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	origin := ""
+	send := func(method, path, accept, body string) (string, string) {
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		assert.Nil(t, err)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		bts, err := io.ReadAll(resp.Body)
+		assert.Nil(t, err)
+		return resp.Header.Get("Content-Type"), string(bts)
+	}
+
+	events := "data: {\"response\":\"a\"}\n\nevent: error\ndata: {\"error\":\"runner crashed\"}\n\n"
+
+	contentType, body := send(http.MethodPost, "/api/generate", "text/event-stream", `{"model": "test"}`)
+	assert.Equal(t, "text/event-stream", contentType)
+	assert.Equal(t, events, body)
+
+	contentType, body = send(http.MethodPost, "/api/generate", "application/json", `{"model": "test"}`)
+	assert.Equal(t, "application/x-ndjson", contentType)
+	assert.Equal(t, "{\"response\":\"a\"}\n{\"error\":\"runner crashed\"}\n", body)
+
+	// responses which aren't streamed are sent as they are
+	contentType, body = send(http.MethodPost, "/api/generate", "text/event-stream", `{"model": "test", "stream": false}`)
+	assert.Equal(t, "application/json; charset=utf-8", contentType)
+	assert.Equal(t, `{"done":true,"response":"ab"}`, body)
+
+	// GET requests are only taken from an EventSource
+	request := "/api/generate?request=" + url.QueryEscape(`{"model": "test"}`)
+	_, body = send(http.MethodGet, request, "text/event-stream", "")
+	assert.Contains(t, body, errEventSourceOnly.Error())
+
+	origin = "http://localhost:3000"
+	_, body = send(http.MethodGet, request, "", "")
+	assert.Contains(t, body, errEventSourceOnly.Error())
+
+	contentType, body = send(http.MethodGet, request, "text/event-stream", "")
+	assert.Equal(t, "text/event-stream", contentType)
+	assert.Equal(t, events, body)
+
+	_, body = send(http.MethodGet, "/api/generate", "text/event-stream", "")
+	assert.Contains(t, body, "EOF")
+}
+
+func TestEventSourceOrigin(t *testing.T) {
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	get := func(origin string) int {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/generate?request="+url.QueryEscape(`{}`), nil)
+		assert.Nil(t, err)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Origin", origin)
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusForbidden, get("http://example.com"))
+
+	// the request gets to the handler, which rejects it for having no model
+	assert.Equal(t, http.StatusBadRequest, get("http://localhost:3000"))
+}
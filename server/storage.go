@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jmorganca/ollama/format"
+)
+
+var errInsufficientStorage = errors.New("not enough storage")
+
+// getMaxStorage returns how many bytes blobs can use, set by
+// OLLAMA_MAX_STORAGE. Blobs can fill the disk by default.
+func getMaxStorage() (int64, bool) {
+	n, err := strconv.ParseInt(os.Getenv("OLLAMA_MAX_STORAGE"), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// blobsSize returns how many bytes the blobs use
+func blobsSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// checkStorage returns errInsufficientStorage if storing need more bytes of
+// blobs would exceed OLLAMA_MAX_STORAGE or fill the disk, so a pull or create
+// fails before it starts rather than part way through
+func checkStorage(need int64) error {
+	if need <= 0 {
+		return nil
+	}
+
+	dir, err := GetBlobsPath("")
+	if err != nil {
+		return err
+	}
+
+	suggestion := "remove models which aren't needed with `ollama rm`"
+	if os.Getenv("OLLAMA_NOPRUNE") != "" {
+		suggestion += ", or restart the server without OLLAMA_NOPRUNE to remove unused blobs"
+	}
+
+	if limit, ok := getMaxStorage(); ok {
+		used, err := blobsSize(dir)
+		if err != nil {
+			return err
+		}
+
+		if used+need > limit {
+			return fmt.Errorf("%w: %s more would exceed OLLAMA_MAX_STORAGE of %s, with %s used; %s", errInsufficientStorage, format.HumanBytes(need), format.HumanBytes(limit), format.HumanBytes(used), suggestion)
+		}
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		// don't stop pulls on systems where free space can't be read
+		return nil
+	}
+
+	if need > free {
+		return fmt.Errorf("%w: %s is needed but %s is free in %s; %s", errInsufficientStorage, format.HumanBytes(need), format.HumanBytes(free), dir, suggestion)
+	}
+
+	return nil
+}
+
+// blobExists returns whether the blob of digest is stored
+func blobExists(digest string) bool {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(fp)
+	return err == nil
+}
+
+// pullSize returns how many bytes pulling the layers of manifest downloads,
+// and how many more bytes of blobs they take to store. Compressed layers are
+// stored both compressed and decompressed until they've all been pulled.
+// Layers which are stored already, or decompressed already by their diffIDs,
+// aren't counted. delta is the delta the model layer is rebuilt from, if one
+// is used, which is downloaded instead of the model layer.
+func pullSize(manifest *ManifestV2, diffIDs []string, delta *Layer) (download, store int64) {
+	if !blobExists(manifest.Config.Digest) {
+		download += manifest.Config.Size
+		store += manifest.Config.Size
+	}
+
+	for i, layer := range manifest.Layers {
+		decompressed := layer.Size
+		if isCompressed(layer) {
+			if diffIDs != nil && blobExists(diffIDs[i]) {
+				continue
+			}
+
+			// layers pushed before the decompressed size was recorded are
+			// at least as large as they are compressed
+			decompressed = max(layer.DecompressedSize, layer.Size)
+		}
+
+		if delta != nil && strings.TrimSuffix(layer.MediaType, zstdSuffix) == "application/vnd.ollama.image.model" {
+			if !blobExists(delta.Digest) {
+				download += delta.Size
+				store += delta.Size
+			}
+
+			store += decompressed
+			continue
+		}
+
+		if !blobExists(layer.Digest) {
+			download += layer.Size
+			store += layer.Size
+		}
+
+		if isCompressed(layer) {
+			store += decompressed
+		}
+	}
+
+	return download, store
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package server
+
+import (
+	"syscall"
+)
+
+// freeSpace returns how many bytes are free on the disk with dir
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
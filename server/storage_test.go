@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/parser"
+)
+
+func TestCheckStorage(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	commands, err := parser.Parse(strings.NewReader("FROM " + mockModelFile(t, "")))
+	assert.Nil(t, err)
+
+	t.Setenv("OLLAMA_MAX_STORAGE", "3")
+	err = CreateModel(context.TODO(), "test", "", commands, func(api.ProgressResponse) {})
+	assert.True(t, errors.Is(err, errInsufficientStorage))
+	assert.Contains(t, err.Error(), "ollama rm")
+
+	t.Setenv("OLLAMA_MAX_STORAGE", "")
+	assert.Nil(t, CreateModel(context.TODO(), "test", "", commands, func(api.ProgressResponse) {}))
+
+	manifest, _, err := GetManifest(ParseModelPath("test"))
+	assert.Nil(t, err)
+
+	// blobs which are stored already don't need more space
+	t.Setenv("OLLAMA_MAX_STORAGE", "1")
+	download, store := pullSize(manifest, nil, nil)
+	assert.Equal(t, int64(0), download)
+	assert.Equal(t, int64(0), store)
+	assert.Nil(t, checkStorage(store))
+
+	t.Setenv("OLLAMA_NOPRUNE", "1")
+	err = checkStorage(10)
+	assert.True(t, errors.Is(err, errInsufficientStorage))
+	assert.Contains(t, err.Error(), "OLLAMA_NOPRUNE")
+
+	s := httptest.NewServer((&Server{}).GenerateRoutes())
+	defer s.Close()
+
+	body := []byte("blob")
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/blobs/sha256:%x", s.URL, body), bytes.NewReader(body))
+	assert.Nil(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+}
+
+func TestPullSize(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	stored, err := NewLayer(strings.NewReader("stored"), "application/vnd.ollama.image.template")
+	assert.Nil(t, err)
+	_, err = stored.Commit()
+	assert.Nil(t, err)
+
+	missing := func(size int64) *Layer {
+		return &Layer{Digest: fmt.Sprintf("sha256:%064d", size), Size: size}
+	}
+
+	config := missing(1)
+	model := missing(100)
+	model.MediaType = "application/vnd.ollama.image.model+zstd"
+	model.DecompressedSize = 300
+
+	manifest := &ManifestV2{Config: config, Layers: []*Layer{model, stored}}
+
+	// the model is stored compressed and decompressed
+	download, store := pullSize(manifest, nil, nil)
+	assert.Equal(t, int64(101), download)
+	assert.Equal(t, int64(401), store)
+
+	// the delta is downloaded instead, and the model rebuilt from it
+	download, store = pullSize(manifest, nil, missing(10))
+	assert.Equal(t, int64(11), download)
+	assert.Equal(t, int64(311), store)
+
+	// the model is stored decompressed already
+	download, store = pullSize(manifest, []string{stored.Digest, ""}, nil)
+	assert.Equal(t, int64(1), download)
+	assert.Equal(t, int64(1), store)
+
+	// layers pushed without their decompressed size count their compressed size
+	model.DecompressedSize = 0
+	_, store = pullSize(manifest, nil, nil)
+	assert.Equal(t, int64(201), store)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+// tensorDigests are the digests of the tensors of each model layer, by the
+// digest of the layer
+type tensorDigests map[string][]llm.TensorDigest
+
+func readTensorDigests(digest string) (tensorDigests, error) {
+	fp, err := GetBlobsPath(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var digests tensorDigests
+	if err := json.NewDecoder(f).Decode(&digests); err != nil {
+		return nil, err
+	}
+
+	return digests, nil
+}
+
+// verifyLayerTensors checks the tensors of a layer of manifest against their
+// digests, to find which tensor is corrupt when the layer doesn't match its
+// digest. Layers without tensor digests aren't checked.
+func verifyLayerTensors(ctx context.Context, manifest *ManifestV2, layer *Layer) error {
+	if layer.MediaType == "application/vnd.ollama.image.tensors" {
+		return nil
+	}
+
+	for _, l := range manifest.Layers {
+		if l.MediaType != "application/vnd.ollama.image.tensors" {
+			continue
+		}
+
+		if err := verifyBlob(l.Digest); err != nil {
+			return err
+		}
+
+		digests, err := readTensorDigests(l.Digest)
+		if err != nil {
+			return err
+		}
+
+		fp, err := GetBlobsPath(layer.Digest)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(fp)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return llm.VerifyTensors(ctx, f, digests[layer.Digest])
+	}
+
+	return nil
+}
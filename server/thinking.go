@@ -0,0 +1,120 @@
+package server
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// thinkingParser splits the thinking of a response, between the think_start
+// and think_end markers, from its content as it's streamed
+type thinkingParser struct {
+	start, end string
+	thinking   bool
+
+	// pending is the end of the last piece, which could be the start of a
+	// marker
+	pending string
+
+	// trim is set after a marker, since models put whitespace between the
+	// thinking and the content
+	trim bool
+}
+
+// newThinkingParser returns a parser for responses to prompt, or nil if the
+// options don't mark thinking. Responses start with thinking if the template
+// ends the prompt with think_start, or there isn't one.
+func newThinkingParser(opts api.Options, prompt string) *thinkingParser {
+	if opts.ThinkEnd == "" {
+		return nil
+	}
+
+	thinking := opts.ThinkStart == "" || strings.HasSuffix(strings.TrimRightFunc(prompt, unicode.IsSpace), opts.ThinkStart)
+	return &thinkingParser{start: opts.ThinkStart, end: opts.ThinkEnd, thinking: thinking, trim: thinking}
+}
+
+// add returns the thinking and content of the next piece of a response. A nil
+// parser returns the piece as content.
+func (p *thinkingParser) add(s string) (thinking, content string) {
+	if p == nil {
+		return "", s
+	}
+
+	var tb, cb strings.Builder
+	write := func(s string) {
+		if p.trim {
+			s = strings.TrimLeftFunc(s, unicode.IsSpace)
+			p.trim = s == ""
+		}
+
+		if p.thinking {
+			tb.WriteString(s)
+		} else {
+			cb.WriteString(s)
+		}
+	}
+
+	s, p.pending = p.pending+s, ""
+	for s != "" {
+		marker := p.end
+		if !p.thinking {
+			marker = p.start
+		}
+
+		if marker == "" {
+			write(s)
+			break
+		}
+
+		if i := strings.Index(s, marker); i >= 0 {
+			write(s[:i])
+			s = s[i+len(marker):]
+			p.thinking = !p.thinking
+			p.trim = true
+			continue
+		}
+
+		// hold back the longest end of the piece which starts the marker
+		n := len(s)
+		for i := max(0, len(s)-len(marker)+1); i < len(s); i++ {
+			if strings.HasPrefix(marker, s[i:]) {
+				n = i
+				break
+			}
+		}
+
+		write(s[:n])
+		p.pending = s[n:]
+		break
+	}
+
+	return tb.String(), cb.String()
+}
+
+// flush returns what's held back at the end of a response
+func (p *thinkingParser) flush() (thinking, content string) {
+	if p == nil || p.pending == "" {
+		return "", ""
+	}
+
+	s := p.pending
+	p.pending = ""
+	if p.thinking {
+		return s, ""
+	}
+
+	return "", s
+}
+
+// next returns the thinking and content of the next piece of a response,
+// with what's held back if it's the last piece
+func (p *thinkingParser) next(s string, done bool) (thinking, content string) {
+	thinking, content = p.add(s)
+	if done {
+		t, c := p.flush()
+		thinking, content = thinking+t, content+c
+	}
+
+	return thinking, content
+}
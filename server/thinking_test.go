@@ -0,0 +1,44 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestThinkingParser(t *testing.T) {
+	cases := []struct {
+		name         string
+		start, end   string
+		prompt       string
+		pieces       []string
+		wantThinking string
+		wantContent  string
+	}{
+		{"no markers", "", "", "", []string{"<think>a</think>b"}, "", "<think>a</think>b"},
+		{"whole", "<think>", "</think>", "", []string{"<think>\nhmm</think>\n\nhello"}, "hmm", "hello"},
+		{"split markers", "<think>", "</think>", "", []string{"<th", "ink>hm", "m</", "thi", "nk>hel", "lo"}, "hmm", "hello"},
+		{"started by the template", "<think>", "</think>", "<|assistant|><think>\n", []string{"hmm</think>hello"}, "hmm", "hello"},
+		{"no start marker", "", "</think>", "", []string{"hmm", "</think>", " hello"}, "hmm", "hello"},
+		{"no thinking", "<think>", "</think>", "", []string{"hello ", "<"}, "", "hello <"},
+		{"unfinished thinking", "<think>", "</think>", "", []string{"<think>hmm</th"}, "hmm</th", ""},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newThinkingParser(api.Options{ThinkStart: tt.start, ThinkEnd: tt.end}, tt.prompt)
+
+			var thinking, content string
+			for i, piece := range tt.pieces {
+				th, c := p.next(piece, i == len(tt.pieces)-1)
+				thinking += th
+				content += c
+			}
+
+			assert.Equal(t, tt.wantThinking, thinking)
+			assert.Equal(t, tt.wantContent, content)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+type tokenizer interface {
+	Encode(string) ([]int, error)
+	Decode([]int) (string, error)
+}
+
+// runnerTokenizer tokenizes with a loaded runner
+type runnerTokenizer struct {
+	ctx    context.Context
+	runner llm.LLM
+}
+
+func (t runnerTokenizer) Encode(s string) ([]int, error) {
+	return t.runner.Encode(t.ctx, s)
+}
+
+func (t runnerTokenizer) Decode(tokens []int) (string, error) {
+	return t.runner.Decode(t.ctx, tokens)
+}
+
+// maxTokenizers is how many vocabularies read from model files are cached
+const maxTokenizers = 4
+
+type cachedTokenizer struct {
+	digest    string
+	tokenizer *llm.Tokenizer
+}
+
+// tokenizers caches the vocabularies read from model files by the digest of
+// the file, which names its blob. Once there are maxTokenizers of them, the
+// least recently used is dropped.
+var tokenizers = struct {
+	mu       sync.Mutex
+	lru      *list.List // of *cachedTokenizer, the most recently used first
+	byDigest map[string]*list.Element
+}{lru: list.New(), byDigest: make(map[string]*list.Element)}
+
+// loadTokenizer returns the cached vocabulary of the model file with digest
+func loadTokenizer(digest string) (*llm.Tokenizer, bool) {
+	tokenizers.mu.Lock()
+	defer tokenizers.mu.Unlock()
+
+	e, ok := tokenizers.byDigest[digest]
+	if !ok {
+		return nil, false
+	}
+
+	tokenizers.lru.MoveToFront(e)
+	return e.Value.(*cachedTokenizer).tokenizer, true
+}
+
+// storeTokenizer caches the vocabulary of the model file with digest
+func storeTokenizer(digest string, t *llm.Tokenizer) {
+	tokenizers.mu.Lock()
+	defer tokenizers.mu.Unlock()
+
+	if e, ok := tokenizers.byDigest[digest]; ok {
+		e.Value.(*cachedTokenizer).tokenizer = t
+		tokenizers.lru.MoveToFront(e)
+		return
+	}
+
+	tokenizers.byDigest[digest] = tokenizers.lru.PushFront(&cachedTokenizer{digest, t})
+	for tokenizers.lru.Len() > maxTokenizers {
+		oldest := tokenizers.lru.Back()
+		tokenizers.lru.Remove(oldest)
+		delete(tokenizers.byDigest, oldest.Value.(*cachedTokenizer).digest)
+	}
+}
+
+// modelTokenizer returns a tokenizer for model which doesn't require the model to be loaded
+func modelTokenizer(model *Model) (*llm.Tokenizer, error) {
+	digest := filepath.Base(model.ModelPath)
+	if t, ok := loadTokenizer(digest); ok {
+		return t, nil
+	}
+
+	f, err := os.Open(model.ModelPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ggml, err := llm.DecodeGGML(f)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := ggml.Tokenizer()
+	if err != nil {
+		return nil, err
+	}
+
+	storeTokenizer(digest, t)
+	return t, nil
+}
+
+// requestTokenizer returns a tokenizer for the named model. The vocabulary is
+// read from the model file so the model doesn't have to be loaded, or wait its
+// turn for it. Models with a vocabulary which can't be read wait in the queue
+// like other requests which use the model, and then use its runner, loading it
+// with the request's options if it isn't resident. The returned func ends the
+// request's turn and unlocks loaded.mu, if they were needed. If there is an
+// error the response is written and false is returned.
+func requestTokenizer(c *gin.Context, name string, requestOpts map[string]interface{}, keepAlive *api.Duration) (tokenizer, func(), bool) {
+	name = routeAlias(name)
+	if name == "" {
+		abortWithError(c, http.StatusBadRequest, errors.New("model is required"))
+		return nil, nil, false
+	}
+
+	model, err := GetModel(name)
+	if err != nil {
+		var pErr *fs.PathError
+		if errors.As(err, &pErr) {
+			abortWithError(c, http.StatusNotFound, errModelNotFound(fmt.Errorf("model '%s' not found, try pulling it first", name)))
+			return nil, nil, false
+		}
+		abortWithError(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	t, err := modelTokenizer(model)
+	if err == nil {
+		return t, func() {}, true
+	}
+
+	slog.Debug(fmt.Sprintf("couldn't read tokenizer from %s, using the runner: %v", model.ModelPath, err))
+
+	dequeue, ok := queueRequest(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	loaded.mu.Lock()
+	release := func() {
+		loaded.mu.Unlock()
+		dequeue()
+	}
+
+	if loaded.runner != nil && loaded.ModelPath == model.ModelPath {
+		return runnerTokenizer{c.Request.Context(), loaded.runner}, release, true
+	}
+
+	opts, err := modelOptions(model, requestOpts)
+	if err != nil {
+		release()
+		abortWithError(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	sessionDuration := getDefaultSessionDuration()
+	if keepAlive != nil {
+		sessionDuration = keepAlive.Duration
+	}
+
+	if err := load(c, model, opts, sessionDuration, nil); err != nil {
+		release()
+		abortWithError(c, http.StatusInternalServerError, err)
+		return nil, nil, false
+	}
+
+	return runnerTokenizer{c.Request.Context(), loaded.runner}, release, true
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// resetTokenizers empties the cache of vocabularies read from model files
+func resetTokenizers() {
+	tokenizers.mu.Lock()
+	defer tokenizers.mu.Unlock()
+
+	tokenizers.lru.Init()
+	clear(tokenizers.byDigest)
+}
+
+func TestTokenizerCache(t *testing.T) {
+	t.Cleanup(resetTokenizers)
+
+	toks := make([]*llm.Tokenizer, maxTokenizers+1)
+	for i := range toks {
+		tok, err := llm.NewTokenizer(llm.KV{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.tokens": []any{"a", "b"}})
+		require.NoError(t, err)
+		toks[i] = tok
+	}
+
+	for i, tok := range toks[:maxTokenizers] {
+		storeTokenizer(fmt.Sprint(i), tok)
+	}
+
+	// using the oldest keeps it, so the next oldest is dropped instead
+	tok, ok := loadTokenizer("0")
+	assert.True(t, ok)
+	assert.Same(t, toks[0], tok)
+
+	storeTokenizer(fmt.Sprint(maxTokenizers), toks[maxTokenizers])
+
+	_, ok = loadTokenizer("1")
+	assert.False(t, ok)
+
+	for _, digest := range []string{"0", "2", fmt.Sprint(maxTokenizers)} {
+		_, ok := loadTokenizer(digest)
+		assert.True(t, ok, digest)
+	}
+}
+
+func TestTokenizeRoundTrip(t *testing.T) {
+	t.Cleanup(resetTokenizers)
+
+	// the runner of the loaded model tokenizes models without a vocabulary
+	// which can be read
+	loadMockModel(t, "runner", "", &wordLLM{})
+
+	cached := createMockModel(t, "cached", "")
+	tok, err := llm.NewTokenizer(llm.KV{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.tokens": []any{"a", "b"}})
+	require.NoError(t, err)
+	storeTokenizer(filepath.Base(cached.ModelPath), tok)
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	post := func(path, body string, v any) int {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+
+		return resp.StatusCode
+	}
+
+	for model, prompt := range map[string]string{"cached": "abba", "runner": "hello world"} {
+		var tokenized api.TokenizeResponse
+		assert.Equal(t, http.StatusOK, post("/api/tokenize", fmt.Sprintf(`{"model": %q, "prompt": %q}`, model, prompt), &tokenized), model)
+		assert.NotEmpty(t, tokenized.Tokens, model)
+
+		bts, err := json.Marshal(api.DetokenizeRequest{Model: model, Tokens: tokenized.Tokens})
+		require.NoError(t, err)
+
+		var detokenized api.DetokenizeResponse
+		assert.Equal(t, http.StatusOK, post("/api/detokenize", string(bts), &detokenized), model)
+		assert.Equal(t, prompt, detokenized.Prompt, model)
+	}
+
+	// empty prompts and tokens aren't tokenized, and are returned empty
+	var tokenized api.TokenizeResponse
+	assert.Equal(t, http.StatusOK, post("/api/tokenize", `{"model": "cached"}`, &tokenized))
+	assert.Equal(t, []int{}, tokenized.Tokens)
+
+	var detokenized api.DetokenizeResponse
+	assert.Equal(t, http.StatusOK, post("/api/detokenize", `{"model": "cached"}`, &detokenized))
+	assert.Equal(t, "", detokenized.Prompt)
+
+	for _, tt := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/tokenize", "", http.StatusBadRequest},
+		{"/api/tokenize", `{"prompt": "hi"}`, http.StatusBadRequest},
+		{"/api/tokenize", `{"model": "missing", "prompt": "hi"}`, http.StatusNotFound},
+		{"/api/tokenize", `{"model": "cached", "prompt": 1}`, http.StatusBadRequest},
+		{"/api/detokenize", "", http.StatusBadRequest},
+		{"/api/detokenize", `{"tokens": [0]}`, http.StatusBadRequest},
+		{"/api/detokenize", `{"model": "missing", "tokens": [0]}`, http.StatusNotFound},
+		{"/api/detokenize", `{"model": "cached", "tokens": [2]}`, http.StatusBadRequest},
+	} {
+		assert.Equal(t, tt.status, post(tt.path, tt.body, nil), tt.path+" "+tt.body)
+	}
+}
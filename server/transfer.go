@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/format"
+)
+
+// rateLimiter limits how many bytes per second the transfers using it read
+// between them. Its rate is set by an environment variable, or for the
+// transfers of a single request, by the request.
+type rateLimiter struct {
+	env  string
+	rate int64
+
+	mu sync.Mutex
+
+	// next is when the bytes which have already been read would have been
+	// read at the rate
+	next time.Time
+}
+
+var (
+	downloadLimiter = &rateLimiter{env: "OLLAMA_MAX_DOWNLOAD_RATE"}
+	uploadLimiter   = &rateLimiter{env: "OLLAMA_MAX_UPLOAD_RATE"}
+)
+
+// rateLimitChunk is the most bytes read at once by rate limited transfers, so
+// they're read smoothly rather than in bursts
+const rateLimitChunk = 16 * format.KiloByte
+
+// minPartRate is the slowest each part of a rate limited transfer is read,
+// so parts aren't retried as stalled when many share a low rate
+const minPartRate = 256 * format.KiloByte
+
+// limit returns the rate in bytes per second, or 0 if it isn't limited
+func (l *rateLimiter) limit() int64 {
+	if l == nil {
+		return 0
+	}
+
+	if l.env == "" {
+		return max(l.rate, 0)
+	}
+
+	s := os.Getenv(l.env)
+	if s == "" {
+		return 0
+	}
+
+	rate, err := format.ParseBytes(s)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("invalid %s: %v", l.env, err))
+		return 0
+	}
+
+	return rate
+}
+
+// wait blocks until n more bytes can be read
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	rate := l.limit()
+	if rate == 0 || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestLimiter returns the limiter of the transfers of a request with a
+// rate limit, or nil if it doesn't have one
+func requestLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate}
+}
+
+// transferRate returns the lowest rate of limiters, or 0 if none of them are
+// limited
+func transferRate(limiters ...*rateLimiter) int64 {
+	var rate int64
+	for _, l := range limiters {
+		if r := l.limit(); r > 0 && (rate == 0 || r < rate) {
+			rate = r
+		}
+	}
+
+	return rate
+}
+
+// transferParts returns how many of parts can be transferred at once at
+// rate, so each of them is at least minPartRate
+func transferParts(parts int, rate int64) int {
+	if rate <= 0 {
+		return parts
+	}
+
+	return max(1, min(parts, int(rate/minPartRate)))
+}
+
+// rateLimitedReader reads from r at the rate of each of its limiters
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*rateLimiter) io.Reader {
+	if transferRate(limiters...) == 0 {
+		return r
+	}
+
+	return &rateLimitedReader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+
+	n, err := r.r.Read(p)
+	for _, l := range r.limiters {
+		if l == nil {
+			continue
+		}
+
+		if err := l.wait(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+
+	return n, err
+}
+
+// offHours is a daily window of local time, such as 22:00-06:00, which ends
+// the next day when it ends before it starts
+type offHours struct {
+	start, end time.Duration
+}
+
+func parseOffHours(s string) (offHours, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return offHours{}, fmt.Errorf("invalid off hours %q, must be like 22:00-06:00", s)
+	}
+
+	var hours offHours
+	for _, t := range []struct {
+		s string
+		d *time.Duration
+	}{{from, &hours.start}, {to, &hours.end}} {
+		clock, err := time.Parse("15:04", strings.TrimSpace(t.s))
+		if err != nil {
+			return offHours{}, fmt.Errorf("invalid off hours %q, must be like 22:00-06:00", s)
+		}
+
+		*t.d = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+	}
+
+	return hours, nil
+}
+
+// until returns how long there is from now until the window starts, or 0 if
+// it has already started
+func (h offHours) until(now time.Time) time.Duration {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	clock := now.Sub(midnight)
+
+	var in bool
+	if h.start <= h.end {
+		in = clock >= h.start && clock < h.end
+	} else {
+		in = clock >= h.start || clock < h.end
+	}
+
+	if in {
+		return 0
+	}
+
+	start := midnight.Add(h.start)
+	if !start.After(now) {
+		start = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Add(h.start)
+	}
+
+	return start.Sub(now)
+}
+
+// getDeferPullSize returns the size pulls have to be larger than to wait
+// for OLLAMA_OFF_HOURS, set by OLLAMA_DEFER_PULL_SIZE. It's 1 GB by default.
+func getDeferPullSize() int64 {
+	if s := os.Getenv("OLLAMA_DEFER_PULL_SIZE"); s != "" {
+		if size, err := format.ParseBytes(s); err == nil {
+			return size
+		}
+
+		slog.Warn(fmt.Sprintf("invalid OLLAMA_DEFER_PULL_SIZE %q", s))
+	}
+
+	return format.GigaByte
+}
+
+// waitForOffHours waits for OLLAMA_OFF_HOURS to start before a pull which
+// needs more than OLLAMA_DEFER_PULL_SIZE bytes downloaded, so large pulls
+// don't use the network while it's busy
+func waitForOffHours(ctx context.Context, size int64, fn func(api.ProgressResponse)) error {
+	s := os.Getenv("OLLAMA_OFF_HOURS")
+	if s == "" || size <= getDeferPullSize() {
+		return nil
+	}
+
+	hours, err := parseOffHours(s)
+	if err != nil {
+		return err
+	}
+
+	d := hours.until(time.Now())
+	if d == 0 {
+		return nil
+	}
+
+	at := time.Now().Add(d)
+	fn(api.ProgressResponse{Status: fmt.Sprintf("waiting until %s to pull %s", at.Format("15:04"), format.HumanBytes(size))})
+	slog.Info(fmt.Sprintf("deferring pull of %s until %s", format.HumanBytes(size), at.Format(time.DateTime)))
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/format"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 64*format.KiloByte)
+
+	// the first chunk is read at once, and the rest at the rate
+	start := time.Now()
+	r := newRateLimitedReader(context.Background(), bytes.NewReader(data), requestLimiter(512*format.KiloByte))
+	n, err := io.Copy(io.Discard, r)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// readers without a rate aren't wrapped
+	br := bytes.NewReader(data)
+	assert.Equal(t, io.Reader(br), newRateLimitedReader(context.Background(), br, downloadLimiter, requestLimiter(0)))
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("OLLAMA_MAX_DOWNLOAD_RATE", "10MB")
+		assert.Equal(t, int64(10*format.MegaByte), transferRate(downloadLimiter, nil))
+		assert.Equal(t, int64(format.MegaByte), transferRate(downloadLimiter, requestLimiter(format.MegaByte)))
+		assert.Equal(t, int64(0), transferRate(uploadLimiter))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := newRateLimitedReader(ctx, bytes.NewReader(data), requestLimiter(format.KiloByte))
+		_, err := io.Copy(io.Discard, r)
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestTransferParts(t *testing.T) {
+	assert.Equal(t, 64, transferParts(64, 0))
+	assert.Equal(t, 64, transferParts(64, 100*format.MegaByte))
+	assert.Equal(t, 3, transferParts(64, format.MegaByte))
+	assert.Equal(t, 1, transferParts(64, format.KiloByte))
+}
+
+func TestOffHours(t *testing.T) {
+	_, err := parseOffHours("22:00")
+	assert.NotNil(t, err)
+	_, err = parseOffHours("10pm-6am")
+	assert.NotNil(t, err)
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 3, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	overnight, err := parseOffHours("22:00-06:00")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), overnight.until(at(23, 0)))
+	assert.Equal(t, time.Duration(0), overnight.until(at(5, 59)))
+	assert.Equal(t, 30*time.Minute, overnight.until(at(21, 30)))
+	assert.Equal(t, 16*time.Hour, overnight.until(at(6, 0)))
+
+	lunch, err := parseOffHours("12:00 - 13:30")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), lunch.until(at(13, 0)))
+	assert.Equal(t, 22*time.Hour+30*time.Minute, lunch.until(at(13, 30)))
+
+	t.Run("wait", func(t *testing.T) {
+		var statuses []string
+		fn := func(r api.ProgressResponse) {
+			statuses = append(statuses, r.Status)
+		}
+
+		// pulls aren't deferred without off hours, or when they're small
+		assert.Nil(t, waitForOffHours(context.Background(), 10*format.GigaByte, fn))
+
+		now := time.Now()
+		start := now.Add(2 * time.Hour)
+		t.Setenv("OLLAMA_OFF_HOURS", start.Format("15:04")+"-"+start.Add(time.Hour).Format("15:04"))
+		assert.Nil(t, waitForOffHours(context.Background(), 100*format.MegaByte, fn))
+		assert.Empty(t, statuses)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, waitForOffHours(ctx, 10*format.GigaByte, fn), context.DeadlineExceeded)
+		assert.Equal(t, []string{"waiting until " + start.Format("15:04") + " to pull 10 GB"}, statuses)
+
+		t.Setenv("OLLAMA_DEFER_PULL_SIZE", "20GB")
+		assert.Nil(t, waitForOffHours(context.Background(), 10*format.GigaByte, fn))
+	})
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+var errTTFTExceeded = errors.New("ttft budget exceeded")
+
+// promptRateSamples is how many of the last prompts of a model the rate it
+// evaluates prompts at is estimated from
+const promptRateSamples = 16
+
+// minPromptRateTokens is the fewest tokens a prompt must have had evaluated to
+// be a sample. The time shorter prompts take is mostly the overhead of the
+// runner.
+const minPromptRateTokens = 32
+
+// imageTokens is the number of tokens an image is estimated to take, like it
+// is for the context window
+const imageTokens = 768
+
+type promptSample struct {
+	tokens   int
+	duration time.Duration
+}
+
+// promptRates are the samples of the last prompts of each model, by its path
+var promptRates = struct {
+	mu      sync.Mutex
+	samples map[string][]promptSample
+}{samples: make(map[string][]promptSample)}
+
+// recordPromptRate adds the evaluation of a prompt of the model to its
+// samples, replacing the oldest when there are promptRateSamples of them
+func recordPromptRate(model string, tokens int, duration time.Duration) {
+	if tokens < minPromptRateTokens || duration <= 0 {
+		return
+	}
+
+	promptRates.mu.Lock()
+	defer promptRates.mu.Unlock()
+
+	samples := append(promptRates.samples[model], promptSample{tokens, duration})
+	if len(samples) > promptRateSamples {
+		samples = samples[len(samples)-promptRateSamples:]
+	}
+
+	promptRates.samples[model] = samples
+}
+
+// promptRate returns the rate, in tokens per second, the model evaluated its
+// last prompts at, or false if none have been sampled
+func promptRate(model string) (float64, bool) {
+	promptRates.mu.Lock()
+	defer promptRates.mu.Unlock()
+
+	var tokens int
+	var duration time.Duration
+	for _, s := range promptRates.samples[model] {
+		tokens += s.tokens
+		duration += s.duration
+	}
+
+	if duration <= 0 {
+		return 0, false
+	}
+
+	return float64(tokens) / duration.Seconds(), true
+}
+
+// evaluated are the prompts the loaded runner evaluated last in each of its
+// slots, which it keeps cached so only the rest of the next prompt in the
+// slot is evaluated. It is up to the caller to lock loaded.mu.
+var evaluated struct {
+	runner  llm.LLM
+	prompts map[int]string
+}
+
+// setEvaluated sets the prompt the loaded runner is about to evaluate.
+// Deterministic prompts and prompts with images or a suffix aren't cached.
+func setEvaluated(predict llm.PredictOpts) {
+	if evaluated.runner != loaded.runner {
+		evaluated.runner, evaluated.prompts = loaded.runner, make(map[int]string)
+	}
+
+	evaluated.prompts[predict.Slot] = predict.Prompt
+	if predict.Options.Deterministic || len(predict.Images) > 0 || predict.Suffix != "" {
+		delete(evaluated.prompts, predict.Slot)
+	}
+}
+
+// countImages returns the number of images in a prompt, by their markers
+func countImages(prompt string) int {
+	return strings.Count(prompt, "[img-")
+}
+
+// promptTokens returns the number of tokens of prompt and its images
+func promptTokens(ctx context.Context, prompt string, images int) (int, error) {
+	tokens, err := loaded.runner.Encode(ctx, prompt)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(tokens) + images*imageTokens, nil
+}
+
+// uncachedTokens returns the number of tokens of prompt the loaded runner
+// would evaluate in slot, which are those after the prefix it has cached
+func uncachedTokens(ctx context.Context, prompt string, images, slot int) (int, error) {
+	n, err := promptTokens(ctx, prompt, images)
+	if err != nil {
+		return 0, err
+	}
+
+	cached := evaluated.prompts[slot]
+	if evaluated.runner != loaded.runner || cached == "" {
+		return n, nil
+	}
+
+	var prefix int
+	for prefix < len(prompt) && prefix < len(cached) && prompt[prefix] == cached[prefix] {
+		prefix++
+	}
+
+	if prefix == 0 {
+		return n, nil
+	}
+
+	tokens, err := loaded.runner.Encode(ctx, prompt[:prefix])
+	if err != nil {
+		return 0, err
+	}
+
+	return max(n-len(tokens), 1), nil
+}
+
+// ttftWarning warns of a prompt which takes longer than its budget, in the
+// log and the X-Ollama-Warning header
+func ttftWarning(c *gin.Context, warning string) {
+	slog.Warn(fmt.Sprintf("%s: %s", c.FullPath(), warning))
+	c.Writer.Header().Add("X-Ollama-Warning", warning)
+}
+
+// fitTTFT estimates how long the loaded model takes to evaluate prompt from
+// the rate it evaluated its last prompts at, and handles prompts which take
+// longer than the ttft_budget of opts by its ttft_strategy. truncate returns
+// the prompt shortened to about the given number of tokens, for the
+// drop_middle and summarize strategies. Until a prompt has been sampled, the
+// budget isn't checked.
+func fitTTFT(c *gin.Context, opts api.Options, prompt string, images int, truncate func(tokens int) (string, error)) (string, error) {
+	if opts.TTFTBudget <= 0 {
+		return prompt, nil
+	}
+
+	rate, ok := promptRate(loaded.ModelPath)
+	if !ok {
+		slog.Debug("no prompts have been evaluated to estimate the ttft budget from", "model", loaded.ModelPath)
+		return prompt, nil
+	}
+
+	ctx := c.Request.Context()
+	slot := cacheSlot(c)
+	budget := time.Duration(opts.TTFTBudget) * time.Millisecond
+	estimate := func(tokens int) time.Duration {
+		return time.Duration(float64(tokens) / rate * float64(time.Second))
+	}
+
+	tokens, err := uncachedTokens(ctx, prompt, images, slot)
+	if err != nil {
+		return "", err
+	}
+
+	if estimate(tokens) <= budget {
+		return prompt, nil
+	}
+
+	exceeded := fmt.Sprintf("the prompt has %d tokens to evaluate, which would take about %s at %.0f tokens/s, more than the ttft_budget of %s", tokens, estimate(tokens).Round(time.Millisecond), rate, budget)
+	switch opts.TTFTStrategy {
+	case "", api.TTFTStrategyWarn:
+		ttftWarning(c, exceeded)
+		return prompt, nil
+	case api.TTFTStrategyReject:
+		return "", fmt.Errorf("%w: %s", errTTFTExceeded, exceeded)
+	}
+
+	fit := int(rate * budget.Seconds())
+	truncated, err := truncate(fit)
+	if err != nil {
+		return "", err
+	}
+
+	// the truncated prompt doesn't share the cached prefix past where it
+	// was truncated, so it's checked again
+	after, err := uncachedTokens(ctx, truncated, images, slot)
+	if err != nil {
+		return "", err
+	}
+
+	if estimate(after) > budget {
+		return "", fmt.Errorf("%w: %s, and would still have %d once truncated", errTTFTExceeded, exceeded, after)
+	}
+
+	ttftWarning(c, fmt.Sprintf("truncated the prompt from %d to %d tokens to evaluate, to fit the ttft_budget of %s", tokens, after, budget))
+	return truncated, nil
+}
+
+// truncateGenerate returns the prompt of a generate request with the middle of
+// its prompt dropped so it has about tokens. When summarizing, the paragraphs
+// between its first and its last are shortened first. The system message and
+// context are kept.
+func truncateGenerate(ctx context.Context, req api.GenerateRequest, tokens int, strategy string) (string, error) {
+	render := func() (string, error) {
+		if req.Raw || req.Suffix != "" {
+			return req.Prompt, nil
+		}
+
+		return generatePrompt(ctx, req)
+	}
+
+	if strategy == api.TTFTStrategySummarize {
+		req.Prompt = summarizeMiddle(req.Prompt)
+	}
+
+	prompt, err := render()
+	if err != nil {
+		return "", err
+	}
+
+	n, err := promptTokens(ctx, prompt, len(req.Images))
+	if err != nil {
+		return "", err
+	}
+
+	if req.Prompt, err = dropMiddle(ctx, req.Prompt, n-tokens); err != nil {
+		return "", err
+	}
+
+	return render()
+}
+
+// truncateChat returns the prompt of messages with the middle of the chat
+// dropped so it has about tokens. The messages after the system message are
+// dropped oldest first, and then the middle of the last message if it's still
+// too long. When summarizing, the messages before the last are shortened to
+// the first sentences of their paragraphs first.
+func truncateChat(ctx context.Context, template string, messages []api.Message, tokens int, strategy string) (string, error) {
+	messages = slices.Clone(messages)
+	if strategy == api.TTFTStrategySummarize {
+		for i := range messages[:len(messages)-1] {
+			if messages[i].Role != "system" {
+				messages[i].Content = summarize(messages[i].Content)
+			}
+		}
+	}
+
+	prompt, err := chatPrompt(ctx, template, messages, tokens)
+	if err != nil {
+		return "", err
+	}
+
+	n, err := promptTokens(ctx, prompt, countImages(prompt))
+	if err != nil {
+		return "", err
+	}
+
+	if n <= tokens {
+		return prompt, nil
+	}
+
+	last := &messages[len(messages)-1]
+	if last.Content, err = dropMiddle(ctx, last.Content, n-tokens); err != nil {
+		return "", err
+	}
+
+	return chatPrompt(ctx, template, messages, tokens)
+}
+
+// ellipsis replaces the middle of a text which has been dropped
+const ellipsis = "\n...\n"
+
+// dropMiddle returns text without drop of its tokens from the middle, which
+// are replaced with an ellipsis. All of text is dropped if it doesn't have
+// more tokens than drop and the ellipsis.
+func dropMiddle(ctx context.Context, text string, drop int) (string, error) {
+	if drop <= 0 {
+		return text, nil
+	}
+
+	tokens, err := loaded.runner.Encode(ctx, text)
+	if err != nil {
+		return "", err
+	}
+
+	marker, err := loaded.runner.Encode(ctx, ellipsis)
+	if err != nil {
+		return "", err
+	}
+
+	keep := len(tokens) - drop - len(marker)
+	if keep <= 0 {
+		return "", nil
+	}
+
+	head, err := loaded.runner.Decode(ctx, tokens[:keep/2])
+	if err != nil {
+		return "", err
+	}
+
+	tail, err := loaded.runner.Decode(ctx, tokens[len(tokens)-(keep-keep/2):])
+	if err != nil {
+		return "", err
+	}
+
+	return head + ellipsis + tail, nil
+}
+
+// summarize shortens text to the first sentence of each of its paragraphs
+func summarize(text string) string {
+	paragraphs := strings.Split(text, "\n\n")
+	for i, p := range paragraphs {
+		paragraphs[i] = firstSentence(p)
+	}
+
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// summarizeMiddle shortens the paragraphs of text between its first and its
+// last to their first sentences
+func summarizeMiddle(text string) string {
+	paragraphs := strings.Split(text, "\n\n")
+	if len(paragraphs) < 3 {
+		return text
+	}
+
+	middle := summarize(strings.Join(paragraphs[1:len(paragraphs)-1], "\n\n"))
+	return strings.Join([]string{paragraphs[0], middle, paragraphs[len(paragraphs)-1]}, "\n\n")
+}
+
+// firstSentence returns the first sentence, or line, of a paragraph
+func firstSentence(p string) string {
+	p = strings.TrimSpace(p)
+	for i, r := range p {
+		switch r {
+		case '\n':
+			return p[:i]
+		case '.', '?', '!':
+			if i+1 == len(p) || p[i+1] == ' ' || p[i+1] == '\n' {
+				return p[:i+1]
+			}
+		}
+	}
+
+	return p
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// wordLLM tokenizes prompts by their words
+type wordLLM struct {
+	MockLLM
+	words []string
+}
+
+func (l *wordLLM) Encode(ctx context.Context, prompt string) ([]int, error) {
+	var tokens []int
+	for _, word := range strings.Fields(prompt) {
+		tokens = append(tokens, len(l.words))
+		l.words = append(l.words, word)
+	}
+
+	return tokens, nil
+}
+
+func (l *wordLLM) Decode(ctx context.Context, tokens []int) (string, error) {
+	words := make([]string, len(tokens))
+	for i, t := range tokens {
+		words[i] = l.words[t]
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+func TestPromptRate(t *testing.T) {
+	t.Cleanup(func() {
+		promptRates.mu.Lock()
+		delete(promptRates.samples, "rate")
+		promptRates.mu.Unlock()
+	})
+
+	_, ok := promptRate("rate")
+	assert.False(t, ok)
+
+	// short prompts are mostly overhead
+	recordPromptRate("rate", 4, time.Second)
+	_, ok = promptRate("rate")
+	assert.False(t, ok)
+
+	recordPromptRate("rate", 100, time.Second)
+	recordPromptRate("rate", 300, time.Second)
+	rate, ok := promptRate("rate")
+	assert.True(t, ok)
+	assert.InDelta(t, 200, rate, 0.01)
+
+	// only the last samples are kept
+	for range promptRateSamples {
+		recordPromptRate("rate", 50, time.Second)
+	}
+
+	rate, _ = promptRate("rate")
+	assert.InDelta(t, 50, rate, 0.01)
+}
+
+func TestSummarize(t *testing.T) {
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"One. Two.", "One."},
+		{"What is 3.5? Half of 7.", "What is 3.5?"},
+		{"A heading\nand its text. More.", "A heading"},
+		{"First. Second.\n\nThird! Fourth.", "First.\n\nThird!"},
+		{"no sentence", "no sentence"},
+	}
+
+	for _, tt := range cases {
+		assert.Equal(t, tt.want, summarize(tt.text))
+	}
+
+	assert.Equal(t, "Intro. Kept.\n\nMiddle.\n\nEnd. Kept.", summarizeMiddle("Intro. Kept.\n\nMiddle. Dropped.\n\nEnd. Kept."))
+	assert.Equal(t, "Only. Two.\n\nParagraphs. Kept.", summarizeMiddle("Only. Two.\n\nParagraphs. Kept."))
+}
+
+func TestFitTTFT(t *testing.T) {
+	var prompts []string
+	runner := &wordLLM{MockLLM: MockLLM{predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		prompts = append(prompts, p.Prompt)
+		fn(llm.PredictResult{Done: true})
+		return nil
+	}}}
+
+	model := loadMockModel(t, "ttft", "", runner)
+
+	loaded.mu.Lock()
+	keepLoaded(time.Hour)
+	loaded.mu.Unlock()
+
+	t.Cleanup(func() {
+		evaluated.runner, evaluated.prompts = nil, nil
+
+		promptRates.mu.Lock()
+		delete(promptRates.samples, model.ModelPath)
+		promptRates.mu.Unlock()
+	})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	words := func(prefix string, n int) string {
+		w := make([]string, n)
+		for i := range w {
+			w[i] = fmt.Sprintf("%s%d", prefix, i)
+		}
+
+		return strings.Join(w, " ")
+	}
+
+	generate := func(prompt, strategy string) (*http.Response, api.StatusError) {
+		bts, err := json.Marshal(api.GenerateRequest{
+			Model:   "ttft",
+			Prompt:  prompt,
+			Raw:     true,
+			Options: map[string]interface{}{"ttft_budget": 1000, "ttft_strategy": strategy},
+		})
+		require.NoError(t, err)
+
+		resp, err := http.Post(srv.URL+"/api/generate", "application/json", strings.NewReader(string(bts)))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var serr api.StatusError
+		if resp.StatusCode != http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&serr))
+		}
+
+		return resp, serr
+	}
+
+	// the budget isn't checked until a prompt has been evaluated
+	resp, _ := generate(words("a", 300), "reject")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// 100 tokens can be evaluated in the budget of a second
+	recordPromptRate(model.ModelPath, 100, time.Second)
+
+	resp, serr := generate(words("b", 300), "reject")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, api.ErrorCodeTTFTExceeded, serr.Code)
+
+	resp, _ = generate(words("c", 300), "warn")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("X-Ollama-Warning"), "more than the ttft_budget of 1s")
+	assert.Equal(t, words("c", 300), prompts[len(prompts)-1])
+
+	// the prompt the runner evaluated last is cached
+	resp, _ = generate(words("c", 300), "reject")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = generate(words("d", 300), "drop_middle")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("X-Ollama-Warning"), "truncated the prompt from 300 to 100 tokens")
+
+	truncated := prompts[len(prompts)-1]
+	assert.Len(t, strings.Fields(truncated), 100)
+	assert.True(t, strings.HasPrefix(truncated, "d0 d1 "))
+	assert.True(t, strings.HasSuffix(truncated, " d298 d299"))
+	assert.Contains(t, truncated, "\n...\n")
+
+	// the paragraphs in the middle are shortened, and then what still
+	// doesn't fit is dropped
+	resp, _ = generate(words("e", 100)+"\n\nf. "+words("g", 200)+"\n\nh", "summarize")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	summarized := prompts[len(prompts)-1]
+	assert.Len(t, strings.Fields(summarized), 100)
+	assert.True(t, strings.HasSuffix(summarized, " e99 f. h"))
+	assert.NotContains(t, summarized, "g0")
+}
+
+func TestTruncateChat(t *testing.T) {
+	runner := &wordLLM{}
+
+	loaded.mu.Lock()
+	loaded.runner = runner
+	loaded.mu.Unlock()
+
+	t.Cleanup(func() {
+		loaded.mu.Lock()
+		loaded.runner = nil
+		loaded.mu.Unlock()
+	})
+
+	template := "{{ .System }} {{ .Prompt }} {{ .Response }}"
+	messages := []api.Message{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "first question. with details"},
+		{Role: "assistant", Content: "first answer. with details"},
+		{Role: "user", Content: "last question"},
+	}
+
+	// the messages after the system message are dropped, as they would be
+	// from the context window
+	prompt, err := truncateChat(context.TODO(), template, messages, 8, api.TTFTStrategyDropMiddle)
+	require.NoError(t, err)
+	assert.Equal(t, "be brief last question ", prompt)
+
+	prompt, err = truncateChat(context.TODO(), template, messages, 10, api.TTFTStrategySummarize)
+	require.NoError(t, err)
+	assert.Equal(t, "be brief first question. first answer. last question ", prompt)
+
+	// the last message is the middle which is dropped when it's too long
+	messages[3].Content = "a b c d e f g h"
+	prompt, err = truncateChat(context.TODO(), template, messages, 7, api.TTFTStrategyDropMiddle)
+	require.NoError(t, err)
+	assert.Equal(t, "be brief a b\n...\ng h ", prompt)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// updates has the result of the last update check of each model. Models are
+// compared by the digest of their config, since pulls rewrite the manifest of
+// models with compressed layers or deltas but keep the config as it is.
+var updates = struct {
+	mu      sync.Mutex
+	byModel map[string]modelUpdate
+}{byModel: make(map[string]modelUpdate)}
+
+type modelUpdate struct {
+	// config is the digest of the config in the registry
+	config    string
+	checkedAt time.Time
+	err       error
+}
+
+// remoteManifest fetches the manifest of a model from its registry
+var remoteManifest = func(ctx context.Context, mp ModelPath) (*ManifestV2, error) {
+	return pullModelManifest(ctx, mp, &registryOptions{})
+}
+
+// localConfig returns the digest of the config of a local model
+func localConfig(name string) (string, error) {
+	manifest, _, err := GetManifest(ParseModelPath(name))
+	if err != nil {
+		return "", err
+	}
+
+	if manifest.Config == nil {
+		return "", fmt.Errorf("%s has no config", name)
+	}
+
+	return manifest.Config.Digest, nil
+}
+
+// updateAvailable reports whether the last check of a model found a newer
+// version of it than the one it has now
+func updateAvailable(name string) bool {
+	updates.mu.Lock()
+	u, ok := updates.byModel[ParseModelPath(name).GetShortTagname()]
+	updates.mu.Unlock()
+	if !ok || u.err != nil {
+		return false
+	}
+
+	config, err := localConfig(name)
+	return err == nil && config != u.config
+}
+
+// checkUpdate compares a model with the registry it's from
+func checkUpdate(ctx context.Context, name string) api.ModelUpdate {
+	mp := ParseModelPath(name)
+	u := modelUpdate{checkedAt: time.Now().UTC()}
+
+	manifest, err := remoteManifest(ctx, mp)
+	switch {
+	case err != nil:
+		u.err = err
+	case manifest.Config == nil:
+		u.err = fmt.Errorf("%s has no config", name)
+	default:
+		u.config = manifest.Config.Digest
+	}
+
+	updates.mu.Lock()
+	updates.byModel[mp.GetShortTagname()] = u
+	updates.mu.Unlock()
+
+	resp := api.ModelUpdate{Model: mp.GetShortTagname(), CheckedAt: u.checkedAt, UpdateAvailable: updateAvailable(name)}
+	if u.err != nil {
+		resp.Error = u.err.Error()
+	}
+
+	return resp
+}
+
+// checkUpdates compares every local model with its registry
+func checkUpdates(ctx context.Context) ([]api.ModelUpdate, error) {
+	var names []string
+	if err := walkManifests(func(name string, _ os.FileInfo) error {
+		names = append(names, name)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	resp := []api.ModelUpdate{}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		resp = append(resp, checkUpdate(ctx, name))
+	}
+
+	return resp, nil
+}
+
+// getUpdateInterval returns how often models are checked for updates, set
+// by OLLAMA_UPDATE_INTERVAL. Models are only checked when asked by default,
+// and never on a schedule when OLLAMA_READONLY is set, as they couldn't be
+// updated.
+func getUpdateInterval() (time.Duration, bool) {
+	d, err := time.ParseDuration(os.Getenv("OLLAMA_UPDATE_INTERVAL"))
+	if err != nil || d <= 0 {
+		return 0, false
+	}
+
+	if readOnly, _ := strconv.ParseBool(os.Getenv("OLLAMA_READONLY")); readOnly {
+		slog.Info("models aren't checked for updates on a schedule as OLLAMA_READONLY is set")
+		return 0, false
+	}
+
+	return d, true
+}
+
+// scheduleUpdates checks for updates every interval until ctx is done. Models
+// with updates are pulled if OLLAMA_AUTO_UPDATE is set.
+func scheduleUpdates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		models, err := checkUpdates(ctx)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("couldn't check for model updates: %v", err))
+			continue
+		}
+
+		autoUpdate, _ := strconv.ParseBool(os.Getenv("OLLAMA_AUTO_UPDATE"))
+		for _, m := range models {
+			if !m.UpdateAvailable {
+				continue
+			}
+
+			if !autoUpdate {
+				slog.Info(fmt.Sprintf("an update is available for %s", m.Model))
+				continue
+			}
+
+			slog.Info(fmt.Sprintf("updating %s", m.Model))
+			err := PullModel(ctx, m.Model, &registryOptions{}, func(api.ProgressResponse) {})
+			if err != nil {
+				slog.Warn(fmt.Sprintf("couldn't update %s: %v", m.Model, err))
+			}
+
+			recordAudit(api.AuditEntry{Operation: "pull", Model: m.Model, Source: ParseModelPath(m.Model).GetFullTagname(), UserAgent: "ollama auto update"}, err)
+		}
+	}
+}
+
+// UpdatesHandler checks every model for updates
+func UpdatesHandler(c *gin.Context) {
+	models, err := checkUpdates(c.Request.Context())
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, api.UpdatesResponse{Models: models})
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestCheckUpdates(t *testing.T) {
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	for _, name := range []string{"current", "outdated", "local"} {
+		createMockModel(t, name, "")
+	}
+
+	current, _, err := GetManifest(ParseModelPath("current"))
+	assert.Nil(t, err)
+
+	remote := remoteManifest
+	remoteManifest = func(_ context.Context, mp ModelPath) (*ManifestV2, error) {
+		switch mp.Repository {
+		case "current":
+			return current, nil
+		case "outdated":
+			return &ManifestV2{Config: &Layer{Digest: "sha256:newer"}}, nil
+		default:
+			return nil, errors.New("not found")
+		}
+	}
+
+	t.Cleanup(func() {
+		remoteManifest = remote
+		updates.mu.Lock()
+		defer updates.mu.Unlock()
+		clear(updates.byModel)
+	})
+
+	assert.False(t, updateAvailable("outdated"))
+
+	models, err := checkUpdates(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, models, 3)
+
+	byModel := make(map[string]api.ModelUpdate)
+	for _, m := range models {
+		byModel[m.Model] = m
+	}
+
+	assert.False(t, byModel["current:latest"].UpdateAvailable)
+	assert.True(t, byModel["outdated:latest"].UpdateAvailable)
+	assert.False(t, byModel["local:latest"].UpdateAvailable)
+	assert.NotEmpty(t, byModel["local:latest"].Error)
+
+	assert.True(t, updateAvailable("outdated"))
+	assert.False(t, updateAvailable("current"))
+}
+
+func TestGetUpdateInterval(t *testing.T) {
+	t.Setenv("OLLAMA_UPDATE_INTERVAL", "")
+	_, ok := getUpdateInterval()
+	assert.False(t, ok)
+
+	t.Setenv("OLLAMA_UPDATE_INTERVAL", "24h")
+	interval, ok := getUpdateInterval()
+	assert.True(t, ok)
+	assert.Equal(t, 24*time.Hour, interval)
+
+	// models can't be pulled on a read-only server
+	t.Setenv("OLLAMA_READONLY", "1")
+	_, ok = getUpdateInterval()
+	assert.False(t, ok)
+}
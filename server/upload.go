@@ -37,6 +37,9 @@ type blobUpload struct {
 
 	file *os.File
 
+	// limiters limit the rate the parts are uploaded at
+	limiters []*rateLimiter
+
 	done       bool
 	err        error
 	references atomic.Int32
@@ -137,8 +140,10 @@ func (b *blobUpload) Run(ctx context.Context, opts *registryOptions) {
 	}
 	defer b.file.Close()
 
+	b.limiters = []*rateLimiter{uploadLimiter, requestLimiter(opts.RateLimit)}
+
 	g, inner := errgroup.WithContext(ctx)
-	g.SetLimit(numUploadParts)
+	g.SetLimit(transferParts(numUploadParts, transferRate(b.limiters...)))
 	for i := range b.Parts {
 		part := &b.Parts[i]
 		select {
@@ -224,7 +229,8 @@ func (b *blobUpload) uploadPart(ctx context.Context, method string, requestURL *
 	md5sum := md5.New()
 	w := &progressWriter{blobUpload: b}
 
-	resp, err := makeRequest(ctx, method, requestURL, headers, io.TeeReader(sr, io.MultiWriter(w, md5sum)), opts)
+	body := newRateLimitedReader(ctx, sr, b.limiters...)
+	resp, err := makeRequest(ctx, method, requestURL, headers, io.TeeReader(body, io.MultiWriter(w, md5sum)), opts)
 	if err != nil {
 		w.Rollback()
 		return err
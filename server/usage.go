@@ -0,0 +1,335 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// usageAccountKey is the key of the account of a request in its gin context
+const usageAccountKey = "usage_account"
+
+var errBudgetExceeded = errors.New("token budget exceeded")
+
+// usageFlushInterval is how often the usage kept in memory is written to
+// usage.json
+const usageFlushInterval = 30 * time.Second
+
+// usage is the tokens each account has used. It's read from usage.json, in
+// the models directory, on first use and kept in memory, and changes are
+// written back by flushUsage.
+var usage struct {
+	mu sync.Mutex
+
+	// path is the usage.json accounts were read from. They're read again if
+	// the models directory changes.
+	path     string
+	accounts map[string]accountUsage
+	dirty    bool
+}
+
+// accountUsage is the usage of an account as it's kept in usage.json
+type accountUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+
+	// Day is the UTC date DailyTokens were used on
+	Day         string `json:"day"`
+	DailyTokens int64  `json:"daily_tokens"`
+}
+
+func (u accountUsage) total() int64 {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// daily returns the tokens used on the day of now
+func (u accountUsage) daily(now time.Time) int64 {
+	if u.Day != now.UTC().Format(time.DateOnly) {
+		return 0
+	}
+
+	return u.DailyTokens
+}
+
+// getTokenBudgets returns how many tokens each account can use each day and
+// in total, set by OLLAMA_DAILY_TOKEN_BUDGET and OLLAMA_TOKEN_BUDGET. 0 is
+// unlimited, which is the default.
+func getTokenBudgets() (daily, total int64) {
+	daily, _ = strconv.ParseInt(os.Getenv("OLLAMA_DAILY_TOKEN_BUDGET"), 10, 64)
+	total, _ = strconv.ParseInt(os.Getenv("OLLAMA_TOKEN_BUDGET"), 10, 64)
+	return max(daily, 0), max(total, 0)
+}
+
+// getAPIKeys returns the API keys requests are counted against by their
+// names, set by OLLAMA_API_KEYS as a comma separated list of name=key pairs
+func getAPIKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(os.Getenv("OLLAMA_API_KEYS"), ",") {
+		if name, key, ok := strings.Cut(strings.TrimSpace(pair), "="); ok && name != "" && key != "" {
+			keys[name] = key
+		}
+	}
+
+	return keys
+}
+
+func usagePath() (string, error) {
+	dir, err := modelsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "usage.json"), nil
+}
+
+// readUsage reads the usage of each account from fp
+func readUsage(fp string) (map[string]accountUsage, error) {
+	accounts := make(map[string]accountUsage)
+	bts, err := os.ReadFile(fp)
+	if errors.Is(err, os.ErrNotExist) {
+		return accounts, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bts, &accounts); err != nil {
+		return nil, fmt.Errorf("%s: %w", fp, err)
+	}
+
+	return accounts, nil
+}
+
+// writeUsage replaces the usage of each account in fp
+func writeUsage(fp string, accounts map[string]accountUsage) error {
+	if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(accounts)
+	if err != nil {
+		return err
+	}
+
+	// write a temporary file first so the usage isn't lost if it fails
+	tmp := fp + ".tmp"
+	if err := os.WriteFile(tmp, bts, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, fp)
+}
+
+// loadUsage reads usage.json if it hasn't been read from the models directory
+// yet. It is up to the caller to lock usage.mu.
+func loadUsage() error {
+	fp, err := usagePath()
+	if err != nil {
+		return err
+	}
+
+	if usage.accounts != nil && usage.path == fp {
+		return nil
+	}
+
+	accounts, err := readUsage(fp)
+	if err != nil {
+		return err
+	}
+
+	usage.path, usage.accounts, usage.dirty = fp, accounts, false
+	return nil
+}
+
+// flushUsage writes the usage kept in memory to usage.json, if it changed
+// since it was last written
+func flushUsage() error {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	if !usage.dirty {
+		return nil
+	}
+
+	if err := writeUsage(usage.path, usage.accounts); err != nil {
+		return err
+	}
+
+	usage.dirty = false
+	return nil
+}
+
+// scheduleUsageFlush flushes the usage every usageFlushInterval until ctx is
+// done
+func scheduleUsageFlush(ctx context.Context) {
+	ticker := time.NewTicker(usageFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := flushUsage(); err != nil {
+				slog.Warn(fmt.Sprintf("couldn't write token usage: %v", err))
+			}
+		}
+	}
+}
+
+// requestAccount returns the account a request is counted against: the name
+// of its API key, sent as a bearer token, if it's one of OLLAMA_API_KEYS, or
+// otherwise its session. Requests with other keys are anonymous.
+func requestAccount(c *gin.Context) string {
+	if key, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && key != "" {
+		for name, k := range getAPIKeys() {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				return "key:" + name
+			}
+		}
+	}
+
+	if id := c.Param("id"); id != "" && strings.HasPrefix(c.FullPath(), "/api/sessions/") {
+		return "session:" + id
+	}
+
+	return "anonymous"
+}
+
+// checkBudget returns errBudgetExceeded if the account has used its daily or
+// total budget of tokens, with how many seconds until the daily budget resets
+// if that's the one used
+func checkBudget(account string, now time.Time) (int, error) {
+	daily, total := getTokenBudgets()
+	if daily == 0 && total == 0 {
+		return 0, nil
+	}
+
+	usage.mu.Lock()
+	err := loadUsage()
+	u := usage.accounts[account]
+	usage.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case total > 0 && u.total() >= total:
+		return 0, fmt.Errorf("%w: %s has used its budget of %d tokens", errBudgetExceeded, account, total)
+	case daily > 0 && u.daily(now) >= daily:
+		return untilMidnight(now), fmt.Errorf("%w: %s has used its daily budget of %d tokens, which resets at midnight UTC", errBudgetExceeded, account, daily)
+	}
+
+	return 0, nil
+}
+
+// untilMidnight returns how many seconds there are until midnight UTC, when
+// daily budgets reset
+func untilMidnight(now time.Time) int {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return int(midnight.Sub(now).Seconds()) + 1
+}
+
+// usageMiddleware rejects requests from accounts which have used their
+// budget of tokens, and sets the account the tokens the request uses are
+// counted against
+func usageMiddleware(c *gin.Context) {
+	account := requestAccount(c)
+
+	retryAfter, err := checkBudget(account, time.Now())
+	if errors.Is(err, errBudgetExceeded) {
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+		}
+
+		abortWithError(c, http.StatusTooManyRequests, err)
+		return
+	} else if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Set(usageAccountKey, account)
+	c.Next()
+}
+
+// recordUsage adds the tokens a request used to its account
+func recordUsage(c *gin.Context, prompt, completion int) {
+	account := c.GetString(usageAccountKey)
+	if account == "" || prompt+completion == 0 {
+		return
+	}
+
+	if err := addUsage(account, int64(prompt), int64(completion), time.Now()); err != nil {
+		slog.Warn(fmt.Sprintf("couldn't record token usage: %v", err))
+	}
+}
+
+func addUsage(account string, prompt, completion int64, now time.Time) error {
+	usage.mu.Lock()
+	defer usage.mu.Unlock()
+
+	if err := loadUsage(); err != nil {
+		return err
+	}
+
+	u := usage.accounts[account]
+	u.PromptTokens += prompt
+	u.CompletionTokens += completion
+
+	day := now.UTC().Format(time.DateOnly)
+	if u.Day != day {
+		u.Day, u.DailyTokens = day, 0
+	}
+
+	u.DailyTokens += prompt + completion
+	usage.accounts[account] = u
+	usage.dirty = true
+	return nil
+}
+
+func UsageHandler(c *gin.Context) {
+	now := time.Now()
+	resp := api.UsageResponse{Usage: []api.Usage{}}
+	resp.DailyBudget, resp.TotalBudget = getTokenBudgets()
+
+	usage.mu.Lock()
+	err := loadUsage()
+	for account, u := range usage.accounts {
+		resp.Usage = append(resp.Usage, api.Usage{
+			Account:          account,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			TotalTokens:      u.total(),
+			DailyTokens:      u.daily(now),
+		})
+	}
+	usage.mu.Unlock()
+
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	slices.SortFunc(resp.Usage, func(a, b api.Usage) int {
+		return cmp.Compare(a.Account, b.Account)
+	})
+
+	c.JSON(http.StatusOK, resp)
+}
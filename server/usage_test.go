@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestUsage(t *testing.T) {
+	t.Setenv("OLLAMA_API_KEYS", "alice=secret,bob=other")
+
+	loadMockModel(t, "budgeted", "", &MockLLM{encoding: []int{1, 2, 3}, predict: func(p llm.PredictOpts, fn func(llm.PredictResult)) error {
+		fn(llm.PredictResult{Content: "hello", Done: true, PromptEvalCount: 3, EvalCount: 5})
+		return nil
+	}})
+
+	srv := httptest.NewServer((&Server{}).GenerateRoutes())
+	t.Cleanup(srv.Close)
+
+	stream := false
+	generate := func(key string) *http.Response {
+		bts, err := json.Marshal(api.GenerateRequest{Model: "budgeted", Prompt: "hi", Stream: &stream})
+		assert.Nil(t, err)
+
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/generate", bytes.NewReader(bts))
+		assert.Nil(t, err)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	usage := func() api.UsageResponse {
+		resp, err := http.Get(srv.URL + "/api/usage")
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+
+		var usage api.UsageResponse
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&usage))
+		return usage
+	}
+
+	assert.Equal(t, api.UsageResponse{Usage: []api.Usage{}}, usage())
+
+	assert.Equal(t, http.StatusOK, generate("").StatusCode)
+	assert.Equal(t, http.StatusOK, generate("secret").StatusCode)
+	assert.Equal(t, http.StatusOK, generate("secret").StatusCode)
+
+	// keys which aren't configured are anonymous
+	assert.Equal(t, http.StatusOK, generate("unknown").StatusCode)
+
+	u := usage()
+	assert.Len(t, u.Usage, 2)
+	assert.Equal(t, api.Usage{Account: "anonymous", PromptTokens: 6, CompletionTokens: 10, TotalTokens: 16, DailyTokens: 16}, u.Usage[0])
+
+	// keys are reported by their name
+	assert.Equal(t, "key:alice", u.Usage[1].Account)
+	assert.Equal(t, int64(16), u.Usage[1].TotalTokens)
+
+	t.Run("daily budget", func(t *testing.T) {
+		t.Setenv("OLLAMA_DAILY_TOKEN_BUDGET", "16")
+
+		resp := generate("secret")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		assert.Nil(t, err)
+		assert.Greater(t, retryAfter, 0)
+		assert.LessOrEqual(t, retryAfter, 24*60*60)
+
+		// other accounts have their own budget
+		assert.Equal(t, http.StatusOK, generate("other").StatusCode)
+		assert.Equal(t, int64(16), usage().DailyBudget)
+	})
+
+	t.Run("total budget", func(t *testing.T) {
+		t.Setenv("OLLAMA_TOKEN_BUDGET", "8")
+
+		resp := generate("")
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		assert.Empty(t, resp.Header.Get("Retry-After"))
+	})
+}
+
+func TestAccountUsageDaily(t *testing.T) {
+	account := "key:alice"
+	today := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+	t.Setenv("OLLAMA_DAILY_TOKEN_BUDGET", "10")
+
+	assert.Nil(t, addUsage(account, 4, 6, today))
+
+	_, err := checkBudget(account, today)
+	assert.ErrorIs(t, err, errBudgetExceeded)
+
+	// the daily budget resets at midnight UTC
+	tomorrow := today.Add(2 * time.Hour)
+	_, err = checkBudget(account, tomorrow)
+	assert.Nil(t, err)
+
+	assert.Nil(t, addUsage(account, 1, 1, tomorrow))
+
+	// usage is only written when it's flushed
+	fp, err := usagePath()
+	assert.Nil(t, err)
+	assert.NoFileExists(t, fp)
+
+	assert.Nil(t, flushUsage())
+	accounts, err := readUsage(fp)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), accounts[account].total())
+	assert.Equal(t, int64(2), accounts[account].daily(tomorrow))
+	assert.Equal(t, 3601, untilMidnight(today))
+
+	// and read when the server starts
+	usage.mu.Lock()
+	usage.accounts = nil
+	usage.mu.Unlock()
+
+	_, err = checkBudget(account, tomorrow)
+	assert.Nil(t, err)
+	assert.Nil(t, addUsage(account, 8, 0, tomorrow))
+	_, err = checkBudget(account, tomorrow)
+	assert.ErrorIs(t, err, errBudgetExceeded)
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// getKeepAliveVRAM returns how long an idle model keeps its layers on the GPU,
+// set by OLLAMA_KEEP_ALIVE_VRAM. Models keep them until they're unloaded by
+// default.
+func getKeepAliveVRAM() (time.Duration, bool) {
+	if t, exists := os.LookupEnv("OLLAMA_KEEP_ALIVE_VRAM"); exists {
+		return parseKeepAlive(t)
+	}
+
+	return 0, false
+}
+
+// scheduleReleaseVRAM starts the timer which releases the GPU memory of the
+// loaded model once it has been idle for keepAliveVRAM. It is up to the caller
+// to lock loaded.mu.
+func scheduleReleaseVRAM(sessionDuration time.Duration) {
+	keepAliveVRAM, ok := getKeepAliveVRAM()
+	if !ok || keepAliveVRAM >= sessionDuration {
+		if loaded.vramTimer != nil {
+			loaded.vramTimer.Stop()
+		}
+
+		return
+	}
+
+	loaded.sessionDuration = sessionDuration
+	if loaded.vramTimer == nil {
+		loaded.vramTimer = time.AfterFunc(keepAliveVRAM, func() {
+			loaded.mu.Lock()
+			defer loaded.mu.Unlock()
+
+			if loaded.runner == nil || loaded.released {
+				return
+			}
+
+			// handlers extend expireAt while a model is used, so it has been
+			// idle since expireAt less the session duration
+			idle := loaded.sessionDuration - time.Until(loaded.expireAt)
+			if keepAliveVRAM, _ := getKeepAliveVRAM(); idle < keepAliveVRAM {
+				loaded.vramTimer.Reset(keepAliveVRAM - idle)
+				return
+			}
+
+			if err := releaseVRAM(); err != nil {
+				slog.Error(fmt.Sprintf("failed to release GPU memory: %v", err))
+			}
+		})
+	}
+
+	loaded.vramTimer.Reset(keepAliveVRAM)
+}
+
+// releaseVRAM reloads the loaded model with all of its layers in system
+// memory. The next request reloads it with its layers on the GPU, which is
+// faster than loading it from scratch as the model is in the page cache. It is
+// up to the caller to lock loaded.mu, which is unlocked while the model is
+// reloaded so requests which don't use the runner aren't held up. Requests
+// which load a model wait for it in waitReleased.
+func releaseVRAM() error {
+	if strings.HasPrefix(loaded.runner.Library(), "cpu") || loaded.Options.NumGPU == 0 {
+		return nil
+	}
+
+	slog.Info("model is idle, releasing GPU memory")
+	loaded.runner.Close()
+	loaded.runner = nil
+
+	model := loaded.Model
+	opts := *loaded.Options
+	opts.NumGPU = 0
+
+	releasing := make(chan struct{})
+	loaded.releasing = releasing
+	defer func() {
+		loaded.releasing = nil
+		close(releasing)
+	}()
+
+	loaded.mu.Unlock()
+	runner, err := newRunner(model.ModelPath, model.AdapterPaths, model.ProjectorPaths, opts)
+	loaded.mu.Lock()
+
+	// the model expired while it was reloaded
+	if loaded.Model != model {
+		if runner != nil {
+			runner.Close()
+		}
+
+		return nil
+	}
+
+	if err != nil {
+		loaded.Model = nil
+		loaded.Options = nil
+		clearLiveOptions()
+		return err
+	}
+
+	loaded.runner = runner
+	loaded.released = true
+	return nil
+}
+
+// waitReleased waits for the GPU memory of the loaded model to be released,
+// if it's being released. It is up to the caller to lock loaded.mu, which is
+// unlocked while it waits.
+func waitReleased() {
+	for loaded.releasing != nil {
+		releasing := loaded.releasing
+		loaded.mu.Unlock()
+		<-releasing
+		loaded.mu.Lock()
+	}
+}
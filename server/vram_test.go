@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestReleaseVRAM(t *testing.T) {
+	model := loadMockModel(t, "vram", "", &MockLLM{})
+	numGPU := loaded.Options.NumGPU
+
+	var started []api.Options
+	reloading, reloaded := make(chan struct{}), make(chan struct{})
+	newRunner = func(_ string, _, _ []string, opts api.Options) (llm.LLM, error) {
+		started = append(started, opts)
+		if len(started) == 1 {
+			close(reloading)
+			<-reloaded
+		}
+
+		return &MockLLM{}, nil
+	}
+	t.Cleanup(func() { newRunner = llm.New })
+
+	released := make(chan error)
+	go func() {
+		loaded.mu.Lock()
+		defer loaded.mu.Unlock()
+		released <- releaseVRAM()
+	}()
+
+	// requests which don't use the runner aren't held up while the model is
+	// reloaded with its layers in system memory
+	<-reloading
+	require.True(t, loaded.mu.TryLock())
+	assert.Nil(t, loaded.runner)
+	loaded.mu.Unlock()
+
+	// and requests which load it wait for it, then move it back to the GPU
+	reloadedGPU := make(chan error)
+	go func() {
+		loaded.mu.Lock()
+		defer loaded.mu.Unlock()
+		reloadedGPU <- load(nil, model, *loaded.Options, time.Hour, nil)
+	}()
+
+	close(reloaded)
+	require.NoError(t, <-released)
+	require.NoError(t, <-reloadedGPU)
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+
+	require.Len(t, started, 2)
+	assert.Equal(t, 0, started[0].NumGPU)
+	assert.Equal(t, numGPU, started[1].NumGPU)
+	assert.False(t, loaded.released)
+	assert.Same(t, model, loaded.Model)
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+const (
+	// wsPingInterval is how often idle and streaming connections are pinged
+	wsPingInterval = 30 * time.Second
+
+	// wsWriteTimeout is how long a message can take to send before the
+	// connection is closed
+	wsWriteTimeout = 10 * time.Second
+)
+
+var errRequestCanceled = errors.New("request canceled")
+
+// wsRequest is a message from a WebSocket client. Generate and chat messages
+// start a request with the body in Request once the requests before it have
+// finished, and cancel stops every request which hasn't.
+type wsRequest struct {
+	Type    string          `json:"type"`
+	Request json.RawMessage `json:"request,omitempty"`
+}
+
+// wsConn serializes the messages and pings sent on a connection
+type wsConn struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (c *wsConn) send(payloadType byte, b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+
+	c.ws.PayloadType = payloadType
+	_, err := c.ws.Write(b)
+	return err
+}
+
+func (c *wsConn) sendJSON(v any) error {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return c.send(websocket.TextFrame, bts)
+}
+
+// wsResponseWriter sends each line of a response as a message, so a stream
+// is sent as the same objects as it would be over HTTP
+type wsResponseWriter struct {
+	conn   *wsConn
+	ctx    context.Context
+	header http.Header
+
+	partial []byte
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// WriteHeader is a no-op, since errors are already objects with an error field
+func (w *wsResponseWriter) WriteHeader(int) {}
+
+func (w *wsResponseWriter) Write(b []byte) (int, error) {
+	// the client has canceled the request, so the rest isn't sent
+	if w.ctx.Err() != nil {
+		return len(b), nil
+	}
+
+	w.partial = append(w.partial, b...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		if err := w.conn.send(websocket.TextFrame, w.partial[:i]); err != nil {
+			return 0, err
+		}
+
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(b), nil
+}
+
+func (w *wsResponseWriter) Flush() {}
+
+// CloseNotify fires when the request is canceled
+func (w *wsResponseWriter) CloseNotify() <-chan bool {
+	ch := make(chan bool, 1)
+	go func() {
+		<-w.ctx.Done()
+		ch <- true
+	}()
+
+	return ch
+}
+
+// finish sends a response which isn't streamed, since it doesn't end with a
+// new line
+func (w *wsResponseWriter) finish() error {
+	if len(w.partial) == 0 || w.ctx.Err() != nil {
+		return nil
+	}
+
+	return w.conn.send(websocket.TextFrame, w.partial)
+}
+
+// websocketHandler streams generate and chat requests over a WebSocket. Each
+// request is sent to h as it would be over HTTP, with the headers of the
+// upgrade request.
+func websocketHandler(h http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// origins are checked by the cors middleware, like other requests
+		s := websocket.Server{Handler: func(ws *websocket.Conn) {
+			serveWebSocket(c.Request, h, ws)
+		}}
+
+		s.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+func serveWebSocket(r *http.Request, h http.Handler, ws *websocket.Conn) {
+	defer ws.Close()
+
+	conn := &wsConn{ws: ws}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// clients which don't answer are found when writes fail
+			if err := conn.send(websocket.PingFrame, nil); err != nil {
+				ws.Close()
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// cancels has the cancel functions of the requests which haven't
+	// finished, and done is closed when the last request sent has finished
+	var mu sync.Mutex
+	cancels := make(map[*context.CancelFunc]struct{})
+	cancelAll := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for cancel := range cancels {
+			(*cancel)()
+		}
+	}
+	defer cancelAll()
+
+	done := make(chan struct{})
+	close(done)
+
+	for {
+		var bts []byte
+		if err := websocket.Message.Receive(ws, &bts); err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug(fmt.Sprintf("websocket closed: %v", err))
+			}
+			return
+		}
+
+		var msg wsRequest
+		if err := json.Unmarshal(bts, &msg); err != nil {
+			conn.sendJSON(errorResponse(codeError{api.ErrorCodeInvalidRequest, err}))
+			continue
+		}
+
+		switch msg.Type {
+		case "cancel":
+			cancelAll()
+		case "generate", "chat":
+			reqCtx, reqCancel := context.WithCancel(ctx)
+			mu.Lock()
+			cancels[&reqCancel] = struct{}{}
+			mu.Unlock()
+
+			// requests run one after another, so their responses aren't
+			// interleaved
+			prev, next := done, make(chan struct{})
+			done = next
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer close(next)
+				defer func() {
+					mu.Lock()
+					defer mu.Unlock()
+					delete(cancels, &reqCancel)
+					reqCancel()
+				}()
+
+				<-prev
+				serveWebSocketRequest(reqCtx, r, h, conn, msg)
+			}()
+		default:
+			conn.sendJSON(errorResponse(codeError{api.ErrorCodeInvalidRequest, fmt.Errorf("unknown message type %q", msg.Type)}))
+		}
+	}
+}
+
+// serveWebSocketRequest sends a request from a WebSocket client to h, and
+// its response back to the client
+func serveWebSocketRequest(ctx context.Context, r *http.Request, h http.Handler, conn *wsConn, msg wsRequest) {
+	// the request was canceled while it waited for the one before it
+	if ctx.Err() != nil {
+		conn.sendJSON(gin.H{"error": errRequestCanceled.Error()})
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/api/"+msg.Type, bytes.NewReader(msg.Request))
+	if err != nil {
+		conn.sendJSON(errorResponse(err))
+		return
+	}
+
+	req.Header = r.Header.Clone()
+	for _, key := range []string{"Accept", "Connection", "Upgrade", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol", "X-Ollama-Request-Id", "X-Ollama-Resume-From"} {
+		req.Header.Del(key)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+
+	w := &wsResponseWriter{conn: conn, ctx: ctx, header: make(http.Header)}
+	h.ServeHTTP(w, req)
+
+	if ctx.Err() != nil {
+		conn.sendJSON(gin.H{"error": errRequestCanceled.Error()})
+		return
+	}
+
+	if err := w.finish(); err != nil {
+		slog.Debug(fmt.Sprintf("websocket write failed: %v", err))
+	}
+}
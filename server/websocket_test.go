@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebSocket(t *testing.T) {
+	r := gin.New()
+	r.POST("/api/generate", func(c *gin.Context) {
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			for _, s := range []string{"a", "b", "c"} {
+				ch <- gin.H{"response": s, "done": s == "c"}
+			}
+		}()
+
+		streamResponse(c, ch)
+	})
+	r.POST("/api/chat", func(c *gin.Context) {
+		ctx := c.Request.Context()
+		ch := make(chan any)
+		go func() {
+			defer close(ch)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- gin.H{"message": gin.H{"content": "x"}}:
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+		}()
+
+		streamResponse(c, ch)
+	})
+	r.GET("/api/ws", websocketHandler(r))
+
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/ws"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	assert.Nil(t, err)
+	defer ws.Close()
+
+	receive := func() map[string]any {
+		var msg map[string]any
+		assert.Nil(t, ws.SetReadDeadline(time.Now().Add(5*time.Second)))
+		assert.Nil(t, websocket.JSON.Receive(ws, &msg))
+		return msg
+	}
+
+	assert.Nil(t, websocket.JSON.Send(ws, gin.H{"type": "generate", "request": gin.H{"model": "test"}}))
+	for _, s := range []string{"a", "b", "c"} {
+		assert.Equal(t, s, receive()["response"])
+	}
+
+	assert.Nil(t, websocket.JSON.Send(ws, gin.H{"type": "chat", "request": gin.H{"model": "test"}}))
+	assert.NotNil(t, receive()["message"])
+
+	// requests wait for the one before them, and are canceled with it
+	assert.Nil(t, websocket.JSON.Send(ws, gin.H{"type": "generate"}))
+	assert.Nil(t, websocket.JSON.Send(ws, gin.H{"type": "cancel"}))
+
+	var errs []any
+	for len(errs) < 2 {
+		msg := receive()
+		assert.Nil(t, msg["response"])
+		if msg["error"] != nil {
+			errs = append(errs, msg["error"])
+		}
+	}
+
+	assert.Equal(t, []any{"request canceled", "request canceled"}, errs)
+
+	// the connection can be used again once the request is canceled
+	assert.Nil(t, websocket.JSON.Send(ws, gin.H{"type": "generate"}))
+	assert.Equal(t, "a", receive()["response"])
+}